@@ -8,7 +8,11 @@ env = Environment(
     loader=FileSystemLoader('templates'),
     autoescape=select_autoescape(['html', 'xml'])
 )
-template = env.get_template('confirmation.html')
+# Checkout picks the template with the "template" field of the request.
+templates = {
+    name: env.get_template(f'{name}.html')
+    for name in ('confirmation', 'cancellation', 'return')
+}
 
 @functions_framework.http
 def send_email(request):
@@ -21,11 +25,14 @@ def send_email(request):
     
     email = request_json["email"]
     order = request_json.get("order", {})
+    name = request_json.get("template", "confirmation")
+    if name not in templates:
+        return f"Invalid request: unknown template '{name}'", 400
     
-    logger.info(f"A request to send order confirmation email to {email} has been received.")
+    logger.info(f"A request to send order {name} email to {email} has been received.")
     
     try:
-        confirmation = template.render(order=order)
+        confirmation = templates[name].render(order=order)
     except TemplateError as err:
         logger.error(f"Error rendering template: {str(err)}")
         return "Error preparing confirmation email", 500
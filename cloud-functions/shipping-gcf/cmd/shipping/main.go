@@ -0,0 +1,41 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command shipping serves the shipping function's HTTP API as a standalone
+// server, for running it on VMs, GKE or Cloud Run instead of Cloud
+// Functions. It listens on PORT, 8080 by default, and is configured by the
+// same environment as the function.
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	gcf "example.com/shippingservice-gcf"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/shipping"
+)
+
+func main() {
+	svc, err := shipping.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	port := "8080"
+	if p := os.Getenv("PORT"); p != "" {
+		port = p
+	}
+	log.Printf("shipping API listening on port %s", port)
+	log.Fatal(http.ListenAndServe(":"+port, gcf.NewHandler(svc)))
+}
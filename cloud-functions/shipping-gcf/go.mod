@@ -4,4 +4,13 @@ go 1.21
 
 require (
 cloud.google.com/go/functions v0.11.0
-)
\ No newline at end of file
+github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/quote v0.0.0
+github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/shipping v0.0.0
+github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/trackingid v0.0.0
+)
+
+replace github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/quote => ../../src/shippingservice/quote
+
+replace github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/shipping => ../../src/shippingservice/shipping
+
+replace github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/trackingid => ../../src/shippingservice/trackingid
@@ -0,0 +1,242 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shipping
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// apiVersion is the version of the request and response schemas in
+// schema/<version>. Requests name the version they follow in "version".
+const apiVersion = "v1"
+
+//go:embed schema
+var schemaFiles embed.FS
+
+// schemas holds the parsed schema files by path, e.g. "v1/getQuote.request.json".
+var schemas, schemasErr = loadSchemas()
+
+func loadSchemas() (map[string]map[string]interface{}, error) {
+	out := make(map[string]map[string]interface{})
+	entries, err := schemaFiles.ReadDir("schema/" + apiVersion)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name := path.Join(apiVersion, e.Name())
+		b, err := schemaFiles.ReadFile("schema/" + name)
+		if err != nil {
+			return nil, err
+		}
+		var s map[string]interface{}
+		if err := json.Unmarshal(b, &s); err != nil {
+			return nil, fmt.Errorf("schema %s: %v", name, err)
+		}
+		out[name] = s
+	}
+	return out, nil
+}
+
+// decodeRequest validates the JSON body against the request schema of the
+// endpoint and then decodes it into v.
+func decodeRequest(body []byte, endpoint string, v interface{}) error {
+	if schemasErr != nil {
+		return fmt.Errorf("failed to load schemas: %v", schemasErr)
+	}
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return fmt.Errorf("malformed JSON: %v", err)
+	}
+	if obj, ok := doc.(map[string]interface{}); ok {
+		if version, ok := obj["version"].(string); ok && version != apiVersion {
+			return fmt.Errorf("unsupported version %q, want %q", version, apiVersion)
+		}
+	}
+	name := path.Join(apiVersion, endpoint+".request.json")
+	schema, ok := schemas[name]
+	if !ok {
+		return fmt.Errorf("no schema %s", name)
+	}
+	if err := validateSchema(schema, doc, apiVersion, ""); err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// validateSchema checks doc against the subset of JSON Schema the schema
+// files use: $ref to a sibling file, type, const, enum, properties,
+// required, additionalProperties, items, min/maxItems, min/maxLength,
+// pattern and minimum/maximum. Keywords next to $ref apply as well. at is
+// the JSON pointer of doc, for error messages.
+func validateSchema(schema map[string]interface{}, doc interface{}, dir, at string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		target, ok := schemas[path.Join(dir, ref)]
+		if !ok {
+			return fmt.Errorf("unknown schema %s", ref)
+		}
+		if err := validateSchema(target, doc, dir, at); err != nil {
+			return err
+		}
+	}
+	where := at
+	if where == "" {
+		where = "request"
+	}
+
+	if want, ok := schema["const"]; ok && !jsonEqual(want, doc) {
+		return fmt.Errorf("%s must be %v", where, want)
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, want := range enum {
+			found = found || jsonEqual(want, doc)
+		}
+		if !found {
+			return fmt.Errorf("%s must be one of %v", where, enum)
+		}
+	}
+	if t, ok := schema["type"].(string); ok && !hasType(doc, t) {
+		return fmt.Errorf("%s must be of type %s", where, t)
+	}
+
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		for _, r := range asSlice(schema["required"]) {
+			if _, ok := d[r.(string)]; !ok {
+				return fmt.Errorf("%s/%s is required", at, r)
+			}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		keys := make([]string, 0, len(d))
+		for k := range d {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			sub, ok := props[k].(map[string]interface{})
+			if !ok {
+				if schema["additionalProperties"] == false {
+					return fmt.Errorf("%s/%s is not allowed", at, k)
+				}
+				continue
+			}
+			if err := validateSchema(sub, d[k], dir, at+"/"+k); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if n, ok := number(schema["minItems"]); ok && float64(len(d)) < n {
+			return tooShort(where, n, "elements")
+		}
+		if n, ok := number(schema["maxItems"]); ok && float64(len(d)) > n {
+			return fmt.Errorf("%s must have at most %v elements", where, n)
+		}
+		if sub, ok := schema["items"].(map[string]interface{}); ok {
+			for i, e := range d {
+				if err := validateSchema(sub, e, dir, fmt.Sprintf("%s/%d", at, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		if n, ok := number(schema["minLength"]); ok && float64(utf8.RuneCountInString(d)) < n {
+			return tooShort(where, n, "characters")
+		}
+		if n, ok := number(schema["maxLength"]); ok && float64(utf8.RuneCountInString(d)) > n {
+			return fmt.Errorf("%s must have at most %v characters", where, n)
+		}
+		if p, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return fmt.Errorf("bad pattern %q: %v", p, err)
+			}
+			if !re.MatchString(d) {
+				return fmt.Errorf("%s must match %s", where, p)
+			}
+		}
+	case json.Number:
+		v, _ := d.Float64()
+		if n, ok := number(schema["minimum"]); ok && v < n {
+			return fmt.Errorf("%s must be at least %v", where, n)
+		}
+		if n, ok := number(schema["maximum"]); ok && v > n {
+			return fmt.Errorf("%s must be at most %v", where, n)
+		}
+	}
+	return nil
+}
+
+func tooShort(where string, min float64, unit string) error {
+	if min == 1 {
+		return fmt.Errorf("%s must not be empty", where)
+	}
+	return fmt.Errorf("%s must have at least %v %s", where, min, unit)
+}
+
+func hasType(doc interface{}, t string) bool {
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		return t == "object"
+	case []interface{}:
+		return t == "array"
+	case string:
+		return t == "string"
+	case bool:
+		return t == "boolean"
+	case nil:
+		return t == "null"
+	case json.Number:
+		if t == "number" {
+			return true
+		}
+		if t == "integer" {
+			_, err := d.Int64()
+			return err == nil || !strings.ContainsAny(d.String(), ".eE")
+		}
+	}
+	return false
+}
+
+// number reads a numeric keyword of a schema, which encoding/json decoded
+// as float64.
+func number(v interface{}) (float64, bool) {
+	n, ok := v.(float64)
+	return n, ok
+}
+
+func asSlice(v interface{}) []interface{} {
+	s, _ := v.([]interface{})
+	return s
+}
+
+// jsonEqual compares a schema value with a document value.
+func jsonEqual(schemaValue, doc interface{}) bool {
+	if n, ok := doc.(json.Number); ok {
+		f, err := n.Float64()
+		return err == nil && schemaValue == f
+	}
+	return reflect.DeepEqual(schemaValue, doc)
+}
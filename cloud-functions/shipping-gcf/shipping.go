@@ -2,82 +2,172 @@ package shipping
 
 import (
     "encoding/json"
+    "errors"
     "fmt"
-    "math"
-    "math/rand"
+    "io"
     "time"
     "net/http"
+
+    "github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/quote"
+    "github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/shipping"
 )
 
-// Quote represents a currency value.
-type Quote struct {
-    Dollars uint32
-    Cents   uint32
+type jsonMoney struct {
+    CurrencyCode string `json:"currency_code"`
+    Units        int64  `json:"units"`
+    Nanos        int32  `json:"nanos"`
 }
 
-// CreateQuoteFromFloat takes a price as a float and creates a Quote struct.
-func CreateQuoteFromFloat(value float64) Quote {
-    units, fraction := math.Modf(value)
-    return Quote{
-        Dollars: uint32(units),
-        Cents:   uint32(math.Trunc(fraction * 100)),
-    }
+// shippingOption is a service level offered by getQuote.
+type shippingOption struct {
+    ServiceLevel          string    `json:"service_level"`
+    Name                  string    `json:"name"`
+    Carrier               string    `json:"carrier"`
+    Cost                  jsonMoney `json:"cost"`
+    EstimatedDeliveryDate string    `json:"estimated_delivery_date"`
+    EarliestDeliveryDate  string    `json:"earliest_delivery_date"`
+}
+
+// jsonAddress and jsonItem are the address and items of schema/v1.
+type jsonAddress struct {
+    StreetAddress string `json:"street_address"`
+    City          string `json:"city"`
+    State         string `json:"state"`
+    Country       string `json:"country"`
+    ZipCode       int32  `json:"zip_code"`
+}
+
+type jsonItem struct {
+    ProductID string `json:"product_id"`
+    Quantity  int32  `json:"quantity"`
 }
 
-// Tracking ID generation
-var seeded bool = false
-var rng *rand.Rand
+func (a jsonAddress) address() shipping.Address {
+    return shipping.Address(a)
+}
 
-func CreateTrackingId(salt string) string {
-    if !seeded {
-		rng = rand.New(rand.NewSource(time.Now().UnixNano()))   
-		seeded = true
+func quoteItems(items []jsonItem) []quote.Item {
+    out := make([]quote.Item, len(items))
+    for i, it := range items {
+        out[i] = quote.Item{ProductID: it.ProductID, Quantity: it.Quantity}
     }
-    return fmt.Sprintf("%c%c-%d%s-%d%s",
-        getRandomLetterCode(),
-        getRandomLetterCode(),
-        len(salt),
-        getRandomNumber(3),
-        len(salt)/2,
-        getRandomNumber(7),
-    )
+    return out
 }
 
-func getRandomLetterCode() uint32 {
-    return 65 + uint32(rng.Intn(25))
+// writeRuleError answers 422 with the violations of a shipment that breaks
+// shipping rules (schema/v1/error.json) and returns true, or returns false
+// for any other error.
+func writeRuleError(w http.ResponseWriter, err error) bool {
+    var rules *quote.RuleError
+    if !errors.As(err, &rules) {
+        return false
+    }
+    type violation struct {
+        Type        string `json:"type"`
+        Subject     string `json:"subject"`
+        Description string `json:"description"`
+    }
+    resp := struct {
+        Version    string      `json:"version"`
+        Error      string      `json:"error"`
+        Violations []violation `json:"violations"`
+    }{Version: apiVersion, Error: err.Error()}
+    for _, v := range rules.Violations {
+        resp.Violations = append(resp.Violations, violation{Type: v.Rule, Subject: v.Subject, Description: v.Description})
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusUnprocessableEntity)
+    json.NewEncoder(w).Encode(resp)
+    return true
 }
 
-func getRandomNumber(digits int) string {
-    str := ""
-    for i := 0; i < digits; i++ {
-        str = fmt.Sprintf("%s%d", str, rng.Intn(10))
+// readRequest checks that r is a POST and decodes its body, validated
+// against the request schema of the endpoint, into v. It answers the
+// request itself and returns false when it is not acceptable.
+func readRequest(w http.ResponseWriter, r *http.Request, endpoint string, v interface{}) bool {
+    if r.Method != http.MethodPost {
+        w.Header().Set("Allow", http.MethodPost)
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return false
     }
-    return str
+    body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Failed to read request: %v", err), http.StatusBadRequest)
+        return false
+    }
+    if err := decodeRequest(body, endpoint, v); err != nil {
+        http.Error(w, fmt.Sprintf("Invalid %s request: %v", endpoint, err), http.StatusBadRequest)
+        return false
+    }
+    return true
 }
 
+// Shipping core shared with shippingservice, configured the same way
+// (SHIPPING_RATES, PACKAGING_SERVICE_URL, TRACKING_ID_PREFIX).
+var defaultHandler = func() http.Handler {
+    svc, err := shipping.FromEnv()
+    if err != nil {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+        })
+    }
+    return NewHandler(svc)
+}()
+
 // HTTP handler for GCF
 func ShippingHandler(w http.ResponseWriter, r *http.Request) {
+    defaultHandler.ServeHTTP(w, r)
+}
+
+// NewHandler returns the shipping API served by svc, for the function and
+// for cmd/shipping, which serves it as a standalone binary.
+func NewHandler(svc *shipping.Service) http.Handler {
+    return &handler{svc: svc}
+}
+
+type handler struct {
+    svc *shipping.Service
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
     switch r.URL.Path {
     case "/getQuote":
-        // Fixed $8.99 quote (reuses CreateQuoteFromFloat)
-        quote := CreateQuoteFromFloat(8.99)
+        var req struct {
+            Address jsonAddress `json:"address"`
+            Items   []jsonItem  `json:"items"`
+        }
+        if !readRequest(w, r, "getQuote", &req) {
+            return
+        }
+        options, err := h.svc.Quote(r.Context(), req.Address.address(), quoteItems(req.Items))
+        if writeRuleError(w, err) {
+            return
+        }
+        if err != nil {
+            http.Error(w, fmt.Sprintf("Failed to quote shipping: %v", err), http.StatusBadRequest)
+            return
+        }
         resp := struct {
-            CostUSD struct {
-                CurrencyCode string `json:"currency_code"`
-                Units        int64  `json:"units"`
-                Nanos        int32  `json:"nanos"`
-            } `json:"cost_usd"`
-        }{
-            CostUSD: struct {
-                CurrencyCode string `json:"currency_code"`
-                Units        int64  `json:"units"`
-                Nanos        int32  `json:"nanos"`
-            }{
-                CurrencyCode: "USD",
-                Units:        int64(quote.Dollars),
-                Nanos:        int32(quote.Cents * 10000000), // Cents to nanos
-            },
+            Version string `json:"version"`
+            // Cost of the default option, for callers that do not offer a choice.
+            CostUSD jsonMoney        `json:"cost_usd"`
+            Options []shippingOption `json:"options"`
+        }{Version: apiVersion}
+        for _, o := range options {
+            resp.Options = append(resp.Options, shippingOption{
+                ServiceLevel: o.ServiceLevel,
+                Name:         o.Name,
+                Carrier:      o.Carrier,
+                Cost: jsonMoney{
+                    CurrencyCode: h.svc.Quotes().CurrencyCode(),
+                    Units:        int64(o.Quote.Dollars),
+                    Nanos:        o.Quote.Nanos(),
+                },
+                EstimatedDeliveryDate: o.EstimatedDelivery.Format(time.DateOnly),
+                EarliestDeliveryDate:  o.EarliestDelivery.Format(time.DateOnly),
+            })
         }
+        resp.CostUSD = resp.Options[0].Cost
         w.Header().Set("Content-Type", "application/json")
         if err := json.NewEncoder(w).Encode(resp); err != nil {
             http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
@@ -86,32 +176,47 @@ func ShippingHandler(w http.ResponseWriter, r *http.Request) {
 
     case "/shipOrder":
         var req struct {
-            Address struct {
-                StreetAddress string `json:"street_address"`
-                City          string `json:"city"`
-                State         string `json:"state"`
-            } `json:"address"`
+            Address      jsonAddress `json:"address"`
+            Items        []jsonItem  `json:"items"`
+            ServiceLevel string      `json:"service_level"`
         }
-        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-            http.Error(w, fmt.Sprintf("Failed to decode request: %v", err), http.StatusBadRequest)
+        if !readRequest(w, r, "shipOrder", &req) {
             return
         }
-        baseAddress := fmt.Sprintf("%s, %s, %s", req.Address.StreetAddress, req.Address.City, req.Address.State)
-        trackingID := CreateTrackingId(baseAddress)
+        // Broken shipping rules, a level not offered to the address and an
+        // address no zone serves stop the shipment; other quote failures
+        // only leave it without an estimated delivery.
+        shipment, err := h.svc.Ship(r.Context(), req.Address.address(), quoteItems(req.Items), req.ServiceLevel)
+        if writeRuleError(w, err) {
+            return
+        }
+        if errors.Is(err, quote.ErrUnavailable) || errors.Is(err, quote.ErrNoZone) {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
         resp := struct {
+            Version    string `json:"version"`
             TrackingID string `json:"tracking_id"`
-        }{TrackingID: trackingID}
+            Carrier    string `json:"carrier"`
+        }{Version: apiVersion, TrackingID: shipment.TrackingID, Carrier: shipment.ServiceLevel.Carrier}
         w.Header().Set("Content-Type", "application/json")
         if err := json.NewEncoder(w).Encode(resp); err != nil {
             http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
             return
         }
 
+    case "/track":
+        h.track(w, r)
+
+    case "/trackingEvent":
+        h.trackingEvent(w, r)
+
     default:
         http.Error(w, "Endpoint not found", http.StatusNotFound)
     }
 }
-
-// func main() {
-//     http.HandleFunc("/", ShippingHandler)
-// }
\ No newline at end of file
@@ -0,0 +1,254 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shipping
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/quote"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/shipping"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/trackingid"
+)
+
+func post(t *testing.T, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	ShippingHandler(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+	return w
+}
+
+// checkResponse validates a response body against a schema file.
+func checkResponse(t *testing.T, schema string, body []byte) {
+	t.Helper()
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateSchema(schemas[apiVersion+"/"+schema], doc, apiVersion, ""); err != nil {
+		t.Errorf("response %s does not follow %s: %v", body, schema, err)
+	}
+}
+
+func TestGetQuote(t *testing.T) {
+	w := post(t, "/getQuote", `{"version": "v1",
+		"address": {"street_address": "1600 Amphitheatre Pkwy", "city": "Mountain View", "state": "CA", "country": "US", "zip_code": 94043},
+		"items": [{"product_id": "OLJCESPC7Z", "quantity": 2}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", w.Code, w.Body)
+	}
+	checkResponse(t, "getQuote.response.json", w.Body.Bytes())
+
+	w = httptest.NewRecorder()
+	ShippingHandler(w, httptest.NewRequest(http.MethodGet, "/getQuote?country=US", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got %d for a GET, want 405", w.Code)
+	}
+}
+
+func TestShipOrder(t *testing.T) {
+	w := post(t, "/shipOrder", `{"version": "v1", "service_level": "express",
+		"address": {"street_address": "1600 Amphitheatre Pkwy", "city": "Mountain View", "state": "CA", "country": "US", "zip_code": 94043},
+		"items": [{"product_id": "OLJCESPC7Z", "quantity": 1}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", w.Code, w.Body)
+	}
+	checkResponse(t, "shipOrder.response.json", w.Body.Bytes())
+	var resp struct {
+		TrackingID string `json:"tracking_id"`
+		Carrier    string `json:"carrier"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := trackingid.ValidateTrackingId(resp.TrackingID); err != nil || resp.Carrier != "UPS" {
+		t.Errorf("got %+v (%v), want a valid tracking ID from UPS", resp, err)
+	}
+}
+
+func TestShipOrderUnavailable(t *testing.T) {
+	// With the international zone narrowed to Japan, no zone serves France.
+	card, err := quote.DefaultRateCard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	card.Zones[len(card.Zones)-1].Countries = []string{"JP"}
+	quotes, err := quote.New(card, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := trackingid.NewGenerator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(shipping.New(quotes, ids))
+
+	for _, tc := range []struct {
+		name, body string
+	}{
+		{"level not offered", `{"version": "v1", "service_level": "overnight",
+			"address": {"street_address": "1 Main St", "city": "Anchorage", "state": "AK", "country": "US"},
+			"items": [{"product_id": "OLJCESPC7Z", "quantity": 1}]}`},
+		{"no zone", `{"version": "v1",
+			"address": {"street_address": "5 Avenue Anatole France", "city": "Paris", "country": "FR"},
+			"items": [{"product_id": "OLJCESPC7Z", "quantity": 1}]}`},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/shipOrder", strings.NewReader(tc.body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d %s, want 400", tc.name, w.Code, w.Body)
+		}
+	}
+}
+
+func TestShippingRules(t *testing.T) {
+	w := post(t, "/shipOrder", `{"version": "v1", "service_level": "express",
+		"address": {"street_address": "PO Box 7", "country": "US"},
+		"items": [{"product_id": "OLJCESPC7Z", "quantity": 1}]}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got %d %s, want 422 for express to a PO box", w.Code, w.Body)
+	}
+	checkResponse(t, "error.json", w.Body.Bytes())
+	if !strings.Contains(w.Body.String(), `"subject":"address.street_address"`) {
+		t.Errorf("got %s, want the street address named", w.Body)
+	}
+
+	w = post(t, "/getQuote", `{"version": "v1", "address": {"country": "SY"}, "items": [{"product_id": "OLJCESPC7Z", "quantity": 1}]}`)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), `"type":"BLOCKED_DESTINATION"`) {
+		t.Errorf("got %d %s, want 422 for a blocked country", w.Code, w.Body)
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	const address = `{"street_address": "1600 Amphitheatre Pkwy", "country": "US"}`
+	const items = `[{"product_id": "OLJCESPC7Z", "quantity": 1}]`
+	for _, tc := range []struct {
+		name, path, body, want string
+	}{
+		{"no version", "/getQuote", `{"address": ` + address + `, "items": ` + items + `}`, "/version is required"},
+		{"old version", "/getQuote", `{"version": "v0", "address": ` + address + `, "items": ` + items + `}`, "unsupported version"},
+		{"no items", "/getQuote", `{"version": "v1", "address": ` + address + `}`, "/items is required"},
+		{"zero quantity", "/getQuote", `{"version": "v1", "address": ` + address + `, "items": [{"product_id": "X", "quantity": 0}]}`, "/items/0/quantity must be at least 1"},
+		{"zip code as string", "/getQuote", `{"version": "v1", "address": {"zip_code": "94043"}, "items": ` + items + `}`, "/address/zip_code must be of type integer"},
+		{"unknown field", "/getQuote", `{"version": "v1", "address": ` + address + `, "items": ` + items + `, "rush": true}`, "/rush is not allowed"},
+		{"no street", "/shipOrder", `{"version": "v1", "address": {"country": "US"}, "items": ` + items + `}`, "/address/street_address is required"},
+		{"empty country", "/shipOrder", `{"version": "v1", "address": {"street_address": "1 Main St", "country": ""}, "items": ` + items + `}`, "/address/country must not be empty"},
+		{"nothing to ship", "/shipOrder", `{"version": "v1", "address": ` + address + `, "items": []}`, "/items must not be empty"},
+		{"bad service level", "/shipOrder", `{"version": "v1", "address": ` + address + `, "items": ` + items + `, "service_level": "Express!"}`, "/service_level must match"},
+		{"not JSON", "/shipOrder", `version=v1`, "malformed JSON"},
+	} {
+		w := post(t, tc.path, tc.body)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tc.want) {
+			t.Errorf("%s: got %d %q, want 400 mentioning %q", tc.name, w.Code, w.Body, tc.want)
+		}
+	}
+}
+
+func TestTrack(t *testing.T) {
+	w := post(t, "/shipOrder", `{"version": "v1",
+		"address": {"street_address": "1600 Amphitheatre Pkwy", "city": "Mountain View", "state": "CA", "country": "US"},
+		"items": [{"product_id": "OLJCESPC7Z", "quantity": 1}]}`)
+	var shipped struct {
+		TrackingID string `json:"tracking_id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &shipped); err != nil {
+		t.Fatal(err)
+	}
+	track := func(query string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		ShippingHandler(w, httptest.NewRequest(http.MethodGet, "/track?"+query, nil))
+		return w
+	}
+
+	w = track("tracking_id=" + shipped.TrackingID)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"SHIPMENT_STATUS_LABEL_CREATED"`) {
+		t.Errorf("got %d %s, want the shipment just handed over", w.Code, w.Body)
+	}
+	if w := track("tracking_id=XX-1-2"); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d for a malformed tracking ID, want 400", w.Code)
+	}
+	ids, err := trackingid.NewGenerator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := ids.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := track("tracking_id=" + id); w.Code != http.StatusNotFound {
+		t.Errorf("got %d for an unknown shipment, want 404", w.Code)
+	}
+	if w := track("tracking_id=" + id + "&shipped_at_unix=1709564400&estimated_delivery_date=2024-03-08"); !strings.Contains(w.Body.String(), `"status":"SHIPMENT_STATUS_DELIVERED"`) {
+		t.Errorf("got %d %s from the hints, want it delivered", w.Code, w.Body)
+	}
+
+	// The function's own service has no CARRIER_EVENT_SECRET, so it
+	// refuses every event.
+	const event = `{"status": "SHIPMENT_STATUS_IN_TRANSIT", "description": "Delayed by weather"}`
+	if w := post(t, "/trackingEvent", `{"tracking_id": "`+id+`", "event": `+event+`}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("got %d %s recording an event without a secret, want 401", w.Code, w.Body)
+	}
+}
+
+func TestTrackingEvent(t *testing.T) {
+	svc, err := shipping.FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.EventSecret = "carrier-secret"
+	h := NewHandler(svc)
+	ids, err := trackingid.NewGenerator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := ids.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"tracking_id": "` + id + `", "event": {"status": "SHIPMENT_STATUS_IN_TRANSIT", "description": "Delayed by weather"}}`
+	e := shipping.Event{Status: shipping.StatusInTransit, Description: "Delayed by weather"}
+
+	for _, tc := range []struct {
+		name, signature string
+		want            int
+	}{
+		{"unsigned", "", http.StatusUnauthorized},
+		{"wrong secret", shipping.SignEvent("guess", time.Now(), id, e), http.StatusUnauthorized},
+		{"signed", shipping.SignEvent("carrier-secret", time.Now(), id, e), http.StatusNoContent},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/trackingEvent", strings.NewReader(body))
+		if tc.signature != "" {
+			r.Header.Set(shipping.EventSignatureHeader, tc.signature)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s: got %d %s, want %d", tc.name, w.Code, w.Body, tc.want)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/track?tracking_id="+id, nil))
+	if !strings.Contains(w.Body.String(), "Delayed by weather") || strings.Count(w.Body.String(), `"description"`) != 1 {
+		t.Errorf("got %d %s, want the signed event only", w.Code, w.Body)
+	}
+}
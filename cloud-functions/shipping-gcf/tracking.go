@@ -0,0 +1,104 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shipping
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/shipping"
+)
+
+// track serves GET /track?tracking_id=...[&shipped_at_unix=<unix>&estimated_delivery_date=YYYY-MM-DD].
+// Shipments handed over and carrier events live in the memory of the
+// instance only; callers pass the hints so tracking works on any instance.
+// shipped_at is the old name of shipped_at_unix.
+func (h *handler) track(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id := q.Get("tracking_id")
+	shippedAtParam := q.Get("shipped_at_unix")
+	if shippedAtParam == "" {
+		shippedAtParam = q.Get("shipped_at")
+	}
+	var hints shipping.Hints
+	if shippedAt, _ := strconv.ParseInt(shippedAtParam, 10, 64); shippedAt != 0 {
+		hints.ShippedAt = time.Unix(shippedAt, 0).UTC()
+	}
+	if d := q.Get("estimated_delivery_date"); d != "" {
+		t, err := time.Parse(time.DateOnly, d)
+		if err != nil {
+			http.Error(w, "estimated_delivery_date must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		hints.Delivery = t
+	}
+
+	events, err := h.svc.Track(id, hints)
+	if err != nil {
+		http.Error(w, err.Error(), trackingErrorCode(err))
+		return
+	}
+	resp := struct {
+		TrackingID string           `json:"tracking_id"`
+		Status     shipping.Status  `json:"status"`
+		Events     []shipping.Event `json:"events"`
+	}{TrackingID: id, Events: events}
+	if len(events) > 0 {
+		resp.Status = events[len(events)-1].Status
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// trackingEvent serves POST /trackingEvent, where carriers push status
+// updates signed in the X-Carrier-Signature header (see
+// shipping.SignEvent). Shipments with carrier events are tracked from
+// those alone.
+func (h *handler) trackingEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		TrackingID string         `json:"tracking_id"`
+		Event      shipping.Event `json:"event"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := h.svc.RecordEvent(req.TrackingID, req.Event, r.Header.Get(shipping.EventSignatureHeader)); err != nil {
+		http.Error(w, err.Error(), trackingErrorCode(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// trackingErrorCode returns the HTTP status of a tracking failure.
+func trackingErrorCode(err error) int {
+	switch {
+	case errors.Is(err, shipping.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, shipping.ErrUnauthenticated):
+		return http.StatusUnauthorized
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,276 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+	money "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/money"
+)
+
+const (
+	defaultGiftCardsFile = "gift_cards.json"
+
+	// storeCreditPrefix starts the ledger account of a user's store credit.
+	// Gift card codes are alphanumeric, so they can never collide with it.
+	storeCreditPrefix = "credit:"
+)
+
+// giftCardConfig is an issued gift card in the gift cards file.
+type giftCardConfig struct {
+	Code    string      `json:"code"`
+	Balance moneyConfig `json:"balance"`
+}
+
+// ledgerEntry is one movement on a gift card or store credit account:
+// negative for a purchase, positive for an issue or refund.
+type ledgerEntry struct {
+	orderID string
+	amount  pb.Money
+	at      time.Time
+}
+
+type giftCardAccount struct {
+	balance pb.Money
+	entries []ledgerEntry
+}
+
+// giftCardDebit is what an order took from one account, and how much of it
+// has been paid back since.
+type giftCardDebit struct {
+	account  string
+	amount   pb.Money
+	refunded pb.Money
+}
+
+// giftCardLedger holds the balances of gift cards and store credit. Every
+// change is recorded against the order that caused it.
+type giftCardLedger struct {
+	mu       sync.Mutex
+	accounts map[string]*giftCardAccount
+	now      func() time.Time
+}
+
+func newGiftCardLedger(cards []*giftCardConfig) (*giftCardLedger, error) {
+	l := &giftCardLedger{
+		accounts: make(map[string]*giftCardAccount),
+		now:      time.Now,
+	}
+	for _, c := range cards {
+		code := normalizeGiftCardCode(c.Code)
+		if code == "" {
+			return nil, fmt.Errorf("gift card is missing a code")
+		}
+		balance := *c.Balance.toProto()
+		if !money.IsValid(balance) || money.IsNegative(balance) || balance.CurrencyCode == "" {
+			return nil, fmt.Errorf("gift card %s: balance must be a non-negative amount with a currency", maskGiftCard(code))
+		}
+		if _, ok := l.accounts[code]; ok {
+			return nil, fmt.Errorf("gift card %s is listed twice", maskGiftCard(code))
+		}
+		l.accounts[code] = &giftCardAccount{
+			balance: balance,
+			entries: []ledgerEntry{{amount: balance, at: l.now()}},
+		}
+	}
+	return l, nil
+}
+
+// loadGiftCards reads the issued gift cards from the file named by
+// GIFT_CARDS_CONFIG, or gift_cards.json next to the binary. Without either
+// only store credit can be used.
+func loadGiftCards() (*giftCardLedger, error) {
+	path := os.Getenv("GIFT_CARDS_CONFIG")
+	explicit := path != ""
+	if !explicit {
+		path = defaultGiftCardsFile
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		log.Info("no gift cards configured")
+		return newGiftCardLedger(nil)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read gift cards file: %v", err)
+	}
+	var cfg struct {
+		GiftCards []*giftCardConfig `json:"gift_cards"`
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse gift cards file %s: %v", path, err)
+	}
+	log.Infof("loaded %d gift cards from %s", len(cfg.GiftCards), path)
+	return newGiftCardLedger(cfg.GiftCards)
+}
+
+// normalizeGiftCardCode uppercases a code and drops everything that is not
+// a letter or digit, so "abcd-1234 5678" and "ABCD12345678" are the same
+// card.
+func normalizeGiftCardCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return -1
+	}, code)
+}
+
+func storeCreditAccount(userID, currencyCode string) string {
+	return storeCreditPrefix + userID + ":" + currencyCode
+}
+
+// maskGiftCard returns the account as it may be shown and logged: the last
+// four characters of a gift card code, or "Store credit".
+func maskGiftCard(account string) string {
+	if strings.HasPrefix(account, storeCreditPrefix) {
+		return "Store credit"
+	}
+	if len(account) <= 4 {
+		return "****"
+	}
+	return "****" + account[len(account)-4:]
+}
+
+// debit takes up to amount from the accounts, in order, and returns what
+// was taken from each plus the part of amount they did not cover. Either
+// every account is debited or, on error, none is. Store credit the user
+// does not have is skipped rather than rejected.
+func (l *giftCardLedger) debit(orderID string, accounts []string, amount pb.Money) ([]*giftCardDebit, pb.Money, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	remaining := amount
+	var debits []*giftCardDebit
+	seen := make(map[string]bool)
+	for _, account := range accounts {
+		if seen[account] {
+			continue
+		}
+		seen[account] = true
+		a, ok := l.accounts[account]
+		if !ok {
+			if strings.HasPrefix(account, storeCreditPrefix) {
+				continue
+			}
+			return nil, amount, status.Errorf(codes.InvalidArgument, "unknown gift card %s", maskGiftCard(account))
+		}
+		if !money.AreSameCurrency(a.balance, amount) {
+			return nil, amount, status.Errorf(codes.InvalidArgument, "gift card %s is in %s and cannot pay for an order in %s",
+				maskGiftCard(account), a.balance.CurrencyCode, amount.CurrencyCode)
+		}
+		if !money.IsPositive(remaining) || !money.IsPositive(a.balance) {
+			continue
+		}
+		take := money.Must(money.Min(a.balance, remaining))
+		debits = append(debits, &giftCardDebit{
+			account:  account,
+			amount:   take,
+			refunded: pb.Money{CurrencyCode: take.CurrencyCode},
+		})
+		remaining = money.Must(money.Subtract(remaining, take))
+	}
+
+	now := l.now()
+	for _, d := range debits {
+		a := l.accounts[d.account]
+		a.balance = money.Must(money.Subtract(a.balance, d.amount))
+		a.entries = append(a.entries, ledgerEntry{orderID: orderID, amount: money.Negate(d.amount), at: now})
+	}
+	return debits, remaining, nil
+}
+
+// credit adds amount to an account. Store credit accounts are opened on
+// first use.
+func (l *giftCardLedger) credit(orderID, account string, amount pb.Money) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a, ok := l.accounts[account]
+	if !ok {
+		if !strings.HasPrefix(account, storeCreditPrefix) {
+			return fmt.Errorf("unknown gift card %s", maskGiftCard(account))
+		}
+		a = &giftCardAccount{balance: pb.Money{CurrencyCode: amount.CurrencyCode}}
+		l.accounts[account] = a
+	}
+	balance, err := money.Sum(a.balance, amount)
+	if err != nil {
+		return fmt.Errorf("failed to credit %s: %v", maskGiftCard(account), err)
+	}
+	a.balance = balance
+	a.entries = append(a.entries, ledgerEntry{orderID: orderID, amount: amount, at: l.now()})
+	return nil
+}
+
+// release pays back debits of an order that was not placed.
+func (l *giftCardLedger) release(orderID string, debits []*giftCardDebit) {
+	for _, d := range debits {
+		if err := l.credit(orderID, d.account, d.amount); err != nil {
+			log.Errorf("failed to release gift card debit for order %s: %v", orderID, err)
+		}
+	}
+}
+
+// balance returns the balance of an account. Store credit the user does
+// not have is a zero balance in currencyCode.
+func (l *giftCardLedger) balance(account, currencyCode string) (pb.Money, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a, ok := l.accounts[account]
+	if !ok {
+		if strings.HasPrefix(account, storeCreditPrefix) {
+			return pb.Money{CurrencyCode: currencyCode}, nil
+		}
+		return pb.Money{}, status.Errorf(codes.NotFound, "unknown gift card %s", maskGiftCard(account))
+	}
+	return a.balance, nil
+}
+
+// giftCardCharges returns the order's gift card and store credit payments
+// as shown to the shopper.
+func giftCardCharges(debits []*giftCardDebit) []*pb.GiftCardCharge {
+	out := make([]*pb.GiftCardCharge, len(debits))
+	for i, d := range debits {
+		amount := d.amount
+		out[i] = &pb.GiftCardCharge{Code: maskGiftCard(d.account), Amount: &amount}
+	}
+	return out
+}
+
+func (cs *checkoutService) GetGiftCardBalance(ctx context.Context, req *pb.GetGiftCardBalanceRequest) (*pb.GetGiftCardBalanceResponse, error) {
+	var account string
+	if req.GetCode() != "" {
+		account = normalizeGiftCardCode(req.GetCode())
+	} else {
+		if req.GetUserId() == "" || req.GetCurrencyCode() == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "either a gift card code or a user_id and currency_code are required")
+		}
+		account = storeCreditAccount(req.GetUserId(), req.GetCurrencyCode())
+	}
+	balance, err := cs.giftCards.balance(account, req.GetCurrencyCode())
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GetGiftCardBalanceResponse{Balance: &balance}, nil
+}
@@ -0,0 +1,183 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+func testGiftCards(t *testing.T, cards ...*giftCardConfig) *giftCardLedger {
+	t.Helper()
+	l, err := newGiftCardLedger(cards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestGiftCardDebitSplitsAcrossCards(t *testing.T) {
+	l := testGiftCards(t,
+		&giftCardConfig{Code: "AAAA-1111", Balance: moneyConfig{CurrencyCode: "USD", Units: 5}},
+		&giftCardConfig{Code: "BBBB-2222", Balance: moneyConfig{CurrencyCode: "USD", Units: 20}})
+
+	debits, rest, err := l.debit("order-1", []string{"AAAA1111", "BBBB2222"}, *usd(12, 500000000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(debits) != 2 || nanosOf(debits[0].amount) != 5e9 || nanosOf(debits[1].amount) != 7.5e9 {
+		t.Fatalf("got debits %v, want 5.00 then 7.50", debits)
+	}
+	if nanosOf(rest) != 0 {
+		t.Errorf("got %v left for the card, want nothing", rest)
+	}
+	if b, _ := l.balance("BBBB2222", ""); nanosOf(b) != 12.5e9 {
+		t.Errorf("got balance %v, want 12.50", b)
+	}
+
+	l.release("order-1", debits)
+	if b, _ := l.balance("AAAA1111", ""); nanosOf(b) != 5e9 {
+		t.Errorf("got balance %v after release, want 5.00", b)
+	}
+}
+
+func TestGiftCardDebitIsAtomic(t *testing.T) {
+	l := testGiftCards(t,
+		&giftCardConfig{Code: "AAAA1111", Balance: moneyConfig{CurrencyCode: "USD", Units: 5}},
+		&giftCardConfig{Code: "EURO1111", Balance: moneyConfig{CurrencyCode: "EUR", Units: 5}})
+
+	for _, accounts := range [][]string{{"AAAA1111", "NOPE0000"}, {"AAAA1111", "EURO1111"}} {
+		if _, _, err := l.debit("order-1", accounts, *usd(10, 0)); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("debit(%v): got %v, want InvalidArgument", accounts, err)
+		}
+	}
+	if b, _ := l.balance("AAAA1111", ""); nanosOf(b) != 5e9 {
+		t.Errorf("got balance %v, want the failed debits to leave 5.00", b)
+	}
+}
+
+func TestPlaceOrderPaidByGiftCard(t *testing.T) {
+	ctx := context.Background()
+	cs, fakes := newTestCheckoutServiceWithBackends(t, 1)
+	cs.giftCards = testGiftCards(t, &giftCardConfig{Code: "GIFT1234", Balance: moneyConfig{CurrencyCode: "USD", Units: 50}})
+
+	req := placeOrderRequest("1600 Amphitheatre Pkwy")
+	req.CardToken = ""
+	req.GiftCardCodes = []string{"gift-1234"}
+	resp, err := cs.PlaceOrder(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := resp.GetOrder()
+	if len(fakes.payment.captures) != 0 || nanosOf(*order.GetCardCharged()) != 0 {
+		t.Errorf("the card was charged %v for an order covered by a gift card", order.GetCardCharged())
+	}
+	if got := order.GetGiftCardCharges(); len(got) != 1 || got[0].GetCode() != "****1234" || nanosOf(*got[0].GetAmount()) != nanosOf(*order.GetTotal()) {
+		t.Errorf("got gift card charges %v, want the whole total on ****1234", got)
+	}
+
+	if err := deliverTestOrder(ctx, cs, order.GetOrderId()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.CreateReturn(ctx, &pb.CreateReturnRequest{OrderId: order.GetOrderId(), UserId: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	// Returns refund everything but the $8.99 shipping.
+	if b, _ := cs.giftCards.balance("GIFT1234", ""); nanosOf(b) != 41010000000 {
+		t.Errorf("got balance %v after returning, want 41.01", b)
+	}
+}
+
+func TestPlaceOrderSplitsGiftCardAndCard(t *testing.T) {
+	ctx := context.Background()
+	cs, fakes := newTestCheckoutServiceWithBackends(t, 1)
+	fakes.payment.approve = true
+	cs.giftCards = testGiftCards(t, &giftCardConfig{Code: "GIFT1234", Balance: moneyConfig{CurrencyCode: "USD", Units: 15}})
+
+	req := placeOrderRequest("1600 Amphitheatre Pkwy")
+	req.GiftCardCodes = []string{"GIFT1234"}
+	resp, err := cs.PlaceOrder(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := resp.GetOrder()
+	cardCharged := nanosOf(*order.GetTotal()) - 15e9
+	if len(fakes.payment.captures) != 1 || nanosOf(*fakes.payment.captures[0].GetAmount()) != cardCharged {
+		t.Fatalf("got captures %v, want the total less the gift card", fakes.payment.captures)
+	}
+
+	// The $10.50 item is refunded to the card first and the gift card gets
+	// the rest; shipping is kept.
+	if err := deliverTestOrder(ctx, cs, order.GetOrderId()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.CreateReturn(ctx, &pb.CreateReturnRequest{OrderId: order.GetOrderId(), UserId: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fakes.payment.refunds) != 1 || nanosOf(*fakes.payment.refunds[0].GetAmount()) != cardCharged {
+		t.Errorf("got card refunds %v, want all %d nanos charged to the card", fakes.payment.refunds, cardCharged)
+	}
+	if b, _ := cs.giftCards.balance("GIFT1234", ""); nanosOf(b) != 10.5e9-cardCharged {
+		t.Errorf("got gift card balance %v, want the rest of the refund", b)
+	}
+}
+
+func TestReturnToStoreCredit(t *testing.T) {
+	ctx := context.Background()
+	cs, fakes := newTestCheckoutServiceWithBackends(t, 1)
+	fakes.payment.approve = true
+
+	resp, err := cs.PlaceOrder(ctx, placeOrderRequest("1600 Amphitheatre Pkwy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orderID := resp.GetOrder().GetOrderId()
+	if err := deliverTestOrder(ctx, cs, orderID); err != nil {
+		t.Fatal(err)
+	}
+	order, err := cs.CreateReturn(ctx, &pb.CreateReturnRequest{OrderId: orderID, UserId: "u1", StoreCredit: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fakes.payment.refunds) != 0 || !order.GetReturns()[0].GetStoreCredit() {
+		t.Errorf("got card refunds %v, want the return credited to the store", fakes.payment.refunds)
+	}
+	credit, err := cs.GetGiftCardBalance(ctx, &pb.GetGiftCardBalanceRequest{UserId: "u1", CurrencyCode: "USD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nanosOf(*credit.GetBalance()) != nanosOf(*order.GetReturns()[0].GetRefund()) {
+		t.Errorf("got store credit %v, want the refund %v", credit.GetBalance(), order.GetReturns()[0].GetRefund())
+	}
+
+	if _, err := cs.GetGiftCardBalance(ctx, &pb.GetGiftCardBalanceRequest{Code: "NOPE0000"}); status.Code(err) != codes.NotFound {
+		t.Errorf("unknown gift card: got %v, want NotFound", err)
+	}
+}
+
+// deliverTestOrder marks an order as shipped and delivered.
+func deliverTestOrder(ctx context.Context, cs *checkoutService, orderID string) error {
+	for _, s := range []pb.OrderStatus{pb.OrderStatus_ORDER_STATUS_SHIPPED, pb.OrderStatus_ORDER_STATUS_DELIVERED} {
+		if _, err := cs.UpdateOrderStatus(ctx, &pb.UpdateOrderStatusRequest{OrderId: orderID, Status: s}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -25,15 +25,20 @@ import (
 	"encoding/json"
 	"net/url"
 	"io"
+	"strconv"
+	"strings"
 
 
 	"cloud.google.com/go/profiler"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
 	money "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/money"
@@ -41,14 +46,19 @@ import (
 
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 const (
 	listenPort  = "5050"
 	usdCurrency = "USD"
+
+	defaultGCFBaseURL      = "https://us-central1-cloudblend-435916.cloudfunctions.net"
+	defaultPrepConcurrency = 8
 )
 
 var log *logrus.Logger
@@ -56,14 +66,14 @@ var log *logrus.Logger
 func init() {
 	log = logrus.New()
 	log.Level = logrus.DebugLevel
-	log.Formatter = &logrus.JSONFormatter{
+	log.Formatter = redactingFormatter{&logrus.JSONFormatter{
 		FieldMap: logrus.FieldMap{
 			logrus.FieldKeyTime:  "timestamp",
 			logrus.FieldKeyLevel: "severity",
 			logrus.FieldKeyMsg:   "message",
 		},
 		TimestampFormat: time.RFC3339Nano,
-	}
+	}}
 	log.Out = os.Stdout
 }
 
@@ -88,6 +98,26 @@ type checkoutService struct {
 
 	paymentSvcAddr string
 	paymentSvcConn *grpc.ClientConn
+
+	// gcfBaseURL is the root of the Cloud Functions that replaced the
+	// currency, shipping and email gRPC services.
+	gcfBaseURL string
+	// shippingBaseURL is the root of the shipping API: gcfBaseURL, or the
+	// HTTP gateway of the shipping service, which takes the same payloads.
+	shippingBaseURL string
+
+	// prepConcurrency bounds the number of in-flight catalog and currency
+	// requests while preparing an order.
+	prepConcurrency int
+
+	webhooks   *webhookDispatcher
+	promotions *promotionEngine
+	taxes      *taxTable
+	orders     *orderStore
+
+	authorizations *authorizationSweeper
+	risk           *riskEngine
+	giftCards      *giftCardLedger
 }
 
 func main() {
@@ -100,6 +130,15 @@ func main() {
 		log.Info("Tracing disabled.")
 	}
 
+	if os.Getenv("ENABLE_STATS") == "1" {
+		if err := initStats(); err != nil {
+			log.Fatalf("failed to initialize stats: %v", err)
+		}
+		log.Info("Stats enabled.")
+	} else {
+		log.Info("Stats disabled.")
+	}
+
 	if os.Getenv("ENABLE_PROFILER") == "1" {
 		log.Info("Profiling enabled.")
 		go initProfiling("checkoutservice", "1.0.0")
@@ -113,6 +152,22 @@ func main() {
 	}
 
 	svc := new(checkoutService)
+	svc.gcfBaseURL = defaultGCFBaseURL
+	if v := os.Getenv("GCF_BASE_URL"); v != "" {
+		svc.gcfBaseURL = v
+	}
+	svc.shippingBaseURL = svc.gcfBaseURL
+	if v := os.Getenv("SHIPPING_BASE_URL"); v != "" {
+		svc.shippingBaseURL = v
+	}
+	svc.prepConcurrency = defaultPrepConcurrency
+	if v := os.Getenv("ORDER_PREP_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("invalid ORDER_PREP_CONCURRENCY %q", v)
+		}
+		svc.prepConcurrency = n
+	}
 	// mustMapEnv(&svc.shippingSvcAddr, "SHIPPING_SERVICE_ADDR")
 	mustMapEnv(&svc.productCatalogSvcAddr, "PRODUCT_CATALOG_SERVICE_ADDR")
 	mustMapEnv(&svc.cartSvcAddr, "CART_SERVICE_ADDR")
@@ -127,7 +182,52 @@ func main() {
 	// mustConnGRPC(ctx, &svc.emailSvcConn, svc.emailSvcAddr) //this must be changed
 	mustConnGRPC(ctx, &svc.paymentSvcConn, svc.paymentSvcAddr)
 
-	log.Infof("service config: %+v", svc)
+	svc.webhooks = webhookDispatcherFromEnv()
+	svc.orders = newOrderStore()
+	svc.authorizations = newAuthorizationSweeper()
+	sweepInterval := defaultAuthorizationSweepInterval
+	if v := os.Getenv("AUTHORIZATION_SWEEP_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("failed to parse AUTHORIZATION_SWEEP_INTERVAL (%s) as time.Duration: %v", v, err)
+		}
+		sweepInterval = d
+	}
+	go svc.runAuthorizationSweeper(ctx, sweepInterval)
+	shipmentRetryInterval := defaultShipmentRetryInterval
+	if v := os.Getenv("SHIPMENT_RETRY_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("failed to parse SHIPMENT_RETRY_INTERVAL (%s) as time.Duration: %v", v, err)
+		}
+		shipmentRetryInterval = d
+	}
+	go svc.runShipmentRetrier(ctx, shipmentRetryInterval)
+	promotions, err := loadPromotions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	svc.promotions = promotions
+	svc.taxes, err = loadTaxTable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	svc.risk, err = loadRiskEngine(svc.convertCurrencyViaGCF, otel.GetMeterProvider())
+	if err != nil {
+		log.Fatal(err)
+	}
+	svc.giftCards, err = loadGiftCards()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if addr := os.Getenv("WEBHOOK_ADMIN_ADDR"); addr != "" {
+		go func() {
+			log.Fatal(svc.webhooks.serveWebhookAdmin(addr))
+		}()
+	}
+
+	log.Infof("service config: product_catalog=%s cart=%s payment=%s gcf=%s shipping=%s",
+		svc.productCatalogSvcAddr, svc.cartSvcAddr, svc.paymentSvcAddr, svc.gcfBaseURL, svc.shippingBaseURL)
 
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
 	if err != nil {
@@ -152,8 +252,19 @@ func main() {
 	log.Fatal(err)
 }
 
-func initStats() {
-	//TODO(arbrown) Implement OpenTelemetry stats
+// initStats exports metrics over OTLP/HTTP to COLLECTOR_METRICS_ADDR.
+func initStats() error {
+	var collectorAddr string
+	mustMapEnv(&collectorAddr, "COLLECTOR_METRICS_ADDR")
+	exporter, err := otlpmetrichttp.New(context.Background(),
+		otlpmetrichttp.WithEndpoint(collectorAddr),
+		otlpmetrichttp.WithInsecure())
+	if err != nil {
+		return fmt.Errorf("failed to create metric exporter: %v", err)
+	}
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter))))
+	return nil
 }
 
 func initTracing() {
@@ -236,87 +347,444 @@ func (cs *checkoutService) Watch(req *healthpb.HealthCheckRequest, ws healthpb.H
 func (cs *checkoutService) PlaceOrder(ctx context.Context, req *pb.PlaceOrderRequest) (*pb.PlaceOrderResponse, error) {
 	log.Infof("[PlaceOrder] user_id=%q user_currency=%q", req.UserId, req.UserCurrency)
 
+	if req.CardToken == "" && len(req.GiftCardCodes) == 0 && !req.UseStoreCredit {
+		return nil, status.Errorf(codes.InvalidArgument, "card_token is required")
+	}
+
 	orderID, err := uuid.NewUUID()
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to generate order uuid")
 	}
 
-	prep, err := cs.prepareOrderItemsAndShippingQuoteFromCart(ctx, req.UserId, req.UserCurrency, req.Address)
+	prep, rejected, err := cs.priceOrder(ctx, req.UserId, req.UserCurrency, req.Address, req.CouponCodes, req.ServiceLevel)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, err.Error())
+		return nil, pricingError(err)
+	}
+	if len(rejected) > 0 {
+		return nil, status.Error(codes.InvalidArgument, rejected[0].Error())
 	}
 
-	total := pb.Money{CurrencyCode: req.UserCurrency,
-		Units: 0,
-		Nanos: 0}
-	total = money.Must(money.Sum(total, *prep.shippingCostLocalized))
-	for _, it := range prep.orderItems {
-		multPrice := money.MultiplySlow(*it.Cost, uint32(it.GetItem().GetQuantity()))
-		total = money.Must(money.Sum(total, multPrice))
+	_, total := prep.totals(req.UserCurrency)
+
+	risk := cs.risk.assess(ctx, &riskCheck{
+		UserID:          req.UserId,
+		Email:           req.Email,
+		CardFingerprint: req.CardFingerprint,
+		ShippingCountry: req.GetAddress().GetCountry(),
+		BillingCountry:  req.BillingCountry,
+		Total:           &total,
+	})
+	switch risk.Decision {
+	case pb.RiskDecision_RISK_DECISION_DENY:
+		log.Warnf("order %s denied by risk screening: %s", orderID, strings.Join(risk.Reasons, "; "))
+		return nil, status.Errorf(codes.PermissionDenied, "order declined by risk screening")
+	case pb.RiskDecision_RISK_DECISION_REVIEW:
+		log.Infof("order %s flagged for review: %s", orderID, strings.Join(risk.Reasons, "; "))
 	}
 
-	txID, err := cs.chargeCard(ctx, &total, req.CreditCard)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to charge card: %+v", err)
+	// Stock and coupon redemptions are held until the order is placed and
+	// handed back if any later step fails.
+	placed := false
+	if err := cs.reserveStock(ctx, orderID.String(), prep.shipments); err != nil {
+		return nil, status.Errorf(status.Code(err), "failed to reserve stock: %s", status.Convert(err).Message())
+	}
+	defer func() {
+		if !placed {
+			cs.releaseStock(context.WithoutCancel(ctx), orderID.String())
+		}
+	}()
+
+	if err := cs.promotions.reserve(prep.discounts, req.UserId); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
 	}
-	log.Infof("payment went through (transaction_id: %s)", txID)
+	defer func() {
+		if !placed {
+			cs.promotions.release(prep.discounts, req.UserId)
+		}
+	}()
 
-	shippingTrackingID, err := cs.shipOrder(ctx, req.Address, prep.cartItems)
+	// Gift cards and store credit pay first; the card covers the rest.
+	var accounts []string
+	for _, code := range req.GiftCardCodes {
+		accounts = append(accounts, normalizeGiftCardCode(code))
+	}
+	if req.UseStoreCredit {
+		accounts = append(accounts, storeCreditAccount(req.UserId, total.CurrencyCode))
+	}
+	giftCards, cardAmount, err := cs.giftCards.debit(orderID.String(), accounts, total)
 	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if !placed {
+			cs.giftCards.release(orderID.String(), giftCards)
+		}
+	}()
+
+	// The card is only authorized here and captured once the order has
+	// shipped, so a shipping failure releases the hold instead of refunding.
+	var auth *pb.AuthorizeResponse
+	if money.IsPositive(cardAmount) {
+		if req.CardToken == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "gift cards do not cover the total; card_token is required")
+		}
+		auth, err = cs.authorizeCard(ctx, &cardAmount, req.CardToken)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to authorize card: %+v", err)
+		}
+		log.Infof("payment authorized (authorization_id: %s)", auth.GetAuthorizationId())
+		defer func() {
+			if !placed {
+				cs.releaseAuthorization(context.WithoutCancel(ctx), auth)
+			}
+		}()
+	}
+
+	// Once a shipment has been handed over the order is kept: shipments that
+	// failed after it stay pending and are retried in the background.
+	shipped, err := cs.shipAll(ctx, req.Address, prep.shipments)
+	if shipped == 0 && err != nil {
+		if status.Code(err) == codes.FailedPrecondition {
+			return nil, err
+		}
 		return nil, status.Errorf(codes.Unavailable, "shipping error: %+v", err)
+	} else if err != nil {
+		log.Warnf("order %s: %d of %d shipments pending: %v", orderID, pendingShipments(prep.shipments), len(prep.shipments), err)
+	}
+	placed = true
+	cs.commitStock(ctx, orderID.String())
+
+	var (
+		txID       string
+		captureErr error
+	)
+	if auth != nil {
+		txID, captureErr = cs.captureAuthorization(ctx, auth.GetAuthorizationId(), &cardAmount)
+		if captureErr == nil {
+			log.Infof("payment captured (transaction_id: %s)", txID)
+		}
 	}
 
 	_ = cs.emptyUserCart(ctx, req.UserId)
 
 	orderResult := &pb.OrderResult{
-		OrderId:            orderID.String(),
-		ShippingTrackingId: shippingTrackingID,
-		ShippingCost:       prep.shippingCostLocalized,
-		ShippingAddress:    req.Address,
-		Items:              prep.orderItems,
+		OrderId:         orderID.String(),
+		ShippingCost:    prep.shippingCostLocalized,
+		ShippingAddress: req.Address,
+		Items:           prep.orderItems,
+		Discounts:       prep.discounts,
+		TaxLines:        prep.taxLines,
+		Total:           &total,
+		Status:          pb.OrderStatus_ORDER_STATUS_PLACED,
+		Refunded:        &pb.Money{CurrencyCode: total.CurrencyCode},
+		CardLastFour:    req.CardLastFour,
+		Risk:            risk,
+		GiftCardCharges: giftCardCharges(giftCards),
+		CardCharged:     &cardAmount,
+		Shipments:       prep.shipments,
+	}
+	cs.orders.add(&orderRecord{
+		order:           proto.Clone(orderResult).(*pb.OrderResult),
+		userID:          req.UserId,
+		email:           req.Email,
+		transactionID:   txID,
+		authorizationID: auth.GetAuthorizationId(),
+		giftCards:       giftCards,
+		cardRefunded:    pb.Money{CurrencyCode: total.CurrencyCode},
+		placedAt:        time.Now(),
+	})
+	if captureErr != nil {
+		log.Warnf("%v; retrying in the background", captureErr)
+		cs.authorizations.add(&pendingAuthorization{
+			id:      auth.GetAuthorizationId(),
+			expires: time.Unix(auth.GetExpiresAtUnix(), 0),
+			orderID: orderID.String(),
+			amount:  &cardAmount,
+		})
 	}
 
-	if err := cs.sendOrderConfirmation(ctx, req.Email, orderResult); err != nil {
+	if err := cs.sendOrderEmail(ctx, req.Email, emailConfirmation, orderResult); err != nil {
 		log.Warnf("failed to send order confirmation to %q: %+v", req.Email, err)
 	} else {
 		log.Infof("order confirmation email sent to %q", req.Email)
 	}
+	cs.webhooks.publish(eventOrderPlaced, orderResult)
+
 	resp := &pb.PlaceOrderResponse{Order: orderResult}
 	return resp, nil
 }
 
+// PreviewOrder runs the same pricing pipeline as PlaceOrder and returns the
+// itemized breakdown without any side effects.
+func (cs *checkoutService) PreviewOrder(ctx context.Context, req *pb.PreviewOrderRequest) (*pb.PreviewOrderResponse, error) {
+	log.Infof("[PreviewOrder] user_id=%q user_currency=%q", req.UserId, req.UserCurrency)
+
+	prep, rejected, err := cs.priceOrder(ctx, req.UserId, req.UserCurrency, req.Address, req.CouponCodes, req.ServiceLevel)
+	if err != nil {
+		return nil, pricingError(err)
+	}
+	subtotal, total := prep.totals(req.UserCurrency)
+	resp := &pb.PreviewOrderResponse{
+		Items:        prep.orderItems,
+		ShippingCost: prep.shippingCostLocalized,
+		Subtotal:     &subtotal,
+		Total:        &total,
+		Discounts:    prep.discounts,
+		TaxLines:     prep.taxLines,
+		Shipments:    prep.shipments,
+
+		ShippingOptions: prep.shippingOptions,
+		ServiceLevel:    prep.serviceLevel,
+	}
+	for _, r := range rejected {
+		resp.RejectedCouponCodes = append(resp.RejectedCouponCodes, r.code)
+	}
+	return resp, nil
+}
+
 type orderPrep struct {
 	orderItems            []*pb.OrderItem
+	products              []*pb.Product // parallel to orderItems
 	cartItems             []*pb.CartItem
+	shipments             []*pb.Shipment
+	shippingOptions       []*pb.ShippingOption
+	serviceLevel          string
 	shippingCostLocalized *pb.Money
+	discounts             []*pb.Discount
+	taxLines              []*pb.TaxLine
 }
 
-func (cs *checkoutService) prepareOrderItemsAndShippingQuoteFromCart(ctx context.Context, userID, userCurrency string, address *pb.Address) (orderPrep, error) {
+// subtotal returns the sum of item costs multiplied by quantity.
+func (prep orderPrep) subtotal(userCurrency string) pb.Money {
+	subtotal := pb.Money{CurrencyCode: userCurrency}
+	for _, it := range prep.orderItems {
+		multPrice := money.MultiplySlow(*it.Cost, uint32(it.GetItem().GetQuantity()))
+		subtotal = money.Must(money.Sum(subtotal, multPrice))
+	}
+	return subtotal
+}
+
+// totals returns the item subtotal and the grand total (items plus shipping
+// and tax not included in prices, minus discounts) of the prepared order in
+// the user's currency.
+func (prep orderPrep) totals(userCurrency string) (subtotal, total pb.Money) {
+	subtotal = prep.subtotal(userCurrency)
+	total = money.Must(money.Sum(subtotal, *prep.shippingCostLocalized))
+	for _, d := range prep.discounts {
+		total = money.Must(money.Subtract(total, *d.Amount))
+	}
+	for _, t := range prep.taxLines {
+		if !t.Included {
+			total = money.Must(money.Sum(total, *t.Amount))
+		}
+	}
+	return subtotal, total
+}
+
+// pricingError returns the error of priceOrder as an RPC error. Errors the
+// caller can fix already carry their status; anything else is internal.
+func pricingError(err error) error {
+	if s, ok := status.FromError(err); ok {
+		return s.Err()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// priceOrder prepares the user's cart and applies promotions and tax. Coupon
+// codes that cannot be used are returned separately so callers can decide
+// whether to reject the order or just report them.
+func (cs *checkoutService) priceOrder(ctx context.Context, userID, userCurrency string, address *pb.Address, couponCodes []string, serviceLevel string) (orderPrep, []*couponError, error) {
+	prep, err := cs.prepareOrderItemsAndShippingQuoteFromCart(ctx, userID, userCurrency, address, serviceLevel)
+	if err != nil {
+		return prep, nil, err
+	}
+	var rejected []*couponError
+	if cs.promotions != nil {
+		var promos []*promotion
+		promos, rejected = cs.promotions.applicable(userID, couponCodes)
+		prep.discounts, err = cs.promotions.discounts(ctx, promos, prep, userCurrency, cs.convertCurrency)
+		if err != nil {
+			return prep, nil, fmt.Errorf("failed to apply promotions: %+v", err)
+		}
+	}
+	prep.taxLines = cs.taxes.taxLines(address, prep, userCurrency)
+	return prep, rejected, nil
+}
+
+// prepareOrderItemsAndShippingQuoteFromCart prices the user's cart and quotes
+// shipping. Item pricing and the shipping quote run concurrently, and each
+// item is priced in parallel up to cs.prepConcurrency requests at a time. All
+// requests share ctx, so the caller's deadline bounds the whole preparation
+// and the first failure cancels the rest.
+func (cs *checkoutService) prepareOrderItemsAndShippingQuoteFromCart(ctx context.Context, userID, userCurrency string, address *pb.Address, serviceLevel string) (orderPrep, error) {
 	var out orderPrep
 	cartItems, err := cs.getUserCart(ctx, userID)
 	if err != nil {
 		return out, fmt.Errorf("cart failure: %+v", err)
 	}
-	orderItems, err := cs.prepOrderItems(ctx, cartItems, userCurrency)
+
+	var (
+		orderItems []*pb.OrderItem
+		products   []*pb.Product
+		plan       *shippingPlan
+	)
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		var err error
+		orderItems, products, err = cs.prepOrderItems(gctx, cartItems, userCurrency)
+		if err != nil {
+			return fmt.Errorf("failed to prepare order: %+v", err)
+		}
+		return nil
+	})
+	g.Go(func() error {
+		var err error
+		plan, err = cs.planShipments(gctx, address, cartItems, userCurrency, serviceLevel)
+		return err
+	})
+	if err := g.Wait(); err != nil {
+		return out, err
+	}
+
+	out.shipments = plan.shipments
+	out.shippingOptions = plan.options
+	out.serviceLevel = plan.serviceLevel
+	out.shippingCostLocalized = plan.cost
+	out.cartItems = cartItems
+	out.orderItems = orderItems
+	out.products = products
+	return out, nil
+}
+
+// shippingAPIVersion is the version of the shipping function's JSON schema
+// (cloud-functions/shipping-gcf/schema) that requests follow.
+const shippingAPIVersion = "v1"
+
+// shippingAddress and shippingItem are the address and items of the
+// shipping function's schema.
+type shippingAddress struct {
+	StreetAddress string `json:"street_address"`
+	City          string `json:"city"`
+	State         string `json:"state"`
+	Country       string `json:"country"`
+	ZipCode       int32  `json:"zip_code"`
+}
+
+type shippingItem struct {
+	ProductID string `json:"product_id"`
+	Quantity  int32  `json:"quantity"`
+}
+
+// shippingRequest is the body of getQuote and, with a service level, of
+// shipOrder.
+type shippingRequest struct {
+	Version      string          `json:"version"`
+	Address      shippingAddress `json:"address"`
+	Items        []shippingItem  `json:"items"`
+	ServiceLevel string          `json:"service_level,omitempty"`
+}
+
+func newShippingRequest(address *pb.Address, items []*pb.CartItem, serviceLevel string) shippingRequest {
+	req := shippingRequest{
+		Version: shippingAPIVersion,
+		Address: shippingAddress{
+			StreetAddress: address.GetStreetAddress(),
+			City:          address.GetCity(),
+			State:         address.GetState(),
+			Country:       address.GetCountry(),
+			ZipCode:       address.GetZipCode(),
+		},
+		Items:        make([]shippingItem, len(items)),
+		ServiceLevel: serviceLevel,
+	}
+	for i, it := range items {
+		req.Items[i] = shippingItem{ProductID: it.GetProductId(), Quantity: it.GetQuantity()}
+	}
+	return req
+}
+
+// jsonInt64 is an int64 that also decodes from a JSON string, as the proto3
+// JSON mapping of the shipping service's HTTP gateway writes 64-bit
+// integers.
+type jsonInt64 int64
+
+func (n *jsonInt64) UnmarshalJSON(b []byte) error {
+	var v json.Number
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	i, err := v.Int64()
+	if err != nil {
+		return err
+	}
+	*n = jsonInt64(i)
+	return nil
+}
+
+// postShipping POSTs a request to an endpoint of the shipping API and
+// decodes its answer into resp.
+func (cs *checkoutService) postShipping(ctx context.Context, endpoint string, body shippingRequest, resp interface{}) error {
+	jsonData, err := json.Marshal(body)
 	if err != nil {
-		return out, fmt.Errorf("failed to prepare order: %+v", err)
+		return fmt.Errorf("failed to marshal %s request: %v", endpoint, err)
 	}
-	shippingUSD, err := cs.quoteShipping(ctx, address, cartItems)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cs.shippingBaseURL+"/shipping/"+endpoint, bytes.NewReader(jsonData))
 	if err != nil {
-		return out, fmt.Errorf("shipping quote failure: %+v", err)
+		return fmt.Errorf("failed to create GCF %s request: %v", endpoint, err)
 	}
-	shippingPrice, err := cs.convertCurrency(ctx, shippingUSD, userCurrency)
+	req.Header.Set("Content-Type", "application/json")
+	httpResp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return out, fmt.Errorf("failed to convert shipping cost to currency: %+v", err)
+		return fmt.Errorf("failed to call GCF %s: %v", endpoint, err)
 	}
+	defer httpResp.Body.Close()
 
-	out.shippingCostLocalized = shippingPrice
-	out.cartItems = cartItems
-	out.orderItems = orderItems
-	return out, nil
+	if httpResp.StatusCode == http.StatusUnprocessableEntity {
+		return shippingRuleError(httpResp.Body)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(httpResp.Body)
+		return fmt.Errorf("GCF %s returned %d: %s", endpoint, httpResp.StatusCode, string(b))
+	}
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return fmt.Errorf("failed to parse GCF %s response: %v", endpoint, err)
+	}
+	return nil
 }
 
-func (cs *checkoutService) quoteShipping(ctx context.Context, address *pb.Address, items []*pb.CartItem) (*pb.Money, error) {
+// shippingRuleError turns the shipping function's answer to a shipment
+// that breaks shipping rules into a FAILED_PRECONDITION error with a
+// PreconditionFailure detail, as the shipping service returns it.
+func shippingRuleError(body io.Reader) error {
+	var resp struct {
+		Error      string `json:"error"`
+		Violations []struct {
+			Type        string `json:"type"`
+			Subject     string `json:"subject"`
+			Description string `json:"description"`
+		} `json:"violations"`
+	}
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
+		return fmt.Errorf("failed to parse GCF shipping rule error: %v", err)
+	}
+	details := &errdetails.PreconditionFailure{}
+	for _, v := range resp.Violations {
+		details.Violations = append(details.Violations, &errdetails.PreconditionFailure_Violation{
+			Type:        v.Type,
+			Subject:     v.Subject,
+			Description: v.Description,
+		})
+	}
+	st, err := status.New(codes.FailedPrecondition, resp.Error).WithDetails(details)
+	if err != nil {
+		return status.Error(codes.FailedPrecondition, resp.Error)
+	}
+	return st.Err()
+}
+
+// quoteShipping returns the service levels offered for shipping items to
+// address, default first, with their cost in USD.
+func (cs *checkoutService) quoteShipping(ctx context.Context, address *pb.Address, items []*pb.CartItem) ([]*pb.ShippingOption, error) {
 	// shippingQuote, err := pb.NewShippingServiceClient(cs.shippingSvcConn).
 	// 	GetQuote(ctx, &pb.GetQuoteRequest{
 	// 		Address: address,
@@ -324,42 +792,45 @@ func (cs *checkoutService) quoteShipping(ctx context.Context, address *pb.Addres
 	// if err != nil {
 	// 	return nil, fmt.Errorf("failed to get shipping quote: %+v", err)
 	// }
-	// return shippingQuote.GetCostUsd(), nil
+	// return shippingQuote.GetOptions(), nil
 
-	gcfURL := "https://us-central1-cloudblend-435916.cloudfunctions.net/shipping/getQuote"
-	req, err := http.NewRequestWithContext(ctx, "GET", gcfURL, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create GCF shipping quote request: %v", err)
+	var shippingResp struct {
+		Options []struct {
+			ServiceLevel string `json:"service_level"`
+			Name         string `json:"name"`
+			Carrier      string `json:"carrier"`
+			Cost         struct {
+				CurrencyCode string    `json:"currency_code"`
+				Units        jsonInt64 `json:"units"`
+				Nanos        int32     `json:"nanos"`
+			} `json:"cost"`
+			EstimatedDeliveryDate string `json:"estimated_delivery_date"`
+			EarliestDeliveryDate  string `json:"earliest_delivery_date"`
+		} `json:"options"`
 	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to call GCF for shipping quote: %v", err)
+	if err := cs.postShipping(ctx, "getQuote", newShippingRequest(address, items, ""), &shippingResp); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("GCF shipping quote returned %d: %s", resp.StatusCode, string(body))
+	if len(shippingResp.Options) == 0 {
+		return nil, fmt.Errorf("GCF shipping quote offered no service level")
 	}
 
-	var shippingResp struct {
-		CostUSD struct {
-			CurrencyCode string `json:"currency_code"`
-			Units        int64  `json:"units"`
-			Nanos        int32  `json:"nanos"`
-		} `json:"cost_usd"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&shippingResp); err != nil {
-		return nil, fmt.Errorf("failed to parse GCF shipping quote response: %v", err)
+	options := make([]*pb.ShippingOption, len(shippingResp.Options))
+	for i, o := range shippingResp.Options {
+		options[i] = &pb.ShippingOption{
+			ServiceLevel: o.ServiceLevel,
+			Name:         o.Name,
+			Carrier:      o.Carrier,
+			Cost: &pb.Money{
+				CurrencyCode: o.Cost.CurrencyCode,
+				Units:        int64(o.Cost.Units),
+				Nanos:        o.Cost.Nanos,
+			},
+			EstimatedDeliveryDate: o.EstimatedDeliveryDate,
+			EarliestDeliveryDate:  o.EarliestDeliveryDate,
+		}
 	}
-
-	return &pb.Money{
-		CurrencyCode: shippingResp.CostUSD.CurrencyCode,
-		Units:        shippingResp.CostUSD.Units,
-		Nanos:        shippingResp.CostUSD.Nanos,
-	}, nil
-
+	return options, nil
 }
 
 func (cs *checkoutService) getUserCart(ctx context.Context, userID string) ([]*pb.CartItem, error) {
@@ -377,24 +848,66 @@ func (cs *checkoutService) emptyUserCart(ctx context.Context, userID string) err
 	return nil
 }
 
-func (cs *checkoutService) prepOrderItems(ctx context.Context, items []*pb.CartItem, userCurrency string) ([]*pb.OrderItem, error) {
+// reserveStock holds catalog stock for the shipments under the order ID, in
+// the warehouses they were planned for. Errors keep the catalog's status
+// code so out-of-stock reaches the caller as FAILED_PRECONDITION.
+func (cs *checkoutService) reserveStock(ctx context.Context, orderID string, shipments []*pb.Shipment) error {
+	_, err := pb.NewProductCatalogServiceClient(cs.productCatalogSvcConn).ReserveStock(ctx, &pb.ReserveStockRequest{
+		ReservationId: orderID,
+		Allocations:   stockAllocations(shipments)})
+	return err
+}
+
+// commitStock and releaseStock only log failures so an order is never failed
+// after the fact; reservations left behind expire in the catalog.
+func (cs *checkoutService) commitStock(ctx context.Context, orderID string) {
+	if _, err := pb.NewProductCatalogServiceClient(cs.productCatalogSvcConn).CommitReservation(ctx, &pb.CommitReservationRequest{
+		ReservationId: orderID}); err != nil {
+		log.Errorf("failed to commit stock reservation %s: %+v", orderID, err)
+	}
+}
+
+func (cs *checkoutService) releaseStock(ctx context.Context, orderID string) {
+	if _, err := pb.NewProductCatalogServiceClient(cs.productCatalogSvcConn).ReleaseReservation(ctx, &pb.ReleaseReservationRequest{
+		ReservationId: orderID}); err != nil {
+		log.Warnf("failed to release stock reservation %s: %+v", orderID, err)
+	} else {
+		log.Infof("released stock reservation %s", orderID)
+	}
+}
+
+// prepOrderItems prices each cart item in the user's currency. It also
+// returns the catalog product behind each item, in the same order.
+func (cs *checkoutService) prepOrderItems(ctx context.Context, items []*pb.CartItem, userCurrency string) ([]*pb.OrderItem, []*pb.Product, error) {
 	out := make([]*pb.OrderItem, len(items))
+	products := make([]*pb.Product, len(items))
 	cl := pb.NewProductCatalogServiceClient(cs.productCatalogSvcConn)
 
+	g, ctx := errgroup.WithContext(ctx)
+	if cs.prepConcurrency > 0 {
+		g.SetLimit(cs.prepConcurrency)
+	}
 	for i, item := range items {
-		product, err := cl.GetProduct(ctx, &pb.GetProductRequest{Id: item.GetProductId()})
-		if err != nil {
-			return nil, fmt.Errorf("failed to get product #%q", item.GetProductId())
-		}
-		price, err := cs.convertCurrency(ctx, product.GetPriceUsd(), userCurrency)
-		if err != nil {
-			return nil, fmt.Errorf("failed to convert price of %q to %s", item.GetProductId(), userCurrency)
-		}
-		out[i] = &pb.OrderItem{
-			Item: item,
-			Cost: price}
+		g.Go(func() error {
+			product, err := cl.GetProduct(ctx, &pb.GetProductRequest{Id: item.GetProductId()})
+			if err != nil {
+				return fmt.Errorf("failed to get product #%q", item.GetProductId())
+			}
+			price, err := cs.convertCurrency(ctx, product.GetPriceUsd(), userCurrency)
+			if err != nil {
+				return fmt.Errorf("failed to convert price of %q to %s", item.GetProductId(), userCurrency)
+			}
+			out[i] = &pb.OrderItem{
+				Item: item,
+				Cost: price}
+			products[i] = product
+			return nil
+		})
 	}
-	return out, nil
+	if err := g.Wait(); err != nil {
+		return nil, nil, err
+	}
+	return out, products, nil
 }
 
 func (cs *checkoutService) convertCurrency(ctx context.Context, from *pb.Money, toCurrency string) (*pb.Money, error) {
@@ -411,7 +924,7 @@ func (cs *checkoutService) convertCurrency(ctx context.Context, from *pb.Money,
 
 func (cs *checkoutService) convertCurrencyViaGCF(ctx context.Context, from *pb.Money, toCurrency string) (*pb.Money, error) {
     // Replace with your GCF URL
-    gcfURL := "https://us-central1-cloudblend-435916.cloudfunctions.net/convertCurrency"
+    gcfURL := cs.gcfBaseURL + "/convertCurrency"
     params := url.Values{}
     params.Add("from_currency_code", from.CurrencyCode)
     params.Add("from_units", fmt.Sprintf("%d", from.Units))
@@ -455,28 +968,44 @@ func (cs *checkoutService) convertCurrencyViaGCF(ctx context.Context, from *pb.M
     }, nil
 }
 
-func (cs *checkoutService) chargeCard(ctx context.Context, amount *pb.Money, paymentInfo *pb.CreditCardInfo) (string, error) {
-	paymentResp, err := pb.NewPaymentServiceClient(cs.paymentSvcConn).Charge(ctx, &pb.ChargeRequest{
-		Amount:     amount,
-		CreditCard: paymentInfo})
-	if err != nil {
-		return "", fmt.Errorf("could not charge the card: %+v", err)
-	}
-	return paymentResp.GetTransactionId(), nil
-}
-
-func (cs *checkoutService) sendOrderConfirmation(ctx context.Context, email string, order *pb.OrderResult) error {
+// sendOrderEmail asks the email function to render the given template for
+// the order.
+func (cs *checkoutService) sendOrderEmail(ctx context.Context, email, template string, order *pb.OrderResult) error {
 	// _, err := pb.NewEmailServiceClient(cs.emailSvcConn).SendOrderConfirmation(ctx, &pb.SendOrderConfirmationRequest{
 	// 	Email: email,
 	// 	Order: order})
 	// return err
 
-//new http call to gcf-email-service
-orderData := map[string]interface{}{
-	"email": email,
-	"order": map[string]interface{}{
-		"order_id":            order.OrderId,
-		"shipping_tracking_id": order.ShippingTrackingId,
+	// new http call to gcf-email-service
+	orderData := map[string]interface{}{
+		"email":    email,
+		"template": template,
+		"order":    orderPayload(order),
+	}
+	jsonData, err := json.Marshal(orderData)
+	if err != nil {
+		return fmt.Errorf("failed to marshal order data: %v", err)
+	}
+
+	gcfURL := cs.gcfBaseURL + "/send_email"
+	resp, err := http.Post(gcfURL, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to call GCF: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GCF returned non-OK status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// orderPayload renders an order in the JSON shape shared by the email
+// function and merchant webhooks.
+func orderPayload(order *pb.OrderResult) map[string]interface{} {
+	return map[string]interface{}{
+		"order_id":  order.OrderId,
+		"shipments": convertShipments(order.Shipments),
 		"shipping_cost": map[string]interface{}{
 			"units":         order.ShippingCost.Units,
 			"nanos":         order.ShippingCost.Nanos,
@@ -489,25 +1018,106 @@ orderData := map[string]interface{}{
 			"country":          order.ShippingAddress.Country,
 			"zip_code":         order.ShippingAddress.ZipCode,
 		},
-		"items": convertOrderItems(order.Items),
-	},
+		"items":          convertOrderItems(order.Items),
+		"discounts":      convertDiscounts(order.Discounts),
+		"tax_lines":      convertTaxLines(order.TaxLines),
+		"total":          convertMoney(order.Total),
+		"status":         order.Status.String(),
+		"refunded":       convertMoney(order.Refunded),
+		"returns":        convertReturns(order.Returns),
+		"card_last_four": order.CardLastFour,
+	}
 }
-jsonData, err := json.Marshal(orderData)
-if err != nil {
-	return fmt.Errorf("failed to marshal order data: %v", err)
+
+func convertMoney(m *pb.Money) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"units":         m.Units,
+		"nanos":         m.Nanos,
+		"currency_code": m.CurrencyCode,
+	}
 }
 
-gcfURL := "https://us-central1-cloudblend-435916.cloudfunctions.net/send_email" // Replace with your GCF URL
-resp, err := http.Post(gcfURL, "application/json", bytes.NewBuffer(jsonData))
-if err != nil {
-	return fmt.Errorf("failed to call GCF: %v", err)
+func convertReturns(returns []*pb.OrderReturn) []map[string]interface{} {
+	var result []map[string]interface{}
+	for _, r := range returns {
+		var items []map[string]interface{}
+		for _, it := range r.Items {
+			items = append(items, map[string]interface{}{
+				"product_id": it.ProductId,
+				"quantity":   it.Quantity,
+			})
+		}
+		result = append(result, map[string]interface{}{
+			"return_id":  r.ReturnId,
+			"items":      items,
+			"refund":     convertMoney(r.Refund),
+			"reason":     r.Reason,
+			"created_at": time.Unix(r.CreatedAtUnix, 0).UTC().Format(time.RFC3339),
+		})
+	}
+	return result
 }
-defer resp.Body.Close()
 
-if resp.StatusCode != http.StatusOK {
-	return fmt.Errorf("GCF returned non-OK status: %d", resp.StatusCode)
+func convertShipments(shipments []*pb.Shipment) []map[string]interface{} {
+	var result []map[string]interface{}
+	for _, s := range shipments {
+		var items []map[string]interface{}
+		for _, it := range s.Items {
+			items = append(items, map[string]interface{}{
+				"product_id": it.ProductId,
+				"quantity":   it.Quantity,
+			})
+		}
+		result = append(result, map[string]interface{}{
+			"warehouse_id":  s.WarehouseId,
+			"tracking_id":   s.TrackingId,
+			"shipping_cost": convertMoney(s.ShippingCost),
+			"items":         items,
+
+			"service_level":           s.ServiceLevel,
+			"carrier":                 s.Carrier,
+			"estimated_delivery_date": s.EstimatedDeliveryDate,
+			"earliest_delivery_date":  s.EarliestDeliveryDate,
+		})
+	}
+	return result
 }
-return nil
+
+func convertTaxLines(lines []*pb.TaxLine) []map[string]interface{} {
+	var result []map[string]interface{}
+	for _, t := range lines {
+		result = append(result, map[string]interface{}{
+			"name":     t.Name,
+			"rate":     t.Rate,
+			"included": t.Included,
+			"amount": map[string]interface{}{
+				"units":         t.Amount.Units,
+				"nanos":         t.Amount.Nanos,
+				"currency_code": t.Amount.CurrencyCode,
+			},
+		})
+	}
+	return result
+}
+
+func convertDiscounts(discounts []*pb.Discount) []map[string]interface{} {
+	var result []map[string]interface{}
+	for _, d := range discounts {
+		result = append(result, map[string]interface{}{
+			"promotion_id": d.PromotionId,
+			"code":         d.Code,
+			"description":  d.Description,
+			"amount": map[string]interface{}{
+				"units":         d.Amount.Units,
+				"nanos":         d.Amount.Nanos,
+				"currency_code": d.Amount.CurrencyCode,
+			},
+		})
+	}
+	return result
 }
 
 func convertOrderItems(items []*pb.OrderItem) []map[string]interface{} {
@@ -528,62 +1138,24 @@ func convertOrderItems(items []*pb.OrderItem) []map[string]interface{} {
 	return result
 }
 
-func (cs *checkoutService) shipOrder(ctx context.Context, address *pb.Address, items []*pb.CartItem) (string, error) {
+// shipOrder hands items to the carrier of the service level and returns the
+// tracking ID and the carrier's name.
+func (cs *checkoutService) shipOrder(ctx context.Context, address *pb.Address, items []*pb.CartItem, serviceLevel string) (string, string, error) {
 	// resp, err := pb.NewShippingServiceClient(cs.shippingSvcConn).ShipOrder(ctx, &pb.ShipOrderRequest{
-	// 	Address: address,
-	// 	Items:   items})
+	// 	Address:      address,
+	// 	Items:        items,
+	// 	ServiceLevel: serviceLevel})
 	// if err != nil {
-	// 	return "", fmt.Errorf("shipment failed: %+v", err)
+	// 	return "", "", fmt.Errorf("shipment failed: %+v", err)
 	// }
-	// return resp.GetTrackingId(), nil
-
-	gcfURL := "https://us-central1-cloudblend-435916.cloudfunctions.net/shipping/shipOrder"
-	shippingReq := struct {
-		Address struct {
-			StreetAddress string `json:"street_address"`
-			City          string `json:"city"`
-			State         string `json:"state"`
-		} `json:"address"`
-		
-		}{
-		Address: struct {
-			StreetAddress string `json:"street_address"`
-			City          string `json:"city"`
-			State         string `json:"state"`
-		}{
-			StreetAddress: address.StreetAddress,
-			City:          address.City,
-			State:         address.State,
-		},
-	}
-	jsonData, err := json.Marshal(shippingReq)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal shipping request: %v", err)
-	}
-
-	req, err := http.NewRequestWithContext(ctx, "POST", gcfURL, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("failed to create GCF ship order request: %v", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to call GCF for ship order: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("GCF ship order returned %d: %s", resp.StatusCode, string(body))
-	}
+	// return resp.GetTrackingId(), resp.GetCarrier(), nil
 
 	var shipResp struct {
 		TrackingID string `json:"tracking_id"`
+		Carrier    string `json:"carrier"`
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&shipResp); err != nil {
-		return "", fmt.Errorf("failed to parse GCF ship order response: %v", err)
+	if err := cs.postShipping(ctx, "shipOrder", newShippingRequest(address, items, serviceLevel), &shipResp); err != nil {
+		return "", "", err
 	}
-
-	return shipResp.TrackingID, nil
+	return shipResp.TrackingID, shipResp.Carrier, nil
 }
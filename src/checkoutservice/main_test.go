@@ -0,0 +1,469 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+// fakeBackendLatency approximates a round trip to a dependency.
+const fakeBackendLatency = 2 * time.Millisecond
+
+type fakeCart struct {
+	pb.UnimplementedCartServiceServer
+	items []*pb.CartItem
+}
+
+func (c *fakeCart) GetCart(ctx context.Context, req *pb.GetCartRequest) (*pb.Cart, error) {
+	time.Sleep(fakeBackendLatency)
+	return &pb.Cart{UserId: req.UserId, Items: c.items}, nil
+}
+
+func (c *fakeCart) EmptyCart(ctx context.Context, req *pb.EmptyCartRequest) (*pb.Empty, error) {
+	return &pb.Empty{}, nil
+}
+
+type fakeCatalog struct {
+	pb.UnimplementedProductCatalogServiceServer
+
+	mu         sync.Mutex
+	outOfStock bool
+	// warehouses, when set, are assigned to cart items in turn; otherwise
+	// everything ships from "default".
+	warehouses  []string
+	reserved    []*pb.ReserveStockRequest
+	released    []string
+	committed   []string
+	restocked   []*pb.CartItem
+	restockedIn []string
+}
+
+func (*fakeCatalog) GetProduct(ctx context.Context, req *pb.GetProductRequest) (*pb.Product, error) {
+	time.Sleep(fakeBackendLatency)
+	return &pb.Product{
+		Id:       req.Id,
+		PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 10, Nanos: 500000000},
+	}, nil
+}
+
+func (c *fakeCatalog) AllocateStock(ctx context.Context, req *pb.AllocateStockRequest) (*pb.AllocateStockResponse, error) {
+	warehouses := c.warehouses
+	if len(warehouses) == 0 {
+		warehouses = []string{"default"}
+	}
+	var out []*pb.StockAllocation
+	byWarehouse := make(map[string]*pb.StockAllocation)
+	for i, it := range req.Items {
+		w := warehouses[i%len(warehouses)]
+		a, ok := byWarehouse[w]
+		if !ok {
+			a = &pb.StockAllocation{WarehouseId: w}
+			byWarehouse[w] = a
+			out = append(out, a)
+		}
+		a.Items = append(a.Items, it)
+	}
+	return &pb.AllocateStockResponse{Allocations: out}, nil
+}
+
+func (c *fakeCatalog) ReserveStock(ctx context.Context, req *pb.ReserveStockRequest) (*pb.ReserveStockResponse, error) {
+	if c.outOfStock {
+		return nil, status.Errorf(codes.FailedPrecondition, "product %s is out of stock", req.Allocations[0].Items[0].ProductId)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reserved = append(c.reserved, req)
+	return &pb.ReserveStockResponse{ReservationId: req.ReservationId, Allocations: req.Allocations}, nil
+}
+
+func (c *fakeCatalog) CommitReservation(ctx context.Context, req *pb.CommitReservationRequest) (*pb.Empty, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.committed = append(c.committed, req.ReservationId)
+	return &pb.Empty{}, nil
+}
+
+func (c *fakeCatalog) ReleaseReservation(ctx context.Context, req *pb.ReleaseReservationRequest) (*pb.Empty, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.released = append(c.released, req.ReservationId)
+	return &pb.Empty{}, nil
+}
+
+func (c *fakeCatalog) RestockProducts(ctx context.Context, req *pb.RestockProductsRequest) (*pb.Empty, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.restocked = append(c.restocked, req.Items...)
+	c.restockedIn = append(c.restockedIn, req.WarehouseId)
+	return &pb.Empty{}, nil
+}
+
+type fakePayment struct {
+	pb.UnimplementedPaymentServiceServer
+
+	mu      sync.Mutex
+	approve bool
+	// failCaptures is the number of captures that fail before they succeed.
+	failCaptures int
+	captures     []*pb.CaptureRequest
+	voids        []string
+	refunds      []*pb.RefundRequest
+}
+
+func (*fakePayment) Charge(ctx context.Context, req *pb.ChargeRequest) (*pb.ChargeResponse, error) {
+	return nil, status.Errorf(codes.InvalidArgument, "card declined")
+}
+
+func (p *fakePayment) Authorize(ctx context.Context, req *pb.AuthorizeRequest) (*pb.AuthorizeResponse, error) {
+	if req.GetCardToken() == "" || req.GetCreditCard() != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "checkout must authorize with a card token")
+	}
+	if !p.approve {
+		return nil, status.Errorf(codes.InvalidArgument, "card declined")
+	}
+	return &pb.AuthorizeResponse{AuthorizationId: "auth-1", ExpiresAtUnix: time.Now().Add(time.Hour).Unix()}, nil
+}
+
+func (p *fakePayment) Capture(ctx context.Context, req *pb.CaptureRequest) (*pb.CaptureResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failCaptures > 0 {
+		p.failCaptures--
+		return nil, status.Errorf(codes.Unavailable, "payment processor unavailable")
+	}
+	p.captures = append(p.captures, req)
+	return &pb.CaptureResponse{TransactionId: fmt.Sprintf("tx-%d", len(p.captures))}, nil
+}
+
+func (p *fakePayment) Void(ctx context.Context, req *pb.VoidRequest) (*pb.Empty, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.voids = append(p.voids, req.GetAuthorizationId())
+	return &pb.Empty{}, nil
+}
+
+func (p *fakePayment) Refund(ctx context.Context, req *pb.RefundRequest) (*pb.RefundResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refunds = append(p.refunds, req)
+	return &pb.RefundResponse{RefundId: fmt.Sprintf("refund-%d", len(p.refunds))}, nil
+}
+
+// testBackends are the fakes behind a test checkoutService.
+// fakeShipping makes the fake shipping function refuse shipments.
+type fakeShipping struct {
+	mu sync.Mutex
+	// refused are products whose shipments cannot be handed over.
+	refused map[string]bool
+	// hold, when set, parks each shipment: the function sends on it when a
+	// request arrives and answers once it receives from it.
+	hold chan struct{}
+}
+
+func (f *fakeShipping) holdChan() chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.hold
+}
+
+func (f *fakeShipping) refuses(items []shippingItem) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, it := range items {
+		if f.refused[it.ProductID] {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeShipping) refuse(productIDs ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.refused = make(map[string]bool)
+	for _, id := range productIDs {
+		f.refused[id] = true
+	}
+}
+
+type testBackends struct {
+	catalog  *fakeCatalog
+	payment  *fakePayment
+	shipping *fakeShipping
+}
+
+// fakeGCF serves the currency and shipping Cloud Function endpoints.
+func fakeGCF(shipping *fakeShipping) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/convertCurrency", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(fakeBackendLatency)
+		units, _ := strconv.ParseInt(r.URL.Query().Get("from_units"), 10, 64)
+		nanos, _ := strconv.ParseInt(r.URL.Query().Get("from_nanos"), 10, 32)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"currency_code": r.URL.Query().Get("to_code"),
+			"units":         units,
+			"nanos":         nanos,
+		})
+	})
+	mux.HandleFunc("/shipping/getQuote", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(fakeBackendLatency)
+		var req shippingRequest
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&req) != nil || req.Version != shippingAPIVersion || len(req.Items) == 0 {
+			http.Error(w, "want a v1 POST with items", http.StatusBadRequest)
+			return
+		}
+		// Nothing ships to KP.
+		if req.Address.Country == "KP" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"version": "v1",
+				"error":   "shipment is not allowed: We do not ship to this country.",
+				"violations": []map[string]string{
+					{"type": "BLOCKED_DESTINATION", "subject": "address.country", "description": "We do not ship to this country."},
+				},
+			})
+			return
+		}
+		option := func(level, carrier string, units, nanos int, earliest, date string) map[string]interface{} {
+			return map[string]interface{}{
+				"service_level": level, "name": level, "carrier": carrier,
+				"cost":                    map[string]interface{}{"currency_code": "USD", "units": units, "nanos": nanos},
+				"estimated_delivery_date": date,
+				"earliest_delivery_date":  earliest,
+			}
+		}
+		// Pickup is only offered in the US.
+		options := []interface{}{
+			option("standard", "USPS", 8, 990000000, "2024-04-03", "2024-04-05"),
+			option("express", "UPS", 19, 990000000, "2024-04-01", "2024-04-02"),
+		}
+		if req.Address.Country == "US" {
+			options = append(options, option("pickup", "Store", 0, 0, "2024-04-01", "2024-04-01"))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"cost_usd": map[string]interface{}{"currency_code": "USD", "units": 8, "nanos": 990000000},
+			"options":  options,
+		})
+	})
+	// Every shipment has been delivered a day after it was handed over.
+	// Times are strings, as the shipping service's HTTP gateway writes them.
+	mux.HandleFunc("/shipping/track", func(w http.ResponseWriter, r *http.Request) {
+		shippedAt, _ := strconv.ParseInt(r.URL.Query().Get("shipped_at_unix"), 10, 64)
+		if shippedAt == 0 || r.URL.Query().Get("estimated_delivery_date") == "" {
+			http.Error(w, "missing hints", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"tracking_id": r.URL.Query().Get("tracking_id"),
+			"status":      "SHIPMENT_STATUS_DELIVERED",
+			"events": []map[string]interface{}{
+				{"status": "SHIPMENT_STATUS_LABEL_CREATED", "description": "Shipping label created", "time_unix": strconv.FormatInt(shippedAt, 10)},
+				{"status": "SHIPMENT_STATUS_DELIVERED", "description": "Delivered", "time_unix": strconv.FormatInt(shippedAt+86400, 10)},
+			},
+		})
+	})
+	// Orders to the street "Nowhere" cannot be shipped.
+	var shipped atomic.Int32
+	mux.HandleFunc("/shipping/shipOrder", func(w http.ResponseWriter, r *http.Request) {
+		var req shippingRequest
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&req) != nil || req.Version != shippingAPIVersion || len(req.Items) == 0 || req.Address.Country == "" {
+			http.Error(w, "want a v1 POST with items and a country", http.StatusBadRequest)
+			return
+		}
+		if req.Address.StreetAddress == "Nowhere" {
+			http.Error(w, "undeliverable address", http.StatusBadRequest)
+			return
+		}
+		if hold := shipping.holdChan(); hold != nil {
+			hold <- struct{}{}
+			<-hold
+		}
+		if shipping.refuses(req.Items) {
+			http.Error(w, "carrier unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"tracking_id": fmt.Sprintf("TRACK-%d", shipped.Add(1)),
+			"carrier":     "carrier of " + req.ServiceLevel,
+		})
+	})
+	return httptest.NewServer(mux)
+}
+
+func dialBufconn(tb testing.TB, register func(*grpc.Server)) *grpc.ClientConn {
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	register(srv)
+	go srv.Serve(lis)
+	tb.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// newTestCheckoutService wires a checkoutService to in-process fakes holding
+// a cart of cartSize distinct products.
+func newTestCheckoutService(tb testing.TB, cartSize int) *checkoutService {
+	cs, _ := newTestCheckoutServiceWithBackends(tb, cartSize)
+	return cs
+}
+
+// newTestCheckoutServiceWithBackends is newTestCheckoutService that also
+// returns the fakes. The fake payment service declines every card unless
+// payment.approve is set.
+func newTestCheckoutServiceWithBackends(tb testing.TB, cartSize int) (*checkoutService, testBackends) {
+	items := make([]*pb.CartItem, cartSize)
+	for i := range items {
+		items[i] = &pb.CartItem{ProductId: fmt.Sprintf("P%03d", i), Quantity: 1}
+	}
+	fakes := testBackends{catalog: &fakeCatalog{}, payment: &fakePayment{}, shipping: &fakeShipping{}}
+	gcf := fakeGCF(fakes.shipping)
+	tb.Cleanup(gcf.Close)
+
+	return &checkoutService{
+		cartSvcConn: dialBufconn(tb, func(s *grpc.Server) {
+			pb.RegisterCartServiceServer(s, &fakeCart{items: items})
+		}),
+		productCatalogSvcConn: dialBufconn(tb, func(s *grpc.Server) {
+			pb.RegisterProductCatalogServiceServer(s, fakes.catalog)
+		}),
+		paymentSvcConn: dialBufconn(tb, func(s *grpc.Server) {
+			pb.RegisterPaymentServiceServer(s, fakes.payment)
+		}),
+		gcfBaseURL:      gcf.URL,
+		shippingBaseURL: gcf.URL,
+		prepConcurrency: defaultPrepConcurrency,
+		orders:          newOrderStore(),
+		authorizations:  newAuthorizationSweeper(),
+		giftCards:       &giftCardLedger{accounts: make(map[string]*giftCardAccount), now: time.Now},
+	}, fakes
+}
+
+func TestPrepareOrderItemsAndShippingQuoteFromCart(t *testing.T) {
+	cs := newTestCheckoutService(t, 5)
+	prep, err := cs.prepareOrderItemsAndShippingQuoteFromCart(context.Background(), "u1", "EUR", &pb.Address{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(prep.orderItems), 5; got != want {
+		t.Fatalf("got %d order items, want %d", got, want)
+	}
+	for i, it := range prep.orderItems {
+		if got, want := it.GetItem().GetProductId(), fmt.Sprintf("P%03d", i); got != want {
+			t.Errorf("order item %d: got product %s, want %s", i, got, want)
+		}
+		if got := it.GetCost().GetCurrencyCode(); got != "EUR" {
+			t.Errorf("order item %d: got currency %s, want EUR", i, got)
+		}
+	}
+	if got := prep.shippingCostLocalized.GetUnits(); got != 8 {
+		t.Errorf("got shipping units %d, want 8", got)
+	}
+}
+
+func TestPrepareOrderHonorsDeadline(t *testing.T) {
+	cs := newTestCheckoutService(t, 50)
+	cs.prepConcurrency = 1
+	ctx, cancel := context.WithTimeout(context.Background(), 5*fakeBackendLatency)
+	defer cancel()
+	if _, err := cs.prepareOrderItemsAndShippingQuoteFromCart(ctx, "u1", "USD", &pb.Address{}, ""); err == nil {
+		t.Fatal("expected preparation to fail once the deadline passed")
+	}
+}
+
+// BenchmarkPrepareOrder reports checkout preparation latency against cart
+// size, with items priced one at a time (concurrency 1) and fanned out.
+func BenchmarkPrepareOrder(b *testing.B) {
+	for _, concurrency := range []int{1, defaultPrepConcurrency} {
+		for _, size := range []int{1, 4, 16, 64} {
+			b.Run(fmt.Sprintf("concurrency=%d/items=%d", concurrency, size), func(b *testing.B) {
+				cs := newTestCheckoutService(b, size)
+				cs.prepConcurrency = concurrency
+				ctx := context.Background()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := cs.prepareOrderItemsAndShippingQuoteFromCart(ctx, "u1", "USD", &pb.Address{}, ""); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestPreviewOrder(t *testing.T) {
+	cs := newTestCheckoutService(t, 2)
+	resp, err := cs.PreviewOrder(context.Background(), &pb.PreviewOrderRequest{UserId: "u1", UserCurrency: "USD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(resp.GetItems()), 2; got != want {
+		t.Fatalf("got %d items, want %d", got, want)
+	}
+	if got := resp.GetSubtotal(); got.GetUnits() != 21 || got.GetNanos() != 0 {
+		t.Errorf("got subtotal %d.%09d, want 21.000000000", got.GetUnits(), got.GetNanos())
+	}
+	if got := resp.GetTotal(); got.GetUnits() != 29 || got.GetNanos() != 990000000 {
+		t.Errorf("got total %d.%09d, want 29.990000000", got.GetUnits(), got.GetNanos())
+	}
+}
+
+func TestPlaceOrderOutOfStock(t *testing.T) {
+	cs, fakes := newTestCheckoutServiceWithBackends(t, 1)
+	fakes.catalog.outOfStock = true
+	_, err := cs.PlaceOrder(context.Background(), &pb.PlaceOrderRequest{UserId: "u1", UserCurrency: "USD", Address: &pb.Address{}, CardToken: "tok_1"})
+	if got, want := status.Code(err), codes.FailedPrecondition; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestPlaceOrderReleasesStockOnFailure(t *testing.T) {
+	cs, fakes := newTestCheckoutServiceWithBackends(t, 1)
+	catalog := fakes.catalog
+	if _, err := cs.PlaceOrder(context.Background(), &pb.PlaceOrderRequest{UserId: "u1", UserCurrency: "USD", Address: &pb.Address{}, CardToken: "tok_1"}); err == nil {
+		t.Fatal("expected the declined card to fail the order")
+	}
+	catalog.mu.Lock()
+	defer catalog.mu.Unlock()
+	if len(catalog.released) != 1 || len(catalog.committed) != 0 {
+		t.Errorf("got %d released and %d committed reservations, want 1 and 0", len(catalog.released), len(catalog.committed))
+	}
+}
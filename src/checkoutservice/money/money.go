@@ -16,6 +16,7 @@ package money
 
 import (
 	"errors"
+	"math/big"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
 )
@@ -130,3 +131,77 @@ func MultiplySlow(m pb.Money, n uint32) pb.Money {
 	}
 	return out
 }
+
+// Subtract returns l - r. It has the same error conditions as Sum.
+func Subtract(l, r pb.Money) (pb.Money, error) {
+	return Sum(l, Negate(r))
+}
+
+// Compare returns -1, 0 or +1 depending on whether l is less than, equal to
+// or greater than r. Returns an error if one of the values are invalid or
+// currency codes are not matching.
+func Compare(l, r pb.Money) (int, error) {
+	if !IsValid(l) || !IsValid(r) {
+		return 0, ErrInvalidValue
+	} else if l.GetCurrencyCode() != r.GetCurrencyCode() {
+		return 0, ErrMismatchingCurrency
+	}
+	return toNanos(l).Cmp(toNanos(r)), nil
+}
+
+// Min returns the smaller of l and r. It has the same error conditions as
+// Compare.
+func Min(l, r pb.Money) (pb.Money, error) {
+	c, err := Compare(l, r)
+	if err != nil {
+		return pb.Money{}, err
+	} else if c > 0 {
+		return r, nil
+	}
+	return l, nil
+}
+
+// MultiplyRatio returns m * num / den, rounded half away from zero to the
+// nearest nano. It can be used for percentages, e.g. 7.25% is
+// MultiplyRatio(m, 725, 10000).
+func MultiplyRatio(m pb.Money, num, den int64) pb.Money {
+	if den == 0 {
+		panic("money: division by zero")
+	}
+	n := new(big.Int).Mul(toNanos(m), big.NewInt(num))
+	return fromNanos(roundDiv(n, big.NewInt(den)), m.GetCurrencyCode())
+}
+
+// RoundTo rounds m half away from zero to a multiple of the given number of
+// nanos, e.g. RoundTo(m, 10000000) rounds to whole cents.
+func RoundTo(m pb.Money, nanos int64) pb.Money {
+	step := big.NewInt(nanos)
+	q := roundDiv(toNanos(m), step)
+	return fromNanos(q.Mul(q, step), m.GetCurrencyCode())
+}
+
+func toNanos(m pb.Money) *big.Int {
+	n := new(big.Int).Mul(big.NewInt(m.GetUnits()), big.NewInt(nanosMod))
+	return n.Add(n, big.NewInt(int64(m.GetNanos())))
+}
+
+func fromNanos(n *big.Int, currencyCode string) pb.Money {
+	units, nanos := new(big.Int).QuoRem(n, big.NewInt(nanosMod), new(big.Int))
+	return pb.Money{
+		Units:        units.Int64(),
+		Nanos:        int32(nanos.Int64()),
+		CurrencyCode: currencyCode}
+}
+
+// roundDiv returns n / d rounded half away from zero.
+func roundDiv(n, d *big.Int) *big.Int {
+	q, r := new(big.Int).QuoRem(n, d, new(big.Int))
+	if new(big.Int).Mul(new(big.Int).Abs(r), big.NewInt(2)).Cmp(new(big.Int).Abs(d)) >= 0 {
+		if (n.Sign() < 0) != (d.Sign() < 0) {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q
+}
@@ -243,3 +243,93 @@ func TestSum(t *testing.T) {
 		})
 	}
 }
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name    string
+		l, r    pb.Money
+		want    int
+		wantErr error
+	}{
+		{"equal", mm(1, 500000000), mm(1, 500000000), 0, nil},
+		{"less by nanos", mm(1, 400000000), mm(1, 500000000), -1, nil},
+		{"greater by units", mm(2, 0), mm(1, 999999999), 1, nil},
+		{"negative vs zero", mm(0, -1), mm(0, 0), -1, nil},
+		{"currency mismatch", mmc(1, 0, "USD"), mmc(1, 0, "EUR"), 0, ErrMismatchingCurrency},
+		{"invalid", mm(1, -1), mm(0, 0), 0, ErrInvalidValue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Compare(tt.l, tt.r)
+			if err != tt.wantErr || got != tt.want {
+				t.Errorf("Compare(%v, %v) = %d, %v; want %d, %v", tt.l, tt.r, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMin(t *testing.T) {
+	tests := []struct {
+		name    string
+		l, r    pb.Money
+		want    pb.Money
+		wantErr error
+	}{
+		{"left", mm(1, 0), mm(2, 0), mm(1, 0), nil},
+		{"right", mm(2, 0), mm(1, 999999999), mm(1, 999999999), nil},
+		{"equal", mm(1, 0), mm(1, 0), mm(1, 0), nil},
+		{"currency mismatch", mmc(1, 0, "USD"), mmc(1, 0, "EUR"), pb.Money{}, ErrMismatchingCurrency},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Min(tt.l, tt.r)
+			if err != tt.wantErr || !AreEquals(got, tt.want) {
+				t.Errorf("Min(%v, %v) = %v, %v; want %v, %v", tt.l, tt.r, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMultiplyRatio(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       pb.Money
+		num, den int64
+		want     pb.Money
+	}{
+		{"10 percent", mmc(19, 990000000, "USD"), 10, 100, mmc(1, 999000000, "USD")},
+		{"7.25 percent", mm(100, 0), 725, 10000, mm(7, 250000000)},
+		{"rounds half up", mm(0, 5), 1, 2, mm(0, 3)},
+		{"rounds half away from zero", mm(0, -5), 1, 2, mm(0, -3)},
+		{"whole", mm(3, 300000000), 1, 1, mm(3, 300000000)},
+		{"large", mm(9000000000, 0), 3, 2, mm(13500000000, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MultiplyRatio(tt.in, tt.num, tt.den); !AreEquals(got, tt.want) {
+				t.Errorf("MultiplyRatio(%v, %d, %d) = %v, want %v", tt.in, tt.num, tt.den, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundTo(t *testing.T) {
+	const cent = 10000000
+	tests := []struct {
+		name string
+		in   pb.Money
+		want pb.Money
+	}{
+		{"down", mm(1, 994999999), mm(1, 990000000)},
+		{"up", mm(1, 995000000), mm(2, 0)},
+		{"negative", mm(-1, -995000000), mm(-2, 0)},
+		{"exact", mm(1, 990000000), mm(1, 990000000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RoundTo(tt.in, cent); !AreEquals(got, tt.want) {
+				t.Errorf("RoundTo(%v) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
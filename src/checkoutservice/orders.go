@@ -0,0 +1,439 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+	money "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/money"
+)
+
+// Templates rendered by the email function.
+const (
+	emailConfirmation = "confirmation"
+	emailCancellation = "cancellation"
+	emailReturn       = "return"
+)
+
+// orderTransitions lists the statuses each status can move to.
+var orderTransitions = map[pb.OrderStatus][]pb.OrderStatus{
+	pb.OrderStatus_ORDER_STATUS_PLACED:    {pb.OrderStatus_ORDER_STATUS_SHIPPED, pb.OrderStatus_ORDER_STATUS_CANCELLED},
+	pb.OrderStatus_ORDER_STATUS_SHIPPED:   {pb.OrderStatus_ORDER_STATUS_DELIVERED},
+	pb.OrderStatus_ORDER_STATUS_DELIVERED: {pb.OrderStatus_ORDER_STATUS_RETURNED, pb.OrderStatus_ORDER_STATUS_REFUNDED},
+	pb.OrderStatus_ORDER_STATUS_RETURNED:  {pb.OrderStatus_ORDER_STATUS_RETURNED, pb.OrderStatus_ORDER_STATUS_REFUNDED},
+}
+
+func canTransition(from, to pb.OrderStatus) bool {
+	for _, s := range orderTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// orderRecord is a placed order plus what is needed to cancel or return it.
+type orderRecord struct {
+	// mu is held for the whole of a cancellation or return so that refunds
+	// are never issued twice for the same items.
+	mu            sync.Mutex
+	order         *pb.OrderResult
+	userID        string
+	email         string
+	transactionID string
+	// authorizationID is the card hold behind the order. transactionID
+	// stays empty until the hold has been captured.
+	authorizationID string
+	// giftCards are the gift card and store credit payments, and
+	// cardRefunded how much of order.CardCharged has been paid back.
+	giftCards    []*giftCardDebit
+	cardRefunded pb.Money
+	placedAt     time.Time
+}
+
+// snapshot returns a copy of the order that is safe to hand out.
+func (r *orderRecord) snapshot() *pb.OrderResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return proto.Clone(r.order).(*pb.OrderResult)
+}
+
+// orderStore keeps placed orders in memory.
+type orderStore struct {
+	mu     sync.RWMutex
+	orders map[string]*orderRecord
+	byUser map[string][]*orderRecord
+}
+
+func newOrderStore() *orderStore {
+	return &orderStore{
+		orders: make(map[string]*orderRecord),
+		byUser: make(map[string][]*orderRecord),
+	}
+}
+
+func (s *orderStore) add(r *orderRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.orders[r.order.GetOrderId()] = r
+	s.byUser[r.userID] = append(s.byUser[r.userID], r)
+}
+
+// get looks up an order. Orders of other users are reported as not found.
+func (s *orderStore) get(orderID, userID string) (*orderRecord, error) {
+	s.mu.RLock()
+	r, ok := s.orders[orderID]
+	s.mu.RUnlock()
+	if !ok || (userID != "" && r.userID != userID) {
+		return nil, status.Errorf(codes.NotFound, "no order with ID %s", orderID)
+	}
+	return r, nil
+}
+
+// unshipped returns the orders that still have shipments without a
+// tracking ID.
+func (s *orderStore) unshipped() []*orderRecord {
+	s.mu.RLock()
+	records := make([]*orderRecord, 0, len(s.orders))
+	for _, r := range s.orders {
+		records = append(records, r)
+	}
+	s.mu.RUnlock()
+	var out []*orderRecord
+	for _, r := range records {
+		r.mu.Lock()
+		if pendingShipments(r.order.GetShipments()) > 0 {
+			out = append(out, r)
+		}
+		r.mu.Unlock()
+	}
+	return out
+}
+
+func (s *orderStore) list(userID string) []*pb.OrderResult {
+	s.mu.RLock()
+	records := append([]*orderRecord(nil), s.byUser[userID]...)
+	s.mu.RUnlock()
+	sort.SliceStable(records, func(i, j int) bool { return records[i].placedAt.After(records[j].placedAt) })
+	out := make([]*pb.OrderResult, len(records))
+	for i, r := range records {
+		out[i] = r.snapshot()
+	}
+	return out
+}
+
+func (cs *checkoutService) GetOrder(ctx context.Context, req *pb.GetOrderRequest) (*pb.OrderResult, error) {
+	r, err := cs.orders.get(req.GetOrderId(), req.GetUserId())
+	if err != nil {
+		return nil, err
+	}
+	return r.snapshot(), nil
+}
+
+func (cs *checkoutService) ListOrders(ctx context.Context, req *pb.ListOrdersRequest) (*pb.ListOrdersResponse, error) {
+	return &pb.ListOrdersResponse{Orders: cs.orders.list(req.GetUserId())}, nil
+}
+
+func (cs *checkoutService) UpdateOrderStatus(ctx context.Context, req *pb.UpdateOrderStatusRequest) (*pb.OrderResult, error) {
+	log.Infof("[UpdateOrderStatus] order_id=%q status=%s", req.GetOrderId(), req.GetStatus())
+	var event string
+	switch req.GetStatus() {
+	case pb.OrderStatus_ORDER_STATUS_SHIPPED:
+		event = eventOrderShipped
+	case pb.OrderStatus_ORDER_STATUS_DELIVERED:
+		event = eventOrderDelivered
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "status %s cannot be set directly", req.GetStatus())
+	}
+	r, err := cs.orders.get(req.GetOrderId(), "")
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	if from := r.order.Status; !canTransition(from, req.GetStatus()) {
+		r.mu.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "order %s is %s and cannot become %s", req.GetOrderId(), from, req.GetStatus())
+	}
+	r.order.Status = req.GetStatus()
+	r.mu.Unlock()
+
+	order := r.snapshot()
+	cs.webhooks.publish(event, order)
+	return order, nil
+}
+
+func (cs *checkoutService) CancelOrder(ctx context.Context, req *pb.CancelOrderRequest) (*pb.OrderResult, error) {
+	log.Infof("[CancelOrder] order_id=%q user_id=%q", req.GetOrderId(), req.GetUserId())
+	r, err := cs.orders.get(req.GetOrderId(), req.GetUserId())
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	order := r.order
+	if !canTransition(order.Status, pb.OrderStatus_ORDER_STATUS_CANCELLED) {
+		return nil, status.Errorf(codes.FailedPrecondition, "order %s is %s and can no longer be cancelled", order.OrderId, order.Status)
+	}
+	// Goods with a carrier cannot be put back on the shelf or refunded
+	// before they arrive; the customer returns them instead.
+	if n := len(order.GetShipments()) - pendingShipments(order.GetShipments()); n > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "order %s has %d shipments with the carrier and can no longer be cancelled", order.OrderId, n)
+	}
+
+	refund := *order.Total
+	if r.authorizationID != "" && r.transactionID == "" {
+		// Never captured, so releasing the hold is enough. Holding r.mu
+		// keeps the sweeper from capturing it meanwhile. Only gift cards
+		// and store credit are left to pay back.
+		if err := cs.voidAuthorization(ctx, r.authorizationID); err != nil {
+			return nil, status.Errorf(codes.Unavailable, "failed to void payment: %+v", err)
+		}
+		cs.authorizations.remove(r.authorizationID)
+		r.cardRefunded = *order.CardCharged
+		refund = money.Must(money.Subtract(refund, *order.CardCharged))
+		log.Infof("order %s cancelled (voided authorization_id: %s)", order.OrderId, r.authorizationID)
+	}
+	if err := cs.refundTenders(ctx, r, refund, false); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to refund order: %+v", err)
+	}
+	log.Infof("order %s cancelled", order.OrderId)
+	order.Status = pb.OrderStatus_ORDER_STATUS_CANCELLED
+	order.Refunded = proto.Clone(order.Total).(*pb.Money)
+
+	cs.restockShipments(ctx, order.GetShipments(), orderedItems(order))
+	cs.notify(ctx, r.email, emailCancellation, eventOrderCancelled, order)
+	return proto.Clone(order).(*pb.OrderResult), nil
+}
+
+func (cs *checkoutService) CreateReturn(ctx context.Context, req *pb.CreateReturnRequest) (*pb.OrderResult, error) {
+	log.Infof("[CreateReturn] order_id=%q user_id=%q", req.GetOrderId(), req.GetUserId())
+	r, err := cs.orders.get(req.GetOrderId(), req.GetUserId())
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	order := r.order
+	if !canTransition(order.Status, pb.OrderStatus_ORDER_STATUS_RETURNED) {
+		return nil, status.Errorf(codes.FailedPrecondition, "order %s is %s and cannot be returned", order.OrderId, order.Status)
+	}
+	if r.authorizationID != "" && r.transactionID == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "payment for order %s has not been captured yet", order.OrderId)
+	}
+
+	returnable := returnableItems(order)
+	items := req.GetItems()
+	if len(items) == 0 {
+		for _, it := range orderedItems(order) {
+			if n := returnable[it.ProductId]; n > 0 {
+				items = append(items, &pb.CartItem{ProductId: it.ProductId, Quantity: n})
+			}
+		}
+	}
+	if len(items) == 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "order %s has nothing left to return", order.OrderId)
+	}
+	for _, it := range items {
+		if it.GetQuantity() <= 0 || it.GetQuantity() > returnable[it.GetProductId()] {
+			return nil, status.Errorf(codes.InvalidArgument, "cannot return %d of product %s", it.GetQuantity(), it.GetProductId())
+		}
+		returnable[it.GetProductId()] -= it.GetQuantity()
+	}
+	fullyReturned := true
+	for _, n := range returnable {
+		if n > 0 {
+			fullyReturned = false
+		}
+	}
+
+	amount := returnRefund(order, items, fullyReturned)
+	if err := cs.refundTenders(ctx, r, amount, req.GetStoreCredit()); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to refund return: %+v", err)
+	}
+
+	returnID, err := uuid.NewUUID()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate return uuid")
+	}
+	order.Returns = append(order.Returns, &pb.OrderReturn{
+		ReturnId:      returnID.String(),
+		Items:         items,
+		Refund:        &amount,
+		Reason:        req.GetReason(),
+		CreatedAtUnix: time.Now().Unix(),
+		StoreCredit:   req.GetStoreCredit(),
+	})
+	refunded := money.Must(money.Sum(*order.Refunded, amount))
+	order.Refunded = &refunded
+	order.Status = pb.OrderStatus_ORDER_STATUS_RETURNED
+	if fullyReturned {
+		order.Status = pb.OrderStatus_ORDER_STATUS_REFUNDED
+	}
+
+	cs.restockShipments(ctx, order.GetShipments(), items)
+	cs.notify(ctx, r.email, emailReturn, eventOrderReturned, order)
+	return proto.Clone(order).(*pb.OrderResult), nil
+}
+
+// orderedItems returns the cart items of an order.
+func orderedItems(order *pb.OrderResult) []*pb.CartItem {
+	items := make([]*pb.CartItem, len(order.GetItems()))
+	for i, it := range order.GetItems() {
+		items[i] = it.GetItem()
+	}
+	return items
+}
+
+// returnableItems returns, per product, the quantity not returned yet.
+func returnableItems(order *pb.OrderResult) map[string]int32 {
+	out := make(map[string]int32)
+	for _, it := range order.GetItems() {
+		out[it.GetItem().GetProductId()] += it.GetItem().GetQuantity()
+	}
+	for _, ret := range order.GetReturns() {
+		for _, it := range ret.GetItems() {
+			out[it.GetProductId()] -= it.GetQuantity()
+		}
+	}
+	return out
+}
+
+// returnRefund works out how much to refund for returned items. Shipping is
+// not refunded; the rest of the charge (items after discounts, plus tax) is
+// refunded in proportion to the value of the returned items. The last return
+// refunds whatever is left so that rounding never leaves money behind.
+func returnRefund(order *pb.OrderResult, items []*pb.CartItem, last bool) pb.Money {
+	currency := order.GetTotal().GetCurrencyCode()
+	itemsCharged := money.Must(money.Subtract(*order.GetTotal(), *order.GetShippingCost()))
+	for _, d := range order.GetDiscounts() {
+		if d.GetShipping() {
+			itemsCharged = money.Must(money.Sum(itemsCharged, *d.GetAmount()))
+		}
+	}
+	itemsCharged = nonNegative(itemsCharged)
+
+	if last {
+		return nonNegative(money.Must(money.Subtract(itemsCharged, *order.GetRefunded())))
+	}
+
+	unitCost := make(map[string]*pb.Money)
+	subtotal := pb.Money{CurrencyCode: currency}
+	for _, it := range order.GetItems() {
+		unitCost[it.GetItem().GetProductId()] = it.GetCost()
+		subtotal = money.Must(money.Sum(subtotal, money.MultiplySlow(*it.GetCost(), uint32(it.GetItem().GetQuantity()))))
+	}
+	value := pb.Money{CurrencyCode: currency}
+	for _, it := range items {
+		value = money.Must(money.Sum(value, money.MultiplySlow(*unitCost[it.GetProductId()], uint32(it.GetQuantity()))))
+	}
+	if money.IsZero(subtotal) {
+		return pb.Money{CurrencyCode: currency}
+	}
+	return money.RoundTo(money.MultiplyRatio(itemsCharged, nanosOf(value), nanosOf(subtotal)), nanosPerCent)
+}
+
+func nanosOf(m pb.Money) int64 {
+	return m.GetUnits()*1e9 + int64(m.GetNanos())
+}
+
+// refundTenders pays amount back the way the order was paid: the card
+// first, then the gift cards in the order they were used. With storeCredit
+// all of it goes to the user's store credit instead. The caller holds r.mu.
+func (cs *checkoutService) refundTenders(ctx context.Context, r *orderRecord, amount pb.Money, storeCredit bool) error {
+	orderID := r.order.GetOrderId()
+	if !money.IsPositive(amount) {
+		return nil
+	}
+	if storeCredit {
+		if err := cs.giftCards.credit(orderID, storeCreditAccount(r.userID, amount.CurrencyCode), amount); err != nil {
+			return err
+		}
+		log.Infof("order %s refunded to store credit", orderID)
+		return nil
+	}
+
+	remaining := amount
+	if card := money.Must(money.Subtract(*r.order.GetCardCharged(), r.cardRefunded)); money.IsPositive(card) {
+		n := money.Must(money.Min(card, remaining))
+		refundID, err := cs.refundCharge(ctx, r.transactionID, &n)
+		if err != nil {
+			return err
+		}
+		log.Infof("order %s refunded to the card (refund_id: %s)", orderID, refundID)
+		r.cardRefunded = money.Must(money.Sum(r.cardRefunded, n))
+		remaining = money.Must(money.Subtract(remaining, n))
+	}
+	for _, d := range r.giftCards {
+		if !money.IsPositive(remaining) {
+			break
+		}
+		left := money.Must(money.Subtract(d.amount, d.refunded))
+		if !money.IsPositive(left) {
+			continue
+		}
+		n := money.Must(money.Min(left, remaining))
+		if err := cs.giftCards.credit(orderID, d.account, n); err != nil {
+			return err
+		}
+		d.refunded = money.Must(money.Sum(d.refunded, n))
+		remaining = money.Must(money.Subtract(remaining, n))
+	}
+	if money.IsPositive(remaining) {
+		log.Warnf("order %s: %d.%09d %s of the refund exceeds what was paid", orderID, remaining.Units, remaining.Nanos, remaining.CurrencyCode)
+	}
+	return nil
+}
+
+func (cs *checkoutService) refundCharge(ctx context.Context, transactionID string, amount *pb.Money) (string, error) {
+	resp, err := pb.NewPaymentServiceClient(cs.paymentSvcConn).Refund(ctx, &pb.RefundRequest{
+		TransactionId: transactionID,
+		Amount:        amount})
+	if err != nil {
+		return "", fmt.Errorf("could not refund the card: %+v", err)
+	}
+	return resp.GetRefundId(), nil
+}
+
+// restock puts items back into a warehouse's inventory. Failures are logged
+// only; the refund has already been issued.
+func (cs *checkoutService) restock(ctx context.Context, warehouseID string, items []*pb.CartItem) {
+	if _, err := pb.NewProductCatalogServiceClient(cs.productCatalogSvcConn).RestockProducts(ctx, &pb.RestockProductsRequest{
+		Items:       items,
+		WarehouseId: warehouseID}); err != nil {
+		log.Warnf("failed to restock %d items in %q: %+v", len(items), warehouseID, err)
+	}
+}
+
+// notify emails the customer and publishes the webhook event for an order
+// change.
+func (cs *checkoutService) notify(ctx context.Context, email, template, event string, order *pb.OrderResult) {
+	if err := cs.sendOrderEmail(ctx, email, template, order); err != nil {
+		log.Warnf("failed to send %s email to %q: %+v", template, email, err)
+	}
+	cs.webhooks.publish(event, proto.Clone(order).(*pb.OrderResult))
+}
@@ -0,0 +1,160 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+// placeTestOrder stores a $58.99 order for user u1: two $10.00 mugs and a
+// $30.00 lamp with $8.99 shipping and a $5.00 item discount, plus $3.00 tax.
+func placeTestOrder(cs *checkoutService) *pb.OrderResult {
+	order := &pb.OrderResult{
+		OrderId:         "order-1",
+		ShippingCost:    usd(8, 990000000),
+		ShippingAddress: &pb.Address{Country: "US", State: "NY"},
+		Items: []*pb.OrderItem{
+			{Item: &pb.CartItem{ProductId: "MUG", Quantity: 2}, Cost: usd(10, 0)},
+			{Item: &pb.CartItem{ProductId: "LAMP", Quantity: 1}, Cost: usd(30, 0)},
+		},
+		Discounts: []*pb.Discount{{PromotionId: "five-off", Amount: usd(5, 0)}},
+		TaxLines:  []*pb.TaxLine{{Name: "tax", Amount: usd(3, 0)}},
+		Total:     usd(56, 990000000),
+		Status:    pb.OrderStatus_ORDER_STATUS_PLACED,
+		Refunded:  usd(0, 0),
+
+		CardCharged: usd(56, 990000000),
+	}
+	cs.orders.add(&orderRecord{order: order, userID: "u1", transactionID: "tx-1", cardRefunded: *usd(0, 0), placedAt: time.Now()})
+	return order
+}
+
+func TestCancelOrder(t *testing.T) {
+	ctx := context.Background()
+	cs, fakes := newTestCheckoutServiceWithBackends(t, 0)
+	placeTestOrder(cs)
+
+	if _, err := cs.CancelOrder(ctx, &pb.CancelOrderRequest{OrderId: "order-1", UserId: "u2"}); status.Code(err) != codes.NotFound {
+		t.Errorf("cancelling another user's order: got %v, want NotFound", err)
+	}
+
+	order, err := cs.CancelOrder(ctx, &pb.CancelOrderRequest{OrderId: "order-1", UserId: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.GetStatus() != pb.OrderStatus_ORDER_STATUS_CANCELLED {
+		t.Errorf("got status %s, want CANCELLED", order.GetStatus())
+	}
+	if len(fakes.payment.refunds) != 1 || fakes.payment.refunds[0].GetAmount().GetUnits() != 56 || fakes.payment.refunds[0].GetTransactionId() != "tx-1" {
+		t.Errorf("got refunds %v, want the full 56.99 on tx-1", fakes.payment.refunds)
+	}
+	if len(fakes.catalog.restocked) != 2 {
+		t.Errorf("got %d restocked items, want 2", len(fakes.catalog.restocked))
+	}
+
+	if _, err := cs.CancelOrder(ctx, &pb.CancelOrderRequest{OrderId: "order-1"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("cancelling twice: got %v, want FailedPrecondition", err)
+	}
+}
+
+func TestCancelShippedOrder(t *testing.T) {
+	ctx := context.Background()
+	cs, _ := newTestCheckoutServiceWithBackends(t, 0)
+	placeTestOrder(cs)
+
+	if _, err := cs.UpdateOrderStatus(ctx, &pb.UpdateOrderStatusRequest{OrderId: "order-1", Status: pb.OrderStatus_ORDER_STATUS_SHIPPED}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.CancelOrder(ctx, &pb.CancelOrderRequest{OrderId: "order-1"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("cancelling a shipped order: got %v, want FailedPrecondition", err)
+	}
+	if _, err := cs.UpdateOrderStatus(ctx, &pb.UpdateOrderStatusRequest{OrderId: "order-1", Status: pb.OrderStatus_ORDER_STATUS_REFUNDED}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("setting REFUNDED directly: got %v, want InvalidArgument", err)
+	}
+}
+
+func TestCreateReturn(t *testing.T) {
+	ctx := context.Background()
+	cs, fakes := newTestCheckoutServiceWithBackends(t, 0)
+	placeTestOrder(cs)
+
+	req := &pb.CreateReturnRequest{OrderId: "order-1", UserId: "u1", Items: []*pb.CartItem{{ProductId: "MUG", Quantity: 1}}}
+	if _, err := cs.CreateReturn(ctx, req); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("returning an undelivered order: got %v, want FailedPrecondition", err)
+	}
+	for _, s := range []pb.OrderStatus{pb.OrderStatus_ORDER_STATUS_SHIPPED, pb.OrderStatus_ORDER_STATUS_DELIVERED} {
+		if _, err := cs.UpdateOrderStatus(ctx, &pb.UpdateOrderStatusRequest{OrderId: "order-1", Status: s}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// One $10.00 mug is a fifth of the $50.00 subtotal, so a fifth of the
+	// $48.00 charged for items comes back.
+	order, err := cs.CreateReturn(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := order.GetReturns()[0].GetRefund(); got.GetUnits() != 9 || got.GetNanos() != 600000000 {
+		t.Errorf("got refund %d.%09d, want 9.60", got.GetUnits(), got.GetNanos())
+	}
+	if order.GetStatus() != pb.OrderStatus_ORDER_STATUS_RETURNED {
+		t.Errorf("got status %s, want RETURNED", order.GetStatus())
+	}
+
+	req.Items = []*pb.CartItem{{ProductId: "MUG", Quantity: 2}}
+	if _, err := cs.CreateReturn(ctx, req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("returning more than is left: got %v, want InvalidArgument", err)
+	}
+
+	req.Items = nil
+	order, err = cs.CreateReturn(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.GetStatus() != pb.OrderStatus_ORDER_STATUS_REFUNDED {
+		t.Errorf("got status %s, want REFUNDED", order.GetStatus())
+	}
+	if got := order.GetRefunded(); got.GetUnits() != 48 || got.GetNanos() != 0 {
+		t.Errorf("got %d.%09d refunded in total, want 48.00", got.GetUnits(), got.GetNanos())
+	}
+	if len(fakes.payment.refunds) != 2 {
+		t.Errorf("got %d refunds, want 2", len(fakes.payment.refunds))
+	}
+	if len(fakes.catalog.restocked) != 3 {
+		t.Errorf("got %d restocked lines, want 3", len(fakes.catalog.restocked))
+	}
+}
+
+func TestListOrders(t *testing.T) {
+	cs, _ := newTestCheckoutServiceWithBackends(t, 0)
+	placeTestOrder(cs)
+	resp, err := cs.ListOrders(context.Background(), &pb.ListOrdersRequest{UserId: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetOrders()) != 1 {
+		t.Errorf("got %d orders, want 1", len(resp.GetOrders()))
+	}
+	if resp, _ := cs.ListOrders(context.Background(), &pb.ListOrdersRequest{UserId: "u2"}); len(resp.GetOrders()) != 0 {
+		t.Errorf("got %d orders for another user, want 0", len(resp.GetOrders()))
+	}
+}
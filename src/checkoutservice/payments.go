@@ -0,0 +1,191 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+const defaultAuthorizationSweepInterval = time.Minute
+
+// pendingAuthorization is a card hold whose capture or void failed and is
+// retried by the sweeper until it succeeds or the hold lapses.
+type pendingAuthorization struct {
+	id      string
+	expires time.Time
+	// orderID is set for holds that still need to be captured; the others
+	// need to be voided.
+	orderID string
+	amount  *pb.Money
+}
+
+// authorizationSweeper tracks card holds that could not be settled right
+// away. Without it a failed capture would ship an order that is never paid
+// for, and a failed void would keep the shopper's funds held until the
+// issuer drops the hold.
+type authorizationSweeper struct {
+	mu      sync.Mutex
+	pending map[string]*pendingAuthorization
+	now     func() time.Time
+}
+
+func newAuthorizationSweeper() *authorizationSweeper {
+	return &authorizationSweeper{
+		pending: make(map[string]*pendingAuthorization),
+		now:     time.Now,
+	}
+}
+
+func (s *authorizationSweeper) add(p *pendingAuthorization) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[p.id] = p
+}
+
+// remove stops retrying an authorization and reports whether it was pending.
+func (s *authorizationSweeper) remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.pending[id]
+	delete(s.pending, id)
+	return ok
+}
+
+// due returns the pending authorizations, dropping the ones that have
+// lapsed.
+func (s *authorizationSweeper) due() []*pendingAuthorization {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	var out []*pendingAuthorization
+	for id, p := range s.pending {
+		if !now.Before(p.expires) {
+			delete(s.pending, id)
+			if p.orderID != "" {
+				log.Errorf("authorization %s for order %s expired before it could be captured", id, p.orderID)
+			} else {
+				log.Infof("authorization %s lapsed before it could be voided", id)
+			}
+			continue
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// authorizeCard places a hold on the card behind a vault token. Checkout
+// never sees the card itself.
+func (cs *checkoutService) authorizeCard(ctx context.Context, amount *pb.Money, cardToken string) (*pb.AuthorizeResponse, error) {
+	resp, err := pb.NewPaymentServiceClient(cs.paymentSvcConn).Authorize(ctx, &pb.AuthorizeRequest{
+		Amount:    amount,
+		CardToken: cardToken})
+	if err != nil {
+		return nil, fmt.Errorf("could not authorize the card: %+v", err)
+	}
+	return resp, nil
+}
+
+func (cs *checkoutService) captureAuthorization(ctx context.Context, authorizationID string, amount *pb.Money) (string, error) {
+	resp, err := pb.NewPaymentServiceClient(cs.paymentSvcConn).Capture(ctx, &pb.CaptureRequest{
+		AuthorizationId: authorizationID,
+		Amount:          amount})
+	if err != nil {
+		return "", fmt.Errorf("could not capture authorization %s: %+v", authorizationID, err)
+	}
+	return resp.GetTransactionId(), nil
+}
+
+func (cs *checkoutService) voidAuthorization(ctx context.Context, authorizationID string) error {
+	if _, err := pb.NewPaymentServiceClient(cs.paymentSvcConn).Void(ctx, &pb.VoidRequest{
+		AuthorizationId: authorizationID}); err != nil {
+		return fmt.Errorf("could not void authorization %s: %+v", authorizationID, err)
+	}
+	return nil
+}
+
+// releaseAuthorization voids a hold for an order that was not placed,
+// leaving it to the sweeper if the payment service cannot be reached.
+func (cs *checkoutService) releaseAuthorization(ctx context.Context, auth *pb.AuthorizeResponse) {
+	if err := cs.voidAuthorization(ctx, auth.GetAuthorizationId()); err != nil {
+		log.Warnf("%v; retrying in the background", err)
+		cs.authorizations.add(&pendingAuthorization{
+			id:      auth.GetAuthorizationId(),
+			expires: time.Unix(auth.GetExpiresAtUnix(), 0),
+		})
+	}
+}
+
+// sweepAuthorizations retries the captures and voids that failed earlier.
+func (cs *checkoutService) sweepAuthorizations(ctx context.Context) {
+	for _, p := range cs.authorizations.due() {
+		if p.orderID == "" {
+			if err := cs.voidAuthorization(ctx, p.id); err != nil {
+				log.Warnf("sweeper: %v", err)
+				continue
+			}
+			cs.authorizations.remove(p.id)
+			log.Infof("sweeper: voided authorization %s", p.id)
+			continue
+		}
+		if err := cs.captureOrder(ctx, p); err != nil {
+			log.Warnf("sweeper: %v", err)
+		}
+	}
+}
+
+// captureOrder captures a pending authorization and records the transaction
+// on its order. It holds the order lock so that it does not race with a
+// cancellation voiding the same hold.
+func (cs *checkoutService) captureOrder(ctx context.Context, p *pendingAuthorization) error {
+	r, err := cs.orders.get(p.orderID, "")
+	if err != nil {
+		cs.authorizations.remove(p.id)
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.transactionID != "" || r.order.Status == pb.OrderStatus_ORDER_STATUS_CANCELLED {
+		cs.authorizations.remove(p.id)
+		return nil
+	}
+	txID, err := cs.captureAuthorization(ctx, p.id, p.amount)
+	if err != nil {
+		return err
+	}
+	cs.authorizations.remove(p.id)
+	r.transactionID = txID
+	log.Infof("sweeper: captured order %s (transaction_id: %s)", p.orderID, txID)
+	return nil
+}
+
+// runAuthorizationSweeper calls sweepAuthorizations every interval until ctx
+// is done.
+func (cs *checkoutService) runAuthorizationSweeper(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			cs.sweepAuthorizations(ctx)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+func placeOrderRequest(street string) *pb.PlaceOrderRequest {
+	return &pb.PlaceOrderRequest{
+		UserId:       "u1",
+		UserCurrency: "USD",
+		Address:      &pb.Address{StreetAddress: street, Country: "US"},
+		Email:        "someone@example.com",
+		CardToken:    "tok_1",
+		CardLastFour: "0454",
+	}
+}
+
+// unship clears the tracking IDs of a placed order, as if none of its
+// shipments had been handed over yet, so that it can still be cancelled.
+func unship(tb testing.TB, cs *checkoutService, orderID string) {
+	tb.Helper()
+	r, err := cs.orders.get(orderID, "")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, s := range r.order.GetShipments() {
+		s.TrackingId = ""
+	}
+}
+
+func TestPlaceOrderCapturesAfterShipping(t *testing.T) {
+	cs, fakes := newTestCheckoutServiceWithBackends(t, 1)
+	fakes.payment.approve = true
+
+	resp, err := cs.PlaceOrder(context.Background(), placeOrderRequest("1600 Amphitheatre Pkwy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fakes.payment.captures) != 1 || len(fakes.payment.voids) != 0 {
+		t.Fatalf("got %d captures and %d voids, want 1 and 0", len(fakes.payment.captures), len(fakes.payment.voids))
+	}
+	if got := fakes.payment.captures[0]; got.GetAuthorizationId() != "auth-1" || nanosOf(*got.GetAmount()) != nanosOf(*resp.GetOrder().GetTotal()) {
+		t.Errorf("captured %v, want the order total from auth-1", got)
+	}
+	r, err := cs.orders.get(resp.GetOrder().GetOrderId(), "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.transactionID != "tx-1" {
+		t.Errorf("got transaction %q, want tx-1", r.transactionID)
+	}
+}
+
+func TestPlaceOrderVoidsAuthorizationWhenShippingFails(t *testing.T) {
+	cs, fakes := newTestCheckoutServiceWithBackends(t, 1)
+	fakes.payment.approve = true
+
+	if _, err := cs.PlaceOrder(context.Background(), placeOrderRequest("Nowhere")); err == nil {
+		t.Fatal("expected the undeliverable address to fail the order")
+	}
+	if len(fakes.payment.captures) != 0 || len(fakes.payment.voids) != 1 || fakes.payment.voids[0] != "auth-1" {
+		t.Errorf("got captures %v and voids %v, want only auth-1 voided", fakes.payment.captures, fakes.payment.voids)
+	}
+}
+
+func TestSweeperRetriesFailedCapture(t *testing.T) {
+	ctx := context.Background()
+	cs, fakes := newTestCheckoutServiceWithBackends(t, 1)
+	fakes.payment.approve = true
+	fakes.payment.failCaptures = 2
+
+	resp, err := cs.PlaceOrder(ctx, placeOrderRequest("1600 Amphitheatre Pkwy"))
+	if err != nil {
+		t.Fatalf("a failed capture should not fail the shipped order: %v", err)
+	}
+	r, _ := cs.orders.get(resp.GetOrder().GetOrderId(), "u1")
+
+	cs.sweepAuthorizations(ctx)
+	if r.transactionID != "" || len(cs.authorizations.pending) != 1 {
+		t.Fatalf("after a failed retry got transaction %q and %d pending, want none and 1", r.transactionID, len(cs.authorizations.pending))
+	}
+	cs.sweepAuthorizations(ctx)
+	if r.transactionID != "tx-1" || len(cs.authorizations.pending) != 0 {
+		t.Errorf("got transaction %q and %d pending, want tx-1 and 0", r.transactionID, len(cs.authorizations.pending))
+	}
+}
+
+func TestCancelUncapturedOrderVoidsAuthorization(t *testing.T) {
+	ctx := context.Background()
+	cs, fakes := newTestCheckoutServiceWithBackends(t, 1)
+	fakes.payment.approve = true
+	fakes.payment.failCaptures = 1
+
+	resp, err := cs.PlaceOrder(ctx, placeOrderRequest("1600 Amphitheatre Pkwy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unship(t, cs, resp.GetOrder().GetOrderId())
+	if _, err := cs.CancelOrder(ctx, &pb.CancelOrderRequest{OrderId: resp.GetOrder().GetOrderId(), UserId: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fakes.payment.voids) != 1 || len(fakes.payment.refunds) != 0 {
+		t.Errorf("got %d voids and %d refunds, want 1 and 0", len(fakes.payment.voids), len(fakes.payment.refunds))
+	}
+	cs.sweepAuthorizations(ctx)
+	if len(fakes.payment.captures) != 0 {
+		t.Errorf("sweeper captured a cancelled order")
+	}
+}
+
+func TestCancelUncapturedOrderRefundsGiftCards(t *testing.T) {
+	ctx := context.Background()
+	cs, fakes := newTestCheckoutServiceWithBackends(t, 1)
+	fakes.payment.approve = true
+	fakes.payment.failCaptures = 1
+	cs.giftCards = testGiftCards(t, &giftCardConfig{Code: "GIFT1234", Balance: moneyConfig{CurrencyCode: "USD", Units: 15}})
+
+	req := placeOrderRequest("1600 Amphitheatre Pkwy")
+	req.GiftCardCodes = []string{"GIFT1234"}
+	resp, err := cs.PlaceOrder(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unship(t, cs, resp.GetOrder().GetOrderId())
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stdout)
+	if _, err := cs.CancelOrder(ctx, &pb.CancelOrderRequest{OrderId: resp.GetOrder().GetOrderId(), UserId: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := cs.giftCards.balance("GIFT1234", ""); nanosOf(b) != 15e9 {
+		t.Errorf("got gift card balance %v after cancelling, want 15.00", b)
+	}
+	if len(fakes.payment.voids) != 1 || len(fakes.payment.refunds) != 0 {
+		t.Errorf("got %d voids and %d refunds, want 1 and 0", len(fakes.payment.voids), len(fakes.payment.refunds))
+	}
+	if strings.Contains(out.String(), "exceeds what was paid") {
+		t.Errorf("cancelling logged a refund larger than the payment:\n%s", out.String())
+	}
+}
+
+func TestSweeperDropsExpiredAuthorizations(t *testing.T) {
+	s := newAuthorizationSweeper()
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	s.add(&pendingAuthorization{id: "old", expires: now.Add(-time.Second), orderID: "order-1"})
+	s.add(&pendingAuthorization{id: "new", expires: now.Add(time.Hour)})
+
+	due := s.due()
+	if len(due) != 1 || due[0].id != "new" {
+		t.Errorf("got %v, want only the unexpired authorization", due)
+	}
+	if _, ok := s.pending["old"]; ok {
+		t.Error("expired authorization is still pending")
+	}
+}
@@ -0,0 +1,425 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+	money "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/money"
+)
+
+const (
+	defaultPromotionsFile = "promotions.json"
+
+	promoPercentOff   = "percent_off"
+	promoFixedAmount  = "fixed_amount"
+	promoFreeShipping = "free_shipping"
+	promoBuyXGetY     = "buy_x_get_y"
+
+	nanosPerCent = 10000000
+)
+
+// moneyConfig is the JSON form of a pb.Money in the promotions file.
+type moneyConfig struct {
+	CurrencyCode string `json:"currency_code"`
+	Units        int64  `json:"units"`
+	Nanos        int32  `json:"nanos"`
+}
+
+func (m *moneyConfig) toProto() *pb.Money {
+	return &pb.Money{CurrencyCode: m.CurrencyCode, Units: m.Units, Nanos: m.Nanos}
+}
+
+// promotion is a discount rule. Rules without a code apply automatically to
+// every eligible order; rules with a code apply only when the shopper enters
+// it.
+type promotion struct {
+	ID          string `json:"id"`
+	Code        string `json:"code,omitempty"`
+	Description string `json:"description"`
+	Type        string `json:"type"`
+
+	// percent_off
+	Percent float64 `json:"percent,omitempty"`
+	// fixed_amount
+	Amount *moneyConfig `json:"amount,omitempty"`
+	// buy_x_get_y: for every Buy items in Category, the Get cheapest
+	// additional ones are free.
+	Category string `json:"category,omitempty"`
+	Buy      int    `json:"buy,omitempty"`
+	Get      int    `json:"get,omitempty"`
+
+	// MinSubtotal, when set, is the item subtotal an order must reach for
+	// the promotion to apply (e.g. free shipping over $75).
+	MinSubtotal *moneyConfig `json:"min_subtotal,omitempty"`
+	StartsAt    *time.Time   `json:"starts_at,omitempty"`
+	EndsAt      *time.Time   `json:"ends_at,omitempty"`
+
+	// Redemption limits; zero means unlimited.
+	MaxRedemptions        int `json:"max_redemptions,omitempty"`
+	MaxRedemptionsPerUser int `json:"max_redemptions_per_user,omitempty"`
+}
+
+func (p *promotion) validate() error {
+	if p.ID == "" {
+		return fmt.Errorf("promotion is missing an id")
+	}
+	switch p.Type {
+	case promoPercentOff:
+		if p.Percent <= 0 || p.Percent > 100 {
+			return fmt.Errorf("promotion %s: percent must be in (0, 100]", p.ID)
+		}
+	case promoFixedAmount:
+		if p.Amount == nil || !money.IsPositive(*p.Amount.toProto()) {
+			return fmt.Errorf("promotion %s: amount must be positive", p.ID)
+		}
+	case promoFreeShipping:
+	case promoBuyXGetY:
+		if p.Category == "" || p.Buy < 1 || p.Get < 1 {
+			return fmt.Errorf("promotion %s: category, buy and get are required", p.ID)
+		}
+	default:
+		return fmt.Errorf("promotion %s: unknown type %q", p.ID, p.Type)
+	}
+	return nil
+}
+
+func (p *promotion) active(now time.Time) bool {
+	return (p.StartsAt == nil || !now.Before(*p.StartsAt)) && (p.EndsAt == nil || now.Before(*p.EndsAt))
+}
+
+// couponError reports a coupon code that cannot be applied to an order.
+type couponError struct {
+	code   string
+	reason string
+}
+
+func (e *couponError) Error() string {
+	return fmt.Sprintf("coupon %q %s", e.code, e.reason)
+}
+
+// currencyConverter converts an amount into the given currency.
+type currencyConverter func(ctx context.Context, from *pb.Money, toCurrency string) (*pb.Money, error)
+
+// promotionEngine evaluates promotion rules against priced orders and
+// enforces their redemption limits.
+type promotionEngine struct {
+	promotions []*promotion
+	byCode     map[string]*promotion
+	store      *redemptionStore
+	now        func() time.Time
+}
+
+func newPromotionEngine(promotions []*promotion) (*promotionEngine, error) {
+	e := &promotionEngine{
+		byCode: make(map[string]*promotion),
+		store:  newRedemptionStore(),
+		now:    time.Now,
+	}
+	for _, p := range promotions {
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+		if p.Code != "" {
+			code := normalizeCoupon(p.Code)
+			if _, dup := e.byCode[code]; dup {
+				return nil, fmt.Errorf("duplicate coupon code %q", p.Code)
+			}
+			e.byCode[code] = p
+		}
+		e.promotions = append(e.promotions, p)
+	}
+	return e, nil
+}
+
+// loadPromotions reads promotion rules from PROMOTIONS_CONFIG, falling back
+// to promotions.json next to the binary. A missing default file simply means
+// there are no promotions.
+func loadPromotions() (*promotionEngine, error) {
+	path := os.Getenv("PROMOTIONS_CONFIG")
+	explicit := path != ""
+	if !explicit {
+		path = defaultPromotionsFile
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		log.Info("no promotions configured")
+		return newPromotionEngine(nil)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read promotions file: %v", err)
+	}
+	var cfg struct {
+		Promotions []*promotion `json:"promotions"`
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse promotions file %s: %v", path, err)
+	}
+	log.Infof("loaded %d promotions from %s", len(cfg.Promotions), path)
+	return newPromotionEngine(cfg.Promotions)
+}
+
+func normalizeCoupon(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// applicable returns the promotions that apply to an order for the given
+// coupon codes: every active automatic promotion plus each entered coupon.
+// Codes that are unknown, expired or used up are returned as couponErrors.
+func (e *promotionEngine) applicable(userID string, codes []string) ([]*promotion, []*couponError) {
+	now := e.now()
+	var out []*promotion
+	for _, p := range e.promotions {
+		if p.Code == "" && p.active(now) && e.store.available(p, userID) {
+			out = append(out, p)
+		}
+	}
+
+	var rejected []*couponError
+	seen := make(map[string]bool)
+	for _, c := range codes {
+		code := normalizeCoupon(c)
+		if code == "" || seen[code] {
+			continue
+		}
+		seen[code] = true
+		p, ok := e.byCode[code]
+		switch {
+		case !ok:
+			rejected = append(rejected, &couponError{c, "does not exist"})
+		case !p.active(now):
+			rejected = append(rejected, &couponError{c, "has expired"})
+		case !e.store.available(p, userID):
+			rejected = append(rejected, &couponError{c, "has reached its redemption limit"})
+		default:
+			out = append(out, p)
+		}
+	}
+	return out, rejected
+}
+
+// discounts computes the discount line items for a prepared order. Item
+// discounts never exceed the item subtotal and shipping is waived at most
+// once.
+func (e *promotionEngine) discounts(ctx context.Context, promos []*promotion, prep orderPrep, userCurrency string, convert currencyConverter) ([]*pb.Discount, error) {
+	subtotal := prep.subtotal(userCurrency)
+	remaining := subtotal
+	shippingWaived := false
+
+	var out []*pb.Discount
+	for _, p := range promos {
+		if p.MinSubtotal != nil {
+			min, err := localize(ctx, p.MinSubtotal.toProto(), userCurrency, convert)
+			if err != nil {
+				return nil, err
+			}
+			if c, err := money.Compare(subtotal, *min); err != nil || c < 0 {
+				continue
+			}
+		}
+
+		var amount pb.Money
+		switch p.Type {
+		case promoPercentOff:
+			amount = money.MultiplyRatio(subtotal, int64(math.Round(p.Percent*10000)), 1000000)
+		case promoFixedAmount:
+			a, err := localize(ctx, p.Amount.toProto(), userCurrency, convert)
+			if err != nil {
+				return nil, err
+			}
+			amount = *a
+		case promoBuyXGetY:
+			amount = buyXGetYDiscount(p, prep, userCurrency)
+		case promoFreeShipping:
+			if shippingWaived || prep.shippingCostLocalized == nil || money.IsZero(*prep.shippingCostLocalized) {
+				continue
+			}
+			shippingWaived = true
+			d := newDiscount(p, *prep.shippingCostLocalized)
+			d.Shipping = true
+			out = append(out, d)
+			continue
+		}
+
+		amount = money.RoundTo(amount, nanosPerCent)
+		if c, _ := money.Compare(amount, remaining); c > 0 {
+			amount = remaining
+		}
+		if !money.IsPositive(amount) {
+			continue
+		}
+		remaining = money.Must(money.Subtract(remaining, amount))
+		out = append(out, newDiscount(p, amount))
+	}
+	return out, nil
+}
+
+func newDiscount(p *promotion, amount pb.Money) *pb.Discount {
+	return &pb.Discount{
+		PromotionId: p.ID,
+		Code:        p.Code,
+		Description: p.Description,
+		Amount:      &amount,
+	}
+}
+
+// buyXGetYDiscount makes the cheapest units in the promotion's category free:
+// Get units for every Buy+Get units in the order.
+func buyXGetYDiscount(p *promotion, prep orderPrep, userCurrency string) pb.Money {
+	var units []*pb.Money
+	for i, it := range prep.orderItems {
+		if i >= len(prep.products) || !hasCategory(prep.products[i], p.Category) {
+			continue
+		}
+		for q := int32(0); q < it.GetItem().GetQuantity(); q++ {
+			units = append(units, it.GetCost())
+		}
+	}
+	free := len(units) / (p.Buy + p.Get) * p.Get
+	sort.Slice(units, func(i, j int) bool {
+		c, _ := money.Compare(*units[i], *units[j])
+		return c < 0
+	})
+	out := pb.Money{CurrencyCode: userCurrency}
+	for _, u := range units[:free] {
+		out = money.Must(money.Sum(out, *u))
+	}
+	return out
+}
+
+func hasCategory(p *pb.Product, category string) bool {
+	for _, c := range p.GetCategories() {
+		if strings.EqualFold(c, category) {
+			return true
+		}
+	}
+	return false
+}
+
+func localize(ctx context.Context, m *pb.Money, userCurrency string, convert currencyConverter) (*pb.Money, error) {
+	if m.GetCurrencyCode() == userCurrency {
+		return m, nil
+	}
+	out, err := convert(ctx, m, userCurrency)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert promotion amount: %+v", err)
+	}
+	return out, nil
+}
+
+// redemptionStore counts promotion redemptions in memory, globally and per
+// user.
+type redemptionStore struct {
+	mu      sync.Mutex
+	total   map[string]int
+	perUser map[string]map[string]int
+}
+
+func newRedemptionStore() *redemptionStore {
+	return &redemptionStore{
+		total:   make(map[string]int),
+		perUser: make(map[string]map[string]int),
+	}
+}
+
+func (s *redemptionStore) available(p *promotion, userID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.availableLocked(p, userID)
+}
+
+func (s *redemptionStore) availableLocked(p *promotion, userID string) bool {
+	if p.MaxRedemptions > 0 && s.total[p.ID] >= p.MaxRedemptions {
+		return false
+	}
+	if p.MaxRedemptionsPerUser > 0 && s.perUser[p.ID][userID] >= p.MaxRedemptionsPerUser {
+		return false
+	}
+	return true
+}
+
+// reserve atomically redeems every promotion behind the given discounts, or
+// none of them if any limit has been reached in the meantime.
+func (s *redemptionStore) reserve(promos []*promotion, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range promos {
+		if !s.availableLocked(p, userID) {
+			return &couponError{p.Code, "has reached its redemption limit"}
+		}
+	}
+	for _, p := range promos {
+		s.total[p.ID]++
+		if s.perUser[p.ID] == nil {
+			s.perUser[p.ID] = make(map[string]int)
+		}
+		s.perUser[p.ID][userID]++
+	}
+	return nil
+}
+
+// release returns redemptions taken by reserve, e.g. when payment fails.
+func (s *redemptionStore) release(promos []*promotion, userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range promos {
+		if s.total[p.ID] > 0 {
+			s.total[p.ID]--
+		}
+		if s.perUser[p.ID][userID] > 0 {
+			s.perUser[p.ID][userID]--
+		}
+	}
+}
+
+// redeemed returns the promotions behind the given discounts.
+func (e *promotionEngine) redeemed(discounts []*pb.Discount) []*promotion {
+	ids := make(map[string]bool, len(discounts))
+	for _, d := range discounts {
+		ids[d.GetPromotionId()] = true
+	}
+	var out []*promotion
+	for _, p := range e.promotions {
+		if ids[p.ID] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// reserve counts a redemption of every promotion behind the given discounts
+// against its limits. It is a no-op on a nil engine.
+func (e *promotionEngine) reserve(discounts []*pb.Discount, userID string) error {
+	if e == nil {
+		return nil
+	}
+	return e.store.reserve(e.redeemed(discounts), userID)
+}
+
+// release undoes reserve for an order that did not go through.
+func (e *promotionEngine) release(discounts []*pb.Discount, userID string) {
+	if e == nil {
+		return
+	}
+	e.store.release(e.redeemed(discounts), userID)
+}
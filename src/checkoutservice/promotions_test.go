@@ -0,0 +1,146 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+func usd(units int64, nanos int32) *pb.Money {
+	return &pb.Money{CurrencyCode: "USD", Units: units, Nanos: nanos}
+}
+
+func noConvert(ctx context.Context, from *pb.Money, toCurrency string) (*pb.Money, error) {
+	return from, nil
+}
+
+// testPrep is a $50.00 order of two $10.00 mugs and a $30.00 lamp with $8.99
+// shipping.
+func testPrep() orderPrep {
+	return orderPrep{
+		orderItems: []*pb.OrderItem{
+			{Item: &pb.CartItem{ProductId: "MUG", Quantity: 2}, Cost: usd(10, 0)},
+			{Item: &pb.CartItem{ProductId: "LAMP", Quantity: 1}, Cost: usd(30, 0)},
+		},
+		products: []*pb.Product{
+			{Id: "MUG", Categories: []string{"kitchen"}},
+			{Id: "LAMP", Categories: []string{"home"}},
+		},
+		shippingCostLocalized: usd(8, 990000000),
+	}
+}
+
+func TestPromotionDiscounts(t *testing.T) {
+	tests := []struct {
+		name  string
+		promo *promotion
+		want  *pb.Money // nil when the promotion should not apply
+	}{
+		{"percent off", &promotion{ID: "p", Type: promoPercentOff, Percent: 15}, usd(7, 500000000)},
+		{"percent off rounds to cents", &promotion{ID: "p", Type: promoPercentOff, Percent: 33.33}, usd(16, 670000000)},
+		{"fixed amount", &promotion{ID: "p", Type: promoFixedAmount, Amount: &moneyConfig{"USD", 5, 0}}, usd(5, 0)},
+		{"fixed amount capped at subtotal", &promotion{ID: "p", Type: promoFixedAmount, Amount: &moneyConfig{"USD", 80, 0}}, usd(50, 0)},
+		{"free shipping over threshold", &promotion{ID: "p", Type: promoFreeShipping, MinSubtotal: &moneyConfig{"USD", 50, 0}}, usd(8, 990000000)},
+		{"free shipping below threshold", &promotion{ID: "p", Type: promoFreeShipping, MinSubtotal: &moneyConfig{"USD", 75, 0}}, nil},
+		{"buy one get one", &promotion{ID: "p", Type: promoBuyXGetY, Category: "Kitchen", Buy: 1, Get: 1}, usd(10, 0)},
+		{"buy two get one not met", &promotion{ID: "p", Type: promoBuyXGetY, Category: "kitchen", Buy: 2, Get: 1}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := newPromotionEngine([]*promotion{tt.promo})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := e.discounts(context.Background(), e.promotions, testPrep(), "USD", noConvert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == nil {
+				if len(got) != 0 {
+					t.Fatalf("got discounts %v, want none", got)
+				}
+				return
+			}
+			if len(got) != 1 {
+				t.Fatalf("got %d discounts, want 1", len(got))
+			}
+			if a := got[0].GetAmount(); a.GetUnits() != tt.want.Units || a.GetNanos() != tt.want.Nanos {
+				t.Errorf("got discount %d.%09d, want %d.%09d", a.GetUnits(), a.GetNanos(), tt.want.Units, tt.want.Nanos)
+			}
+		})
+	}
+}
+
+func TestPromotionCoupons(t *testing.T) {
+	e, err := newPromotionEngine([]*promotion{
+		{ID: "auto", Type: promoPercentOff, Percent: 5},
+		{ID: "save10", Code: "SAVE10", Type: promoPercentOff, Percent: 10, MaxRedemptionsPerUser: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	promos, rejected := e.applicable("u1", []string{" save10 ", "BOGUS"})
+	if len(promos) != 2 {
+		t.Errorf("got %d applicable promotions, want 2", len(promos))
+	}
+	if len(rejected) != 1 || rejected[0].code != "BOGUS" {
+		t.Errorf("got rejected %v, want BOGUS", rejected)
+	}
+
+	discounts, err := e.discounts(context.Background(), promos, testPrep(), "USD", noConvert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.reserve(discounts, "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, rejected := e.applicable("u1", []string{"SAVE10"}); len(rejected) != 1 {
+		t.Error("expected SAVE10 to be used up for u1")
+	}
+	if _, rejected := e.applicable("u2", []string{"SAVE10"}); len(rejected) != 0 {
+		t.Error("expected SAVE10 to remain available for u2")
+	}
+	if err := e.reserve(discounts, "u1"); err == nil {
+		t.Error("expected second reservation for u1 to fail")
+	}
+
+	e.release(discounts, "u1")
+	if _, rejected := e.applicable("u1", []string{"SAVE10"}); len(rejected) != 0 {
+		t.Error("expected SAVE10 to be available again after release")
+	}
+}
+
+func TestPromotionValidate(t *testing.T) {
+	for _, p := range []*promotion{
+		{ID: "p", Type: "mystery"},
+		{ID: "p", Type: promoPercentOff, Percent: 120},
+		{ID: "p", Type: promoFixedAmount},
+		{ID: "p", Type: promoBuyXGetY, Buy: 1, Get: 1},
+	} {
+		if _, err := newPromotionEngine([]*promotion{p}); err == nil {
+			t.Errorf("expected %+v to be rejected", p)
+		}
+	}
+	if _, err := newPromotionEngine([]*promotion{
+		{ID: "a", Code: "X", Type: promoFreeShipping},
+		{ID: "b", Code: "x", Type: promoFreeShipping},
+	}); err == nil {
+		t.Error("expected duplicate coupon codes to be rejected")
+	}
+}
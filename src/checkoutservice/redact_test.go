@@ -0,0 +1,56 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"card 4432801561520454 declined", "card ************0454 declined"},
+		{"card 4432-8015-6152-0454", "card ************0454"},
+		{"order 1700000000000000001 placed", "order 1700000000000000001 placed"},
+		{`credit_card_cvv:672 credit_card_expiration_year:2030`, `credit_card_cvv:*** credit_card_expiration_year:2030`},
+		{`{"cvv": "672"}`, `{"cvv": "***"}`},
+		{"sent to someone@example.com", "sent to ***@example.com"},
+	}
+	for _, tt := range tests {
+		if got := redact(tt.in); got != tt.want {
+			t.Errorf("redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRedactingFormatter(t *testing.T) {
+	var buf bytes.Buffer
+	l := logrus.New()
+	l.Out = &buf
+	l.Formatter = redactingFormatter{&logrus.JSONFormatter{}}
+	l.WithField("email", "someone@example.com").Infof("charging 4432801561520454 cvv=672")
+
+	out := buf.String()
+	for _, leak := range []string{"4432801561520454", "672", "someone@"} {
+		if strings.Contains(out, leak) {
+			t.Errorf("log output %s leaks %q", out, leak)
+		}
+	}
+}
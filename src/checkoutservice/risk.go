@@ -0,0 +1,394 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	defaultRiskFile           = "risk.json"
+	defaultScoringTimeout     = 2 * time.Second
+	defaultOrderValueCurrency = "USD"
+)
+
+// riskCheck is what the risk assessors know about an order.
+type riskCheck struct {
+	UserID          string    `json:"user_id"`
+	Email           string    `json:"email"`
+	CardFingerprint string    `json:"card_fingerprint"`
+	ShippingCountry string    `json:"shipping_country"`
+	BillingCountry  string    `json:"billing_country"`
+	Total           *pb.Money `json:"total"`
+}
+
+// riskAssessor scores an order. Implementations return ALLOW when they have
+// no opinion.
+type riskAssessor interface {
+	assess(ctx context.Context, c *riskCheck) (*pb.RiskAssessment, error)
+}
+
+// riskEngine runs every assessor and keeps the strictest decision.
+type riskEngine struct {
+	assessors []riskAssessor
+	decisions metric.Int64Counter
+}
+
+type riskConfig struct {
+	Velocity        velocityConfig  `json:"velocity"`
+	CountryMismatch string          `json:"country_mismatch"`
+	OrderValue      orderValueLimit `json:"order_value"`
+	Scoring         *scoringConfig  `json:"scoring"`
+}
+
+type velocityConfig struct {
+	Window      string `json:"window"`
+	MaxPerUser  int    `json:"max_per_user"`
+	MaxPerEmail int    `json:"max_per_email"`
+	MaxPerCard  int    `json:"max_per_card"`
+	Decision    string `json:"decision"`
+}
+
+// orderValueLimit holds thresholds in whole units of Currency. Totals in
+// other currencies are converted to it before they are compared.
+type orderValueLimit struct {
+	Currency string `json:"currency"`
+	Review   int64  `json:"review"`
+	Deny     int64  `json:"deny"`
+}
+
+type scoringConfig struct {
+	URL         string  `json:"url"`
+	Timeout     string  `json:"timeout"`
+	ReviewScore float64 `json:"review_score"`
+	DenyScore   float64 `json:"deny_score"`
+}
+
+var riskDecisions = map[string]pb.RiskDecision{
+	"":       pb.RiskDecision_RISK_DECISION_ALLOW,
+	"allow":  pb.RiskDecision_RISK_DECISION_ALLOW,
+	"review": pb.RiskDecision_RISK_DECISION_REVIEW,
+	"deny":   pb.RiskDecision_RISK_DECISION_DENY,
+}
+
+func parseRiskDecision(s string) (pb.RiskDecision, error) {
+	d, ok := riskDecisions[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown risk decision %q", s)
+	}
+	return d, nil
+}
+
+func newRiskEngine(cfg riskConfig, convert currencyConverter, mp metric.MeterProvider) (*riskEngine, error) {
+	rules, err := newRuleAssessor(cfg, convert)
+	if err != nil {
+		return nil, err
+	}
+	e := &riskEngine{assessors: []riskAssessor{rules}}
+	if cfg.Scoring != nil && cfg.Scoring.URL != "" {
+		remote, err := newRemoteAssessor(*cfg.Scoring)
+		if err != nil {
+			return nil, err
+		}
+		e.assessors = append(e.assessors, remote)
+	}
+	e.decisions, err = mp.Meter("checkoutservice").Int64Counter("checkout.risk.decisions",
+		metric.WithDescription("Risk decisions made for placed orders, by decision."))
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// loadRiskEngine reads the risk rules from RISK_CONFIG, falling back to
+// risk.json next to the binary. A missing default file means no screening.
+// RISK_SCORING_URL overrides the external scoring endpoint. Order totals are
+// converted with convert for the order value rule, and decisions are counted
+// with mp.
+func loadRiskEngine(convert currencyConverter, mp metric.MeterProvider) (*riskEngine, error) {
+	path := os.Getenv("RISK_CONFIG")
+	explicit := path != ""
+	if !explicit {
+		path = defaultRiskFile
+	}
+	var cfg riskConfig
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		log.Info("no risk rules configured")
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read risk file: %v", err)
+	} else if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse risk file %s: %v", path, err)
+	} else {
+		log.Infof("loaded risk rules from %s", path)
+	}
+	if u := os.Getenv("RISK_SCORING_URL"); u != "" {
+		if cfg.Scoring == nil {
+			cfg.Scoring = &scoringConfig{}
+		}
+		cfg.Scoring.URL = u
+	}
+	return newRiskEngine(cfg, convert, mp)
+}
+
+// assess screens an order. A nil engine allows everything. Assessors that
+// fail are skipped so that an outage of the scoring endpoint does not stop
+// checkout.
+func (e *riskEngine) assess(ctx context.Context, c *riskCheck) *pb.RiskAssessment {
+	out := &pb.RiskAssessment{Decision: pb.RiskDecision_RISK_DECISION_ALLOW}
+	if e == nil {
+		return out
+	}
+	for _, a := range e.assessors {
+		r, err := a.assess(ctx, c)
+		if err != nil {
+			log.Warnf("risk assessment failed, ignoring it: %v", err)
+			continue
+		}
+		if r.GetDecision() > out.Decision {
+			out.Decision = r.GetDecision()
+		}
+		if r.GetScore() > out.Score {
+			out.Score = r.GetScore()
+		}
+		out.Reasons = append(out.Reasons, r.GetReasons()...)
+	}
+	e.decisions.Add(ctx, 1, metric.WithAttributes(attribute.String("decision", riskDecisionLabel(out.Decision))))
+	return out
+}
+
+func riskDecisionLabel(d pb.RiskDecision) string {
+	return strings.ToLower(strings.TrimPrefix(d.String(), "RISK_DECISION_"))
+}
+
+// ruleAssessor applies the velocity, country mismatch and order value rules.
+type ruleAssessor struct {
+	velocity         velocityConfig
+	window           time.Duration
+	velocityDecision pb.RiskDecision
+	mismatchDecision pb.RiskDecision
+	orderValue       orderValueLimit
+	convert          currencyConverter
+
+	mu sync.Mutex
+	// seen holds recent order attempts by key, e.g. "email:x@y.z", oldest
+	// first. Keys without attempts in the window are dropped every window.
+	seen   map[string][]time.Time
+	pruned time.Time
+	now    func() time.Time
+}
+
+func newRuleAssessor(cfg riskConfig, convert currencyConverter) (*ruleAssessor, error) {
+	r := &ruleAssessor{
+		velocity:   cfg.Velocity,
+		window:     time.Hour,
+		orderValue: cfg.OrderValue,
+		convert:    convert,
+		seen:       make(map[string][]time.Time),
+		now:        time.Now,
+	}
+	if cfg.Velocity.Window != "" {
+		d, err := time.ParseDuration(cfg.Velocity.Window)
+		if err != nil {
+			return nil, fmt.Errorf("risk velocity window: %v", err)
+		}
+		r.window = d
+	}
+	var err error
+	if cfg.Velocity.Decision == "" {
+		cfg.Velocity.Decision = "review"
+	}
+	if r.velocityDecision, err = parseRiskDecision(cfg.Velocity.Decision); err != nil {
+		return nil, fmt.Errorf("risk velocity: %v", err)
+	}
+	if r.mismatchDecision, err = parseRiskDecision(cfg.CountryMismatch); err != nil {
+		return nil, fmt.Errorf("risk country_mismatch: %v", err)
+	}
+	r.orderValue.Currency = strings.ToUpper(r.orderValue.Currency)
+	if r.orderValue.Currency == "" {
+		r.orderValue.Currency = defaultOrderValueCurrency
+	}
+	return r, nil
+}
+
+func (r *ruleAssessor) assess(ctx context.Context, c *riskCheck) (*pb.RiskAssessment, error) {
+	out := &pb.RiskAssessment{Decision: pb.RiskDecision_RISK_DECISION_ALLOW}
+	flag := func(d pb.RiskDecision, reason string, args ...interface{}) {
+		if d == pb.RiskDecision_RISK_DECISION_ALLOW {
+			return
+		}
+		if d > out.Decision {
+			out.Decision = d
+		}
+		out.Reasons = append(out.Reasons, fmt.Sprintf(reason, args...))
+	}
+
+	for _, v := range []struct {
+		kind, key string
+		max       int
+	}{
+		{"user", c.UserID, r.velocity.MaxPerUser},
+		{"email", strings.ToLower(c.Email), r.velocity.MaxPerEmail},
+		{"card", c.CardFingerprint, r.velocity.MaxPerCard},
+	} {
+		if v.key == "" {
+			continue
+		}
+		if n := r.record(v.kind + ":" + v.key); v.max > 0 && n > v.max {
+			flag(r.velocityDecision, "%d orders from the same %s within %s", n, v.kind, r.window)
+		}
+	}
+
+	ship, bill := strings.TrimSpace(c.ShippingCountry), strings.TrimSpace(c.BillingCountry)
+	if ship != "" && bill != "" && !strings.EqualFold(ship, bill) {
+		flag(r.mismatchDecision, "billing country %s does not match shipping country %s", bill, ship)
+	}
+
+	if limit := r.orderValue; limit.Review > 0 || limit.Deny > 0 {
+		total, err := r.orderValueIn(ctx, c.Total, limit.Currency)
+		if err != nil {
+			// An order that cannot be valued is not let through unseen.
+			flag(pb.RiskDecision_RISK_DECISION_REVIEW, "order value could not be converted to %s: %v", limit.Currency, err)
+			return out, nil
+		}
+		units := total.GetUnits()
+		if total.GetNanos() > 0 {
+			units++
+		}
+		switch {
+		case limit.Deny > 0 && units > limit.Deny:
+			flag(pb.RiskDecision_RISK_DECISION_DENY, "order value above %d %s", limit.Deny, limit.Currency)
+		case limit.Review > 0 && units > limit.Review:
+			flag(pb.RiskDecision_RISK_DECISION_REVIEW, "order value above %d %s", limit.Review, limit.Currency)
+		}
+	}
+	return out, nil
+}
+
+// orderValueIn returns total in currency, converting it if needed.
+func (r *ruleAssessor) orderValueIn(ctx context.Context, total *pb.Money, currency string) (*pb.Money, error) {
+	if strings.EqualFold(total.GetCurrencyCode(), currency) {
+		return total, nil
+	}
+	if r.convert == nil {
+		return nil, fmt.Errorf("no currency converter")
+	}
+	return r.convert(ctx, total, currency)
+}
+
+// record notes an order attempt for key and returns the number of attempts
+// within the window, including this one.
+func (r *ruleAssessor) record(key string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if now.Sub(r.pruned) >= r.window {
+		for k, attempts := range r.seen {
+			if len(attempts) == 0 || now.Sub(attempts[len(attempts)-1]) >= r.window {
+				delete(r.seen, k)
+			}
+		}
+		r.pruned = now
+	}
+	recent := r.seen[key][:0]
+	for _, t := range r.seen[key] {
+		if now.Sub(t) < r.window {
+			recent = append(recent, t)
+		}
+	}
+	r.seen[key] = append(recent, now)
+	return len(r.seen[key])
+}
+
+// remoteAssessor asks an external scoring endpoint. The endpoint receives
+// the riskCheck as JSON and answers {"score": 0.42, "reasons": ["..."]}.
+type remoteAssessor struct {
+	url         string
+	client      *http.Client
+	reviewScore float64
+	denyScore   float64
+}
+
+func newRemoteAssessor(cfg scoringConfig) (*remoteAssessor, error) {
+	timeout := defaultScoringTimeout
+	if cfg.Timeout != "" {
+		d, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("risk scoring timeout: %v", err)
+		}
+		timeout = d
+	}
+	r := &remoteAssessor{
+		url:         cfg.URL,
+		client:      &http.Client{Timeout: timeout},
+		reviewScore: cfg.ReviewScore,
+		denyScore:   cfg.DenyScore,
+	}
+	if r.reviewScore == 0 {
+		r.reviewScore = 0.5
+	}
+	if r.denyScore == 0 {
+		r.denyScore = 0.9
+	}
+	return r, nil
+}
+
+func (r *remoteAssessor) assess(ctx context.Context, c *riskCheck) (*pb.RiskAssessment, error) {
+	body, err := json.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal scoring request: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scoring request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call scoring endpoint: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("scoring endpoint returned %d", resp.StatusCode)
+	}
+	var score struct {
+		Score   float64  `json:"score"`
+		Reasons []string `json:"reasons"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&score); err != nil {
+		return nil, fmt.Errorf("failed to parse scoring response: %v", err)
+	}
+
+	out := &pb.RiskAssessment{Decision: pb.RiskDecision_RISK_DECISION_ALLOW, Score: score.Score, Reasons: score.Reasons}
+	switch {
+	case score.Score >= r.denyScore:
+		out.Decision = pb.RiskDecision_RISK_DECISION_DENY
+	case score.Score >= r.reviewScore:
+		out.Decision = pb.RiskDecision_RISK_DECISION_REVIEW
+	}
+	return out, nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/metric/noop"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+func testRiskConfig() riskConfig {
+	return riskConfig{
+		Velocity:        velocityConfig{Window: "1h", MaxPerEmail: 2, MaxPerCard: 1, Decision: "review"},
+		CountryMismatch: "review",
+		OrderValue:      orderValueLimit{Currency: "usd", Review: 100, Deny: 1000},
+	}
+}
+
+// convertAt100JPY converts between USD and JPY at 100 yen to the dollar.
+func convertAt100JPY(ctx context.Context, from *pb.Money, toCurrency string) (*pb.Money, error) {
+	switch {
+	case from.GetCurrencyCode() == "JPY" && toCurrency == "USD":
+		return &pb.Money{CurrencyCode: "USD", Units: from.GetUnits() / 100}, nil
+	case from.GetCurrencyCode() == "USD" && toCurrency == "JPY":
+		return &pb.Money{CurrencyCode: "JPY", Units: from.GetUnits() * 100}, nil
+	}
+	return nil, fmt.Errorf("cannot convert %s to %s", from.GetCurrencyCode(), toCurrency)
+}
+
+func TestRiskRules(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name  string
+		check riskCheck
+		want  pb.RiskDecision
+	}{
+		{"allow", riskCheck{ShippingCountry: "US", BillingCountry: "us", Total: usd(99, 0)}, pb.RiskDecision_RISK_DECISION_ALLOW},
+		{"country mismatch", riskCheck{ShippingCountry: "US", BillingCountry: "FR", Total: usd(10, 0)}, pb.RiskDecision_RISK_DECISION_REVIEW},
+		{"review value", riskCheck{Total: usd(100, 10000000)}, pb.RiskDecision_RISK_DECISION_REVIEW},
+		{"deny value", riskCheck{Total: usd(1500, 0)}, pb.RiskDecision_RISK_DECISION_DENY},
+		{"converted value", riskCheck{Total: &pb.Money{CurrencyCode: "JPY", Units: 500000}}, pb.RiskDecision_RISK_DECISION_DENY},
+		{"converted value allowed", riskCheck{Total: &pb.Money{CurrencyCode: "JPY", Units: 9900}}, pb.RiskDecision_RISK_DECISION_ALLOW},
+		{"unconvertible value", riskCheck{Total: &pb.Money{CurrencyCode: "CAD", Units: 1}}, pb.RiskDecision_RISK_DECISION_REVIEW},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := newRiskEngine(testRiskConfig(), convertAt100JPY, noop.NewMeterProvider())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := e.assess(ctx, &tt.check); got.GetDecision() != tt.want {
+				t.Errorf("got %s (%v), want %s", got.GetDecision(), got.GetReasons(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRiskVelocity(t *testing.T) {
+	ctx := context.Background()
+	rules, err := newRuleAssessor(testRiskConfig(), convertAt100JPY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	rules.now = func() time.Time { return now }
+	check := &riskCheck{Email: "someone@example.com", Total: usd(1, 0)}
+
+	for i, want := range []pb.RiskDecision{
+		pb.RiskDecision_RISK_DECISION_ALLOW,
+		pb.RiskDecision_RISK_DECISION_ALLOW,
+		pb.RiskDecision_RISK_DECISION_REVIEW,
+	} {
+		got, _ := rules.assess(ctx, check)
+		if got.GetDecision() != want {
+			t.Errorf("attempt %d: got %s, want %s", i+1, got.GetDecision(), want)
+		}
+	}
+	now = now.Add(2 * time.Hour)
+	if got, _ := rules.assess(ctx, check); got.GetDecision() != pb.RiskDecision_RISK_DECISION_ALLOW {
+		t.Errorf("after the window: got %s, want ALLOW", got.GetDecision())
+	}
+
+	card := &riskCheck{CardFingerprint: "fp-1", Total: usd(1, 0)}
+	now = now.Add(2 * time.Hour)
+	rules.assess(ctx, card)
+	if _, ok := rules.seen["email:someone@example.com"]; ok || len(rules.seen) != 1 {
+		t.Errorf("got attempts for %d keys, want only the card's once the email's expired", len(rules.seen))
+	}
+	if got, _ := rules.assess(ctx, card); got.GetDecision() != pb.RiskDecision_RISK_DECISION_REVIEW {
+		t.Errorf("second order on the same card: got %s, want REVIEW", got.GetDecision())
+	}
+}
+
+func TestRiskScoringEndpoint(t *testing.T) {
+	var score float64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var c riskCheck
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil || c.Email != "someone@example.com" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"score": score, "reasons": []string{"scored"}})
+	}))
+	defer srv.Close()
+
+	e, err := newRiskEngine(riskConfig{Scoring: &scoringConfig{URL: srv.URL, ReviewScore: 0.5, DenyScore: 0.9}}, nil, noop.NewMeterProvider())
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := &riskCheck{Email: "someone@example.com", Total: usd(1, 0)}
+	for _, tt := range []struct {
+		score float64
+		want  pb.RiskDecision
+	}{
+		{0.1, pb.RiskDecision_RISK_DECISION_ALLOW},
+		{0.6, pb.RiskDecision_RISK_DECISION_REVIEW},
+		{0.95, pb.RiskDecision_RISK_DECISION_DENY},
+	} {
+		score = tt.score
+		if got := e.assess(context.Background(), check); got.GetDecision() != tt.want || got.GetScore() != tt.score {
+			t.Errorf("score %v: got %s (%v), want %s", tt.score, got.GetDecision(), got.GetScore(), tt.want)
+		}
+	}
+
+	srv.Close()
+	if got := e.assess(context.Background(), check); got.GetDecision() != pb.RiskDecision_RISK_DECISION_ALLOW {
+		t.Errorf("with the endpoint down: got %s, want ALLOW", got.GetDecision())
+	}
+}
+
+func TestPlaceOrderRisk(t *testing.T) {
+	ctx := context.Background()
+	cs, fakes := newTestCheckoutServiceWithBackends(t, 1)
+	fakes.payment.approve = true
+	var err error
+	if cs.risk, err = newRiskEngine(testRiskConfig(), cs.convertCurrencyViaGCF, noop.NewMeterProvider()); err != nil {
+		t.Fatal(err)
+	}
+
+	req := placeOrderRequest("1600 Amphitheatre Pkwy")
+	req.BillingCountry = "FR"
+	resp, err := cs.PlaceOrder(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.GetOrder().GetRisk().GetDecision(); got != pb.RiskDecision_RISK_DECISION_REVIEW {
+		t.Errorf("got %s, want REVIEW recorded on the order", got)
+	}
+
+	cs.risk.assessors[0].(*ruleAssessor).orderValue = orderValueLimit{Currency: "USD", Deny: 1}
+	if _, err := cs.PlaceOrder(ctx, placeOrderRequest("1600 Amphitheatre Pkwy")); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("got %v, want PermissionDenied", err)
+	}
+	if len(fakes.payment.captures) != 1 {
+		t.Errorf("the denied order reached the payment service")
+	}
+}
+
+func TestRiskDecisionMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	e, err := newRiskEngine(testRiskConfig(), convertAt100JPY, sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	e.assess(ctx, &riskCheck{Total: usd(1, 0)})
+	e.assess(ctx, &riskCheck{Total: usd(2, 0)})
+	e.assess(ctx, &riskCheck{Total: usd(1500, 0)})
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(ctx, &rm); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "checkout.risk.decisions" {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				decision, _ := dp.Attributes.Value("decision")
+				got[decision.AsString()] += dp.Value
+			}
+		}
+	}
+	if got["allow"] != 2 || got["deny"] != 1 {
+		t.Errorf("got decisions %v, want 2 allow and 1 deny", got)
+	}
+}
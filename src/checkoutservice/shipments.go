@@ -0,0 +1,391 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+	money "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/money"
+)
+
+// shippingPlan is how an order ships and what it would cost with each
+// service level.
+type shippingPlan struct {
+	shipments []*pb.Shipment
+	// options prices each service level offered for every shipment, for the
+	// whole order in the user's currency.
+	options      []*pb.ShippingOption
+	serviceLevel string
+	// cost is the sum of the shipments' cost at serviceLevel.
+	cost *pb.Money
+}
+
+// planShipments splits the cart into one shipment per warehouse, as
+// allocated by the catalog, and quotes each in the user's currency. All
+// shipments go with serviceLevel, or the default level when it is empty. A
+// level that is not offered for the address is an InvalidArgument error.
+func (cs *checkoutService) planShipments(ctx context.Context, address *pb.Address, items []*pb.CartItem, userCurrency, serviceLevel string) (*shippingPlan, error) {
+	resp, err := pb.NewProductCatalogServiceClient(cs.productCatalogSvcConn).AllocateStock(ctx, &pb.AllocateStockRequest{
+		Items: items})
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate stock: %+v", err)
+	}
+
+	// The options of each shipment, with costs in the user's currency.
+	quotes := make([][]*pb.ShippingOption, len(resp.GetAllocations()))
+	g, gctx := errgroup.WithContext(ctx)
+	for i, a := range resp.GetAllocations() {
+		g.Go(func() error {
+			options, err := cs.quoteShipping(gctx, address, a.GetItems())
+			if status.Code(err) == codes.FailedPrecondition {
+				// Broken shipping rules, for the customer to fix.
+				return err
+			} else if err != nil {
+				return fmt.Errorf("shipping quote failure: %+v", err)
+			}
+			for _, o := range options {
+				if o.Cost, err = cs.convertCurrency(gctx, o.GetCost(), userCurrency); err != nil {
+					return fmt.Errorf("failed to convert shipping cost to currency: %+v", err)
+				}
+			}
+			quotes[i] = options
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	plan := &shippingPlan{
+		options:      orderShippingOptions(quotes, userCurrency),
+		serviceLevel: serviceLevel,
+		cost:         &pb.Money{CurrencyCode: userCurrency},
+	}
+	if len(quotes) == 0 {
+		return plan, nil
+	}
+	if len(plan.options) == 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "no service level can ship every part of the order")
+	}
+	if plan.serviceLevel == "" {
+		plan.serviceLevel = plan.options[0].GetServiceLevel()
+	} else if findShippingOption(plan.options, plan.serviceLevel) == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "service level %q is not available for this address", plan.serviceLevel)
+	}
+	for i, a := range resp.GetAllocations() {
+		o := findShippingOption(quotes[i], plan.serviceLevel)
+		plan.shipments = append(plan.shipments, &pb.Shipment{
+			WarehouseId:           a.GetWarehouseId(),
+			Items:                 a.GetItems(),
+			ShippingCost:          o.GetCost(),
+			ServiceLevel:          o.GetServiceLevel(),
+			Carrier:               o.GetCarrier(),
+			EstimatedDeliveryDate: o.GetEstimatedDeliveryDate(),
+			EarliestDeliveryDate:  o.GetEarliestDeliveryDate(),
+		})
+	}
+	plan.cost = findShippingOption(plan.options, plan.serviceLevel).GetCost()
+	return plan, nil
+}
+
+// orderShippingOptions combines the options of each shipment into options
+// for the whole order: the service levels offered for every shipment, in the
+// order of the first, costing the sum of the shipments and arriving with the
+// last of them.
+func orderShippingOptions(quotes [][]*pb.ShippingOption, userCurrency string) []*pb.ShippingOption {
+	if len(quotes) == 0 {
+		return nil
+	}
+	var out []*pb.ShippingOption
+	for _, first := range quotes[0] {
+		total := &pb.ShippingOption{
+			ServiceLevel: first.GetServiceLevel(),
+			Name:         first.GetName(),
+			Carrier:      first.GetCarrier(),
+			Cost:         &pb.Money{CurrencyCode: userCurrency},
+		}
+		offered := true
+		for _, options := range quotes {
+			o := findShippingOption(options, first.GetServiceLevel())
+			if o == nil {
+				offered = false
+				break
+			}
+			cost := money.Must(money.Sum(*total.Cost, *o.GetCost()))
+			total.Cost = &cost
+			if o.GetEstimatedDeliveryDate() > total.EstimatedDeliveryDate {
+				total.EstimatedDeliveryDate = o.GetEstimatedDeliveryDate()
+			}
+			if o.GetEarliestDeliveryDate() > total.EarliestDeliveryDate {
+				total.EarliestDeliveryDate = o.GetEarliestDeliveryDate()
+			}
+		}
+		if offered {
+			out = append(out, total)
+		}
+	}
+	return out
+}
+
+func findShippingOption(options []*pb.ShippingOption, serviceLevel string) *pb.ShippingOption {
+	for _, o := range options {
+		if o.GetServiceLevel() == serviceLevel {
+			return o
+		}
+	}
+	return nil
+}
+
+// stockAllocations returns the warehouse split of the shipments.
+func stockAllocations(shipments []*pb.Shipment) []*pb.StockAllocation {
+	out := make([]*pb.StockAllocation, len(shipments))
+	for i, s := range shipments {
+		out[i] = &pb.StockAllocation{WarehouseId: s.GetWarehouseId(), Items: s.GetItems()}
+	}
+	return out
+}
+
+// shipAll hands each shipment to the carrier and records its tracking ID
+// and handover time.
+// The shipments were quoted and checked against the shipping rules in
+// priceOrder, so a failure here is the carrier's. If the first shipment
+// fails nothing has left and the error is returned as is. Once one has been
+// handed over the rest are still tried, and those that fail are left without
+// a tracking ID for retryShipments; the number handed over is returned with
+// their errors.
+func (cs *checkoutService) shipAll(ctx context.Context, address *pb.Address, shipments []*pb.Shipment) (int, error) {
+	shipped := 0
+	var errs []error
+	for _, s := range shipments {
+		if s.GetTrackingId() != "" {
+			continue
+		}
+		trackingID, carrier, err := cs.shipOrder(ctx, address, s.GetItems(), s.GetServiceLevel())
+		if err != nil && shipped == 0 {
+			if status.Code(err) == codes.FailedPrecondition {
+				return 0, err
+			}
+			return 0, fmt.Errorf("shipment from %s failed: %+v", s.GetWarehouseId(), err)
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("shipment from %s failed: %+v", s.GetWarehouseId(), err))
+			continue
+		}
+		s.TrackingId = trackingID
+		s.ShippedAtUnix = time.Now().Unix()
+		if carrier != "" {
+			s.Carrier = carrier
+		}
+		shipped++
+	}
+	return shipped, errors.Join(errs...)
+}
+
+// pendingShipments counts the shipments that have no tracking ID yet.
+func pendingShipments(shipments []*pb.Shipment) int {
+	n := 0
+	for _, s := range shipments {
+		if s.GetTrackingId() == "" {
+			n++
+		}
+	}
+	return n
+}
+
+// defaultShipmentRetryInterval is how often shipments that failed at
+// checkout are retried.
+const defaultShipmentRetryInterval = time.Minute
+
+// retryShipments hands over the shipments of placed orders that failed to
+// ship at checkout. The order is not locked while the shipping API is
+// called: the pending shipments are copied, shipped, and the ones handed
+// over are written back.
+func (cs *checkoutService) retryShipments(ctx context.Context) {
+	for _, r := range cs.orders.unshipped() {
+		r.mu.Lock()
+		orderID := r.order.GetOrderId()
+		if r.order.GetStatus() != pb.OrderStatus_ORDER_STATUS_PLACED {
+			r.mu.Unlock()
+			continue
+		}
+		address := proto.Clone(r.order.GetShippingAddress()).(*pb.Address)
+		var (
+			pending []*pb.Shipment
+			indexes []int
+		)
+		for i, s := range r.order.GetShipments() {
+			if s.GetTrackingId() == "" {
+				pending = append(pending, proto.Clone(s).(*pb.Shipment))
+				indexes = append(indexes, i)
+			}
+		}
+		r.mu.Unlock()
+
+		n, err := cs.shipAll(ctx, address, pending)
+		if err != nil {
+			log.Warnf("order %s: %v; retrying later", orderID, err)
+		}
+		if n == 0 {
+			continue
+		}
+
+		// The goods are with the carrier now, so their tracking IDs are
+		// kept even if the order moved on meanwhile.
+		r.mu.Lock()
+		if st := r.order.GetStatus(); st != pb.OrderStatus_ORDER_STATUS_PLACED {
+			log.Warnf("order %s became %s while %d pending shipments were handed over", orderID, st, n)
+		}
+		for j, s := range pending {
+			if s.GetTrackingId() != "" && r.order.Shipments[indexes[j]].GetTrackingId() == "" {
+				r.order.Shipments[indexes[j]] = s
+			}
+		}
+		r.mu.Unlock()
+		log.Infof("order %s: %d pending shipments handed over", orderID, n)
+	}
+}
+
+func (cs *checkoutService) runShipmentRetrier(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			cs.retryShipments(ctx)
+		}
+	}
+}
+
+// restockShipments puts items back into the warehouses they shipped from.
+// A product that shipped from several warehouses goes back to the first.
+func (cs *checkoutService) restockShipments(ctx context.Context, shipments []*pb.Shipment, items []*pb.CartItem) {
+	from := make(map[string]string)
+	for _, s := range shipments {
+		for _, it := range s.GetItems() {
+			if _, ok := from[it.GetProductId()]; !ok {
+				from[it.GetProductId()] = s.GetWarehouseId()
+			}
+		}
+	}
+	byWarehouse := make(map[string][]*pb.CartItem)
+	var warehouses []string
+	for _, it := range items {
+		w := from[it.GetProductId()]
+		if _, ok := byWarehouse[w]; !ok {
+			warehouses = append(warehouses, w)
+		}
+		byWarehouse[w] = append(byWarehouse[w], it)
+	}
+	for _, w := range warehouses {
+		cs.restock(ctx, w, byWarehouse[w])
+	}
+}
+
+// TrackOrder returns the tracking of each shipment of an order. Shipments
+// are tracked concurrently; if any cannot be, the call fails.
+func (cs *checkoutService) TrackOrder(ctx context.Context, req *pb.TrackOrderRequest) (*pb.TrackOrderResponse, error) {
+	r, err := cs.orders.get(req.GetOrderId(), req.GetUserId())
+	if err != nil {
+		return nil, err
+	}
+	var shipped []*pb.Shipment
+	for _, s := range r.snapshot().GetShipments() {
+		if s.GetTrackingId() != "" {
+			shipped = append(shipped, s)
+		}
+	}
+
+	out := make([]*pb.TrackShipmentResponse, len(shipped))
+	g, gctx := errgroup.WithContext(ctx)
+	for i, s := range shipped {
+		g.Go(func() error {
+			t, err := cs.trackShipment(gctx, s.GetTrackingId(), time.Unix(s.GetShippedAtUnix(), 0), s.GetEstimatedDeliveryDate())
+			if err != nil {
+				return fmt.Errorf("failed to track shipment %s: %+v", s.GetTrackingId(), err)
+			}
+			out[i] = t
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &pb.TrackOrderResponse{Shipments: out}, nil
+}
+
+// trackShipment asks the shipping API for the timeline of a shipment.
+// When the shipment was handed over and when it is expected are passed
+// along, so any instance of the function can simulate it.
+func (cs *checkoutService) trackShipment(ctx context.Context, trackingID string, shippedAt time.Time, estimatedDelivery string) (*pb.TrackShipmentResponse, error) {
+	params := url.Values{
+		"tracking_id":             {trackingID},
+		"shipped_at_unix":         {strconv.FormatInt(shippedAt.Unix(), 10)},
+		"estimated_delivery_date": {estimatedDelivery},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cs.shippingBaseURL+"/shipping/track?"+params.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCF tracking request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call GCF for tracking: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("GCF tracking returned %d: %s", resp.StatusCode, string(body))
+	}
+
+	var trackResp struct {
+		Status string `json:"status"`
+		Events []struct {
+			Status      string    `json:"status"`
+			Description string    `json:"description"`
+			Location    string    `json:"location"`
+			TimeUnix    jsonInt64 `json:"time_unix"`
+		} `json:"events"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&trackResp); err != nil {
+		return nil, fmt.Errorf("failed to parse GCF tracking response: %v", err)
+	}
+	out := &pb.TrackShipmentResponse{
+		TrackingId: trackingID,
+		Status:     pb.ShipmentStatus(pb.ShipmentStatus_value[trackResp.Status]),
+	}
+	for _, e := range trackResp.Events {
+		out.Events = append(out.Events, &pb.TrackingEvent{
+			Status:      pb.ShipmentStatus(pb.ShipmentStatus_value[e.Status]),
+			Description: e.Description,
+			Location:    e.Location,
+			TimeUnix:    int64(e.TimeUnix),
+		})
+	}
+	return out, nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+func TestPlaceOrderSplitsShipmentsByWarehouse(t *testing.T) {
+	ctx := context.Background()
+	cs, fakes := newTestCheckoutServiceWithBackends(t, 3)
+	fakes.payment.approve = true
+	fakes.catalog.warehouses = []string{"us-west", "us-east"}
+
+	resp, err := cs.PlaceOrder(ctx, placeOrderRequest("1600 Amphitheatre Pkwy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := resp.GetOrder()
+	shipments := order.GetShipments()
+	if len(shipments) != 2 || shipments[0].GetWarehouseId() != "us-west" || len(shipments[0].GetItems()) != 2 || len(shipments[1].GetItems()) != 1 {
+		t.Fatalf("got shipments %v, want two items from us-west and one from us-east", shipments)
+	}
+	if shipments[0].GetTrackingId() == "" || shipments[0].GetTrackingId() == shipments[1].GetTrackingId() {
+		t.Errorf("got tracking IDs %q and %q, want one per shipment", shipments[0].GetTrackingId(), shipments[1].GetTrackingId())
+	}
+	// Each shipment is quoted $8.99 by the fake shipping function.
+	if got := nanosOf(*order.GetShippingCost()); got != 2*8990000000 {
+		t.Errorf("got shipping cost %d nanos, want two quotes", got)
+	}
+	if len(fakes.catalog.reserved) != 1 || len(fakes.catalog.reserved[0].GetAllocations()) != 2 {
+		t.Errorf("got reservations %v, want the planned allocations reserved", fakes.catalog.reserved)
+	}
+
+	// The shipments are with the carrier, so the order can only be returned.
+	if _, err := cs.CancelOrder(ctx, &pb.CancelOrderRequest{OrderId: order.GetOrderId(), UserId: "u1"}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("cancelling a handed-over order: got %v, want FailedPrecondition", err)
+	}
+	if len(fakes.payment.refunds) != 0 || len(fakes.catalog.restocked) != 0 {
+		t.Fatalf("got refunds %v and restocked %v for a refused cancellation, want none", fakes.payment.refunds, fakes.catalog.restocked)
+	}
+	if err := deliverTestOrder(ctx, cs, order.GetOrderId()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.CreateReturn(ctx, &pb.CreateReturnRequest{OrderId: order.GetOrderId(), UserId: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fakes.catalog.restockedIn; len(got) != 2 || got[0] != "us-west" || got[1] != "us-east" {
+		t.Errorf("restocked into %v, want each warehouse the items shipped from", got)
+	}
+}
+
+func TestPlaceOrderKeepsPartlyShippedOrder(t *testing.T) {
+	ctx := context.Background()
+	cs, fakes := newTestCheckoutServiceWithBackends(t, 3)
+	fakes.payment.approve = true
+	fakes.catalog.warehouses = []string{"us-west", "us-east"}
+	fakes.shipping.refuse("P001")
+
+	resp, err := cs.PlaceOrder(ctx, placeOrderRequest("1600 Amphitheatre Pkwy"))
+	if err != nil {
+		t.Fatalf("got %v, want the order placed once a shipment has left", err)
+	}
+	shipments := resp.GetOrder().GetShipments()
+	if len(shipments) != 2 || shipments[0].GetTrackingId() == "" || shipments[1].GetTrackingId() != "" {
+		t.Fatalf("got shipments %v, want us-west shipped and us-east pending", shipments)
+	}
+	if len(fakes.catalog.committed) != 1 || len(fakes.catalog.released) != 0 {
+		t.Errorf("got committed %v and released %v, want the stock committed", fakes.catalog.committed, fakes.catalog.released)
+	}
+	if len(fakes.payment.captures) != 1 || len(fakes.payment.voids) != 0 {
+		t.Errorf("got %d captures and %d voids, want the card captured", len(fakes.payment.captures), len(fakes.payment.voids))
+	}
+
+	cs.retryShipments(ctx)
+	if got := cs.orders.unshipped(); len(got) != 1 {
+		t.Fatalf("got %d orders with pending shipments, want 1 while the carrier refuses", len(got))
+	}
+	// The order stays readable while the retry waits on the carrier.
+	fakes.shipping.refuse()
+	hold := make(chan struct{})
+	fakes.shipping.mu.Lock()
+	fakes.shipping.hold = hold
+	fakes.shipping.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		cs.retryShipments(ctx)
+		close(done)
+	}()
+	<-hold
+	if _, err := cs.GetOrder(ctx, &pb.GetOrderRequest{OrderId: resp.GetOrder().GetOrderId(), UserId: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	hold <- struct{}{}
+	<-done
+	order, err := cs.GetOrder(ctx, &pb.GetOrderRequest{OrderId: resp.GetOrder().GetOrderId(), UserId: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := order.GetShipments()[1]; got.GetTrackingId() == "" || got.GetCarrier() == "" || got.GetShippedAtUnix() == 0 {
+		t.Errorf("got shipment %v, want it handed over by the retry", got)
+	}
+	if got := cs.orders.unshipped(); len(got) != 0 {
+		t.Errorf("got %d orders with pending shipments, want none", len(got))
+	}
+}
+
+func TestPreviewOrderShipments(t *testing.T) {
+	cs, fakes := newTestCheckoutServiceWithBackends(t, 2)
+	fakes.catalog.warehouses = []string{"us-west", "us-east"}
+
+	resp, err := cs.PreviewOrder(context.Background(), &pb.PreviewOrderRequest{UserId: "u1", UserCurrency: "USD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetShipments()) != 2 {
+		t.Fatalf("got %d shipments, want 2", len(resp.GetShipments()))
+	}
+	for _, s := range resp.GetShipments() {
+		if s.GetTrackingId() != "" || s.GetShippingCost() == nil {
+			t.Errorf("got preview shipment %v, want a quote and no tracking ID", s)
+		}
+	}
+}
+
+func TestPreviewOrderShippingOptions(t *testing.T) {
+	cs, fakes := newTestCheckoutServiceWithBackends(t, 2)
+	fakes.catalog.warehouses = []string{"us-west", "us-east"}
+
+	resp, err := cs.PreviewOrder(context.Background(), &pb.PreviewOrderRequest{
+		UserId: "u1", UserCurrency: "USD", Address: &pb.Address{Country: "US"}, ServiceLevel: "express"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two shipments, each quoted $8.99 standard, $19.99 express and free
+	// pickup by the fake shipping function.
+	want := map[string]int64{"standard": 2 * 8990000000, "express": 2 * 19990000000, "pickup": 0}
+	if len(resp.GetShippingOptions()) != len(want) {
+		t.Fatalf("got options %v, want %d", resp.GetShippingOptions(), len(want))
+	}
+	for _, o := range resp.GetShippingOptions() {
+		if nanosOf(*o.GetCost()) != want[o.GetServiceLevel()] {
+			t.Errorf("got %s for %s, want %d nanos for both shipments", o.GetCost(), o.GetServiceLevel(), want[o.GetServiceLevel()])
+		}
+	}
+	if resp.GetServiceLevel() != "express" || nanosOf(*resp.GetShippingCost()) != want["express"] {
+		t.Errorf("got %s shipping %v, want express", resp.GetServiceLevel(), resp.GetShippingCost())
+	}
+	for _, s := range resp.GetShipments() {
+		if s.GetServiceLevel() != "express" || s.GetCarrier() != "UPS" || s.GetEarliestDeliveryDate() != "2024-04-01" || s.GetEstimatedDeliveryDate() != "2024-04-02" {
+			t.Errorf("got shipment %v, want it to go express with UPS", s)
+		}
+	}
+}
+
+func TestPlaceOrderServiceLevel(t *testing.T) {
+	ctx := context.Background()
+	cs, fakes := newTestCheckoutServiceWithBackends(t, 1)
+	fakes.payment.approve = true
+
+	req := placeOrderRequest("1600 Amphitheatre Pkwy")
+	req.ServiceLevel = "pickup"
+	resp, err := cs.PlaceOrder(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := resp.GetOrder().GetShipments()[0]; s.GetServiceLevel() != "pickup" || s.GetCarrier() != "carrier of pickup" {
+		t.Errorf("got shipment %v, want it handed over for pickup", s)
+	}
+
+	// Pickup is not offered outside the US.
+	req = placeOrderRequest("10 Downing St")
+	req.Address.Country = "GB"
+	req.ServiceLevel = "pickup"
+	if _, err := cs.PlaceOrder(ctx, req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v, want InvalidArgument for a service level not offered", err)
+	}
+}
+
+func TestTrackOrder(t *testing.T) {
+	ctx := context.Background()
+	cs, fakes := newTestCheckoutServiceWithBackends(t, 2)
+	fakes.payment.approve = true
+	fakes.catalog.warehouses = []string{"us-west", "us-east"}
+
+	resp, err := cs.PlaceOrder(ctx, placeOrderRequest("1600 Amphitheatre Pkwy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := resp.GetOrder()
+	// The second shipment left a day after the first, as after a retry.
+	r, err := cs.orders.get(order.GetOrderId(), "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.order.Shipments[1].ShippedAtUnix += 86400
+	order = r.snapshot()
+	tracking, err := cs.TrackOrder(ctx, &pb.TrackOrderRequest{OrderId: order.GetOrderId(), UserId: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracking.GetShipments()) != 2 {
+		t.Fatalf("got %d tracked shipments, want 2", len(tracking.GetShipments()))
+	}
+	for i, s := range tracking.GetShipments() {
+		if s.GetTrackingId() != order.GetShipments()[i].GetTrackingId() || s.GetStatus() != pb.ShipmentStatus_SHIPMENT_STATUS_DELIVERED || len(s.GetEvents()) != 2 {
+			t.Errorf("got tracking %v, want shipment %d delivered", s, i)
+			continue
+		}
+		if got, want := s.GetEvents()[0].GetTimeUnix(), order.GetShipments()[i].GetShippedAtUnix(); want == 0 || got != want {
+			t.Errorf("shipment %d: got a label created at %d, want its handover at %d", i, got, want)
+		}
+	}
+
+	if _, err := cs.TrackOrder(ctx, &pb.TrackOrderRequest{OrderId: order.GetOrderId(), UserId: "u2"}); status.Code(err) != codes.NotFound {
+		t.Errorf("got %v tracking another user's order, want NotFound", err)
+	}
+}
+
+func TestPlaceOrderShippingRules(t *testing.T) {
+	cs, fakes := newTestCheckoutServiceWithBackends(t, 1)
+	fakes.payment.approve = true
+
+	req := placeOrderRequest("1 Main St")
+	req.Address.Country = "KP"
+	_, err := cs.PlaceOrder(context.Background(), req)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("got %v, want FailedPrecondition", err)
+	}
+	var violations []*errdetails.PreconditionFailure_Violation
+	for _, d := range status.Convert(err).Details() {
+		if pf, ok := d.(*errdetails.PreconditionFailure); ok {
+			violations = pf.GetViolations()
+		}
+	}
+	if len(violations) != 1 || violations[0].GetType() != "BLOCKED_DESTINATION" || violations[0].GetSubject() != "address.country" {
+		t.Errorf("got violations %v, want the blocked country", violations)
+	}
+	if len(fakes.payment.captures) != 0 {
+		t.Errorf("got %d captures, want none for an order that cannot ship", len(fakes.payment.captures))
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+	money "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/money"
+)
+
+const (
+	defaultTaxFile = "taxes.json"
+
+	taxExclusive = "exclusive"
+	taxInclusive = "inclusive"
+
+	ppmPerPercent = 10000
+	ppmWhole      = 100 * ppmPerPercent
+)
+
+// taxRate is one row of the rate table. A rate applies to every address in
+// its country, narrowed down by state and zip code range when those are set.
+// All matching rates are charged, so state and local taxes stack.
+type taxRate struct {
+	Name    string  `json:"name"`
+	Country string  `json:"country"`
+	State   string  `json:"state,omitempty"`
+	ZipFrom int32   `json:"zip_from,omitempty"`
+	ZipTo   int32   `json:"zip_to,omitempty"`
+	Rate    float64 `json:"rate"` // percent
+	// Mode is "exclusive" (tax is added on top of prices) or "inclusive"
+	// (prices already contain the tax). Defaults to the table's mode.
+	Mode        string `json:"mode,omitempty"`
+	TaxShipping bool   `json:"tax_shipping,omitempty"`
+}
+
+func (r *taxRate) matches(country string, addr *pb.Address) bool {
+	if r.Country != country {
+		return false
+	}
+	if r.State != "" && !strings.EqualFold(r.State, strings.TrimSpace(addr.GetState())) {
+		return false
+	}
+	if r.ZipFrom != 0 && addr.GetZipCode() < r.ZipFrom {
+		return false
+	}
+	if r.ZipTo != 0 && addr.GetZipCode() > r.ZipTo {
+		return false
+	}
+	return true
+}
+
+func (r *taxRate) ppm() int64 { return int64(math.Round(r.Rate * ppmPerPercent)) }
+
+// taxTable computes sales tax or VAT for a destination address.
+type taxTable struct {
+	// countries maps lower-cased country names to the codes used in rates.
+	countries map[string]string
+	rates     []*taxRate
+}
+
+type taxConfig struct {
+	Mode      string            `json:"mode"`
+	Countries map[string]string `json:"countries"`
+	Rates     []*taxRate        `json:"rates"`
+}
+
+func newTaxTable(cfg taxConfig) (*taxTable, error) {
+	if cfg.Mode == "" {
+		cfg.Mode = taxExclusive
+	}
+	t := &taxTable{countries: make(map[string]string)}
+	for name, code := range cfg.Countries {
+		t.countries[strings.ToLower(name)] = strings.ToUpper(code)
+	}
+	for _, r := range cfg.Rates {
+		if r.Mode == "" {
+			r.Mode = cfg.Mode
+		}
+		if r.Mode != taxExclusive && r.Mode != taxInclusive {
+			return nil, fmt.Errorf("tax rate %q: unknown mode %q", r.Name, r.Mode)
+		}
+		if r.Country == "" {
+			return nil, fmt.Errorf("tax rate %q: country is required", r.Name)
+		}
+		if r.Rate < 0 || r.Rate > 100 {
+			return nil, fmt.Errorf("tax rate %q: rate must be in [0, 100]", r.Name)
+		}
+		r.Country = strings.ToUpper(r.Country)
+		t.rates = append(t.rates, r)
+	}
+	return t, nil
+}
+
+// loadTaxTable reads the rate table from TAX_CONFIG, falling back to
+// taxes.json next to the binary. A missing default file means no tax.
+func loadTaxTable() (*taxTable, error) {
+	path := os.Getenv("TAX_CONFIG")
+	explicit := path != ""
+	if !explicit {
+		path = defaultTaxFile
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		log.Info("no tax rates configured")
+		return newTaxTable(taxConfig{})
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read tax file: %v", err)
+	}
+	var cfg taxConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse tax file %s: %v", path, err)
+	}
+	log.Infof("loaded %d tax rates from %s", len(cfg.Rates), path)
+	return newTaxTable(cfg)
+}
+
+// country resolves the free-form country of an address to a country code.
+func (t *taxTable) country(addr *pb.Address) string {
+	c := strings.TrimSpace(addr.GetCountry())
+	if code, ok := t.countries[strings.ToLower(c)]; ok {
+		return code
+	}
+	return strings.ToUpper(c)
+}
+
+// taxLines returns one line per rate that applies to the address. Item
+// discounts reduce the taxable amount of items and shipping discounts that of
+// shipping. It returns nil on a nil table or when the address is unknown.
+func (t *taxTable) taxLines(addr *pb.Address, prep orderPrep, userCurrency string) []*pb.TaxLine {
+	if t == nil || addr == nil || addr.GetCountry() == "" {
+		return nil
+	}
+	itemBase := prep.subtotal(userCurrency)
+	shippingBase := pb.Money{CurrencyCode: userCurrency}
+	if prep.shippingCostLocalized != nil {
+		shippingBase = *prep.shippingCostLocalized
+	}
+	for _, d := range prep.discounts {
+		if d.GetShipping() {
+			shippingBase = money.Must(money.Subtract(shippingBase, *d.GetAmount()))
+		} else {
+			itemBase = money.Must(money.Subtract(itemBase, *d.GetAmount()))
+		}
+	}
+	itemBase, shippingBase = nonNegative(itemBase), nonNegative(shippingBase)
+
+	country := t.country(addr)
+	var matched []*taxRate
+	// Inclusive rates are backed out of prices together: with rates r1 and
+	// r2 in a price p, tax i is p*ri/(1+r1+r2).
+	var itemInclusive, shippingInclusive int64
+	for _, r := range t.rates {
+		if !r.matches(country, addr) {
+			continue
+		}
+		matched = append(matched, r)
+		if r.Mode == taxInclusive {
+			itemInclusive += r.ppm()
+			if r.TaxShipping {
+				shippingInclusive += r.ppm()
+			}
+		}
+	}
+
+	var out []*pb.TaxLine
+	for _, r := range matched {
+		itemDen, shippingDen := int64(ppmWhole), int64(ppmWhole)
+		if r.Mode == taxInclusive {
+			itemDen += itemInclusive
+			shippingDen += shippingInclusive
+		}
+		amount := money.MultiplyRatio(itemBase, r.ppm(), itemDen)
+		if r.TaxShipping {
+			amount = money.Must(money.Sum(amount, money.MultiplyRatio(shippingBase, r.ppm(), shippingDen)))
+		}
+		amount = money.RoundTo(amount, nanosPerCent)
+		out = append(out, &pb.TaxLine{
+			Name:     r.Name,
+			Rate:     r.Rate,
+			Amount:   &amount,
+			Included: r.Mode == taxInclusive,
+		})
+	}
+	return out
+}
+
+func nonNegative(m pb.Money) pb.Money {
+	if money.IsNegative(m) {
+		return pb.Money{CurrencyCode: m.GetCurrencyCode()}
+	}
+	return m
+}
@@ -0,0 +1,124 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+func testTaxTable(t *testing.T) *taxTable {
+	t.Helper()
+	table, err := newTaxTable(taxConfig{
+		Countries: map[string]string{"United States": "US", "Germany": "DE"},
+		Rates: []*taxRate{
+			{Name: "CA", Country: "US", State: "CA", Rate: 7.25},
+			{Name: "Santa Clara", Country: "US", State: "CA", ZipFrom: 94022, ZipTo: 95196, Rate: 1.875},
+			{Name: "NY", Country: "us", State: "NY", Rate: 4, TaxShipping: true},
+			{Name: "VAT", Country: "DE", Rate: 19, Mode: taxInclusive, TaxShipping: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+func TestTaxLines(t *testing.T) {
+	type line struct {
+		name     string
+		units    int64
+		nanos    int32
+		included bool
+	}
+	tests := []struct {
+		name      string
+		addr      *pb.Address
+		discounts []*pb.Discount
+		want      []line
+	}{
+		{"state and district rates stack",
+			&pb.Address{Country: "United States", State: "ca", ZipCode: 94043}, nil,
+			[]line{{"CA", 3, 630000000, false}, {"Santa Clara", 0, 940000000, false}}},
+		{"outside district",
+			&pb.Address{Country: "US", State: "CA", ZipCode: 90210}, nil,
+			[]line{{"CA", 3, 630000000, false}}},
+		{"shipping taxed",
+			&pb.Address{Country: "US", State: "NY", ZipCode: 10004}, nil,
+			[]line{{"NY", 2, 360000000, false}}},
+		{"item discount lowers taxable amount",
+			&pb.Address{Country: "US", State: "NY"}, []*pb.Discount{{Amount: usd(10, 0)}},
+			[]line{{"NY", 1, 960000000, false}}},
+		{"free shipping is not taxed",
+			&pb.Address{Country: "US", State: "NY"}, []*pb.Discount{{Amount: usd(8, 990000000), Shipping: true}},
+			[]line{{"NY", 2, 0, false}}},
+		{"inclusive VAT",
+			&pb.Address{Country: "Germany"}, nil,
+			[]line{{"VAT", 9, 420000000, true}}},
+		{"no matching rate", &pb.Address{Country: "FR"}, nil, nil},
+		{"no address", nil, nil, nil},
+	}
+	table := testTaxTable(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prep := testPrep()
+			prep.discounts = tt.discounts
+			got := table.taxLines(tt.addr, prep, "USD")
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d tax lines, want %d: %v", len(got), len(tt.want), got)
+			}
+			for i, w := range tt.want {
+				g := got[i]
+				if g.GetName() != w.name || g.GetAmount().GetUnits() != w.units || g.GetAmount().GetNanos() != w.nanos || g.GetIncluded() != w.included {
+					t.Errorf("line %d: got %s %d.%09d included=%v, want %s %d.%09d included=%v", i,
+						g.GetName(), g.GetAmount().GetUnits(), g.GetAmount().GetNanos(), g.GetIncluded(),
+						w.name, w.units, w.nanos, w.included)
+				}
+			}
+		})
+	}
+}
+
+func TestTotalsWithTax(t *testing.T) {
+	table := testTaxTable(t)
+	for _, tt := range []struct {
+		country, state string
+		units          int64
+		nanos          int32
+	}{
+		{"US", "NY", 61, 350000000},    // 50.00 + 8.99 + 2.36 tax
+		{"Germany", "", 58, 990000000}, // VAT already in prices
+	} {
+		prep := testPrep()
+		prep.taxLines = table.taxLines(&pb.Address{Country: tt.country, State: tt.state}, prep, "USD")
+		_, total := prep.totals("USD")
+		if total.GetUnits() != tt.units || total.GetNanos() != tt.nanos {
+			t.Errorf("%s: got total %d.%09d, want %d.%09d", tt.country, total.GetUnits(), total.GetNanos(), tt.units, tt.nanos)
+		}
+	}
+}
+
+func TestNewTaxTableRejectsInvalidRates(t *testing.T) {
+	for _, r := range []*taxRate{
+		{Name: "no country", Rate: 5},
+		{Name: "negative", Country: "US", Rate: -1},
+		{Name: "bad mode", Country: "US", Rate: 5, Mode: "sometimes"},
+	} {
+		if _, err := newTaxTable(taxConfig{Rates: []*taxRate{r}}); err == nil {
+			t.Errorf("expected rate %q to be rejected", r.Name)
+		}
+	}
+}
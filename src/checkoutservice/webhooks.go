@@ -0,0 +1,391 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+const (
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookIDHeader        = "X-Webhook-Id"
+
+	defaultWebhookMaxAttempts = 5
+	defaultWebhookBackoff     = time.Second
+	maxWebhookDeliveryLog     = 500
+)
+
+// Order lifecycle events delivered to merchant webhooks.
+const (
+	eventOrderPlaced    = "order.placed"
+	eventOrderShipped   = "order.shipped"
+	eventOrderDelivered = "order.delivered"
+	eventOrderCancelled = "order.cancelled"
+	eventOrderReturned  = "order.returned"
+)
+
+var (
+	errWebhookSecretRequired = errors.New("webhook endpoint needs a signing secret")
+	errWebhookInFlight       = errors.New("webhook delivery is still in flight")
+)
+
+// webhookEndpoint is a merchant URL registered to receive order events.
+type webhookEndpoint struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"`
+	Events []string `json:"events,omitempty"` // empty means all events
+}
+
+func (e *webhookEndpoint) wants(event string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, ev := range e.Events {
+		if ev == event {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookDelivery records a single event sent (or being sent) to an endpoint.
+type webhookDelivery struct {
+	ID         string    `json:"id"`
+	EndpointID string    `json:"endpoint_id"`
+	Event      string    `json:"event"`
+	Payload    []byte    `json:"-"`
+	Attempts   int       `json:"attempts"`
+	Status     string    `json:"status"` // pending, delivered or failed
+	LastCode   int       `json:"last_status_code,omitempty"`
+	LastError  string    `json:"last_error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// webhookDispatcher signs order events with HMAC-SHA256 and delivers them to
+// every registered endpoint, retrying with exponential backoff. It keeps a
+// bounded in-memory log of deliveries so they can be inspected and replayed.
+type webhookDispatcher struct {
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+
+	mu         sync.Mutex
+	endpoints  map[string]*webhookEndpoint
+	deliveries []*webhookDelivery
+	byID       map[string]*webhookDelivery
+}
+
+func newWebhookDispatcher() *webhookDispatcher {
+	return &webhookDispatcher{
+		client:      &http.Client{Timeout: 10 * time.Second},
+		maxAttempts: defaultWebhookMaxAttempts,
+		backoff:     defaultWebhookBackoff,
+		endpoints:   make(map[string]*webhookEndpoint),
+		byID:        make(map[string]*webhookDelivery),
+	}
+}
+
+// webhookDispatcherFromEnv builds a dispatcher with endpoints listed in
+// WEBHOOK_URLS (comma separated), all signed with WEBHOOK_SECRET. Without a
+// secret the URLs are not registered, since receivers could not verify them.
+func webhookDispatcherFromEnv() *webhookDispatcher {
+	d := newWebhookDispatcher()
+	if v := os.Getenv("WEBHOOK_MAX_ATTEMPTS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			d.maxAttempts = n
+		} else {
+			log.Warnf("ignoring invalid WEBHOOK_MAX_ATTEMPTS %q", v)
+		}
+	}
+	secret := os.Getenv("WEBHOOK_SECRET")
+	for _, u := range strings.Split(os.Getenv("WEBHOOK_URLS"), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			if _, err := d.register(&webhookEndpoint{URL: u, Secret: secret}); err != nil {
+				log.Warnf("not registering webhook endpoint %s: set WEBHOOK_SECRET", u)
+			}
+		}
+	}
+	return d
+}
+
+// register adds an endpoint, assigning it an ID unless it has one. Endpoints
+// without a secret are refused.
+func (d *webhookDispatcher) register(e *webhookEndpoint) (*webhookEndpoint, error) {
+	if e.Secret == "" {
+		return nil, errWebhookSecretRequired
+	}
+	if e.ID == "" {
+		e.ID = uuid.NewString()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.endpoints[e.ID] = e
+	log.Infof("registered webhook endpoint %s (%s)", e.ID, e.URL)
+	return e, nil
+}
+
+func (d *webhookDispatcher) unregister(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.endpoints[id]
+	delete(d.endpoints, id)
+	return ok
+}
+
+func (d *webhookDispatcher) listEndpoints() []webhookEndpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]webhookEndpoint, 0, len(d.endpoints))
+	for _, e := range d.endpoints {
+		v := *e
+		v.Secret = ""
+		out = append(out, v)
+	}
+	return out
+}
+
+func (d *webhookDispatcher) listDeliveries() []webhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]webhookDelivery, len(d.deliveries))
+	for i, dl := range d.deliveries {
+		out[i] = *dl
+	}
+	return out
+}
+
+// publish fans an order event out to every interested endpoint. Deliveries
+// run in the background so PlaceOrder never waits on a merchant.
+func (d *webhookDispatcher) publish(event string, order *pb.OrderResult) {
+	if d == nil {
+		return
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":         uuid.NewString(),
+		"type":       event,
+		"created_at": time.Now().UTC().Format(time.RFC3339Nano),
+		"data":       map[string]interface{}{"order": orderPayload(order)},
+	})
+	if err != nil {
+		log.Warnf("failed to marshal %s webhook payload: %v", event, err)
+		return
+	}
+
+	d.mu.Lock()
+	var targets []*webhookDelivery
+	for _, e := range d.endpoints {
+		if !e.wants(event) {
+			continue
+		}
+		dl := &webhookDelivery{
+			ID:         uuid.NewString(),
+			EndpointID: e.ID,
+			Event:      event,
+			Payload:    payload,
+			Status:     "pending",
+			CreatedAt:  time.Now(),
+		}
+		d.record(dl)
+		targets = append(targets, dl)
+	}
+	d.mu.Unlock()
+
+	for _, dl := range targets {
+		go d.deliver(dl)
+	}
+}
+
+// replay re-sends a previously logged delivery with a fresh set of attempts.
+// A delivery still pending is refused, so one event is never sent twice at once.
+func (d *webhookDispatcher) replay(id string) error {
+	d.mu.Lock()
+	dl, ok := d.byID[id]
+	if !ok {
+		d.mu.Unlock()
+		return fmt.Errorf("no webhook delivery with ID %s", id)
+	}
+	if _, ok := d.endpoints[dl.EndpointID]; !ok {
+		d.mu.Unlock()
+		return fmt.Errorf("webhook endpoint %s is no longer registered", dl.EndpointID)
+	}
+	if dl.Status == "pending" {
+		d.mu.Unlock()
+		return errWebhookInFlight
+	}
+	dl.Status = "pending"
+	dl.Attempts = 0
+	d.mu.Unlock()
+
+	go d.deliver(dl)
+	return nil
+}
+
+// record appends to the delivery log, evicting the oldest entry when full.
+// Callers must hold d.mu.
+func (d *webhookDispatcher) record(dl *webhookDelivery) {
+	if len(d.deliveries) >= maxWebhookDeliveryLog {
+		delete(d.byID, d.deliveries[0].ID)
+		d.deliveries = d.deliveries[1:]
+	}
+	d.deliveries = append(d.deliveries, dl)
+	d.byID[dl.ID] = dl
+}
+
+func (d *webhookDispatcher) deliver(dl *webhookDelivery) {
+	for attempt := 1; attempt <= d.maxAttempts; attempt++ {
+		d.mu.Lock()
+		e, ok := d.endpoints[dl.EndpointID]
+		d.mu.Unlock()
+		if !ok {
+			d.finish(dl, attempt-1, 0, fmt.Errorf("endpoint unregistered"), "failed")
+			return
+		}
+
+		code, err := d.send(e, dl)
+		if err == nil {
+			d.finish(dl, attempt, code, nil, "delivered")
+			return
+		}
+		status := "pending"
+		if attempt == d.maxAttempts {
+			status = "failed"
+		}
+		d.finish(dl, attempt, code, err, status)
+		log.Warnf("webhook delivery %s to %s failed (attempt %d/%d): %v", dl.ID, e.URL, attempt, d.maxAttempts, err)
+		if attempt < d.maxAttempts {
+			time.Sleep(d.backoff * time.Duration(1<<(attempt-1)))
+		}
+	}
+}
+
+func (d *webhookDispatcher) send(e *webhookEndpoint, dl *webhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, e.URL, bytes.NewReader(dl.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, dl.Event)
+	req.Header.Set(webhookIDHeader, dl.ID)
+	req.Header.Set(webhookSignatureHeader, signWebhook(e.Secret, time.Now(), dl.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint returned %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func (d *webhookDispatcher) finish(dl *webhookDelivery, attempts, code int, err error, status string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dl.Attempts = attempts
+	dl.LastCode = code
+	dl.Status = status
+	dl.LastError = ""
+	if err != nil {
+		dl.LastError = err.Error()
+	}
+	dl.UpdatedAt = time.Now()
+}
+
+// signWebhook returns the signature header value "t=<unix>,v1=<hex>", where
+// v1 is HMAC-SHA256(secret, "<unix>.<body>"). Including the timestamp lets
+// receivers reject replayed requests.
+func signWebhook(secret string, ts time.Time, body []byte) string {
+	t := strconv.FormatInt(ts.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%s,v1=%s", t, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// serveWebhookAdmin exposes endpoint registration, the delivery log and
+// replay over HTTP for operators.
+func (d *webhookDispatcher) serveWebhookAdmin(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /webhooks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.listEndpoints())
+	})
+	mux.HandleFunc("POST /webhooks", func(w http.ResponseWriter, r *http.Request) {
+		var e webhookEndpoint
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil || e.URL == "" || e.Secret == "" {
+			http.Error(w, "invalid webhook endpoint: url and secret are required", http.StatusBadRequest)
+			return
+		}
+		e.ID = ""
+		registered, err := d.register(&e)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, registered)
+	})
+	mux.HandleFunc("DELETE /webhooks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !d.unregister(r.PathValue("id")) {
+			http.Error(w, "webhook endpoint not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /webhooks/deliveries", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.listDeliveries())
+	})
+	mux.HandleFunc("POST /webhooks/deliveries/{id}/replay", func(w http.ResponseWriter, r *http.Request) {
+		switch err := d.replay(r.PathValue("id")); {
+		case errors.Is(err, errWebhookInFlight):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	log.Infof("webhook admin listening on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("failed to encode response: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+func testOrder() *pb.OrderResult {
+	return &pb.OrderResult{
+		OrderId:         "order-1",
+		ShippingCost:    &pb.Money{CurrencyCode: "USD", Units: 8, Nanos: 990000000},
+		ShippingAddress: &pb.Address{StreetAddress: "1600 Amphitheatre Parkway", City: "Mountain View", Country: "US", ZipCode: 94043},
+		Items: []*pb.OrderItem{{
+			Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 2},
+			Cost: &pb.Money{CurrencyCode: "USD", Units: 19, Nanos: 990000000},
+		}},
+		Shipments: []*pb.Shipment{{
+			WarehouseId:  "us-west",
+			Items:        []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}},
+			ShippingCost: &pb.Money{CurrencyCode: "USD", Units: 8, Nanos: 990000000},
+			TrackingId:   "AB-123-456",
+		}},
+	}
+}
+
+func waitForStatus(t *testing.T, d *webhookDispatcher, want string) webhookDelivery {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if dls := d.listDeliveries(); len(dls) == 1 && dls[0].Status == want {
+			return dls[0]
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("delivery never reached status %q: %+v", want, d.listDeliveries())
+	return webhookDelivery{}
+}
+
+func TestWebhookSignedDelivery(t *testing.T) {
+	const secret = "s3cret"
+	got := make(chan *http.Request, 1)
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		got <- r
+	}))
+	defer srv.Close()
+
+	d := newWebhookDispatcher()
+	if _, err := d.register(&webhookEndpoint{URL: srv.URL, Secret: secret}); err != nil {
+		t.Fatal(err)
+	}
+	d.publish(eventOrderPlaced, testOrder())
+
+	r := <-got
+	if ev := r.Header.Get(webhookEventHeader); ev != eventOrderPlaced {
+		t.Errorf("got event %q, want %q", ev, eventOrderPlaced)
+	}
+	sig := r.Header.Get(webhookSignatureHeader)
+	ts := strings.TrimPrefix(strings.Split(sig, ",")[0], "t=")
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		t.Fatalf("malformed signature header %q", sig)
+	}
+	if want := signWebhook(secret, time.Unix(unix, 0), body); sig != want {
+		t.Errorf("got signature %q, want %q", sig, want)
+	}
+
+	var payload struct {
+		Type string `json:"type"`
+		Data struct {
+			Order map[string]interface{} `json:"order"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := payload.Data.Order["order_id"], "order-1"; got != want {
+		t.Errorf("got order_id %v, want %v", got, want)
+	}
+	waitForStatus(t, d, "delivered")
+}
+
+func TestWebhookRetryAndReplay(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	d := newWebhookDispatcher()
+	d.backoff = time.Millisecond
+	d.maxAttempts = 2
+	d.register(&webhookEndpoint{URL: srv.URL, Secret: "s3cret"})
+	d.publish(eventOrderPlaced, testOrder())
+
+	dl := waitForStatus(t, d, "failed")
+	if dl.Attempts != 2 || dl.LastCode != http.StatusServiceUnavailable {
+		t.Errorf("got %d attempts (last code %d), want 2 (503)", dl.Attempts, dl.LastCode)
+	}
+
+	if err := d.replay(dl.ID); err != nil {
+		t.Fatal(err)
+	}
+	dl = waitForStatus(t, d, "delivered")
+	if dl.Attempts != 2 {
+		t.Errorf("got %d replay attempts, want 2", dl.Attempts)
+	}
+	if err := d.replay("missing"); err == nil {
+		t.Error("expected error replaying unknown delivery")
+	}
+}
+
+func TestWebhookRequiresSecret(t *testing.T) {
+	d := newWebhookDispatcher()
+	if _, err := d.register(&webhookEndpoint{URL: "http://example.com"}); err != errWebhookSecretRequired {
+		t.Errorf("got %v registering an endpoint without a secret, want %v", err, errWebhookSecretRequired)
+	}
+	if n := len(d.listEndpoints()); n != 0 {
+		t.Errorf("got %d endpoints, want none", n)
+	}
+}
+
+func TestWebhookReplayInFlight(t *testing.T) {
+	release := make(chan struct{})
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+	}))
+	defer srv.Close()
+
+	d := newWebhookDispatcher()
+	d.register(&webhookEndpoint{URL: srv.URL, Secret: "s3cret"})
+	d.publish(eventOrderPlaced, testOrder())
+
+	dl := d.listDeliveries()[0]
+	if err := d.replay(dl.ID); err != errWebhookInFlight {
+		t.Errorf("got %v replaying a pending delivery, want %v", err, errWebhookInFlight)
+	}
+	close(release)
+	waitForStatus(t, d, "delivered")
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -31,6 +32,9 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
 	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
@@ -50,10 +54,25 @@ var (
 				Funcs(template.FuncMap{
 			"renderMoney":        renderMoney,
 			"renderCurrencyLogo": renderCurrencyLogo,
+			"renderOrderStatus":  renderOrderStatus,
+
+			"renderShipmentStatus": renderShipmentStatus,
+			"renderTrackingTime":   renderTrackingTime,
+			"renderDeliveryWindow": renderDeliveryWindow,
 		}).ParseGlob("templates/*.html"))
 	plat platformDetails
 )
 
+// defaultShippingAddress prefills the checkout form. The cart page estimates
+// shipping and tax for it until the shopper enters their own address.
+var defaultShippingAddress = &pb.Address{
+	StreetAddress: "1600 Amphitheatre Parkway",
+	City:          "Mountain View",
+	State:         "CA",
+	Country:       "United States",
+	ZipCode:       94043,
+}
+
 var validEnvs = []string{"local", "gcp", "azure", "aws", "onprem", "alibaba"}
 
 func (fe *frontendServer) homeHandler(w http.ResponseWriter, r *http.Request) {
@@ -227,6 +246,11 @@ func (fe *frontendServer) addToCartHandler(w http.ResponseWriter, r *http.Reques
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve product"), http.StatusInternalServerError)
 		return
 	}
+	// A negative stock means the catalog does not track the product.
+	if p.GetStock() == 0 {
+		renderHTTPError(log, r, w, errors.Errorf("%s is out of stock", p.GetName()), http.StatusConflict)
+		return
+	}
 
 	if err := fe.insertCart(r.Context(), sessionID(r), p.GetId(), int32(payload.Quantity)); err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "failed to add to cart"), http.StatusInternalServerError)
@@ -249,6 +273,57 @@ func (fe *frontendServer) emptyCartHandler(w http.ResponseWriter, r *http.Reques
 }
 
 func (fe *frontendServer) viewCartHandler(w http.ResponseWriter, r *http.Request) {
+	fe.renderCart(w, r, checkoutForm{address: shippingAddress(r)})
+}
+
+// checkoutForm is what the checkout form of the cart page is filled with:
+// the address and, after an order that could not ship, the shipping rules
+// it broke.
+type checkoutForm struct {
+	email      string
+	address    *pb.Address
+	violations []shippingViolation
+}
+
+// shippingViolation is a shipping rule an order breaks. Field is the
+// checkout form field at fault, or empty when Product is.
+type shippingViolation struct {
+	Field       string
+	Product     string
+	Description string
+}
+
+// shippingViolations returns the shipping rules a failed order broke, from
+// the PreconditionFailure details of its error.
+func (fe *frontendServer) shippingViolations(ctx context.Context, err error) []shippingViolation {
+	if status.Code(err) != codes.FailedPrecondition {
+		return nil
+	}
+	var out []shippingViolation
+	for _, d := range status.Convert(err).Details() {
+		pf, ok := d.(*errdetails.PreconditionFailure)
+		if !ok {
+			continue
+		}
+		for _, v := range pf.GetViolations() {
+			sv := shippingViolation{Description: v.GetDescription()}
+			if field, ok := strings.CutPrefix(v.GetSubject(), "address."); ok {
+				sv.Field = field
+			} else if id, ok := strings.CutPrefix(v.GetSubject(), "items/"); ok {
+				sv.Product = id
+				if p, err := fe.getProduct(ctx, id); err == nil {
+					sv.Product = p.GetName()
+				}
+			}
+			out = append(out, sv)
+		}
+	}
+	return out
+}
+
+// renderCart shows the cart with its checkout form. A form with violations
+// is answered with 422 so the failed order is not mistaken for success.
+func (fe *frontendServer) renderCart(w http.ResponseWriter, r *http.Request, form checkoutForm) {
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	log.Debug("view user cart")
 	currencies, err := fe.getCurrencies(r.Context())
@@ -268,9 +343,24 @@ func (fe *frontendServer) viewCartHandler(w http.ResponseWriter, r *http.Request
 		log.WithField("error", err).Warn("failed to get product recommendations")
 	}
 
-	shippingCost, err := fe.getShippingQuote(r.Context(), cart, currentCurrency(r))
+	preview, err := fe.previewOrder(r.Context(), sessionID(r), currentCurrency(r), form.address, couponCodes(r), serviceLevel(r))
+	if status.Code(err) == codes.InvalidArgument && serviceLevel(r) != "" {
+		// The chosen service level is no longer offered; fall back to the
+		// default rather than failing the page.
+		log.WithField("error", err).Warn("chosen service level is not available")
+		preview, err = fe.previewOrder(r.Context(), sessionID(r), currentCurrency(r), form.address, couponCodes(r), "")
+	}
+	rejected := len(form.violations) > 0
+	if violations := fe.shippingViolations(r.Context(), err); len(violations) > 0 {
+		// Nothing can ship to this address, so there is no shipping or tax
+		// to show for it; list the items at their own prices instead.
+		if !rejected {
+			form.violations = violations
+		}
+		preview, err = fe.unpricedPreview(r, cart)
+	}
 	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "failed to get shipping quote"), http.StatusInternalServerError)
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to price the cart"), http.StatusInternalServerError)
 		return
 	}
 
@@ -279,44 +369,77 @@ func (fe *frontendServer) viewCartHandler(w http.ResponseWriter, r *http.Request
 		Quantity int32
 		Price    *pb.Money
 	}
-	items := make([]cartItemView, len(cart))
-	totalPrice := pb.Money{CurrencyCode: currentCurrency(r)}
-	for i, item := range cart {
-		p, err := fe.getProduct(r.Context(), item.GetProductId())
-		if err != nil {
-			renderHTTPError(log, r, w, errors.Wrapf(err, "could not retrieve product #%s", item.GetProductId()), http.StatusInternalServerError)
-			return
-		}
-		price, err := fe.convertCurrency(r.Context(), p.GetPriceUsd(), currentCurrency(r))
+	items := make([]cartItemView, len(preview.GetItems()))
+	for i, item := range preview.GetItems() {
+		p, err := fe.getProduct(r.Context(), item.GetItem().GetProductId())
 		if err != nil {
-			renderHTTPError(log, r, w, errors.Wrapf(err, "could not convert currency for product #%s", item.GetProductId()), http.StatusInternalServerError)
+			renderHTTPError(log, r, w, errors.Wrapf(err, "could not retrieve product #%s", item.GetItem().GetProductId()), http.StatusInternalServerError)
 			return
 		}
 
-		multPrice := money.MultiplySlow(*price, uint32(item.GetQuantity()))
+		multPrice := money.MultiplySlow(*item.GetCost(), uint32(item.GetItem().GetQuantity()))
 		items[i] = cartItemView{
 			Item:     p,
-			Quantity: item.GetQuantity(),
+			Quantity: item.GetItem().GetQuantity(),
 			Price:    &multPrice}
-		totalPrice = money.Must(money.Sum(totalPrice, multPrice))
 	}
-	totalPrice = money.Must(money.Sum(totalPrice, *shippingCost))
+	// Store credit is only offered when there is some; failing to look it
+	// up just hides the option.
+	storeCredit, err := fe.getStoreCredit(r.Context(), sessionID(r), currentCurrency(r))
+	if err != nil {
+		log.WithField("error", err).Warn("failed to get store credit")
+	}
+	if storeCredit != nil && !money.IsPositive(*storeCredit) {
+		storeCredit = nil
+	}
 	year := time.Now().Year()
 
+	if rejected {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
 	if err := templates.ExecuteTemplate(w, "cart", injectCommonTemplateData(r, map[string]interface{}{
 		"currencies":       currencies,
 		"recommendations":  recommendations,
 		"cart_size":        cartSize(cart),
-		"shipping_cost":    shippingCost,
+		"shipping_cost":    preview.GetShippingCost(),
+		"shipments":        preview.GetShipments(),
+		"shipping_options": preview.GetShippingOptions(),
+		"service_level":    preview.GetServiceLevel(),
 		"show_currency":    true,
-		"total_cost":       totalPrice,
+		"total_cost":       preview.GetTotal(),
+		"discounts":        preview.GetDiscounts(),
+		"tax_lines":        preview.GetTaxLines(),
+		"address":          form.address,
+		"email":            form.email,
+		"shipping_errors":  form.violations,
+		"rejected_coupons": preview.GetRejectedCouponCodes(),
+		"coupon_code":      strings.Join(couponCodes(r), ","),
 		"items":            items,
 		"expiration_years": []int{year, year + 1, year + 2, year + 3, year + 4},
+		"store_credit":     storeCredit,
 	})); err != nil {
 		log.Println(err)
 	}
 }
 
+// unpricedPreview lists the cart's items at their catalog prices in the
+// user's currency, for a cart that cannot be priced for its address.
+func (fe *frontendServer) unpricedPreview(r *http.Request, cart []*pb.CartItem) (*pb.PreviewOrderResponse, error) {
+	preview := &pb.PreviewOrderResponse{}
+	for _, item := range cart {
+		p, err := fe.getProduct(r.Context(), item.GetProductId())
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not retrieve product #%s", item.GetProductId())
+		}
+		price, err := fe.convertCurrency(r.Context(), p.GetPriceUsd(), currentCurrency(r))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to do currency conversion for product %s", p.GetId())
+		}
+		preview.Items = append(preview.Items, &pb.OrderItem{Item: item, Cost: price})
+	}
+	return preview, nil
+}
+
 func (fe *frontendServer) placeOrderHandler(w http.ResponseWriter, r *http.Request) {
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	log.Debug("placing order")
@@ -332,6 +455,9 @@ func (fe *frontendServer) placeOrderHandler(w http.ResponseWriter, r *http.Reque
 		ccMonth, _    = strconv.ParseInt(r.FormValue("credit_card_expiration_month"), 10, 32)
 		ccYear, _     = strconv.ParseInt(r.FormValue("credit_card_expiration_year"), 10, 32)
 		ccCVV, _      = strconv.ParseInt(r.FormValue("credit_card_cvv"), 10, 32)
+		billing       = r.FormValue("billing_country")
+		giftCards     = splitGiftCardCodes(r.FormValue("gift_card_codes"))
+		storeCredit   = r.FormValue("use_store_credit") == "on"
 	)
 
 	payload := validator.PlaceOrderPayload{
@@ -345,31 +471,71 @@ func (fe *frontendServer) placeOrderHandler(w http.ResponseWriter, r *http.Reque
 		CcMonth:       ccMonth,
 		CcYear:        ccYear,
 		CcCVV:         ccCVV,
+
+		BillingCountry: billing,
+		GiftCardCodes:  giftCards,
+		UseStoreCredit: storeCredit,
 	}
 	if err := payload.Validate(); err != nil {
 		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusUnprocessableEntity)
 		return
 	}
 
+	billingCountry := payload.BillingCountry
+	if billingCountry == "" {
+		billingCountry = payload.Country
+	}
+
+	// The card goes to the vault only; checkout gets a single-use token.
+	card := new(pb.TokenizeCardResponse)
+	if payload.CcNumber != "" {
+		var err error
+		card, err = fe.tokenizeCard(r.Context(), &pb.CreditCardInfo{
+			CreditCardNumber:          payload.CcNumber,
+			CreditCardExpirationMonth: int32(payload.CcMonth),
+			CreditCardExpirationYear:  int32(payload.CcYear),
+			CreditCardCvv:             int32(payload.CcCVV)})
+		if status.Code(err) == codes.InvalidArgument {
+			renderHTTPError(log, r, w, errors.New(status.Convert(err).Message()), http.StatusUnprocessableEntity)
+			return
+		} else if err != nil {
+			renderHTTPError(log, r, w, errors.Wrap(err, "failed to process the card"), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	address := &pb.Address{
+		StreetAddress: payload.StreetAddress,
+		City:          payload.City,
+		State:         payload.State,
+		ZipCode:       int32(payload.ZipCode),
+		Country:       payload.Country}
+	// Later visits to the cart estimate shipping and tax for this address.
+	setShippingAddress(w, address)
 	order, err := pb.NewCheckoutServiceClient(fe.checkoutSvcConn).
 		PlaceOrder(r.Context(), &pb.PlaceOrderRequest{
-			Email: payload.Email,
-			CreditCard: &pb.CreditCardInfo{
-				CreditCardNumber:          payload.CcNumber,
-				CreditCardExpirationMonth: int32(payload.CcMonth),
-				CreditCardExpirationYear:  int32(payload.CcYear),
-				CreditCardCvv:             int32(payload.CcCVV)},
-			UserId:       sessionID(r),
-			UserCurrency: currentCurrency(r),
-			Address: &pb.Address{
-				StreetAddress: payload.StreetAddress,
-				City:          payload.City,
-				State:         payload.State,
-				ZipCode:       int32(payload.ZipCode),
-				Country:       payload.Country},
+			Email:        payload.Email,
+			CardToken:    card.GetCardToken(),
+			CardLastFour: card.GetCardLastFour(),
+
+			CardFingerprint: card.GetCardFingerprint(),
+			BillingCountry:  billingCountry,
+			GiftCardCodes:   payload.GiftCardCodes,
+			UseStoreCredit:  payload.UseStoreCredit,
+			UserId:          sessionID(r),
+			UserCurrency:    currentCurrency(r),
+			CouponCodes:     couponCodes(r),
+			ServiceLevel:    serviceLevel(r),
+			Address:         address,
 		})
+	if violations := fe.shippingViolations(r.Context(), err); len(violations) > 0 {
+		// The order can't ship to this address; let the customer fix it.
+		log.WithField("error", err).Info("order breaks shipping rules")
+		fe.renderCart(w, r, checkoutForm{email: payload.Email, address: address, violations: violations})
+		return
+	}
 	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "failed to complete the order"), http.StatusInternalServerError)
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to complete the order"), httpStatusFromRPC(err))
 		return
 	}
 	log.WithField("order", order.GetOrder().GetOrderId()).Info("order placed")
@@ -377,11 +543,8 @@ func (fe *frontendServer) placeOrderHandler(w http.ResponseWriter, r *http.Reque
 	order.GetOrder().GetItems()
 	recommendations, _ := fe.getRecommendations(r.Context(), sessionID(r), nil)
 
-	totalPaid := *order.GetOrder().GetShippingCost()
-	for _, v := range order.GetOrder().GetItems() {
-		multPrice := money.MultiplySlow(*v.GetCost(), uint32(v.GetItem().GetQuantity()))
-		totalPaid = money.Must(money.Sum(totalPaid, multPrice))
-	}
+	http.SetCookie(w, &http.Cookie{Name: cookieCoupon, MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{Name: cookieShipping, MaxAge: -1})
 
 	currencies, err := fe.getCurrencies(r.Context())
 	if err != nil {
@@ -393,13 +556,207 @@ func (fe *frontendServer) placeOrderHandler(w http.ResponseWriter, r *http.Reque
 		"show_currency":   false,
 		"currencies":      currencies,
 		"order":           order.GetOrder(),
-		"total_paid":      &totalPaid,
+		"total_paid":      order.GetOrder().GetTotal(),
 		"recommendations": recommendations,
+		"under_review":    order.GetOrder().GetRisk().GetDecision() == pb.RiskDecision_RISK_DECISION_REVIEW,
 	})); err != nil {
 		log.Println(err)
 	}
 }
 
+func (fe *frontendServer) ordersHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	orders, err := fe.listOrders(r.Context(), sessionID(r))
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve orders"), http.StatusInternalServerError)
+		return
+	}
+	currencies, err := fe.getCurrencies(r.Context())
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
+		return
+	}
+
+	if err := templates.ExecuteTemplate(w, "orders", injectCommonTemplateData(r, map[string]interface{}{
+		"show_currency": false,
+		"currencies":    currencies,
+		"orders":        orders,
+	})); err != nil {
+		log.Println(err)
+	}
+}
+
+func (fe *frontendServer) orderDetailHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	id := mux.Vars(r)["id"]
+	order, err := fe.getOrder(r.Context(), sessionID(r), id)
+	if status.Code(err) == codes.NotFound {
+		renderHTTPError(log, r, w, errors.Errorf("order %s not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve order"), http.StatusInternalServerError)
+		return
+	}
+	currencies, err := fe.getCurrencies(r.Context())
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
+		return
+	}
+
+	// Quantities not returned yet, used for the return form.
+	returned := make(map[string]int32)
+	for _, ret := range order.GetReturns() {
+		for _, it := range ret.GetItems() {
+			returned[it.GetProductId()] += it.GetQuantity()
+		}
+	}
+	type orderItemView struct {
+		Item       *pb.Product
+		Quantity   int32
+		Returnable []int32
+		Price      *pb.Money
+	}
+	items := make([]orderItemView, len(order.GetItems()))
+	for i, it := range order.GetItems() {
+		p, err := fe.getProduct(r.Context(), it.GetItem().GetProductId())
+		if err != nil {
+			renderHTTPError(log, r, w, errors.Wrapf(err, "could not retrieve product #%s", it.GetItem().GetProductId()), http.StatusInternalServerError)
+			return
+		}
+		var returnable []int32
+		for q := int32(0); q <= it.GetItem().GetQuantity()-returned[p.GetId()]; q++ {
+			returnable = append(returnable, q)
+		}
+		multPrice := money.MultiplySlow(*it.GetCost(), uint32(it.GetItem().GetQuantity()))
+		items[i] = orderItemView{Item: p, Quantity: it.GetItem().GetQuantity(), Returnable: returnable, Price: &multPrice}
+	}
+
+	// Tracking is shown when available; failing to get it just hides it.
+	type shipmentView struct {
+		*pb.Shipment
+		Tracking *pb.TrackShipmentResponse
+	}
+	shipments := make([]shipmentView, len(order.GetShipments()))
+	for i, sh := range order.GetShipments() {
+		shipments[i] = shipmentView{Shipment: sh}
+	}
+	if tracking, err := fe.trackOrder(r.Context(), sessionID(r), id); err != nil {
+		log.WithField("error", err).Warn("failed to track order")
+	} else {
+		byID := make(map[string]*pb.TrackShipmentResponse)
+		for _, t := range tracking.GetShipments() {
+			byID[t.GetTrackingId()] = t
+		}
+		for i := range shipments {
+			shipments[i].Tracking = byID[shipments[i].GetTrackingId()]
+		}
+	}
+
+	// Orders with a shipment already handed to the carrier can only be
+	// returned.
+	s := order.GetStatus()
+	canCancel := s == pb.OrderStatus_ORDER_STATUS_PLACED
+	for _, sh := range order.GetShipments() {
+		if sh.GetTrackingId() != "" {
+			canCancel = false
+		}
+	}
+	if err := templates.ExecuteTemplate(w, "order_detail", injectCommonTemplateData(r, map[string]interface{}{
+		"show_currency": false,
+		"currencies":    currencies,
+		"order":         order,
+		"items":         items,
+		"shipments":     shipments,
+		"can_cancel":    canCancel,
+		"can_return":    s == pb.OrderStatus_ORDER_STATUS_DELIVERED || s == pb.OrderStatus_ORDER_STATUS_RETURNED,
+	})); err != nil {
+		log.Println(err)
+	}
+}
+
+func (fe *frontendServer) cancelOrderHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	payload := validator.OrderActionPayload{OrderID: mux.Vars(r)["id"], Reason: r.FormValue("reason")}
+	if err := payload.Validate(); err != nil {
+		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusUnprocessableEntity)
+		return
+	}
+	log.WithField("order", payload.OrderID).Debug("cancelling order")
+
+	if _, err := pb.NewCheckoutServiceClient(fe.checkoutSvcConn).CancelOrder(r.Context(), &pb.CancelOrderRequest{
+		OrderId: payload.OrderID,
+		UserId:  sessionID(r),
+		Reason:  payload.Reason,
+	}); err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to cancel the order"), httpStatusFromRPC(err))
+		return
+	}
+	w.Header().Set("Location", baseUrl+"/order/"+payload.OrderID)
+	w.WriteHeader(http.StatusFound)
+}
+
+// returnOrderHandler starts a return for the quantities chosen on the order
+// page, submitted as return_<product id> fields.
+func (fe *frontendServer) returnOrderHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	payload := validator.OrderActionPayload{OrderID: mux.Vars(r)["id"], Reason: r.FormValue("reason")}
+	if err := payload.Validate(); err != nil {
+		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to parse form"), http.StatusBadRequest)
+		return
+	}
+	var items []*pb.CartItem
+	for key := range r.PostForm {
+		productID, ok := strings.CutPrefix(key, "return_")
+		if !ok {
+			continue
+		}
+		quantity, _ := strconv.ParseInt(r.PostForm.Get(key), 10, 32)
+		if quantity > 0 {
+			items = append(items, &pb.CartItem{ProductId: productID, Quantity: int32(quantity)})
+		}
+	}
+	if len(items) == 0 {
+		renderHTTPError(log, r, w, errors.New("choose at least one item to return"), http.StatusUnprocessableEntity)
+		return
+	}
+	log.WithField("order", payload.OrderID).WithField("items", len(items)).Debug("returning items")
+
+	if _, err := pb.NewCheckoutServiceClient(fe.checkoutSvcConn).CreateReturn(r.Context(), &pb.CreateReturnRequest{
+		OrderId: payload.OrderID,
+		UserId:  sessionID(r),
+		Items:   items,
+		Reason:  payload.Reason,
+
+		StoreCredit: r.PostForm.Get("store_credit") == "on",
+	}); err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to return the items"), httpStatusFromRPC(err))
+		return
+	}
+	w.Header().Set("Location", baseUrl+"/order/"+payload.OrderID)
+	w.WriteHeader(http.StatusFound)
+}
+
+// httpStatusFromRPC maps the checkout errors a shopper can cause to HTTP
+// statuses.
+func httpStatusFromRPC(err error) int {
+	switch status.Code(err) {
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.InvalidArgument:
+		return http.StatusUnprocessableEntity
+	case codes.FailedPrecondition:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func (fe *frontendServer) assistantHandler(w http.ResponseWriter, r *http.Request) {
 	currencies, err := fe.getCurrencies(r.Context())
 	if err != nil {
@@ -522,6 +879,75 @@ func (fe *frontendServer) setCurrencyHandler(w http.ResponseWriter, r *http.Requ
 	w.WriteHeader(http.StatusFound)
 }
 
+// applyCouponHandler remembers the coupon entered on the cart page. Checkout
+// validates the code itself when pricing the cart.
+func (fe *frontendServer) applyCouponHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	payload := validator.ApplyCouponPayload{Code: strings.ToUpper(strings.TrimSpace(r.FormValue("coupon_code")))}
+	if err := payload.Validate(); err != nil {
+		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusUnprocessableEntity)
+		return
+	}
+	log.WithField("coupon", payload.Code).Debug("applying coupon")
+
+	cookie := &http.Cookie{Name: cookieCoupon, Value: payload.Code, MaxAge: cookieMaxAge}
+	if payload.Code == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+	w.Header().Set("Location", baseUrl+"/cart")
+	w.WriteHeader(http.StatusFound)
+}
+
+// chooseShippingHandler remembers the service level picked on the cart page.
+// Checkout checks that it is offered when pricing the cart.
+func (fe *frontendServer) chooseShippingHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	payload := validator.ChooseShippingPayload{ServiceLevel: r.FormValue("service_level")}
+	if err := payload.Validate(); err != nil {
+		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusUnprocessableEntity)
+		return
+	}
+	log.WithField("service_level", payload.ServiceLevel).Debug("choosing shipping")
+
+	cookie := &http.Cookie{Name: cookieShipping, Value: payload.ServiceLevel, MaxAge: cookieMaxAge}
+	if payload.ServiceLevel == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+	w.Header().Set("Location", baseUrl+"/cart")
+	w.WriteHeader(http.StatusFound)
+}
+
+// setAddressHandler remembers the shipping address entered on the cart page,
+// so the cart estimates shipping and tax for it.
+func (fe *frontendServer) setAddressHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	zipCode, _ := strconv.ParseInt(r.FormValue("zip_code"), 10, 32)
+	payload := validator.ShippingAddressPayload{
+		StreetAddress: r.FormValue("street_address"),
+		ZipCode:       zipCode,
+		City:          r.FormValue("city"),
+		State:         r.FormValue("state"),
+		Country:       r.FormValue("country"),
+	}
+	if err := payload.Validate(); err != nil {
+		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusUnprocessableEntity)
+		return
+	}
+	log.WithField("country", payload.Country).Debug("setting shipping address")
+
+	setShippingAddress(w, &pb.Address{
+		StreetAddress: payload.StreetAddress,
+		City:          payload.City,
+		State:         payload.State,
+		Country:       payload.Country,
+		ZipCode:       int32(payload.ZipCode),
+	})
+	w.Header().Set("Location", baseUrl+"/cart")
+	w.WriteHeader(http.StatusFound)
+}
+
 // chooseAd queries for advertisements available and randomly chooses one, if
 // available. It ignores the error retrieving the ad since it is not critical.
 func (fe *frontendServer) chooseAd(ctx context.Context, ctxKeys []string, log logrus.FieldLogger) *pb.Ad {
@@ -578,6 +1004,69 @@ func currentCurrency(r *http.Request) string {
 	return defaultCurrency
 }
 
+// splitGiftCardCodes splits the comma-separated gift card codes entered at
+// checkout.
+func splitGiftCardCodes(v string) []string {
+	var out []string
+	for _, c := range strings.Split(v, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// couponCodes returns the coupon applied on the cart page, if any.
+func couponCodes(r *http.Request) []string {
+	c, _ := r.Cookie(cookieCoupon)
+	if c == nil || c.Value == "" {
+		return nil
+	}
+	return []string{c.Value}
+}
+
+// serviceLevel returns the service level picked on the cart page, or "" for
+// the default.
+func serviceLevel(r *http.Request) string {
+	c, _ := r.Cookie(cookieShipping)
+	if c == nil {
+		return ""
+	}
+	return c.Value
+}
+
+// shippingAddress returns the address the shopper last entered, or
+// defaultShippingAddress if there is none.
+func shippingAddress(r *http.Request) *pb.Address {
+	c, _ := r.Cookie(cookieAddress)
+	if c == nil {
+		return defaultShippingAddress
+	}
+	v, err := url.ParseQuery(c.Value)
+	if err != nil || v.Get("country") == "" {
+		return defaultShippingAddress
+	}
+	zipCode, _ := strconv.ParseInt(v.Get("zip_code"), 10, 32)
+	return &pb.Address{
+		StreetAddress: v.Get("street_address"),
+		City:          v.Get("city"),
+		State:         v.Get("state"),
+		Country:       v.Get("country"),
+		ZipCode:       int32(zipCode),
+	}
+}
+
+// setShippingAddress remembers the shopper's address for shippingAddress.
+func setShippingAddress(w http.ResponseWriter, a *pb.Address) {
+	v := url.Values{}
+	v.Set("street_address", a.GetStreetAddress())
+	v.Set("city", a.GetCity())
+	v.Set("state", a.GetState())
+	v.Set("country", a.GetCountry())
+	v.Set("zip_code", strconv.Itoa(int(a.GetZipCode())))
+	http.SetCookie(w, &http.Cookie{Name: cookieAddress, Value: v.Encode(), MaxAge: cookieMaxAge})
+}
+
 func sessionID(r *http.Request) string {
 	v := r.Context().Value(ctxKeySessionID{})
 	if v != nil {
@@ -608,6 +1097,38 @@ func renderMoney(money pb.Money) string {
 	return fmt.Sprintf("%s%d.%02d", currencyLogo, money.GetUnits(), money.GetNanos()/10000000)
 }
 
+func renderOrderStatus(s pb.OrderStatus) string {
+	name := strings.TrimPrefix(s.String(), "ORDER_STATUS_")
+	return strings.ToUpper(name[:1]) + strings.ToLower(name[1:])
+}
+
+// renderShipmentStatus turns SHIPMENT_STATUS_OUT_FOR_DELIVERY into
+// "Out for delivery".
+func renderShipmentStatus(s pb.ShipmentStatus) string {
+	name := strings.ReplaceAll(strings.TrimPrefix(s.String(), "SHIPMENT_STATUS_"), "_", " ")
+	return strings.ToUpper(name[:1]) + strings.ToLower(name[1:])
+}
+
+func renderTrackingTime(unix int64) string {
+	return time.Unix(unix, 0).UTC().Format("Jan 2, 15:04 MST")
+}
+
+// renderDeliveryWindow turns the YYYY-MM-DD dates of a delivery window into
+// "Mon, Apr 1 – Wed, Apr 3", or a single date when they are the same.
+func renderDeliveryWindow(earliest, latest string) string {
+	format := func(date string) string {
+		t, err := time.Parse(time.DateOnly, date)
+		if err != nil {
+			return date
+		}
+		return t.Format("Mon, Jan 2")
+	}
+	if earliest == "" || earliest == latest {
+		return format(latest)
+	}
+	return format(earliest) + " – " + format(latest)
+}
+
 func renderCurrencyLogo(currencyCode string) string {
 	logos := map[string]string{
 		"USD": "$",
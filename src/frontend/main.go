@@ -44,6 +44,9 @@ const (
 	cookiePrefix    = "shop_"
 	cookieSessionID = cookiePrefix + "session-id"
 	cookieCurrency  = cookiePrefix + "currency"
+	cookieCoupon    = cookiePrefix + "coupon"
+	cookieShipping  = cookiePrefix + "service-level"
+	cookieAddress   = cookiePrefix + "address"
 )
 
 var (
@@ -85,6 +88,9 @@ type frontendServer struct {
 	checkoutSvcAddr string
 	checkoutSvcConn *grpc.ClientConn
 
+	cardVaultSvcAddr string
+	cardVaultSvcConn *grpc.ClientConn
+
 	// shippingSvcAddr string
 	// shippingSvcConn *grpc.ClientConn
 
@@ -107,14 +113,14 @@ func main() {
 	ctx := context.Background()
 	log := logrus.New()
 	log.Level = logrus.DebugLevel
-	log.Formatter = &logrus.JSONFormatter{
+	log.Formatter = redactingFormatter{&logrus.JSONFormatter{
 		FieldMap: logrus.FieldMap{
 			logrus.FieldKeyTime:  "timestamp",
 			logrus.FieldKeyLevel: "severity",
 			logrus.FieldKeyMsg:   "message",
 		},
 		TimestampFormat: time.RFC3339Nano,
-	}
+	}}
 	log.Out = os.Stdout
 
 	svc := new(frontendServer)
@@ -149,6 +155,7 @@ func main() {
 	mustMapEnv(&svc.cartSvcAddr, "CART_SERVICE_ADDR")
 	mustMapEnv(&svc.recommendationSvcAddr, "RECOMMENDATION_SERVICE_ADDR")
 	mustMapEnv(&svc.checkoutSvcAddr, "CHECKOUT_SERVICE_ADDR")
+	mustMapEnv(&svc.cardVaultSvcAddr, "CARD_VAULT_SERVICE_ADDR")
 	// mustMapEnv(&svc.shippingSvcAddr, "SHIPPING_SERVICE_ADDR")
 	// mustMapEnv(&svc.adSvcAddr, "AD_SERVICE_ADDR")
 	mustMapEnv(&svc.shoppingAssistantSvcAddr, "SHOPPING_ASSISTANT_SERVICE_ADDR")
@@ -159,6 +166,7 @@ func main() {
 	mustConnGRPC(ctx, &svc.recommendationSvcConn, svc.recommendationSvcAddr)
 	// mustConnGRPC(ctx, &svc.shippingSvcConn, svc.shippingSvcAddr)
 	mustConnGRPC(ctx, &svc.checkoutSvcConn, svc.checkoutSvcAddr)
+	mustConnGRPC(ctx, &svc.cardVaultSvcConn, svc.cardVaultSvcAddr)
 	// mustConnGRPC(ctx, &svc.adSvcConn, svc.adSvcAddr)
 
 	r := mux.NewRouter()
@@ -167,9 +175,16 @@ func main() {
 	r.HandleFunc(baseUrl + "/cart", svc.viewCartHandler).Methods(http.MethodGet, http.MethodHead)
 	r.HandleFunc(baseUrl + "/cart", svc.addToCartHandler).Methods(http.MethodPost)
 	r.HandleFunc(baseUrl + "/cart/empty", svc.emptyCartHandler).Methods(http.MethodPost)
+	r.HandleFunc(baseUrl + "/cart/coupon", svc.applyCouponHandler).Methods(http.MethodPost)
+	r.HandleFunc(baseUrl + "/cart/shipping", svc.chooseShippingHandler).Methods(http.MethodPost)
+	r.HandleFunc(baseUrl + "/cart/address", svc.setAddressHandler).Methods(http.MethodPost)
 	r.HandleFunc(baseUrl + "/setCurrency", svc.setCurrencyHandler).Methods(http.MethodPost)
 	r.HandleFunc(baseUrl + "/logout", svc.logoutHandler).Methods(http.MethodGet)
 	r.HandleFunc(baseUrl + "/cart/checkout", svc.placeOrderHandler).Methods(http.MethodPost)
+	r.HandleFunc(baseUrl + "/orders", svc.ordersHandler).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc(baseUrl + "/order/{id}", svc.orderDetailHandler).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc(baseUrl + "/order/{id}/cancel", svc.cancelOrderHandler).Methods(http.MethodPost)
+	r.HandleFunc(baseUrl + "/order/{id}/return", svc.returnOrderHandler).Methods(http.MethodPost)
 	r.HandleFunc(baseUrl + "/assistant", svc.assistantHandler).Methods(http.MethodGet)
 	r.PathPrefix(baseUrl + "/static/").Handler(http.StripPrefix(baseUrl + "/static/", http.FileServer(http.Dir("./static/"))))
 	r.HandleFunc(baseUrl + "/robots.txt", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "User-agent: *\nDisallow: /") })
@@ -148,55 +148,46 @@ func (fe *frontendServer) convertCurrency(ctx context.Context, money *pb.Money,
 	}, nil
 }
 
-func (fe *frontendServer) getShippingQuote(ctx context.Context, items []*pb.CartItem, currency string) (*pb.Money, error) {
-	// quote, err := pb.NewShippingServiceClient(fe.shippingSvcConn).GetQuote(ctx,
-	// 	&pb.GetQuoteRequest{
-	// 		Address: nil,
-	// 		Items:   items})
-	// if err != nil {
-	// 	return nil, err
-	// }
-	// localized, err := fe.convertCurrency(ctx, quote.GetCostUsd(), currency)
-	// return localized, errors.Wrap(err, "failed to convert currency for shipping cost")
-	
-//the getQuote function in the shipping service is not directly used ,it's handled by checkout service completely.
-	
-	gcfURL := "https://us-central1-cloudblend-435916.cloudfunctions.net/shipping/getQuote"
-	req, err := http.NewRequestWithContext(ctx, "GET", gcfURL, nil)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create GCF shipping quote request")
-	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to call GCF for shipping quote")
-	}
-	defer resp.Body.Close()
+// previewOrder asks checkout to price the user's cart so the cart page shows
+// the same items, shipping, discounts, tax and total that PlaceOrder will
+// charge.
+func (fe *frontendServer) previewOrder(ctx context.Context, userID, currency string, address *pb.Address, couponCodes []string, serviceLevel string) (*pb.PreviewOrderResponse, error) {
+	return pb.NewCheckoutServiceClient(fe.checkoutSvcConn).PreviewOrder(ctx, &pb.PreviewOrderRequest{
+		UserId:       userID,
+		UserCurrency: currency,
+		Address:      address,
+		CouponCodes:  couponCodes,
+		ServiceLevel: serviceLevel})
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, errors.Errorf("GCF shipping quote returned %d: %s", resp.StatusCode, string(body))
-	}
+func (fe *frontendServer) tokenizeCard(ctx context.Context, card *pb.CreditCardInfo) (*pb.TokenizeCardResponse, error) {
+	return pb.NewCardVaultServiceClient(fe.cardVaultSvcConn).TokenizeCard(ctx, &pb.TokenizeCardRequest{CreditCard: card})
+}
 
-	var shippingResp struct {
-		CostUSD struct {
-			CurrencyCode string `json:"currency_code"`
-			Units        int64  `json:"units"`
-			Nanos        int32  `json:"nanos"`
-		} `json:"cost_usd"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&shippingResp); err != nil {
-		return nil, errors.Wrap(err, "failed to parse GCF shipping quote response")
-	}
+// trackOrder returns the tracking of each shipment of the user's order.
+func (fe *frontendServer) trackOrder(ctx context.Context, userID, orderID string) (*pb.TrackOrderResponse, error) {
+	return pb.NewCheckoutServiceClient(fe.checkoutSvcConn).TrackOrder(ctx, &pb.TrackOrderRequest{
+		OrderId: orderID,
+		UserId:  userID})
+}
 
-	quote := &pb.Money{
-		CurrencyCode: shippingResp.CostUSD.CurrencyCode,
-		Units:        shippingResp.CostUSD.Units,
-		Nanos:        shippingResp.CostUSD.Nanos,
-	}
-	localized, err := fe.convertCurrency(ctx, quote, currency)
-	return localized, errors.Wrap(err, "failed to convert currency for shipping cost")
+// getStoreCredit returns the user's store credit in the given currency.
+func (fe *frontendServer) getStoreCredit(ctx context.Context, userID, currency string) (*pb.Money, error) {
+	resp, err := pb.NewCheckoutServiceClient(fe.checkoutSvcConn).GetGiftCardBalance(ctx, &pb.GetGiftCardBalanceRequest{
+		UserId:       userID,
+		CurrencyCode: currency})
+	return resp.GetBalance(), err
+}
+
+func (fe *frontendServer) listOrders(ctx context.Context, userID string) ([]*pb.OrderResult, error) {
+	resp, err := pb.NewCheckoutServiceClient(fe.checkoutSvcConn).ListOrders(ctx, &pb.ListOrdersRequest{UserId: userID})
+	return resp.GetOrders(), err
+}
 
+func (fe *frontendServer) getOrder(ctx context.Context, userID, orderID string) (*pb.OrderResult, error) {
+	return pb.NewCheckoutServiceClient(fe.checkoutSvcConn).GetOrder(ctx, &pb.GetOrderRequest{
+		OrderId: orderID,
+		UserId:  userID})
 }
 
 func (fe *frontendServer) getRecommendations(ctx context.Context, userID string, productIDs []string) ([]*pb.Product, error) {
@@ -46,16 +46,51 @@ type PlaceOrderPayload struct {
 	City          string `validate:"required,max=128"`
 	State         string `validate:"required,max=128"`
 	Country       string `validate:"required,max=128"`
-	CcNumber      string `validate:"required,credit_card"`
-	CcMonth       int64  `validate:"required,gte=1,lte=12"`
-	CcYear        int64  `validate:"required"`
-	CcCVV         int64  `validate:"required"`
+	// The card may be left out when paying with gift cards or store credit;
+	// checkout rejects the order if they do not cover the total.
+	CcNumber string `validate:"required_without_all=GiftCardCodes UseStoreCredit,omitempty,credit_card"`
+	CcMonth  int64  `validate:"required_with=CcNumber,omitempty,gte=1,lte=12"`
+	CcYear   int64  `validate:"required_with=CcNumber"`
+	CcCVV    int64  `validate:"required_with=CcNumber"`
+	// BillingCountry is only set when it differs from Country.
+	BillingCountry string   `validate:"omitempty,max=128"`
+	GiftCardCodes  []string `validate:"max=5,dive,required,max=32"`
+	UseStoreCredit bool
+}
+
+// ShippingAddressPayload carries the address the cart page estimates
+// shipping and tax for.
+type ShippingAddressPayload struct {
+	StreetAddress string `validate:"required,max=512"`
+	ZipCode       int64  `validate:"required"`
+	City          string `validate:"required,max=128"`
+	State         string `validate:"required,max=128"`
+	Country       string `validate:"required,max=128"`
 }
 
 type SetCurrencyPayload struct {
 	Currency string `validate:"required,iso4217"`
 }
 
+// ApplyCouponPayload carries a coupon code entered on the cart page. An empty
+// code removes the applied coupon.
+type ApplyCouponPayload struct {
+	Code string `validate:"omitempty,alphanum,max=32"`
+}
+
+// ChooseShippingPayload carries the service level picked on the cart page.
+// An empty level goes back to the default.
+type ChooseShippingPayload struct {
+	ServiceLevel string `validate:"omitempty,alphanum,lowercase,max=32"`
+}
+
+// OrderActionPayload is a cancellation or return started from the order
+// page.
+type OrderActionPayload struct {
+	OrderID string `validate:"required,uuid"`
+	Reason  string `validate:"max=512"`
+}
+
 // Implementations of the 'Payload' interface.
 func (ad *AddToCartPayload) Validate() error {
 	return validate.Struct(ad)
@@ -65,10 +100,26 @@ func (po *PlaceOrderPayload) Validate() error {
 	return validate.Struct(po)
 }
 
+func (sa *ShippingAddressPayload) Validate() error {
+	return validate.Struct(sa)
+}
+
 func (sc *SetCurrencyPayload) Validate() error {
 	return validate.Struct(sc)
 }
 
+func (ac *ApplyCouponPayload) Validate() error {
+	return validate.Struct(ac)
+}
+
+func (cs *ChooseShippingPayload) Validate() error {
+	return validate.Struct(cs)
+}
+
+func (oa *OrderActionPayload) Validate() error {
+	return validate.Struct(oa)
+}
+
 // Reusable error response function.
 func ValidationErrorResponse(err error) error {
 	validationErrs, ok := err.(validator.ValidationErrors)
@@ -183,3 +183,125 @@ func TestSetCurrencyFailsValidation(t *testing.T) {
 		})
 	}
 }
+
+func TestApplyCouponValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  string
+		valid bool
+	}{
+		{"valid code", "WELCOME10", true},
+		{"empty code clears coupon", "", true},
+		{"invalid characters", "SAVE 10%", false},
+		{"too long", strings.Repeat("A", 33), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := ApplyCouponPayload{Code: tt.code}
+			if err := payload.Validate(); (err == nil) != tt.valid {
+				t.Errorf("validating %q: got %v, want valid=%v", tt.code, err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestChooseShippingValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		level string
+		valid bool
+	}{
+		{"valid level", "express", true},
+		{"empty level uses the default", "", true},
+		{"uppercase", "EXPRESS", false},
+		{"invalid characters", "next-day", false},
+		{"too long", strings.Repeat("a", 33), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := ChooseShippingPayload{ServiceLevel: tt.level}
+			if err := payload.Validate(); (err == nil) != tt.valid {
+				t.Errorf("validating %q: got %v, want valid=%v", tt.level, err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestShippingAddressValidation(t *testing.T) {
+	valid := ShippingAddressPayload{StreetAddress: "1600 Amphitheatre Parkway", ZipCode: 94043, City: "Mountain View", State: "CA", Country: "United States"}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("validating %+v: got %v, want valid", valid, err)
+	}
+	noCountry := valid
+	noCountry.Country = ""
+	if err := noCountry.Validate(); err == nil {
+		t.Error("validating an address without a country: got valid, want an error")
+	}
+	longCity := valid
+	longCity.City = strings.Repeat("a", 129)
+	if err := longCity.Validate(); err == nil {
+		t.Error("validating an address with a long city: got valid, want an error")
+	}
+}
+
+func TestOrderActionValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		orderID string
+		reason  string
+		valid   bool
+	}{
+		{"valid", "0f8fad5b-d9cb-469f-a165-70867728950e", "wrong size", true},
+		{"no reason", "0f8fad5b-d9cb-469f-a165-70867728950e", "", true},
+		{"not a uuid", "order-1", "", false},
+		{"reason too long", "0f8fad5b-d9cb-469f-a165-70867728950e", strings.Repeat("a", 513), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := OrderActionPayload{OrderID: tt.orderID, Reason: tt.reason}
+			if err := payload.Validate(); (err == nil) != tt.valid {
+				t.Errorf("got %v, want valid=%v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestPlaceOrderPaymentMethods(t *testing.T) {
+	tests := []struct {
+		name        string
+		ccNumber    string
+		ccCVV       int64
+		giftCards   []string
+		storeCredit bool
+		valid       bool
+	}{
+		{"card", "5272940000751666", 584, nil, false, true},
+		{"gift card only", "", 0, []string{"DEMO-GIFT-0100"}, false, true},
+		{"store credit only", "", 0, nil, true, true},
+		{"gift card and card", "5272940000751666", 584, []string{"DEMO-GIFT-0025"}, false, true},
+		{"nothing to pay with", "", 0, nil, false, false},
+		{"card without cvv", "5272940000751666", 0, []string{"DEMO-GIFT-0025"}, false, false},
+		{"gift card code too long", "", 0, []string{strings.Repeat("A", 33)}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := PlaceOrderPayload{
+				Email:          "test@example.com",
+				StreetAddress:  "12345 example street",
+				ZipCode:        10004,
+				City:           "New York",
+				State:          "New York",
+				Country:        "United States",
+				CcNumber:       tt.ccNumber,
+				CcMonth:        4,
+				CcYear:         2024,
+				CcCVV:          tt.ccCVV,
+				GiftCardCodes:  tt.giftCards,
+				UseStoreCredit: tt.storeCredit,
+			}
+			if err := payload.Validate(); (err == nil) != tt.valid {
+				t.Errorf("got %v, want valid=%v", err, tt.valid)
+			}
+		})
+	}
+}
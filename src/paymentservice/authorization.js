@@ -0,0 +1,143 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+const { v4: uuidv4 } = require('uuid');
+const pino = require('pino');
+const { validateCard } = require('./charge');
+const vault = require('./vault');
+
+const logger = pino({
+  name: 'paymentservice-authorization',
+  messageKey: 'message',
+  formatters: {
+    level (logLevelString, logLevelNum) {
+      return { severity: logLevelString }
+    }
+  }
+});
+
+// How long a hold lasts before it lapses, like a card issuer would.
+const AUTHORIZATION_TTL_SECONDS = Number(process.env.AUTHORIZATION_TTL_SECONDS || 7 * 24 * 60 * 60);
+const SWEEP_INTERVAL_SECONDS = Number(process.env.AUTHORIZATION_SWEEP_INTERVAL_SECONDS || 60);
+
+class AuthorizationError extends Error {
+  constructor (message, code) {
+    super(message);
+    this.code = code;
+  }
+}
+
+// gRPC status codes.
+const INVALID_ARGUMENT = 3;
+const NOT_FOUND = 5;
+const FAILED_PRECONDITION = 9;
+
+// Open authorizations by ID. Captured and voided ones are removed.
+const authorizations = new Map();
+
+function nanos (money) {
+  return BigInt(money.units || 0) * 1000000000n + BigInt(money.nanos || 0);
+}
+
+function lookup (authorizationId) {
+  const auth = authorizations.get(authorizationId);
+  if (!auth) { throw new AuthorizationError(`no authorization ${authorizationId}`, NOT_FOUND); }
+  if (auth.expiresAt <= Date.now()) {
+    authorizations.delete(authorizationId);
+    throw new AuthorizationError(`authorization ${authorizationId} has expired`, FAILED_PRECONDITION);
+  }
+  return auth;
+}
+
+/**
+ * Verifies the credit card and (pretend) places a hold for the amount. The
+ * card is given either directly or as a token from the vault.
+ *
+ * @param {*} request
+ * @return authorization_id - a random uuid, and when the hold lapses.
+ */
+function authorize (request) {
+  const { amount, card_token: cardToken } = request;
+  const creditCard = cardToken ? vault.redeemToken(cardToken) : request.credit_card;
+  if (!creditCard) { throw new AuthorizationError('credit_card or card_token is required', INVALID_ARGUMENT); }
+  const cardType = validateCard(creditCard);
+  if (!amount || nanos(amount) <= 0n) { throw new AuthorizationError('amount must be positive', INVALID_ARGUMENT); }
+
+  const authorizationId = uuidv4();
+  const expiresAt = Date.now() + AUTHORIZATION_TTL_SECONDS * 1000;
+  authorizations.set(authorizationId, { amount, expiresAt });
+  logger.info(`Authorization ${authorizationId} placed: ${cardType} ending ${creditCard.credit_card_number.substr(-4)} \
+    Amount: ${amount.currency_code}${amount.units}.${amount.nanos}`);
+
+  return { authorization_id: authorizationId, expires_at_unix: Math.floor(expiresAt / 1000) };
+}
+
+/**
+ * Settles an authorization. The amount may be less than what was authorized;
+ * the rest of the hold is released.
+ *
+ * @param {*} request
+ * @return transaction_id - a random uuid.
+ */
+function capture (request) {
+  const { authorization_id: authorizationId } = request;
+  const auth = lookup(authorizationId);
+  const amount = request.amount || auth.amount;
+  if (amount.currency_code !== auth.amount.currency_code) {
+    throw new AuthorizationError(`cannot capture ${amount.currency_code} from a ${auth.amount.currency_code} authorization`, INVALID_ARGUMENT);
+  }
+  if (nanos(amount) <= 0n || nanos(amount) > nanos(auth.amount)) {
+    throw new AuthorizationError('capture amount must be positive and at most the authorized amount', INVALID_ARGUMENT);
+  }
+
+  authorizations.delete(authorizationId);
+  const transactionId = uuidv4();
+  logger.info(`Authorization ${authorizationId} captured as transaction ${transactionId} \
+    Amount: ${amount.currency_code}${amount.units}.${amount.nanos}`);
+
+  return { transaction_id: transactionId };
+}
+
+/**
+ * Releases an authorization that will not be captured.
+ *
+ * @param {*} request
+ */
+function voidAuthorization (request) {
+  const { authorization_id: authorizationId } = request;
+  lookup(authorizationId);
+  authorizations.delete(authorizationId);
+  logger.info(`Authorization ${authorizationId} voided`);
+  return {};
+}
+
+/**
+ * Periodically drops authorizations whose hold has lapsed so that they can
+ * no longer be captured.
+ */
+function startSweeper () {
+  const timer = setInterval(() => {
+    const now = Date.now();
+    for (const [id, auth] of authorizations) {
+      if (auth.expiresAt <= now) {
+        authorizations.delete(id);
+        logger.warn(`Authorization ${id} expired without being captured`);
+      }
+    }
+  }, SWEEP_INTERVAL_SECONDS * 1000);
+  timer.unref();
+  return timer;
+}
+
+module.exports = { authorize, capture, void: voidAuthorization, startSweeper };
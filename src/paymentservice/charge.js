@@ -53,13 +53,12 @@ class ExpiredCreditCard extends CreditCardError {
 }
 
 /**
- * Verifies the credit card number and (pretend) charges the card.
+ * Verifies the credit card number, type and expiration.
  *
- * @param {*} request
- * @return transaction_id - a random uuid.
+ * @param {*} creditCard
+ * @return the card type.
  */
-module.exports = function charge (request) {
-  const { amount, credit_card: creditCard } = request;
+function validateCard (creditCard) {
   const cardNumber = creditCard.credit_card_number;
   const cardInfo = cardValidator(cardNumber);
   const {
@@ -79,8 +78,25 @@ module.exports = function charge (request) {
   const { credit_card_expiration_year: year, credit_card_expiration_month: month } = creditCard;
   if ((currentYear * 12 + currentMonth) > (year * 12 + month)) { throw new ExpiredCreditCard(cardNumber.replace('-', ''), month, year); }
 
+  return cardType;
+}
+
+/**
+ * Verifies the credit card number and (pretend) charges the card.
+ *
+ * @param {*} request
+ * @return transaction_id - a random uuid.
+ */
+module.exports = function charge (request) {
+  const { amount, credit_card: creditCard } = request;
+  const cardNumber = creditCard.credit_card_number;
+  const cardType = validateCard(creditCard);
+
   logger.info(`Transaction processed: ${cardType} ending ${cardNumber.substr(-4)} \
     Amount: ${amount.currency_code}${amount.units}.${amount.nanos}`);
 
   return { transaction_id: uuidv4() };
 };
+
+module.exports.validateCard = validateCard;
+module.exports.CreditCardError = CreditCardError;
@@ -17,6 +17,9 @@ const grpc = require('@grpc/grpc-js');
 const protoLoader = require('@grpc/proto-loader');
 
 const charge = require('./charge');
+const refund = require('./refund');
+const authorization = require('./authorization');
+const vault = require('./vault');
 
 const logger = require('./logger')
 
@@ -40,7 +43,7 @@ class HipsterShopServer {
    */
   static ChargeServiceHandler(call, callback) {
     try {
-      logger.info(`PaymentService#Charge invoked with request ${JSON.stringify(call.request)}`);
+      logger.info(`PaymentService#Charge invoked for ${JSON.stringify(call.request.amount)}`);
       const response = charge(call.request);
       callback(null, response);
     } catch (err) {
@@ -49,6 +52,87 @@ class HipsterShopServer {
     }
   }
 
+  /**
+   * Handler for PaymentService.Refund.
+   * @param {*} call  { RefundRequest }
+   * @param {*} callback  fn(err, RefundResponse)
+   */
+  static RefundServiceHandler(call, callback) {
+    try {
+      logger.info(`PaymentService#Refund invoked with request ${JSON.stringify(call.request)}`);
+      const response = refund(call.request);
+      callback(null, response);
+    } catch (err) {
+      console.warn(err);
+      callback(err);
+    }
+  }
+
+  /**
+   * Handler for PaymentService.Authorize.
+   * @param {*} call  { AuthorizeRequest }
+   * @param {*} callback  fn(err, AuthorizeResponse)
+   */
+  static AuthorizeServiceHandler(call, callback) {
+    try {
+      logger.info(`PaymentService#Authorize invoked for ${JSON.stringify(call.request.amount)}`);
+      const response = authorization.authorize(call.request);
+      callback(null, response);
+    } catch (err) {
+      console.warn(err);
+      callback(err);
+    }
+  }
+
+  /**
+   * Handler for PaymentService.Capture.
+   * @param {*} call  { CaptureRequest }
+   * @param {*} callback  fn(err, CaptureResponse)
+   */
+  static CaptureServiceHandler(call, callback) {
+    try {
+      logger.info(`PaymentService#Capture invoked with request ${JSON.stringify(call.request)}`);
+      const response = authorization.capture(call.request);
+      callback(null, response);
+    } catch (err) {
+      console.warn(err);
+      callback(err);
+    }
+  }
+
+  /**
+   * Handler for PaymentService.Void.
+   * @param {*} call  { VoidRequest }
+   * @param {*} callback  fn(err, Empty)
+   */
+  static VoidServiceHandler(call, callback) {
+    try {
+      logger.info(`PaymentService#Void invoked with request ${JSON.stringify(call.request)}`);
+      const response = authorization.void(call.request);
+      callback(null, response);
+    } catch (err) {
+      console.warn(err);
+      callback(err);
+    }
+  }
+
+  /**
+   * Handler for CardVaultService.TokenizeCard. The request is not logged
+   * since it carries the card.
+   * @param {*} call  { TokenizeCardRequest }
+   * @param {*} callback  fn(err, TokenizeCardResponse)
+   */
+  static TokenizeCardServiceHandler(call, callback) {
+    try {
+      logger.info('CardVaultService#TokenizeCard invoked');
+      const response = vault.tokenizeCard(call.request);
+      callback(null, response);
+    } catch (err) {
+      console.warn(err.message);
+      callback(err);
+    }
+  }
+
   static CheckHandler(call, callback) {
     callback(null, { status: 'SERVING' });
   }
@@ -63,6 +147,8 @@ class HipsterShopServer {
       function () {
         logger.info(`PaymentService gRPC server started on port ${port}`);
         server.start();
+        authorization.startSweeper();
+        vault.startSweeper();
       }
     );
   }
@@ -88,7 +174,18 @@ class HipsterShopServer {
     this.server.addService(
       hipsterShopPackage.PaymentService.service,
       {
-        charge: HipsterShopServer.ChargeServiceHandler.bind(this)
+        charge: HipsterShopServer.ChargeServiceHandler.bind(this),
+        refund: HipsterShopServer.RefundServiceHandler.bind(this),
+        authorize: HipsterShopServer.AuthorizeServiceHandler.bind(this),
+        capture: HipsterShopServer.CaptureServiceHandler.bind(this),
+        void: HipsterShopServer.VoidServiceHandler.bind(this)
+      }
+    );
+
+    this.server.addService(
+      hipsterShopPackage.CardVaultService.service,
+      {
+        tokenizeCard: HipsterShopServer.TokenizeCardServiceHandler.bind(this)
       }
     );
 
@@ -0,0 +1,109 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+const crypto = require('crypto');
+const pino = require('pino');
+const { validateCard, CreditCardError } = require('./charge');
+
+const logger = pino({
+  name: 'paymentservice-vault',
+  messageKey: 'message',
+  formatters: {
+    level (logLevelString, logLevelNum) {
+      return { severity: logLevelString }
+    }
+  }
+});
+
+// Tokens only need to outlive the checkout request that uses them.
+const CARD_TOKEN_TTL_SECONDS = Number(process.env.CARD_TOKEN_TTL_SECONDS || 15 * 60);
+// Key for card fingerprints. Without a configured secret, fingerprints are
+// only stable for the lifetime of the process.
+const FINGERPRINT_SECRET = process.env.CARD_FINGERPRINT_SECRET || crypto.randomBytes(32).toString('hex');
+
+class VaultError extends Error {
+  constructor (message) {
+    super(message);
+    this.code = 3; // gRPC INVALID_ARGUMENT
+  }
+}
+
+// Cards by token. Entries are removed when used or when they expire.
+const cards = new Map();
+
+/**
+ * Verifies the card and stores it in memory under a random single-use token.
+ *
+ * @param {*} request
+ * @return card_token, card_last_four, card_type, card_fingerprint and when
+ * the token expires.
+ */
+function tokenizeCard (request) {
+  const { credit_card: creditCard } = request;
+  if (!creditCard) { throw new VaultError('credit_card is required'); }
+  let cardType;
+  try {
+    cardType = validateCard(creditCard);
+  } catch (err) {
+    // A bad card is the shopper's to fix: report it as INVALID_ARGUMENT,
+    // not the UNKNOWN grpc-js makes of CreditCardError's code.
+    if (err instanceof CreditCardError) { throw new VaultError(err.message); }
+    throw err;
+  }
+
+  const token = `tok_${crypto.randomBytes(16).toString('hex')}`;
+  const expiresAt = Date.now() + CARD_TOKEN_TTL_SECONDS * 1000;
+  cards.set(token, { creditCard, expiresAt });
+  const digits = creditCard.credit_card_number.replace(/[^0-9]/g, '');
+  const lastFour = digits.slice(-4);
+  const fingerprint = crypto.createHmac('sha256', FINGERPRINT_SECRET).update(digits).digest('hex').slice(0, 32);
+  logger.info(`Tokenized ${cardType} card ending ${lastFour}`);
+
+  return {
+    card_token: token,
+    card_last_four: lastFour,
+    card_type: cardType,
+    expires_at_unix: Math.floor(expiresAt / 1000),
+    card_fingerprint: fingerprint
+  };
+}
+
+/**
+ * Returns the card behind a token and invalidates the token.
+ *
+ * @param {string} token
+ * @return the CreditCardInfo.
+ */
+function redeemToken (token) {
+  const entry = cards.get(token);
+  cards.delete(token);
+  if (!entry || entry.expiresAt <= Date.now()) { throw new VaultError('card token is invalid or has expired'); }
+  return entry.creditCard;
+}
+
+/**
+ * Periodically drops tokens that were never used.
+ */
+function startSweeper () {
+  const timer = setInterval(() => {
+    const now = Date.now();
+    for (const [token, entry] of cards) {
+      if (entry.expiresAt <= now) { cards.delete(token); }
+    }
+  }, 60 * 1000);
+  timer.unref();
+  return timer;
+}
+
+module.exports = { tokenizeCard, redeemToken, startSweeper };
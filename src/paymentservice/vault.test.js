@@ -0,0 +1,59 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+const test = require('node:test');
+const assert = require('node:assert');
+const grpc = require('@grpc/grpc-js');
+
+const HipsterShopServer = require('./server');
+
+function tokenize (creditCard) {
+  return new Promise((resolve) => {
+    HipsterShopServer.TokenizeCardServiceHandler({ request: { credit_card: creditCard } }, (err, response) => {
+      resolve({ err, response });
+    });
+  });
+}
+
+test('a bad card number is rejected as INVALID_ARGUMENT', async () => {
+  const { err } = await tokenize({
+    credit_card_number: '4432-8015-6152-0455',
+    credit_card_cvv: 672,
+    credit_card_expiration_year: new Date().getFullYear() + 1,
+    credit_card_expiration_month: 1
+  });
+  assert.strictEqual(err.code, grpc.status.INVALID_ARGUMENT);
+});
+
+test('an expired card is rejected as INVALID_ARGUMENT', async () => {
+  const { err } = await tokenize({
+    credit_card_number: '4432-8015-6152-0454',
+    credit_card_cvv: 672,
+    credit_card_expiration_year: 2000,
+    credit_card_expiration_month: 1
+  });
+  assert.strictEqual(err.code, grpc.status.INVALID_ARGUMENT);
+});
+
+test('a valid card is tokenized', async () => {
+  const { err, response } = await tokenize({
+    credit_card_number: '4432-8015-6152-0454',
+    credit_card_cvv: 672,
+    credit_card_expiration_year: new Date().getFullYear() + 1,
+    credit_card_expiration_month: 1
+  });
+  assert.ifError(err);
+  assert.strictEqual(response.card_last_four, '0454');
+  assert.match(response.card_token, /^tok_/);
+});
@@ -0,0 +1,139 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/productcatalogservice/genproto"
+)
+
+// catalogSnapshot is an immutable view of the catalog, indexed by product ID
+// and by category. Reloads build a new snapshot and swap it in, so readers
+// never wait for one and never see half of one. Neither the snapshot nor
+// its products may be modified once built.
+type catalogSnapshot struct {
+	// version identifies the content of the catalog: a hash of its
+	// products, so reloading the same data keeps it.
+	version    string
+	products   []*pb.Product
+	byID       map[string]*pb.Product
+	byCategory map[string][]*pb.Product
+	// searchText holds the lowercased name and description of each product,
+	// in the order of products.
+	searchText [][2]string
+}
+
+func newCatalogSnapshot(products []*pb.Product) *catalogSnapshot {
+	c := &catalogSnapshot{
+		products:   products,
+		byID:       make(map[string]*pb.Product, len(products)),
+		byCategory: make(map[string][]*pb.Product),
+		searchText: make([][2]string, len(products)),
+	}
+	for i, p := range products {
+		c.byID[p.GetId()] = p
+		for _, category := range p.GetCategories() {
+			c.byCategory[category] = append(c.byCategory[category], p)
+		}
+		c.searchText[i] = [2]string{strings.ToLower(p.GetName()), strings.ToLower(p.GetDescription())}
+	}
+	data, _ := proto.MarshalOptions{Deterministic: true}.Marshal(&pb.ListProductsResponse{Products: products})
+	sum := sha256.Sum256(data)
+	c.version = hex.EncodeToString(sum[:6])
+	return c
+}
+
+// product returns the product with the given ID.
+func (c *catalogSnapshot) product(id string) (*pb.Product, bool) {
+	p, ok := c.byID[id]
+	return p, ok
+}
+
+// inCategory returns the products of a category, in catalog order.
+func (c *catalogSnapshot) inCategory(category string) []*pb.Product {
+	return c.byCategory[category]
+}
+
+// search returns the products whose name or description contains query,
+// ignoring case.
+func (c *catalogSnapshot) search(query string) []*pb.Product {
+	query = strings.ToLower(query)
+	var found []*pb.Product
+	for i, text := range c.searchText {
+		if strings.Contains(text[0], query) || strings.Contains(text[1], query) {
+			found = append(found, c.products[i])
+		}
+	}
+	return found
+}
+
+var emptyCatalog = newCatalogSnapshot(nil)
+
+// catalog returns the current snapshot of the catalog.
+func (p *productCatalog) catalog() *catalogSnapshot {
+	if c := p.snapshot.Load(); c != nil {
+		return c
+	}
+	return emptyCatalog
+}
+
+// validateCatalog checks products before they are swapped in: there must
+// be some, each with a unique ID, a name and a valid price.
+func validateCatalog(products []*pb.Product) error {
+	if len(products) == 0 {
+		return errors.New("catalog has no products")
+	}
+	var errs []error
+	seen := make(map[string]bool, len(products))
+	for i, p := range products {
+		id := p.GetId()
+		switch {
+		case id == "":
+			errs = append(errs, fmt.Errorf("product %d has no id", i))
+			continue
+		case seen[id]:
+			errs = append(errs, fmt.Errorf("product %s is listed twice", id))
+		}
+		seen[id] = true
+		if p.GetName() == "" {
+			errs = append(errs, fmt.Errorf("product %s has no name", id))
+		}
+		if err := validatePrice(p.GetPriceUsd()); err != nil {
+			errs = append(errs, fmt.Errorf("product %s: %v", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validatePrice(m *pb.Money) error {
+	switch {
+	case m == nil:
+		return errors.New("no price_usd")
+	case len(m.GetCurrencyCode()) != 3 || strings.ToUpper(m.GetCurrencyCode()) != m.GetCurrencyCode():
+		return fmt.Errorf("invalid currency code %q", m.GetCurrencyCode())
+	case m.GetNanos() >= 1e9:
+		return fmt.Errorf("nanos %d out of range", m.GetNanos())
+	case m.GetUnits() < 0 || m.GetNanos() < 0:
+		return errors.New("negative price")
+	}
+	return nil
+}
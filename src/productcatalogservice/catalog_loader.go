@@ -30,21 +30,27 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func loadCatalog(catalog *pb.ListProductsResponse) error {
-	catalogMutex.Lock()
-	defer catalogMutex.Unlock()
-
+// catalogFile is the catalog read when AlloyDB is not configured.
+const catalogFile = "products.json"
+
+// loadCatalog reads the products from AlloyDB, when ALLOYDB_CLUSTER_NAME is
+// set, or else from products.json.
+func loadCatalog() ([]*pb.Product, error) {
+	var catalog pb.ListProductsResponse
+	load := loadCatalogFromLocalFile
 	if os.Getenv("ALLOYDB_CLUSTER_NAME") != "" {
-		return loadCatalogFromAlloyDB(catalog)
+		load = loadCatalogFromAlloyDB
 	}
-
-	return loadCatalogFromLocalFile(catalog)
+	if err := load(&catalog); err != nil {
+		return nil, err
+	}
+	return catalog.Products, nil
 }
 
 func loadCatalogFromLocalFile(catalog *pb.ListProductsResponse) error {
 	log.Info("loading catalog from local products.json file...")
 
-	catalogJSON, err := os.ReadFile("products.json")
+	catalogJSON, err := os.ReadFile(catalogFile)
 	if err != nil {
 		log.Warnf("failed to open product catalog json file: %v", err)
 		return err
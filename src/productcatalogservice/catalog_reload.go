@@ -0,0 +1,167 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/productcatalogservice/genproto"
+)
+
+const (
+	// defaultPollInterval is how often the AlloyDB catalog is reloaded
+	// unless CATALOG_POLL_INTERVAL says otherwise.
+	defaultPollInterval = time.Minute
+	// watchDebounce lets a burst of file events, like an editor's
+	// truncate-and-write, settle into one reload.
+	watchDebounce = 500 * time.Millisecond
+)
+
+// catalogSource names where the catalog is loaded from, for metrics.
+func catalogSource() string {
+	if os.Getenv("ALLOYDB_CLUSTER_NAME") != "" {
+		return "alloydb"
+	}
+	return "file"
+}
+
+// reload loads and validates the catalog and swaps it in. On failure the
+// current snapshot stays. Reloads run one at a time; readers never wait for
+// them.
+func (p *productCatalog) reload() error {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+
+	load := p.load
+	if load == nil {
+		load = loadCatalog
+	}
+	products, err := load()
+	if err == nil {
+		err = validateCatalog(products)
+	}
+	if err != nil {
+		log.Warnf("failed to reload catalog, keeping version %s: %v", p.catalog().version, err)
+		p.reloaded("failure")
+		return err
+	}
+
+	next := newCatalogSnapshot(products)
+	if cur := p.snapshot.Load(); cur != nil && cur.version == next.version {
+		p.reloaded("unchanged")
+		return nil
+	}
+	p.snapshot.Store(next)
+	log.Infof("catalog version %s loaded with %d products", next.version, len(next.products))
+	p.reloaded("success")
+	return nil
+}
+
+func (p *productCatalog) setCatalog(products []*pb.Product) {
+	p.snapshot.Store(newCatalogSnapshot(products))
+}
+
+// watchCatalogFile reloads the catalog whenever the file at path changes,
+// until ctx is done. It watches the file's directory, so that replacing the
+// file, as editors and Kubernetes ConfigMap updates do, is seen too.
+func (p *productCatalog) watchCatalogFile(ctx context.Context, path string) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			// ConfigMap volumes update files by swapping the ..data link.
+			if name := filepath.Base(e.Name); name == filepath.Base(path) || name == "..data" {
+				settled = time.After(watchDebounce)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			log.Warnf("catalog file watch: %v", err)
+		case <-settled:
+			settled = nil
+			p.reload()
+		}
+	}
+}
+
+// pollCatalog reloads the catalog every interval until ctx is done.
+func (p *productCatalog) pollCatalog(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			p.reload()
+		}
+	}
+}
+
+// initMetrics registers the catalog's metrics: reloads by source and
+// result, and the number of products of the current catalog version.
+func (p *productCatalog) initMetrics(mp metric.MeterProvider) error {
+	meter := mp.Meter("github.com/GoogleCloudPlatform/microservices-demo/src/productcatalogservice")
+	reloads, err := meter.Int64Counter("catalog.reloads",
+		metric.WithDescription("Catalog reloads, by source and result: success, unchanged or failure."),
+		metric.WithUnit("{reload}"))
+	if err != nil {
+		return err
+	}
+	_, err = meter.Int64ObservableGauge("catalog.products",
+		metric.WithDescription("Products in the catalog, by catalog version."),
+		metric.WithUnit("{product}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			c := p.catalog()
+			o.Observe(int64(len(c.products)), metric.WithAttributes(attribute.String("catalog.version", c.version)))
+			return nil
+		}))
+	if err != nil {
+		return err
+	}
+	p.reloads = reloads
+	return nil
+}
+
+func (p *productCatalog) reloaded(result string) {
+	if p.reloads == nil {
+		return
+	}
+	p.reloads.Add(context.Background(), 1, metric.WithAttributes(
+		attribute.String("catalog.source", catalogSource()),
+		attribute.String("catalog.reload.result", result)))
+}
@@ -0,0 +1,319 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/productcatalogservice/genproto"
+	"github.com/sirupsen/logrus"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestCatalogSnapshot(t *testing.T) {
+	c := newCatalogSnapshot([]*pb.Product{
+		{Id: "a", Name: "Vintage Typewriter", Categories: []string{"vintage"}},
+		{Id: "b", Name: "Mug", Description: "A simple mug with a vintage finish.", Categories: []string{"kitchen"}},
+		{Id: "c", Name: "Camera", Categories: []string{"photography", "vintage"}},
+	})
+	if p, ok := c.product("b"); !ok || p.GetName() != "Mug" {
+		t.Errorf("got %v, %t for b, want the mug", p, ok)
+	}
+	if _, ok := c.product("d"); ok {
+		t.Error("found d, which is not in the catalog")
+	}
+	if got := c.inCategory("vintage"); len(got) != 2 || got[0].GetId() != "a" || got[1].GetId() != "c" {
+		t.Errorf("got %v in vintage, want a and c", got)
+	}
+	if got := c.search("VINTAGE"); len(got) != 2 || got[0].GetId() != "a" || got[1].GetId() != "b" {
+		t.Errorf("got %v searching VINTAGE, want a by name and b by description", got)
+	}
+}
+
+// TestCatalogSwap checks that readers keep the snapshot they started with
+// while a reload swaps in another.
+func TestCatalogSwap(t *testing.T) {
+	p := &productCatalog{}
+	p.setCatalog([]*pb.Product{{Id: "old"}})
+	before := p.catalog()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := p.GetProduct(context.Background(), &pb.GetProductRequest{Id: "old"}); err != nil {
+					if _, err := p.GetProduct(context.Background(), &pb.GetProductRequest{Id: "OLJCESPC7Z"}); err != nil {
+						t.Errorf("found neither catalog: %v", err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	if err := p.reload(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if _, ok := before.product("old"); !ok || len(before.products) != 1 {
+		t.Error("the reload changed the snapshot readers held")
+	}
+	if _, ok := p.catalog().product("OLJCESPC7Z"); !ok {
+		t.Error("the reload did not swap in products.json")
+	}
+}
+
+// legacyGetProduct is how GetProduct looked products up before catalog
+// snapshots: a scan that parses the catalog three times per product.
+func legacyGetProduct(parseCatalog func() []*pb.Product, id string) *pb.Product {
+	var found *pb.Product
+	for i := 0; i < len(parseCatalog()); i++ {
+		if id == parseCatalog()[i].Id {
+			found = parseCatalog()[i]
+		}
+	}
+	return found
+}
+
+// BenchmarkGetProduct compares GetProduct for the last product of
+// products.json, with stock from inventory.json, against the scan it
+// replaced, both on a loaded catalog and, as with reloading enabled, reading
+// products.json on each parse. The parallel run shows whether reads wait on
+// each other.
+func BenchmarkGetProduct(b *testing.B) {
+	products, err := loadCatalog()
+	if err != nil {
+		b.Fatal(err)
+	}
+	stock, err := os.ReadFile(defaultInventoryFile)
+	if err != nil {
+		b.Fatal(err)
+	}
+	warehouses, err := parseInventory(stock)
+	if err != nil {
+		b.Fatal(err)
+	}
+	p := &productCatalog{inventory: newWarehouseInventory(warehouses)}
+	p.snapshot.Store(newCatalogSnapshot(products))
+	id := products[len(products)-1].GetId()
+	req := &pb.GetProductRequest{Id: id}
+	ctx := context.Background()
+
+	b.Run("snapshot", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := p.GetProduct(ctx, req); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("snapshot-parallel", func(b *testing.B) {
+		b.RunParallel(func(next *testing.PB) {
+			for next.Next() {
+				if _, err := p.GetProduct(ctx, req); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+	b.Run("scan", func(b *testing.B) {
+		parse := func() []*pb.Product { return products }
+		for i := 0; i < b.N; i++ {
+			if p.inventory.withStock(legacyGetProduct(parse, id))[0] == nil {
+				b.Fatal("not found")
+			}
+		}
+	})
+	b.Run("scan-reloading", func(b *testing.B) {
+		log.SetLevel(logrus.WarnLevel)
+		defer log.SetLevel(logrus.InfoLevel)
+		parse := func() []*pb.Product {
+			products, err := loadCatalog()
+			if err != nil {
+				b.Fatal(err)
+			}
+			return products
+		}
+		for i := 0; i < b.N; i++ {
+			if p.inventory.withStock(legacyGetProduct(parse, id))[0] == nil {
+				b.Fatal("not found")
+			}
+		}
+	})
+}
+
+// BenchmarkGetProductDuringReload measures GetProduct while the catalog is
+// reloaded from products.json as fast as possible in the background.
+func BenchmarkGetProductDuringReload(b *testing.B) {
+	log.SetLevel(logrus.WarnLevel)
+	defer log.SetLevel(logrus.InfoLevel)
+	p := &productCatalog{}
+	if err := p.reload(); err != nil {
+		b.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				p.reload()
+			}
+		}
+	}()
+
+	req := &pb.GetProductRequest{Id: "OLJCESPC7Z"}
+	b.ResetTimer()
+	b.RunParallel(func(next *testing.PB) {
+		for next.Next() {
+			if _, err := p.GetProduct(context.Background(), req); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestReloadValidates(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	p := &productCatalog{}
+	if err := p.initMetrics(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))); err != nil {
+		t.Fatal(err)
+	}
+	price := &pb.Money{CurrencyCode: "USD", Units: 1}
+	next := []*pb.Product{{Id: "a", Name: "A", PriceUsd: price}}
+	p.load = func() ([]*pb.Product, error) { return next, nil }
+
+	if err := p.reload(); err != nil {
+		t.Fatal(err)
+	}
+	version := p.catalog().version
+	if err := p.reload(); err != nil || p.catalog().version != version {
+		t.Errorf("got %v, version %s reloading the same products, want version %s", err, p.catalog().version, version)
+	}
+	for _, bad := range [][]*pb.Product{
+		nil,
+		{{Id: "a", Name: "A", PriceUsd: price}, {Id: "a", Name: "Again", PriceUsd: price}},
+		{{Id: "b", PriceUsd: price}},
+		{{Id: "c", Name: "C"}},
+		{{Id: "d", Name: "D", PriceUsd: &pb.Money{CurrencyCode: "usd", Units: 1}}},
+		{{Id: "e", Name: "E", PriceUsd: &pb.Money{CurrencyCode: "USD", Units: -1}}},
+	} {
+		next = bad
+		if err := p.reload(); err == nil {
+			t.Errorf("reloaded %v, want it rejected", bad)
+		}
+	}
+	if _, ok := p.catalog().product("a"); !ok || p.catalog().version != version {
+		t.Error("a rejected catalog replaced the current one")
+	}
+	next = append(next[:0:0], &pb.Product{Id: "f", Name: "F", PriceUsd: price})
+	if err := p.reload(); err != nil || p.catalog().version == version {
+		t.Errorf("got %v, version %s, want a new version", err, p.catalog().version)
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	reloads := map[string]int64{}
+	var products int64
+	var productsVersion string
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				for _, dp := range data.DataPoints {
+					result, _ := dp.Attributes.Value("catalog.reload.result")
+					reloads[result.AsString()] += dp.Value
+				}
+			case metricdata.Gauge[int64]:
+				for _, dp := range data.DataPoints {
+					v, _ := dp.Attributes.Value("catalog.version")
+					products, productsVersion = dp.Value, v.AsString()
+				}
+			}
+		}
+	}
+	if reloads["success"] != 2 || reloads["unchanged"] != 1 || reloads["failure"] != 6 {
+		t.Errorf("got reloads %v, want 2 successes, 1 unchanged and 6 failures", reloads)
+	}
+	if products != 1 || productsVersion != p.catalog().version {
+		t.Errorf("got %d products of version %s, want 1 of %s", products, productsVersion, p.catalog().version)
+	}
+}
+
+func TestWatchCatalogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "products.json")
+	write := func(name string) {
+		t.Helper()
+		data := `{"products": [{"id": "a", "name": "` + name + `", "priceUsd": {"currencyCode": "USD", "units": 1}}]}`
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("Before")
+	p := &productCatalog{load: func() ([]*pb.Product, error) {
+		var catalog pb.ListProductsResponse
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := protojson.Unmarshal(data, &catalog); err != nil {
+			return nil, err
+		}
+		return catalog.Products, nil
+	}}
+	if err := p.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- p.watchCatalogFile(ctx, path) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	name := func() string {
+		product, _ := p.catalog().product("a")
+		return product.GetName()
+	}
+	// The watch may start after a write, so rewrite the file until the
+	// reload shows, leaving each write time to settle.
+	for deadline := time.Now().Add(10 * time.Second); name() != "After"; {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %q after rewriting the file, want After", name())
+		}
+		write("After")
+		for settle := time.Now().Add(2 * watchDebounce); name() != "After" && time.Now().Before(settle); {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
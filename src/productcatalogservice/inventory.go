@@ -0,0 +1,553 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/productcatalogservice/genproto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultInventoryFile  = "inventory.json"
+	defaultReservationTTL = 15 * time.Minute
+	// reservationExpiryInterval is how often expired reservations are
+	// released in the background, and so how long reads may still count
+	// them.
+	reservationExpiryInterval = 10 * time.Second
+
+	// defaultWarehouse holds the stock of an inventory file that is a plain
+	// map of product IDs to units.
+	defaultWarehouse = "default"
+)
+
+// warehouse is a stock location in the inventory file.
+type warehouse struct {
+	ID    string           `json:"id"`
+	Name  string           `json:"name"`
+	Stock map[string]int32 `json:"stock"`
+}
+
+// stockKey identifies the stock of a product in one warehouse.
+type stockKey struct {
+	warehouse string
+	product   string
+}
+
+type reservation struct {
+	items   map[stockKey]int32
+	expires time.Time
+}
+
+// inventory tracks stock per product and warehouse. Products no warehouse
+// has a stock level for are not tracked, can always be ordered and ship
+// from the first warehouse. Reserved units stay on hand but are not
+// available until the reservation is released or expires.
+//
+// Writes hold mu and publish the available units per product in stock,
+// which reads load without locking.
+type inventory struct {
+	stock atomic.Pointer[map[string]int32]
+
+	mu sync.Mutex
+	// warehouses are in order of preference; the first is the default.
+	warehouses   []string
+	tracked      map[string]bool
+	onHand       map[stockKey]int32
+	reserved     map[stockKey]int32
+	reservations map[string]*reservation
+	ttl          time.Duration
+	now          func() time.Time
+}
+
+// newInventory returns an inventory with a single warehouse holding stock.
+func newInventory(stock map[string]int32) *inventory {
+	return newWarehouseInventory([]*warehouse{{ID: defaultWarehouse, Stock: stock}})
+}
+
+func newWarehouseInventory(warehouses []*warehouse) *inventory {
+	inv := &inventory{
+		tracked:      make(map[string]bool),
+		onHand:       make(map[stockKey]int32),
+		reserved:     make(map[stockKey]int32),
+		reservations: make(map[string]*reservation),
+		ttl:          defaultReservationTTL,
+		now:          time.Now,
+	}
+	for _, w := range warehouses {
+		inv.warehouses = append(inv.warehouses, w.ID)
+		for id, n := range w.Stock {
+			inv.tracked[id] = true
+			inv.onHand[stockKey{w.ID, id}] = n
+		}
+	}
+	if len(inv.warehouses) == 0 {
+		inv.warehouses = []string{defaultWarehouse}
+	}
+	inv.publishLocked()
+	return inv
+}
+
+// loadInventory reads stock levels from INVENTORY_FILE, falling back to
+// inventory.json. A missing default file means stock is not tracked.
+func loadInventory() (*inventory, error) {
+	path := os.Getenv("INVENTORY_FILE")
+	explicit := path != ""
+	if !explicit {
+		path = defaultInventoryFile
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		log.Info("no inventory file, stock is not tracked")
+		return newInventory(nil), nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read inventory file: %v", err)
+	}
+	warehouses, err := parseInventory(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse inventory file %s: %v", path, err)
+	}
+	log.Infof("loaded stock levels for %d warehouses from %s", len(warehouses), path)
+	inv := newWarehouseInventory(warehouses)
+	if s := os.Getenv("RESERVATION_TTL"); s != "" {
+		ttl, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse RESERVATION_TTL (%s) as time.Duration: %v", s, err)
+		}
+		inv.ttl = ttl
+	}
+	return inv, nil
+}
+
+// parseInventory accepts either {"warehouses": [...]} or, for a single
+// warehouse, a plain map of product IDs to units.
+func parseInventory(b []byte) ([]*warehouse, error) {
+	var cfg struct {
+		Warehouses []*warehouse `json:"warehouses"`
+	}
+	if err := json.Unmarshal(b, &cfg); err == nil && cfg.Warehouses != nil {
+		seen := make(map[string]bool)
+		for _, w := range cfg.Warehouses {
+			if w.ID == "" {
+				return nil, fmt.Errorf("warehouse is missing an id")
+			}
+			if seen[w.ID] {
+				return nil, fmt.Errorf("warehouse %s is listed twice", w.ID)
+			}
+			seen[w.ID] = true
+		}
+		return cfg.Warehouses, nil
+	}
+	var stock map[string]int32
+	if err := json.Unmarshal(b, &stock); err != nil {
+		return nil, err
+	}
+	return []*warehouse{{ID: defaultWarehouse, Stock: stock}}, nil
+}
+
+// availableAtLocked returns the units of a product that can be reserved in
+// a warehouse, or -1 if its stock is not tracked. The caller must hold
+// inv.mu.
+func (inv *inventory) availableAtLocked(warehouse, id string) int32 {
+	if !inv.tracked[id] {
+		return -1
+	}
+	k := stockKey{warehouse, id}
+	return inv.onHand[k] - inv.reserved[k]
+}
+
+// availableLocked returns the units of a product that can be reserved across
+// all warehouses, or -1 if its stock is not tracked. The caller must hold
+// inv.mu.
+func (inv *inventory) availableLocked(id string) int32 {
+	if !inv.tracked[id] {
+		return -1
+	}
+	var n int32
+	for _, w := range inv.warehouses {
+		n += inv.availableAtLocked(w, id)
+	}
+	return n
+}
+
+func (inv *inventory) knownWarehouse(id string) bool {
+	for _, w := range inv.warehouses {
+		if w == id {
+			return true
+		}
+	}
+	return false
+}
+
+// publishLocked swaps in the available units of every tracked product.
+// The caller must hold inv.mu.
+func (inv *inventory) publishLocked() {
+	stock := make(map[string]int32, len(inv.tracked))
+	for id := range inv.tracked {
+		stock[id] = inv.availableLocked(id)
+	}
+	inv.stock.Store(&stock)
+}
+
+// withStock returns copies of the products with their available stock set,
+// as last published. A nil inventory tracks nothing.
+func (inv *inventory) withStock(products ...*pb.Product) []*pb.Product {
+	var stock map[string]int32
+	if inv != nil {
+		stock = *inv.stock.Load()
+	}
+	out := make([]*pb.Product, len(products))
+	for i, p := range products {
+		out[i] = proto.Clone(p).(*pb.Product)
+		out[i].Stock = -1
+		if n, ok := stock[p.GetId()]; ok {
+			out[i].Stock = n
+		}
+	}
+	return out
+}
+
+// wantedQuantities sums the requested units per product, keeping the order
+// in which products first appear.
+func wantedQuantities(items []*pb.CartItem) ([]string, map[string]int32, error) {
+	var order []string
+	want := make(map[string]int32)
+	for _, it := range items {
+		if it.GetQuantity() <= 0 {
+			return nil, nil, status.Errorf(codes.InvalidArgument, "invalid quantity %d for product %s", it.GetQuantity(), it.GetProductId())
+		}
+		if _, ok := want[it.GetProductId()]; !ok {
+			order = append(order, it.GetProductId())
+		}
+		want[it.GetProductId()] += it.GetQuantity()
+	}
+	return order, want, nil
+}
+
+// allocateLocked splits items across warehouses. Each product ships from a
+// single warehouse when one has enough of it, preferring warehouses the
+// order already ships from; otherwise it is split across warehouses in
+// order of preference. Untracked products ship from the default warehouse.
+// The caller must hold inv.mu.
+func (inv *inventory) allocateLocked(items []*pb.CartItem) ([]*pb.StockAllocation, error) {
+	products, want, err := wantedQuantities(items)
+	if err != nil {
+		return nil, err
+	}
+	take := make(map[stockKey]int32)
+	used := make(map[string]bool)
+	for _, pid := range products {
+		n := want[pid]
+		if !inv.tracked[pid] {
+			take[stockKey{inv.warehouses[0], pid}] = n
+			used[inv.warehouses[0]] = true
+			continue
+		}
+		if avail := inv.availableLocked(pid); avail < n {
+			return nil, status.Errorf(codes.FailedPrecondition, "product %s is out of stock (%d available, %d requested)", pid, avail, n)
+		}
+		// Try the warehouses already in use first, then the rest.
+		candidates := make([]string, 0, len(inv.warehouses))
+		for _, w := range inv.warehouses {
+			if used[w] {
+				candidates = append(candidates, w)
+			}
+		}
+		for _, w := range inv.warehouses {
+			if !used[w] {
+				candidates = append(candidates, w)
+			}
+		}
+		single := ""
+		for _, w := range candidates {
+			if inv.availableAtLocked(w, pid) >= n {
+				single = w
+				break
+			}
+		}
+		if single != "" {
+			take[stockKey{single, pid}] = n
+			used[single] = true
+			continue
+		}
+		for _, w := range candidates {
+			m := inv.availableAtLocked(w, pid)
+			if m <= 0 {
+				continue
+			}
+			if m > n {
+				m = n
+			}
+			take[stockKey{w, pid}] = m
+			used[w] = true
+			if n -= m; n == 0 {
+				break
+			}
+		}
+	}
+	return inv.allocations(products, take), nil
+}
+
+// allocations groups the units taken per warehouse, in warehouse order.
+func (inv *inventory) allocations(products []string, take map[stockKey]int32) []*pb.StockAllocation {
+	var out []*pb.StockAllocation
+	for _, w := range inv.warehouses {
+		var items []*pb.CartItem
+		for _, pid := range products {
+			if n := take[stockKey{w, pid}]; n > 0 {
+				items = append(items, &pb.CartItem{ProductId: pid, Quantity: n})
+			}
+		}
+		if len(items) > 0 {
+			out = append(out, &pb.StockAllocation{WarehouseId: w, Items: items})
+		}
+	}
+	return out
+}
+
+// allocate plans an allocation without reserving anything.
+func (inv *inventory) allocate(items []*pb.CartItem) ([]*pb.StockAllocation, error) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.expireLocked()
+	return inv.allocateLocked(items)
+}
+
+// reserve holds stock under id. With allocations, stock is taken from the
+// given warehouses; otherwise items are allocated first.
+func (inv *inventory) reserve(id string, items []*pb.CartItem, allocations []*pb.StockAllocation) ([]*pb.StockAllocation, time.Time, error) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.expireLocked()
+
+	if _, ok := inv.reservations[id]; ok {
+		return nil, time.Time{}, status.Errorf(codes.AlreadyExists, "reservation %s already exists", id)
+	}
+	if len(allocations) == 0 {
+		var err error
+		if allocations, err = inv.allocateLocked(items); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	want := make(map[stockKey]int32)
+	var products []string
+	seen := make(map[string]bool)
+	for _, a := range allocations {
+		if !inv.knownWarehouse(a.GetWarehouseId()) {
+			return nil, time.Time{}, status.Errorf(codes.InvalidArgument, "unknown warehouse %s", a.GetWarehouseId())
+		}
+		order, n, err := wantedQuantities(a.GetItems())
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		for _, pid := range order {
+			want[stockKey{a.GetWarehouseId(), pid}] += n[pid]
+			if !seen[pid] {
+				seen[pid] = true
+				products = append(products, pid)
+			}
+		}
+	}
+	for k, n := range want {
+		if avail := inv.availableAtLocked(k.warehouse, k.product); avail >= 0 && avail < n {
+			return nil, time.Time{}, status.Errorf(codes.FailedPrecondition, "product %s is out of stock in warehouse %s (%d available, %d requested)", k.product, k.warehouse, avail, n)
+		}
+	}
+
+	r := &reservation{items: make(map[stockKey]int32), expires: inv.now().Add(inv.ttl)}
+	for k, n := range want {
+		if inv.tracked[k.product] {
+			inv.reserved[k] += n
+			r.items[k] = n
+		}
+	}
+	inv.reservations[id] = r
+	inv.publishLocked()
+	return inv.allocations(products, want), r.expires, nil
+}
+
+// commit removes a reservation and its units from stock.
+func (inv *inventory) commit(id string) error {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	r, ok := inv.reservations[id]
+	if !ok {
+		return status.Errorf(codes.NotFound, "no reservation %s", id)
+	}
+	for k, n := range r.items {
+		inv.onHand[k] -= n
+		inv.reserved[k] -= n
+	}
+	delete(inv.reservations, id)
+	inv.publishLocked()
+	return nil
+}
+
+// release removes a reservation and makes its units available again.
+func (inv *inventory) release(id string) error {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	r, ok := inv.reservations[id]
+	if !ok {
+		return status.Errorf(codes.NotFound, "no reservation %s", id)
+	}
+	inv.releaseLocked(id, r)
+	inv.publishLocked()
+	return nil
+}
+
+// restock adds units of tracked products back to stock in a warehouse, the
+// default one if warehouse is empty.
+func (inv *inventory) restock(warehouse string, items []*pb.CartItem) error {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if warehouse == "" {
+		warehouse = inv.warehouses[0]
+	} else if !inv.knownWarehouse(warehouse) {
+		return status.Errorf(codes.InvalidArgument, "unknown warehouse %s", warehouse)
+	}
+	for _, it := range items {
+		if inv.tracked[it.GetProductId()] && it.GetQuantity() > 0 {
+			inv.onHand[stockKey{warehouse, it.GetProductId()}] += it.GetQuantity()
+		}
+	}
+	inv.publishLocked()
+	return nil
+}
+
+func (inv *inventory) releaseLocked(id string, r *reservation) {
+	for k, n := range r.items {
+		inv.reserved[k] -= n
+	}
+	delete(inv.reservations, id)
+}
+
+// expireLocked releases reservations whose TTL has passed, e.g. because the
+// checkout that made them crashed before committing. The caller must hold
+// inv.mu.
+func (inv *inventory) expireLocked() {
+	now := inv.now()
+	expired := false
+	for id, r := range inv.reservations {
+		if now.After(r.expires) {
+			log.Infof("reservation %s expired", id)
+			inv.releaseLocked(id, r)
+			expired = true
+		}
+	}
+	if expired {
+		inv.publishLocked()
+	}
+}
+
+// expire releases the reservations whose TTL has passed.
+func (inv *inventory) expire() {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.expireLocked()
+}
+
+// expireReservations releases expired reservations every interval, so that
+// reads see their units again without scanning reservations themselves.
+func (inv *inventory) expireReservations(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			inv.expire()
+		}
+	}
+}
+
+// checkKnown fails with NOT_FOUND for items that are not in the catalog.
+func (p *productCatalog) checkKnown(items []*pb.CartItem) error {
+	catalog := p.catalog()
+	for _, it := range items {
+		if _, ok := catalog.product(it.GetProductId()); !ok {
+			return status.Errorf(codes.NotFound, "no product with ID %s", it.GetProductId())
+		}
+	}
+	return nil
+}
+
+func (p *productCatalog) AllocateStock(ctx context.Context, req *pb.AllocateStockRequest) (*pb.AllocateStockResponse, error) {
+	if err := p.checkKnown(req.GetItems()); err != nil {
+		return nil, err
+	}
+	allocations, err := p.inventory.allocate(req.GetItems())
+	if err != nil {
+		return nil, err
+	}
+	return &pb.AllocateStockResponse{Allocations: allocations}, nil
+}
+
+func (p *productCatalog) ReserveStock(ctx context.Context, req *pb.ReserveStockRequest) (*pb.ReserveStockResponse, error) {
+	if req.GetReservationId() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "reservation_id is required")
+	}
+	items := req.GetItems()
+	for _, a := range req.GetAllocations() {
+		items = append(items, a.GetItems()...)
+	}
+	if err := p.checkKnown(items); err != nil {
+		return nil, err
+	}
+	allocations, expires, err := p.inventory.reserve(req.GetReservationId(), req.GetItems(), req.GetAllocations())
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("reserved stock for %s in %d warehouses", req.GetReservationId(), len(allocations))
+	return &pb.ReserveStockResponse{
+		ReservationId: req.GetReservationId(),
+		ExpiresAtUnix: expires.Unix(),
+		Allocations:   allocations,
+	}, nil
+}
+
+func (p *productCatalog) CommitReservation(ctx context.Context, req *pb.CommitReservationRequest) (*pb.Empty, error) {
+	if err := p.inventory.commit(req.GetReservationId()); err != nil {
+		return nil, err
+	}
+	log.Infof("committed reservation %s", req.GetReservationId())
+	return &pb.Empty{}, nil
+}
+
+func (p *productCatalog) ReleaseReservation(ctx context.Context, req *pb.ReleaseReservationRequest) (*pb.Empty, error) {
+	if err := p.inventory.release(req.GetReservationId()); err != nil {
+		return nil, err
+	}
+	log.Infof("released reservation %s", req.GetReservationId())
+	return &pb.Empty{}, nil
+}
+
+func (p *productCatalog) RestockProducts(ctx context.Context, req *pb.RestockProductsRequest) (*pb.Empty, error) {
+	if err := p.inventory.restock(req.GetWarehouseId(), req.GetItems()); err != nil {
+		return nil, err
+	}
+	log.Infof("restocked %d items", len(req.GetItems()))
+	return &pb.Empty{}, nil
+}
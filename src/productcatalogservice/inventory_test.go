@@ -0,0 +1,285 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/productcatalogservice/genproto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newStockedCatalog() *productCatalog {
+	p := &productCatalog{inventory: newInventory(map[string]int32{"abc001": 3, "abc002": 0})}
+	p.snapshot.Store(mockProductCatalog.catalog())
+	return p
+}
+
+func stockOf(t *testing.T, p *productCatalog, id string) int32 {
+	t.Helper()
+	product, err := p.GetProduct(context.Background(), &pb.GetProductRequest{Id: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return product.GetStock()
+}
+
+func TestProductStock(t *testing.T) {
+	p := newStockedCatalog()
+	for id, want := range map[string]int32{"abc001": 3, "abc002": 0, "abc003": -1} {
+		if got := stockOf(t, p, id); got != want {
+			t.Errorf("%s: got stock %d, want %d", id, got, want)
+		}
+	}
+	if got := stockOf(t, mockProductCatalog, "abc001"); got != -1 {
+		t.Errorf("got stock %d without inventory, want -1", got)
+	}
+}
+
+func TestReserveCommitRelease(t *testing.T) {
+	ctx := context.Background()
+	p := newStockedCatalog()
+
+	if _, err := p.ReserveStock(ctx, &pb.ReserveStockRequest{
+		ReservationId: "order-1",
+		Items:         []*pb.CartItem{{ProductId: "abc001", Quantity: 2}, {ProductId: "abc003", Quantity: 5}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := stockOf(t, p, "abc001"); got != 1 {
+		t.Errorf("got stock %d after reserving, want 1", got)
+	}
+
+	_, err := p.ReserveStock(ctx, &pb.ReserveStockRequest{
+		ReservationId: "order-2",
+		Items:         []*pb.CartItem{{ProductId: "abc001", Quantity: 2}},
+	})
+	if got, want := status.Code(err), codes.FailedPrecondition; got != want {
+		t.Errorf("reserving more than available: got %s, want %s", got, want)
+	}
+
+	if _, err := p.ReleaseReservation(ctx, &pb.ReleaseReservationRequest{ReservationId: "order-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := stockOf(t, p, "abc001"); got != 3 {
+		t.Errorf("got stock %d after releasing, want 3", got)
+	}
+
+	if _, err := p.ReserveStock(ctx, &pb.ReserveStockRequest{
+		ReservationId: "order-3",
+		Items:         []*pb.CartItem{{ProductId: "abc001", Quantity: 3}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.CommitReservation(ctx, &pb.CommitReservationRequest{ReservationId: "order-3"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := stockOf(t, p, "abc001"); got != 0 {
+		t.Errorf("got stock %d after committing, want 0", got)
+	}
+	_, err = p.ReleaseReservation(ctx, &pb.ReleaseReservationRequest{ReservationId: "order-3"})
+	if got, want := status.Code(err), codes.NotFound; got != want {
+		t.Errorf("releasing a committed reservation: got %s, want %s", got, want)
+	}
+}
+
+func TestReserveStockErrors(t *testing.T) {
+	p := newStockedCatalog()
+	for name, req := range map[string]*pb.ReserveStockRequest{
+		"unknown product": {ReservationId: "r", Items: []*pb.CartItem{{ProductId: "nope", Quantity: 1}}},
+		"out of stock":    {ReservationId: "r", Items: []*pb.CartItem{{ProductId: "abc002", Quantity: 1}}},
+		"no id":           {Items: []*pb.CartItem{{ProductId: "abc001", Quantity: 1}}},
+	} {
+		if _, err := p.ReserveStock(context.Background(), req); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestReservationExpires(t *testing.T) {
+	now := time.Now()
+	p := newStockedCatalog()
+	p.inventory.now = func() time.Time { return now }
+
+	if _, err := p.ReserveStock(context.Background(), &pb.ReserveStockRequest{
+		ReservationId: "abandoned",
+		Items:         []*pb.CartItem{{ProductId: "abc001", Quantity: 3}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := stockOf(t, p, "abc001"); got != 0 {
+		t.Fatalf("got stock %d, want 0", got)
+	}
+	now = now.Add(defaultReservationTTL + time.Second)
+	if got := stockOf(t, p, "abc001"); got != 0 {
+		t.Fatalf("got stock %d before the expiry ran, want 0", got)
+	}
+	p.inventory.expire()
+	if got := stockOf(t, p, "abc001"); got != 3 {
+		t.Errorf("got stock %d after the reservation expired, want 3", got)
+	}
+}
+
+func TestStockReadsDoNotWaitForWrites(t *testing.T) {
+	p := newStockedCatalog()
+	p.inventory.mu.Lock()
+	defer p.inventory.mu.Unlock()
+
+	done := make(chan int32)
+	go func() {
+		product, _ := p.GetProduct(context.Background(), &pb.GetProductRequest{Id: "abc001"})
+		done <- product.GetStock()
+	}()
+	select {
+	case got := <-done:
+		if got != 3 {
+			t.Errorf("got stock %d, want 3", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("GetProduct waited for the inventory lock")
+	}
+}
+
+func TestRestockProducts(t *testing.T) {
+	p := newStockedCatalog()
+	if _, err := p.RestockProducts(context.Background(), &pb.RestockProductsRequest{
+		Items: []*pb.CartItem{{ProductId: "abc002", Quantity: 4}, {ProductId: "abc003", Quantity: 1}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := stockOf(t, p, "abc002"); got != 4 {
+		t.Errorf("got stock %d after restocking, want 4", got)
+	}
+	if got := stockOf(t, p, "abc003"); got != -1 {
+		t.Errorf("got stock %d for an untracked product, want -1", got)
+	}
+}
+
+func newWarehouseCatalog() *productCatalog {
+	p := &productCatalog{inventory: newWarehouseInventory([]*warehouse{
+		{ID: "west", Stock: map[string]int32{"abc001": 2, "abc002": 5}},
+		{ID: "east", Stock: map[string]int32{"abc001": 4, "abc003": 1}},
+	})}
+	p.snapshot.Store(mockProductCatalog.catalog())
+	return p
+}
+
+func TestAllocateStock(t *testing.T) {
+	for name, tt := range map[string]struct {
+		items []*pb.CartItem
+		want  map[string]map[string]int32
+	}{
+		"single warehouse": {
+			items: []*pb.CartItem{{ProductId: "abc001", Quantity: 2}, {ProductId: "abc002", Quantity: 1}},
+			want:  map[string]map[string]int32{"west": {"abc001": 2, "abc002": 1}},
+		},
+		"prefers warehouses already in use": {
+			items: []*pb.CartItem{{ProductId: "abc003", Quantity: 1}, {ProductId: "abc001", Quantity: 1}},
+			want:  map[string]map[string]int32{"east": {"abc003": 1, "abc001": 1}},
+		},
+		"split across warehouses": {
+			items: []*pb.CartItem{{ProductId: "abc001", Quantity: 5}},
+			want:  map[string]map[string]int32{"west": {"abc001": 2}, "east": {"abc001": 3}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			resp, err := newWarehouseCatalog().AllocateStock(context.Background(), &pb.AllocateStockRequest{Items: tt.items})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]map[string]int32)
+			for _, a := range resp.GetAllocations() {
+				got[a.GetWarehouseId()] = make(map[string]int32)
+				for _, it := range a.GetItems() {
+					got[a.GetWarehouseId()][it.GetProductId()] = it.GetQuantity()
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	_, err := newWarehouseCatalog().AllocateStock(context.Background(), &pb.AllocateStockRequest{
+		Items: []*pb.CartItem{{ProductId: "abc001", Quantity: 7}}})
+	if got, want := status.Code(err), codes.FailedPrecondition; got != want {
+		t.Errorf("allocating more than all warehouses hold: got %s, want %s", got, want)
+	}
+}
+
+func TestReserveAllocatedStock(t *testing.T) {
+	ctx := context.Background()
+	p := newWarehouseCatalog()
+
+	resp, err := p.ReserveStock(ctx, &pb.ReserveStockRequest{
+		ReservationId: "order-1",
+		Allocations: []*pb.StockAllocation{
+			{WarehouseId: "east", Items: []*pb.CartItem{{ProductId: "abc001", Quantity: 4}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetAllocations()) != 1 || resp.GetAllocations()[0].GetWarehouseId() != "east" {
+		t.Errorf("got allocations %v, want the requested one", resp.GetAllocations())
+	}
+	if got := stockOf(t, p, "abc001"); got != 2 {
+		t.Errorf("got stock %d after reserving, want 2", got)
+	}
+
+	_, err = p.ReserveStock(ctx, &pb.ReserveStockRequest{
+		ReservationId: "order-2",
+		Allocations: []*pb.StockAllocation{
+			{WarehouseId: "east", Items: []*pb.CartItem{{ProductId: "abc001", Quantity: 1}}},
+		},
+	})
+	if got, want := status.Code(err), codes.FailedPrecondition; got != want {
+		t.Errorf("reserving from an empty warehouse: got %s, want %s", got, want)
+	}
+
+	if _, err := p.CommitReservation(ctx, &pb.CommitReservationRequest{ReservationId: "order-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.RestockProducts(ctx, &pb.RestockProductsRequest{
+		WarehouseId: "east",
+		Items:       []*pb.CartItem{{ProductId: "abc001", Quantity: 1}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	alloc, err := p.AllocateStock(ctx, &pb.AllocateStockRequest{Items: []*pb.CartItem{{ProductId: "abc003", Quantity: 1}, {ProductId: "abc001", Quantity: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alloc.GetAllocations()) != 1 || alloc.GetAllocations()[0].GetWarehouseId() != "east" {
+		t.Errorf("got allocations %v, want the restocked unit from east", alloc.GetAllocations())
+	}
+}
+
+func TestParseInventory(t *testing.T) {
+	flat, err := parseInventory([]byte(`{"abc001": 3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flat) != 1 || flat[0].ID != defaultWarehouse || flat[0].Stock["abc001"] != 3 {
+		t.Errorf("got %+v, want a single default warehouse", flat[0])
+	}
+	if _, err := parseInventory([]byte(`{"warehouses": [{"id": "a"}, {"id": "a"}]}`)); err == nil {
+		t.Error("expected duplicate warehouses to be rejected")
+	}
+}
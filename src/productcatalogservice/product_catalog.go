@@ -16,18 +16,28 @@ package main
 
 import (
 	"context"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/productcatalogservice/genproto"
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
 type productCatalog struct {
 	pb.UnimplementedProductCatalogServiceServer
-	catalog pb.ListProductsResponse
+	snapshot  atomic.Pointer[catalogSnapshot]
+	inventory *inventory
+
+	// load loads the catalog; nil means loadCatalog.
+	load     func() ([]*pb.Product, error)
+	reloadMu sync.Mutex
+	reloads  metric.Int64Counter
 }
 
 func (p *productCatalog) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
@@ -38,49 +48,32 @@ func (p *productCatalog) Watch(req *healthpb.HealthCheckRequest, ws healthpb.Hea
 	return status.Errorf(codes.Unimplemented, "health check via Watch not implemented")
 }
 
-func (p *productCatalog) ListProducts(context.Context, *pb.Empty) (*pb.ListProductsResponse, error) {
+func (p *productCatalog) ListProducts(ctx context.Context, _ *pb.Empty) (*pb.ListProductsResponse, error) {
 	time.Sleep(extraLatency)
 
-	return &pb.ListProductsResponse{Products: p.parseCatalog()}, nil
+	return &pb.ListProductsResponse{Products: p.inventory.withStock(p.catalogFor(ctx).products...)}, nil
 }
 
 func (p *productCatalog) GetProduct(ctx context.Context, req *pb.GetProductRequest) (*pb.Product, error) {
 	time.Sleep(extraLatency)
 
-	var found *pb.Product
-	for i := 0; i < len(p.parseCatalog()); i++ {
-		if req.Id == p.parseCatalog()[i].Id {
-			found = p.parseCatalog()[i]
-		}
-	}
-
-	if found == nil {
+	found, ok := p.catalogFor(ctx).product(req.Id)
+	if !ok {
 		return nil, status.Errorf(codes.NotFound, "no product with ID %s", req.Id)
 	}
-	return found, nil
+	return p.inventory.withStock(found)[0], nil
 }
 
 func (p *productCatalog) SearchProducts(ctx context.Context, req *pb.SearchProductsRequest) (*pb.SearchProductsResponse, error) {
 	time.Sleep(extraLatency)
 
-	var ps []*pb.Product
-	for _, product := range p.parseCatalog() {
-		if strings.Contains(strings.ToLower(product.Name), strings.ToLower(req.Query)) ||
-			strings.Contains(strings.ToLower(product.Description), strings.ToLower(req.Query)) {
-			ps = append(ps, product)
-		}
-	}
-
-	return &pb.SearchProductsResponse{Results: ps}, nil
+	return &pb.SearchProductsResponse{Results: p.inventory.withStock(p.catalogFor(ctx).search(req.Query)...)}, nil
 }
 
-func (p *productCatalog) parseCatalog() []*pb.Product {
-	if reloadCatalog || len(p.catalog.Products) == 0 {
-		err := loadCatalog(&p.catalog)
-		if err != nil {
-			return []*pb.Product{}
-		}
-	}
-
-	return p.catalog.Products
+// catalogFor returns the current snapshot of the catalog for an RPC and
+// tells the caller its version in the catalog-version response header.
+func (p *productCatalog) catalogFor(ctx context.Context) *catalogSnapshot {
+	c := p.catalog()
+	grpc.SetHeader(ctx, metadata.Pairs("catalog-version", c.version))
+	return c
 }
@@ -29,27 +29,12 @@ var (
 )
 
 func TestMain(m *testing.M) {
-	mockProductCatalog = &productCatalog{
-		catalog: pb.ListProductsResponse{
-			Products: []*pb.Product{},
-		},
-	}
-
-	mockProductCatalog.catalog.Products = append(mockProductCatalog.catalog.Products, &pb.Product{
-		Id:   "abc001",
-		Name: "Product Alpha One",
-	})
-	mockProductCatalog.catalog.Products = append(mockProductCatalog.catalog.Products, &pb.Product{
-		Id:   "abc002",
-		Name: "Product Delta",
-	})
-	mockProductCatalog.catalog.Products = append(mockProductCatalog.catalog.Products, &pb.Product{
-		Id:   "abc003",
-		Name: "Product Alpha Two",
-	})
-	mockProductCatalog.catalog.Products = append(mockProductCatalog.catalog.Products, &pb.Product{
-		Id:   "abc004",
-		Name: "Product Gamma",
+	mockProductCatalog = &productCatalog{}
+	mockProductCatalog.setCatalog([]*pb.Product{
+		{Id: "abc001", Name: "Product Alpha One"},
+		{Id: "abc002", Name: "Product Delta"},
+		{Id: "abc003", Name: "Product Alpha Two"},
+		{Id: "abc004", Name: "Product Gamma"},
 	})
 
 	os.Exit(m.Run())
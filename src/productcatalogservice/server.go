@@ -20,9 +20,6 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"os/signal"
-	"sync"
-	"syscall"
 	"time"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/productcatalogservice/genproto"
@@ -34,34 +31,32 @@ import (
 	"github.com/sirupsen/logrus"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"google.golang.org/grpc"
 )
 
 var (
-	catalogMutex *sync.Mutex
 	log          *logrus.Logger
 	extraLatency time.Duration
 
 	port = "3550"
-
-	reloadCatalog bool
 )
 
 func init() {
 	log = logrus.New()
-	log.Formatter = &logrus.JSONFormatter{
+	log.Formatter = redactingFormatter{&logrus.JSONFormatter{
 		FieldMap: logrus.FieldMap{
 			logrus.FieldKeyTime:  "timestamp",
 			logrus.FieldKeyLevel: "severity",
 			logrus.FieldKeyMsg:   "message",
 		},
 		TimestampFormat: time.RFC3339Nano,
-	}
+	}}
 	log.Out = os.Stdout
-	catalogMutex = &sync.Mutex{}
 }
 
 func main() {
@@ -74,6 +69,15 @@ func main() {
 		log.Info("Tracing disabled.")
 	}
 
+	if os.Getenv("ENABLE_STATS") == "1" {
+		if err := initStats(); err != nil {
+			log.Fatalf("failed to initialize stats: %v", err)
+		}
+		log.Info("Stats enabled.")
+	} else {
+		log.Info("Stats disabled.")
+	}
+
 	if os.Getenv("DISABLE_PROFILER") == "" {
 		log.Info("Profiling enabled.")
 		go initProfiling("productcatalogservice", "1.0.0")
@@ -95,22 +99,6 @@ func main() {
 		extraLatency = time.Duration(0)
 	}
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
-	go func() {
-		for {
-			sig := <-sigs
-			log.Printf("Received signal: %s", sig)
-			if sig == syscall.SIGUSR1 {
-				reloadCatalog = true
-				log.Infof("Enable catalog reloading")
-			} else {
-				reloadCatalog = false
-				log.Infof("Disable catalog reloading")
-			}
-		}
-	}()
-
 	if os.Getenv("PORT") != "" {
 		port = os.Getenv("PORT")
 	}
@@ -135,10 +123,21 @@ func run(port string) string {
 		grpc.StreamInterceptor(otelgrpc.StreamServerInterceptor()))
 
 	svc := &productCatalog{}
-	err = loadCatalog(&svc.catalog)
+	if err := svc.initMetrics(otel.GetMeterProvider()); err != nil {
+		log.Fatalf("failed to create metrics: %v", err)
+	}
+	err = svc.reload()
 	if err != nil {
 		log.Fatalf("could not parse product catalog: %v", err)
 	}
+	if err := startCatalogReloading(svc); err != nil {
+		log.Fatalf("could not start catalog reloading: %v", err)
+	}
+	svc.inventory, err = loadInventory()
+	if err != nil {
+		log.Fatalf("could not load inventory: %v", err)
+	}
+	go svc.inventory.expireReservations(context.Background(), reservationExpiryInterval)
 
 	pb.RegisterProductCatalogServiceServer(srv, svc)
 	healthpb.RegisterHealthServer(srv, svc)
@@ -147,8 +146,46 @@ func run(port string) string {
 	return listener.Addr().String()
 }
 
-func initStats() {
-	// TODO(drewbr) Implement OpenTelemetry stats
+// startCatalogReloading keeps the catalog up to date: products.json is
+// watched for changes, and AlloyDB is polled every CATALOG_POLL_INTERVAL
+// (default 1m; 0 disables polling).
+func startCatalogReloading(svc *productCatalog) error {
+	if catalogSource() == "file" {
+		go func() {
+			if err := svc.watchCatalogFile(context.Background(), catalogFile); err != nil {
+				log.Warnf("not watching %s: %v", catalogFile, err)
+			}
+		}()
+		return nil
+	}
+	interval := defaultPollInterval
+	if s := os.Getenv("CATALOG_POLL_INTERVAL"); s != "" {
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("failed to parse CATALOG_POLL_INTERVAL (%s) as time.Duration: %v", s, err)
+		}
+		interval = v
+	}
+	if interval > 0 {
+		log.Infof("polling the catalog every %v", interval)
+		go svc.pollCatalog(context.Background(), interval)
+	}
+	return nil
+}
+
+// initStats exports metrics over OTLP/HTTP to COLLECTOR_METRICS_ADDR.
+func initStats() error {
+	var collectorAddr string
+	mustMapEnv(&collectorAddr, "COLLECTOR_METRICS_ADDR")
+	exporter, err := otlpmetrichttp.New(context.Background(),
+		otlpmetrichttp.WithEndpoint(collectorAddr),
+		otlpmetrichttp.WithInsecure())
+	if err != nil {
+		return fmt.Errorf("failed to create metric exporter: %v", err)
+	}
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter))))
+	return nil
 }
 
 func initTracing() error {
@@ -0,0 +1,118 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/textproto"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/shipping"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// newGateway returns the HTTP/JSON gateway of the shipping service, which
+// calls it over conn. Routes follow protos/shipping_http.yaml, and bodies
+// are the proto3 JSON of the messages with their proto field names: the
+// same paths and payloads as the shipping function. Unknown fields, like
+// the function's "version", are ignored. The X-Carrier-Signature header is
+// passed on as metadata for RecordTrackingEvent.
+func newGateway(ctx context.Context, conn *grpc.ClientConn) (http.Handler, error) {
+	mux := runtime.NewServeMux(
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.JSONPb{
+			MarshalOptions:   protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true},
+			UnmarshalOptions: protojson.UnmarshalOptions{DiscardUnknown: true},
+		}),
+		runtime.WithErrorHandler(gatewayError),
+		runtime.WithIncomingHeaderMatcher(gatewayHeader),
+		runtime.WithHealthzEndpoint(healthpb.NewHealthClient(conn)),
+	)
+	if err := pb.RegisterShippingServiceHandler(ctx, mux, conn); err != nil {
+		return nil, err
+	}
+	return mux, nil
+}
+
+// gatewayHeader passes carrier signatures on to the service along with the
+// headers grpc-gateway passes by default.
+func gatewayHeader(key string) (string, bool) {
+	if textproto.CanonicalMIMEHeaderKey(key) == shipping.EventSignatureHeader {
+		return key, true
+	}
+	return runtime.DefaultHeaderMatcher(key)
+}
+
+// gatewayError answers a shipment that breaks shipping rules with 422 and
+// its violations, as the shipping function does
+// (cloud-functions/shipping-gcf/schema/v1/error.json), and any other error
+// as grpc-gateway does.
+func gatewayError(ctx context.Context, mux *runtime.ServeMux, m runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	st := status.Convert(err)
+	var rules *errdetails.PreconditionFailure
+	for _, d := range st.Details() {
+		if pf, ok := d.(*errdetails.PreconditionFailure); ok {
+			rules = pf
+		}
+	}
+	if st.Code() != codes.FailedPrecondition || rules == nil {
+		runtime.DefaultHTTPErrorHandler(ctx, mux, m, w, r, err)
+		return
+	}
+
+	type violation struct {
+		Type        string `json:"type"`
+		Subject     string `json:"subject"`
+		Description string `json:"description"`
+	}
+	resp := struct {
+		Error      string      `json:"error"`
+		Violations []violation `json:"violations"`
+	}{Error: st.Message()}
+	for _, v := range rules.GetViolations() {
+		resp.Violations = append(resp.Violations, violation{Type: v.GetType(), Subject: v.GetSubject(), Description: v.GetDescription()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// serveGateway serves the HTTP/JSON gateway on addr, calling the gRPC
+// server listening on grpcAddr.
+func serveGateway(addr, grpcAddr string) error {
+	conn, err := grpc.NewClient(grpcAddr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	gw, err := newGateway(context.Background(), conn)
+	if err != nil {
+		return err
+	}
+	log.Infof("HTTP gateway listening on %s", addr)
+	return http.ListenAndServe(addr, gw)
+}
@@ -22,4 +22,7 @@ outdir=./genproto
 
 protoc --proto_path=$protodir --go_out=./$outdir --go_opt=paths=source_relative --go-grpc_out=./$outdir --go-grpc_opt=paths=source_relative $protodir/demo.proto
 
+# HTTP/JSON gateway of ShippingService; needs protoc-gen-grpc-gateway v2.
+protoc --proto_path=$protodir --grpc-gateway_out=./$outdir --grpc-gateway_opt=paths=source_relative --grpc-gateway_opt=grpc_api_configuration=$protodir/shipping_http.yaml $protodir/demo.proto
+
 # [END gke_shippingservice_genproto]
\ No newline at end of file
@@ -0,0 +1,75 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package label renders printable 4×6 inch shipping labels as PDF, or as
+// ZPL II for thermal printers. Everything, barcodes included, is generated
+// here so labels need no fonts, network or external tools.
+package label
+
+import (
+	"strings"
+	"time"
+)
+
+// Address is a sender or recipient as printed on a label.
+type Address struct {
+	Name    string
+	Street  string
+	City    string
+	State   string
+	Zip     string
+	Country string
+}
+
+// lines returns the address as printed, leaving out empty parts.
+func (a Address) lines() []string {
+	city := a.City
+	if region := strings.TrimSpace(a.State + " " + a.Zip); region != "" {
+		if city != "" {
+			city += ", "
+		}
+		city += region
+	}
+	var out []string
+	for _, l := range []string{a.Name, a.Street, city, a.Country} {
+		if l != "" {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// Label is what a shipping label shows.
+type Label struct {
+	// TrackingID is printed and encoded in a Code 128 barcode.
+	TrackingID string
+	Carrier    string
+	// ServiceLevel is the name of the service level, e.g. "Express".
+	ServiceLevel string
+	From         Address
+	To           Address
+	ShipDate     time.Time
+}
+
+// service returns the service line, e.g. "EXPRESS - UPS".
+func (l Label) service() string {
+	s := strings.ToUpper(l.ServiceLevel)
+	if l.Carrier != "" {
+		if s != "" {
+			s += " - "
+		}
+		s += l.Carrier
+	}
+	return s
+}
@@ -0,0 +1,161 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package label
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testLabel() Label {
+	return Label{
+		TrackingID:   "UP-1A2B-3C4D-5E6F-7G8H",
+		Carrier:      "UPS",
+		ServiceLevel: "Express",
+		From:         Address{Name: "Online Boutique", Street: "1600 Amphitheatre Parkway", City: "Mountain View", State: "CA", Zip: "94043", Country: "US"},
+		To:           Address{Street: "8 Rue (Principale)", City: "Montréal", State: "QC", Zip: "H2X", Country: "CA"},
+		ShipDate:     time.Date(2024, 3, 29, 10, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestCode128Patterns(t *testing.T) {
+	seen := map[string]bool{}
+	for v, p := range code128Patterns {
+		modules, bars := 0, 0
+		for i, w := range p {
+			modules += int(w - '0')
+			if i%2 == 0 {
+				bars += int(w - '0')
+			}
+		}
+		want := 11
+		if v == code128Stop {
+			want = 13
+		}
+		if modules != want {
+			t.Errorf("pattern %d is %d modules wide, want %d", v, modules, want)
+		}
+		if bars%2 != 0 {
+			t.Errorf("pattern %d has an odd number of bar modules", v)
+		}
+		if seen[p] {
+			t.Errorf("pattern %d is a duplicate", v)
+		}
+		seen[p] = true
+	}
+}
+
+// decode reads the symbol values back from module widths.
+func decode(t *testing.T, widths []int) []int {
+	t.Helper()
+	byPattern := map[string]int{}
+	for v, p := range code128Patterns {
+		byPattern[p] = v
+	}
+	var values []int
+	for len(widths) > 0 {
+		n := 6
+		if len(widths) == 7 {
+			n = 7
+		}
+		var p strings.Builder
+		for _, w := range widths[:n] {
+			p.WriteString(strconv.Itoa(w))
+		}
+		v, ok := byPattern[p.String()]
+		if !ok {
+			t.Fatalf("unknown pattern %s", p.String())
+		}
+		values = append(values, v)
+		widths = widths[n:]
+	}
+	return values
+}
+
+func TestCode128(t *testing.T) {
+	widths, err := Code128("PJJ123C")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := decode(t, widths)
+	// Start B, the seven characters, the checksum and stop.
+	want := []int{code128StartB, 48, 42, 42, 17, 18, 19, 35, 55, code128Stop}
+	if len(values) != len(want) {
+		t.Fatalf("got values %v, want %v", values, want)
+	}
+	for i := range want {
+		if values[i] != want[i] {
+			t.Fatalf("got values %v, want %v", values, want)
+		}
+	}
+
+	if _, err := Code128("Montréal"); err == nil {
+		t.Error("got no error for a non-ASCII string")
+	}
+}
+
+func TestPDF(t *testing.T) {
+	pdf, err := testLabel().PDF()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+		t.Fatal("not a PDF document")
+	}
+
+	// Every object must start where the cross-reference table says.
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(pdf)
+	if m == nil {
+		t.Fatal("no startxref")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	if !bytes.HasPrefix(pdf[xref:], []byte("xref\n")) {
+		t.Fatalf("startxref %d does not point at the xref table", xref)
+	}
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(pdf[xref:], -1)
+	if len(entries) != 6 {
+		t.Fatalf("got %d xref entries, want 6", len(entries))
+	}
+	for i, e := range entries {
+		off, _ := strconv.Atoi(string(e[1]))
+		if !bytes.HasPrefix(pdf[off:], []byte(strconv.Itoa(i+1)+" 0 obj\n")) {
+			t.Errorf("object %d is not at offset %d", i+1, off)
+		}
+	}
+
+	for _, want := range []string{"(EXPRESS - UPS)", "(8 Rue \\(Principale\\))", "(Montr\xe9al, QC H2X)", "(UP-1A2B-3C4D-5E6F-7G8H)", " re\n"} {
+		if !bytes.Contains(pdf, []byte(want)) {
+			t.Errorf("PDF does not contain %q", want)
+		}
+	}
+}
+
+func TestZPL(t *testing.T) {
+	l := testLabel()
+	l.To.Street = "8 Rue ^Principale~"
+	zpl := string(l.ZPL())
+	if !strings.HasPrefix(zpl, "^XA\n") || !strings.HasSuffix(zpl, "^XZ\n") {
+		t.Fatal("not a ZPL label")
+	}
+	for _, want := range []string{"^BCN,220,N,N,N^FDUP-1A2B-3C4D-5E6F-7G8H^FS", "^FDEXPRESS - UPS^FS", "^FD8 Rue  Principale ^FS", "^FDMontréal, QC H2X^FS"} {
+		if !strings.Contains(zpl, want) {
+			t.Errorf("ZPL does not contain %q", want)
+		}
+	}
+}
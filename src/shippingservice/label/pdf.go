@@ -0,0 +1,153 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package label
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Page size and margin in points.
+const (
+	pageWidth  = 288
+	pageHeight = 432
+	margin     = 18
+)
+
+// PDF renders the label as a one-page PDF. Text is set in the standard
+// Helvetica fonts, which PDF viewers provide, so nothing is embedded.
+func (l Label) PDF() ([]byte, error) {
+	bars, err := Code128(l.TrackingID)
+	if err != nil {
+		return nil, err
+	}
+
+	var c pdfContent
+	y := float64(pageHeight - margin - 8)
+	c.text("F2", 8, margin, y, "FROM")
+	for _, line := range l.From.lines() {
+		y -= 11
+		c.text("F1", 9, margin, y, line)
+	}
+	y -= 12
+	c.rule(y)
+
+	y -= 18
+	c.text("F2", 8, margin, y, "SHIP TO")
+	for _, line := range l.To.lines() {
+		y -= 18
+		c.text("F2", 14, margin, y, line)
+	}
+	y -= 14
+	c.rule(y)
+
+	y -= 26
+	c.text("F2", 20, margin, y, l.service())
+	if !l.ShipDate.IsZero() {
+		y -= 16
+		c.text("F1", 9, margin, y, "Shipped "+l.ShipDate.Format("Jan 2, 2006"))
+	}
+	y -= 12
+	c.rule(y)
+
+	// The barcode fills the width, quiet zones of ten modules included,
+	// with modules no wider than a point.
+	modules := 20
+	for _, w := range bars {
+		modules += w
+	}
+	module := float64(pageWidth-2*margin) / float64(modules)
+	if module > 1 {
+		module = 1
+	}
+	const barHeight = 80
+	y -= 16 + barHeight
+	x := margin + 10*module
+	for i, w := range bars {
+		if i%2 == 0 {
+			c.printf("%.3f %.3f %.3f %d re\n", x, y, float64(w)*module, barHeight)
+		}
+		x += float64(w) * module
+	}
+	c.printf("f\n")
+	y -= 16
+	c.text("F2", 12, margin, y, l.TrackingID)
+
+	return writePDF(c.Bytes()), nil
+}
+
+// pdfContent is a page content stream.
+type pdfContent struct {
+	bytes.Buffer
+}
+
+func (c *pdfContent) printf(format string, args ...interface{}) {
+	fmt.Fprintf(c, format, args...)
+}
+
+func (c *pdfContent) text(font string, size, x, y float64, s string) {
+	c.printf("BT /%s %g Tf %g %.2f Td (%s) Tj ET\n", font, size, x, y, pdfString(s))
+}
+
+// rule draws a horizontal line across the label.
+func (c *pdfContent) rule(y float64) {
+	c.printf("1 w %d %.2f m %d %.2f l S\n", margin, y, pageWidth-margin, y)
+}
+
+// pdfString escapes s for a PDF literal string in WinAnsiEncoding. Latin-1
+// characters are kept; others become "?".
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteByte(byte(r))
+		case r >= 32 && r < 127 || r >= 160 && r <= 255:
+			b.WriteByte(byte(r))
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// writePDF wraps a content stream in a document of one label-sized page.
+func writePDF(content []byte) []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 5 0 R /F2 6 0 R >> >> /Contents 4 0 R >>", pageWidth, pageHeight),
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", len(content), content),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+	}
+
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, o := range objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, o)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return b.Bytes()
+}
@@ -0,0 +1,80 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package label
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// ZPL renders the label as ZPL II for a 203 dpi thermal printer. The
+// printer draws the Code 128 barcode itself.
+func (l Label) ZPL() []byte {
+	const left = 40
+	var b bytes.Buffer
+	// UTF-8 text, 4×6 inches.
+	b.WriteString("^XA\n^CI28\n^PW812\n^LL1218\n")
+	field := func(y, size int, s string) {
+		fmt.Fprintf(&b, "^FO%d,%d^A0N,%d,%d^FD%s^FS\n", left, y, size, size, zplString(s))
+	}
+	rule := func(y int) {
+		fmt.Fprintf(&b, "^FO%d,%d^GB732,3,3^FS\n", left, y)
+	}
+
+	y := 40
+	field(y, 22, "FROM")
+	for _, line := range l.From.lines() {
+		y += 28
+		field(y, 26, line)
+	}
+	y += 44
+	rule(y)
+
+	y += 24
+	field(y, 22, "SHIP TO")
+	for _, line := range l.To.lines() {
+		y += 44
+		field(y, 40, line)
+	}
+	y += 60
+	rule(y)
+
+	y += 28
+	field(y, 56, l.service())
+	if !l.ShipDate.IsZero() {
+		y += 64
+		field(y, 26, "Shipped "+l.ShipDate.Format("Jan 2, 2006"))
+	}
+	y += 44
+	rule(y)
+
+	y += 40
+	fmt.Fprintf(&b, "^FO%d,%d^BY2^BCN,220,N,N,N^FD%s^FS\n", left, y, zplString(l.TrackingID))
+	y += 240
+	field(y, 36, l.TrackingID)
+	b.WriteString("^XZ\n")
+	return b.Bytes()
+}
+
+// zplString drops the characters that start ZPL commands from field data.
+func zplString(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '^' || r == '~' {
+			return ' '
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,200 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/label"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/shipping"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/trackingid"
+)
+
+// defaultSender is the return address printed on labels unless
+// LABEL_SENDER sets another.
+var defaultSender = label.Address{
+	Name:    "Online Boutique",
+	Street:  "1600 Amphitheatre Parkway",
+	City:    "Mountain View",
+	State:   "CA",
+	Zip:     "94043",
+	Country: "United States",
+}
+
+// labelSender reads the return address from LABEL_SENDER, a JSON object
+// with the fields name, street, city, state, zip and country.
+func labelSender() (label.Address, error) {
+	v := os.Getenv("LABEL_SENDER")
+	if v == "" {
+		return defaultSender, nil
+	}
+	var a label.Address
+	if err := json.Unmarshal([]byte(v), &a); err != nil {
+		return label.Address{}, err
+	}
+	return a, nil
+}
+
+// GetLabel renders the shipping label of a shipment as PDF or ZPL.
+func (s *server) GetLabel(ctx context.Context, in *pb.GetLabelRequest) (*pb.GetLabelResponse, error) {
+	log.Infof("[GetLabel] tracking_id=%q format=%s", in.GetTrackingId(), in.GetFormat())
+	if err := trackingid.ValidateTrackingId(in.GetTrackingId()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	// Shipments handed over by another replica or by the shipping function
+	// are labelled from the request's hints.
+	sh, ok := s.shipping.Shipment(in.GetTrackingId())
+	if !ok {
+		if in.GetAddress() == nil {
+			return nil, status.Errorf(codes.NotFound, "unknown tracking ID %s", in.GetTrackingId())
+		}
+		level, err := s.shipping.Quotes().ServiceLevel(in.GetServiceLevel())
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		sh = shipping.Shipment{Address: shippingAddress(in.GetAddress()), ServiceLevel: level}
+		if in.GetShippedAtUnix() != 0 {
+			sh.ShippedAt = time.Unix(in.GetShippedAtUnix(), 0).UTC()
+		}
+	}
+
+	to := label.Address{
+		Street:  sh.Address.StreetAddress,
+		City:    sh.Address.City,
+		State:   sh.Address.State,
+		Country: sh.Address.Country,
+	}
+	if zip := sh.Address.ZipCode; zip != 0 {
+		to.Zip = fmt.Sprint(zip)
+	}
+	l := label.Label{
+		TrackingID:   in.GetTrackingId(),
+		Carrier:      sh.ServiceLevel.Carrier,
+		ServiceLevel: sh.ServiceLevel.Name,
+		From:         s.sender,
+		To:           to,
+		ShipDate:     sh.ShippedAt,
+	}
+
+	switch in.GetFormat() {
+	case pb.LabelFormat_LABEL_FORMAT_UNSPECIFIED, pb.LabelFormat_LABEL_FORMAT_PDF:
+		data, err := l.PDF()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to render label: %v", err)
+		}
+		s.metrics.labelRendered(ctx, "pdf")
+		return &pb.GetLabelResponse{ContentType: "application/pdf", Filename: in.GetTrackingId() + ".pdf", Data: data}, nil
+	case pb.LabelFormat_LABEL_FORMAT_ZPL:
+		s.metrics.labelRendered(ctx, "zpl")
+		return &pb.GetLabelResponse{ContentType: "application/zpl", Filename: in.GetTrackingId() + ".zpl", Data: l.ZPL()}, nil
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown label format %d", in.GetFormat())
+	}
+}
+
+// labelFormats maps the format query parameter of the admin route.
+var labelFormats = map[string]pb.LabelFormat{
+	"":    pb.LabelFormat_LABEL_FORMAT_PDF,
+	"pdf": pb.LabelFormat_LABEL_FORMAT_PDF,
+	"zpl": pb.LabelFormat_LABEL_FORMAT_ZPL,
+}
+
+// labelRequest reads the label format and the hints for shipments this
+// replica did not hand over from the query of the admin route.
+func labelRequest(trackingID string, q url.Values) (*pb.GetLabelRequest, error) {
+	format, ok := labelFormats[strings.ToLower(q.Get("format"))]
+	if !ok {
+		return nil, errors.New("format must be pdf or zpl")
+	}
+	req := &pb.GetLabelRequest{TrackingId: trackingID, Format: format, ServiceLevel: q.Get("service_level")}
+	if v := q.Get("shipped_at_unix"); v != "" {
+		t, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shipped_at_unix %q", v)
+		}
+		req.ShippedAtUnix = t
+	}
+	if q.Get("street_address") == "" && q.Get("country") == "" {
+		return req, nil
+	}
+	req.Address = &pb.Address{
+		StreetAddress: q.Get("street_address"),
+		City:          q.Get("city"),
+		State:         q.Get("state"),
+		Country:       q.Get("country"),
+	}
+	if v := q.Get("zip_code"); v != "" {
+		zip, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid zip_code %q", v)
+		}
+		req.Address.ZipCode = int32(zip)
+	}
+	return req, nil
+}
+
+// labelAdmin lets operators download the label of a shipment:
+// GET /labels/{tracking_id}?format=pdf|zpl. Checkout ships through the
+// shipping function by default, so those shipments are not in this
+// replica's memory; the address (street_address, city, state, country,
+// zip_code), service_level and shipped_at_unix query parameters are passed
+// to GetLabel as hints.
+func (s *server) labelAdmin() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /labels/{tracking_id}", func(w http.ResponseWriter, r *http.Request) {
+		req, err := labelRequest(r.PathValue("tracking_id"), r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := s.GetLabel(r.Context(), req)
+		switch status.Code(err) {
+		case codes.OK:
+		case codes.InvalidArgument:
+			http.Error(w, status.Convert(err).Message(), http.StatusBadRequest)
+			return
+		case codes.NotFound:
+			http.Error(w, status.Convert(err).Message(), http.StatusNotFound)
+			return
+		default:
+			http.Error(w, status.Convert(err).Message(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", resp.GetContentType())
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", resp.GetFilename()))
+		w.Write(resp.GetData())
+	})
+	return mux
+}
+
+// serveLabelAdmin serves the label download route on addr.
+func (s *server) serveLabelAdmin(addr string) error {
+	log.Infof("label admin listening on %s", addr)
+	return http.ListenAndServe(addr, s.labelAdmin())
+}
@@ -15,6 +15,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -22,13 +23,23 @@ import (
 
 	"cloud.google.com/go/profiler"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc/filters"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/label"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/quote"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/shipping"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
@@ -41,26 +52,36 @@ var log *logrus.Logger
 func init() {
 	log = logrus.New()
 	log.Level = logrus.DebugLevel
-	log.Formatter = &logrus.JSONFormatter{
+	log.Formatter = redactingFormatter{&logrus.JSONFormatter{
 		FieldMap: logrus.FieldMap{
 			logrus.FieldKeyTime:  "timestamp",
 			logrus.FieldKeyLevel: "severity",
 			logrus.FieldKeyMsg:   "message",
 		},
 		TimestampFormat: time.RFC3339Nano,
-	}
+	}}
 	log.Out = os.Stdout
 }
 
 func main() {
-	if os.Getenv("DISABLE_TRACING") == "" {
-		log.Info("Tracing enabled, but temporarily unavailable")
-		log.Info("See https://github.com/GoogleCloudPlatform/microservices-demo/issues/422 for more info.")
-		go initTracing()
+	if os.Getenv("ENABLE_TRACING") == "1" {
+		if err := initTracing(); err != nil {
+			log.Fatalf("failed to initialize tracing: %v", err)
+		}
+		log.Info("Tracing enabled.")
 	} else {
 		log.Info("Tracing disabled.")
 	}
 
+	if os.Getenv("ENABLE_STATS") == "1" {
+		if err := initStats(); err != nil {
+			log.Fatalf("failed to initialize stats: %v", err)
+		}
+		log.Info("Stats enabled.")
+	} else {
+		log.Info("Stats disabled.")
+	}
+
 	if os.Getenv("DISABLE_PROFILER") == "" {
 		log.Info("Profiling enabled.")
 		go initProfiling("shippingservice", "1.0.0")
@@ -79,17 +100,39 @@ func main() {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
-	var srv *grpc.Server
-	if os.Getenv("DISABLE_STATS") == "" {
-		log.Info("Stats enabled, but temporarily unavailable")
-		srv = grpc.NewServer()
-	} else {
-		log.Info("Stats disabled.")
-		srv = grpc.NewServer()
+	// Propagate trace context always. The stats handler traces every RPC
+	// but health checks and records their latency as rpc.server.duration.
+	otel.SetTextMapPropagator(
+		propagation.NewCompositeTextMapPropagator(
+			propagation.TraceContext{}, propagation.Baggage{}))
+	srv := grpc.NewServer(grpc.StatsHandler(otelgrpc.NewServerHandler(
+		otelgrpc.WithFilter(filters.Not(filters.HealthCheck())))))
+
+	shipments, err := shipping.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	sender, err := labelSender()
+	if err != nil {
+		log.Fatalf("failed to read LABEL_SENDER: %v", err)
+	}
+	metrics, err := newShippingMetrics(otel.GetMeterProvider())
+	if err != nil {
+		log.Fatalf("failed to create metrics: %v", err)
 	}
-	svc := &server{}
+	svc := &server{shipping: shipments, sender: sender, metrics: metrics}
 	pb.RegisterShippingServiceServer(srv, svc)
 	healthpb.RegisterHealthServer(srv, svc)
+	if addr := os.Getenv("LABEL_ADMIN_ADDR"); addr != "" {
+		go func() {
+			log.Fatal(svc.serveLabelAdmin(addr))
+		}()
+	}
+	if addr := os.Getenv("HTTP_GATEWAY_ADDR"); addr != "" {
+		go func() {
+			log.Fatal(serveGateway(addr, "localhost"+port))
+		}()
+	}
 	log.Infof("Shipping Service listening on port %s", port)
 
 	// Register reflection service on gRPC server.
@@ -102,6 +145,11 @@ func main() {
 // server controls RPC service responses.
 type server struct {
 	pb.UnimplementedShippingServiceServer
+
+	shipping *shipping.Service
+	// sender is the return address printed on labels.
+	sender  label.Address
+	metrics *shippingMetrics
 }
 
 // Check is for health checking.
@@ -118,16 +166,32 @@ func (s *server) GetQuote(ctx context.Context, in *pb.GetQuoteRequest) (*pb.GetQ
 	log.Info("[GetQuote] received request")
 	defer log.Info("[GetQuote] completed request")
 
-	// 1. Generate a quote based on the total number of items to be shipped.
-	quote := CreateQuoteFromCount(0)
+	// 1. Quote every service level based on the weight of the items and the destination.
+	addr := shippingAddress(in.GetAddress())
+	options, err := s.shipping.Quote(ctx, addr, quoteItems(in.GetItems()))
+	if err != nil {
+		return nil, quoteError(err)
+	}
+	zone, _ := s.shipping.Quotes().Zone(addr.Destination())
+	s.metrics.quoteIssued(ctx, zone)
 
 	// 2. Generate a response.
-	return &pb.GetQuoteResponse{
-		CostUsd: &pb.Money{
-			CurrencyCode: "USD",
-			Units:        int64(quote.Dollars),
-			Nanos:        int32(quote.Cents * 10000000)},
-	}, nil
+	resp := &pb.GetQuoteResponse{}
+	for _, o := range options {
+		resp.Options = append(resp.Options, &pb.ShippingOption{
+			ServiceLevel: o.ServiceLevel,
+			Name:         o.Name,
+			Carrier:      o.Carrier,
+			Cost: &pb.Money{
+				CurrencyCode: s.shipping.Quotes().CurrencyCode(),
+				Units:        int64(o.Quote.Dollars),
+				Nanos:        o.Quote.Nanos()},
+			EstimatedDeliveryDate: o.EstimatedDelivery.Format(time.DateOnly),
+			EarliestDeliveryDate:  o.EarliestDelivery.Format(time.DateOnly),
+		})
+	}
+	resp.CostUsd = resp.Options[0].Cost
+	return resp, nil
 
 }
 
@@ -136,22 +200,70 @@ func (s *server) GetQuote(ctx context.Context, in *pb.GetQuoteRequest) (*pb.GetQ
 func (s *server) ShipOrder(ctx context.Context, in *pb.ShipOrderRequest) (*pb.ShipOrderResponse, error) {
 	log.Info("[ShipOrder] received request")
 	defer log.Info("[ShipOrder] completed request")
-	// 1. Create a Tracking ID
-	baseAddress := fmt.Sprintf("%s, %s, %s", in.Address.StreetAddress, in.Address.City, in.Address.State)
-	id := CreateTrackingId(baseAddress)
+
+	// 1. Hand the shipment over under a new tracking ID, unless it breaks
+	// the shipping rules.
+	shipment, err := s.shipping.Ship(ctx, shippingAddress(in.GetAddress()), quoteItems(in.GetItems()), in.GetServiceLevel())
+	switch {
+	case errors.Is(err, quote.ErrUnavailable), errors.Is(err, quote.ErrNoZone):
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	case errors.As(err, new(*quote.RuleError)):
+		return nil, quoteError(err)
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	level := shipment.ServiceLevel
+	s.metrics.shipmentCreated(ctx, level.ID, level.Carrier)
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("shipping.tracking_id", shipment.TrackingID),
+		attribute.String("shipping.service_level", level.ID))
 
 	// 2. Generate a response.
 	return &pb.ShipOrderResponse{
-		TrackingId: id,
+		TrackingId: shipment.TrackingID,
+		Carrier:    level.Carrier,
 	}, nil
 }
 
-func initStats() {
-	//TODO(arbrown) Implement OpenTelemetry stats
+func shippingAddress(a *pb.Address) shipping.Address {
+	return shipping.Address{
+		StreetAddress: a.GetStreetAddress(),
+		City:          a.GetCity(),
+		State:         a.GetState(),
+		Country:       a.GetCountry(),
+		ZipCode:       a.GetZipCode(),
+	}
 }
 
-func initTracing() {
-	// TODO(arbrown) Implement OpenTelemetry tracing
+// quoteError returns a quote failure as an RPC error. Broken shipping rules
+// are FAILED_PRECONDITION with a PreconditionFailure detail listing every
+// violation, so clients can point at the offending address field or item.
+func quoteError(err error) error {
+	var rules *quote.RuleError
+	if !errors.As(err, &rules) {
+		return status.Errorf(codes.InvalidArgument, "failed to quote shipping: %v", err)
+	}
+	details := &errdetails.PreconditionFailure{}
+	for _, v := range rules.Violations {
+		details.Violations = append(details.Violations, &errdetails.PreconditionFailure_Violation{
+			Type:        v.Rule,
+			Subject:     v.Subject,
+			Description: v.Description,
+		})
+	}
+	st, detailsErr := status.New(codes.FailedPrecondition, err.Error()).WithDetails(details)
+	if detailsErr != nil {
+		return status.Errorf(codes.FailedPrecondition, "%v", err)
+	}
+	return st.Err()
+}
+
+func quoteItems(items []*pb.CartItem) []quote.Item {
+	out := make([]quote.Item, len(items))
+	for i, it := range items {
+		out[i] = quote.Item{ProductID: it.GetProductId(), Quantity: it.GetQuantity()}
+	}
+	return out
 }
 
 func initProfiling(service, version string) {
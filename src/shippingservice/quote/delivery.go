@@ -0,0 +1,207 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quote
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	// Time zones must load in images without a zoneinfo database.
+	_ "time/tzdata"
+)
+
+// Delivery decides when shipments leave the warehouse and on which days
+// carriers deliver. The zero value ships immediately and delivers every
+// day, in UTC.
+type Delivery struct {
+	// TimeZone is the warehouse's IANA time zone, e.g. "America/New_York".
+	TimeZone string `json:"time_zone,omitempty"`
+	// Cutoff is the local time, like "14:00", after which orders ship on
+	// the next business day.
+	Cutoff string `json:"cutoff,omitempty"`
+	// Calendar names the warehouse's calendar, and is the default of
+	// service levels that do not name their own.
+	Calendar  string              `json:"calendar,omitempty"`
+	Calendars map[string]Calendar `json:"calendars,omitempty"`
+}
+
+// Calendar lists the days on which nothing ships or is delivered.
+type Calendar struct {
+	// Weekend holds weekday names, e.g. "sunday".
+	Weekend []string `json:"weekend,omitempty"`
+	// Holidays are dates, "2006-01-02", or "01-02" for every year.
+	Holidays []string `json:"holidays,omitempty"`
+}
+
+// Window is when a shipment is promised to arrive, as dates in the
+// warehouse's time zone. Latest is the date promised to the shopper.
+type Window struct {
+	Earliest time.Time
+	Latest   time.Time
+}
+
+// schedule is a validated Delivery.
+type schedule struct {
+	loc       *time.Location
+	cutoff    time.Duration
+	warehouse *calendar
+	// carriers holds the calendar of each service level.
+	carriers map[string]*calendar
+	early    map[string]int
+}
+
+// calendar is a validated Calendar. A nil calendar has no days off.
+type calendar struct {
+	weekend [7]bool
+	dates   map[string]bool
+	annual  map[string]bool
+}
+
+func (c *calendar) isBusinessDay(d time.Time) bool {
+	if c == nil {
+		return true
+	}
+	return !c.weekend[d.Weekday()] && !c.dates[d.Format("2006-01-02")] && !c.annual[d.Format("01-02")]
+}
+
+// next returns d if it is a business day, or else the first one after it.
+func (c *calendar) next(d time.Time) time.Time {
+	for !c.isBusinessDay(d) {
+		d = d.AddDate(0, 0, 1)
+	}
+	return d
+}
+
+// add returns the business day n business days after d.
+func (c *calendar) add(d time.Time, n int) time.Time {
+	d = c.next(d)
+	for ; n > 0; n-- {
+		d = c.next(d.AddDate(0, 0, 1))
+	}
+	return d
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+func (c Calendar) compile() (*calendar, error) {
+	out := &calendar{dates: make(map[string]bool), annual: make(map[string]bool)}
+	for _, name := range c.Weekend {
+		d, ok := weekdays[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown weekday %q", name)
+		}
+		out.weekend[d] = true
+	}
+	if out.weekend == [7]bool{true, true, true, true, true, true, true} {
+		return nil, fmt.Errorf("every day is a weekend day")
+	}
+	for _, h := range c.Holidays {
+		if _, err := time.Parse("2006-01-02", h); err == nil {
+			out.dates[h] = true
+		} else if _, err := time.Parse("01-02", h); err == nil {
+			out.annual[h] = true
+		} else {
+			return nil, fmt.Errorf("holiday %q must be YYYY-MM-DD or MM-DD", h)
+		}
+	}
+	return out, nil
+}
+
+// schedule validates the delivery settings against the service levels.
+func (d Delivery) schedule(levels []ServiceLevel) (*schedule, error) {
+	s := &schedule{loc: time.UTC, carriers: make(map[string]*calendar), early: make(map[string]int)}
+	if d.TimeZone != "" {
+		loc, err := time.LoadLocation(d.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("time_zone: %v", err)
+		}
+		s.loc = loc
+	}
+	if d.Cutoff != "" {
+		t, err := time.Parse("15:04", d.Cutoff)
+		if err != nil {
+			return nil, fmt.Errorf("cutoff %q must be HH:MM", d.Cutoff)
+		}
+		s.cutoff = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	calendars := make(map[string]*calendar)
+	for name, c := range d.Calendars {
+		cal, err := c.compile()
+		if err != nil {
+			return nil, fmt.Errorf("calendar %s: %v", name, err)
+		}
+		calendars[name] = cal
+	}
+	lookup := func(name string) (*calendar, error) {
+		if name == "" {
+			return nil, nil
+		}
+		c, ok := calendars[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown calendar %s", name)
+		}
+		return c, nil
+	}
+	var err error
+	if s.warehouse, err = lookup(d.Calendar); err != nil {
+		return nil, err
+	}
+	for _, l := range levels {
+		if l.EarlyDays < 0 {
+			return nil, fmt.Errorf("service level %s: early_days must not be negative", l.ID)
+		}
+		s.early[l.ID] = l.EarlyDays
+		s.carriers[l.ID] = s.warehouse
+		if l.Calendar != "" {
+			if s.carriers[l.ID], err = lookup(l.Calendar); err != nil {
+				return nil, fmt.Errorf("service level %s: %v", l.ID, err)
+			}
+		}
+	}
+	return s, nil
+}
+
+// shipDate returns the day an order placed at t leaves the warehouse: the
+// same day if it is a business day and the cutoff has not passed, or else
+// the next business day.
+func (s *schedule) shipDate(t time.Time) time.Time {
+	local := t.In(s.loc)
+	y, m, d := local.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, s.loc)
+	if s.cutoff > 0 && local.Sub(day) >= s.cutoff {
+		day = day.AddDate(0, 0, 1)
+	}
+	return s.warehouse.next(day)
+}
+
+// estimate returns the delivery window of a shipment handed over at t that
+// the service level delivers in transitDays business days.
+func (s *schedule) estimate(t time.Time, serviceLevel string, transitDays int) Window {
+	ship := s.shipDate(t)
+	carrier := s.carriers[serviceLevel]
+	early := transitDays - s.early[serviceLevel]
+	if early < 0 {
+		early = 0
+	}
+	return Window{Earliest: carrier.add(ship, early), Latest: carrier.add(ship, transitDays)}
+}
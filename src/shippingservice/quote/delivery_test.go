@@ -0,0 +1,124 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quote
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func testDelivery() Delivery {
+	return Delivery{
+		TimeZone: "America/New_York",
+		Cutoff:   "14:00",
+		Calendar: "business",
+		Calendars: map[string]Calendar{
+			"business": {Weekend: []string{"Saturday", "sunday"}, Holidays: []string{"12-25", "2024-07-05"}},
+			"postal":   {Weekend: []string{"sunday"}, Holidays: []string{"12-25"}},
+		},
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	levels := []ServiceLevel{
+		{ID: "express", TransitDays: map[string]int{"all": 2}, EarlyDays: 1},
+		{ID: "standard", TransitDays: map[string]int{"all": 3}, EarlyDays: 5, Calendar: "postal"},
+		{ID: "pickup", TransitDays: map[string]int{"all": 0}},
+	}
+	s, err := testDelivery().schedule(levels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(date string, hour int) time.Time {
+		d, err := time.ParseInLocation("2006-01-02", date, ny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.Add(time.Duration(hour) * time.Hour)
+	}
+
+	for _, tc := range []struct {
+		name           string
+		at             time.Time
+		level          string
+		days           int
+		earliest, want string
+	}{
+		{"before the cutoff", at("2024-07-02", 10), "express", 2, "2024-07-03", "2024-07-04"},
+		{"after the cutoff", at("2024-07-02", 15), "express", 2, "2024-07-04", "2024-07-08"},
+		{"over a dated holiday and the weekend", at("2024-07-04", 13), "express", 2, "2024-07-08", "2024-07-09"},
+		{"placed on a holiday", at("2024-07-05", 9), "pickup", 0, "2024-07-08", "2024-07-08"},
+		{"over a yearly holiday", at("2024-12-24", 9), "express", 2, "2024-12-26", "2024-12-27"},
+		{"in UTC after the local cutoff", time.Date(2024, 3, 29, 19, 0, 0, 0, time.UTC), "express", 2, "2024-04-02", "2024-04-03"},
+		{"carrier delivering on Saturdays", at("2024-03-29", 10), "standard", 3, "2024-03-29", "2024-04-02"},
+	} {
+		w := s.estimate(tc.at, tc.level, tc.days)
+		if got := w.Earliest.Format("2006-01-02"); got != tc.earliest {
+			t.Errorf("%s: got earliest %s, want %s", tc.name, got, tc.earliest)
+		}
+		if got := w.Latest.Format("2006-01-02"); got != tc.want {
+			t.Errorf("%s: got latest %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestOptionsDeliveryWindow(t *testing.T) {
+	card := testRateCard()
+	card.Delivery = testDelivery()
+	card.ServiceLevels = []ServiceLevel{
+		{ID: "standard", Name: "Standard", Multiplier: 1, TransitDays: map[string]int{"domestic": 5}, EarlyDays: 2},
+	}
+	e, err := New(card, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Friday afternoon in New York, after the cutoff.
+	e.now = func() time.Time { return time.Date(2024, 3, 29, 20, 0, 0, 0, time.UTC) }
+	o, err := e.Quote(context.Background(), Destination{Country: "US"}, []Item{{"A", 1}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := o.EarliestDelivery.Format("2006-01-02") + " " + o.EstimatedDelivery.Format("2006-01-02"); got != "2024-04-04 2024-04-08" {
+		t.Errorf("got window %s, want 2024-04-04 2024-04-08", got)
+	}
+	// Handed over on Monday morning instead.
+	w := e.Estimate(o, time.Date(2024, 4, 1, 13, 0, 0, 0, time.UTC))
+	if got := w.Latest.Format("2006-01-02"); got != "2024-04-08" {
+		t.Errorf("got %s for a Monday hand-over, want 2024-04-08", got)
+	}
+}
+
+func TestParseDelivery(t *testing.T) {
+	base := `"currency_code": "USD", "default_package": {"weight": 1}, "zones": [{"name": "all"}], "rates": {"all": {"bands": [{"max_weight": 1, "price": 1}]}}`
+	for name, delivery := range map[string]string{
+		"unknown time zone":      `"delivery": {"time_zone": "Mars/Olympus_Mons"}`,
+		"bad cutoff":             `"delivery": {"cutoff": "2pm"}`,
+		"unknown weekday":        `"delivery": {"calendars": {"c": {"weekend": ["caturday"]}}}`,
+		"no business days":       `"delivery": {"calendars": {"c": {"weekend": ["monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday"]}}}`,
+		"bad holiday":            `"delivery": {"calendars": {"c": {"holidays": ["Dec 25"]}}}`,
+		"unknown calendar":       `"delivery": {"calendar": "c"}`,
+		"unknown level calendar": `"service_levels": [{"id": "standard", "transit_days": {"all": 1}, "calendar": "c"}]`,
+		"negative early days":    `"service_levels": [{"id": "standard", "transit_days": {"all": 1}, "early_days": -1}]`,
+	} {
+		if _, err := ParseRateCard([]byte("{" + base + ", " + delivery + "}")); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+}
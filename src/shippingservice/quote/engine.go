@@ -0,0 +1,286 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package quote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoZone is returned for a destination that no zone of the rate
+	// card covers.
+	ErrNoZone = errors.New("destination is not served")
+	// ErrUnavailable is returned for a service level that is unknown or not
+	// offered for the destination.
+	ErrUnavailable = errors.New("service level is not available")
+)
+
+// Item is a product and how many units of it ship.
+type Item struct {
+	ProductID string
+	Quantity  int32
+}
+
+// Destination is the part of an address that decides its zone and the
+// rules that apply.
+type Destination struct {
+	Country string
+	State   string
+	Street  string
+}
+
+// Option is the price of shipping with one service level.
+type Option struct {
+	ServiceLevel string
+	Name         string
+	Carrier      string
+	Quote        Quote
+	TransitDays  int
+	// EstimatedDelivery is the day the shipment is promised to arrive if
+	// it ships now, and EarliestDelivery the first day it may arrive.
+	EstimatedDelivery time.Time
+	EarliestDelivery  time.Time
+}
+
+// Engine quotes shipments from a rate card.
+type Engine struct {
+	card      *RateCard
+	levels    []ServiceLevel
+	packaging Packaging
+	schedule  *schedule
+	now       func() time.Time
+}
+
+// New returns an engine for the rate card. packaging may be nil, in which
+// case only the packages listed in the rate card are known.
+func New(card *RateCard, packaging Packaging) (*Engine, error) {
+	if err := card.validate(); err != nil {
+		return nil, err
+	}
+	levels := card.serviceLevels()
+	schedule, err := card.Delivery.schedule(levels)
+	if err != nil {
+		return nil, err
+	}
+	return &Engine{
+		card:      card,
+		levels:    levels,
+		packaging: packaging,
+		schedule:  schedule,
+		now:       time.Now,
+	}, nil
+}
+
+// FromEnv returns an engine for the rate card file named by SHIPPING_RATES,
+// or the built-in one. When PACKAGING_SERVICE_URL is set, packages are
+// looked up there first.
+func FromEnv() (*Engine, error) {
+	var card *RateCard
+	var err error
+	if path := os.Getenv("SHIPPING_RATES"); path != "" {
+		card, err = LoadRateCard(path)
+	} else {
+		card, err = DefaultRateCard()
+	}
+	if err != nil {
+		return nil, err
+	}
+	var packaging Packaging
+	if u := os.Getenv("PACKAGING_SERVICE_URL"); u != "" {
+		packaging = NewHTTPPackaging(u)
+	}
+	return New(card, packaging)
+}
+
+// CurrencyCode returns the currency quotes are in.
+func (e *Engine) CurrencyCode() string {
+	return e.card.CurrencyCode
+}
+
+// ServiceLevel returns the service level with the given ID, or the default
+// one for an empty ID.
+func (e *Engine) ServiceLevel(id string) (ServiceLevel, error) {
+	if id == "" {
+		return e.levels[0], nil
+	}
+	for _, l := range e.levels {
+		if l.ID == id {
+			return l, nil
+		}
+	}
+	return ServiceLevel{}, fmt.Errorf("%w: unknown service level %q", ErrUnavailable, id)
+}
+
+// Zone returns the name of the first zone that covers dest.
+func (e *Engine) Zone(dest Destination) (string, error) {
+	for _, z := range e.card.Zones {
+		if len(z.Countries) > 0 && !containsFold(z.Countries, dest.Country) {
+			continue
+		}
+		if len(z.States) > 0 && !containsFold(z.States, dest.State) {
+			continue
+		}
+		return z.Name, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrNoZone, dest.Country)
+}
+
+// Options prices shipping items to dest with every service level offered
+// there, default first. A shipment that breaks the rate card's rules fails
+// with a *RuleError listing every violation. Each unit is billed at the
+// greater of its actual and volumetric weight; the total is priced by the
+// zone's weight bands plus a handling fee per unit, and then by each
+// level's multiplier and surcharge. Nothing to ship costs nothing.
+func (e *Engine) Options(ctx context.Context, dest Destination, items []Item) ([]Option, error) {
+	var weight float64
+	var units int64
+	for _, it := range items {
+		if it.Quantity <= 0 {
+			return nil, fmt.Errorf("quantity of %s must be positive, got %d", it.ProductID, it.Quantity)
+		}
+		pkg := e.packageOf(ctx, it.ProductID)
+		weight += e.billableWeight(pkg) * float64(it.Quantity)
+		units += int64(it.Quantity)
+	}
+	zone, err := e.Zone(dest)
+	if err != nil {
+		return nil, err
+	}
+	if violations := e.card.Rules.check(dest, zone, items); len(violations) > 0 {
+		return nil, &RuleError{Violations: violations}
+	}
+	var base int64
+	if units > 0 {
+		base = e.price(e.card.Rates[zone], weight, units)
+	}
+
+	now := e.now()
+	var out []Option
+	poBoxed := false
+	for _, l := range e.levels {
+		days, ok := l.TransitDays[zone]
+		if !ok {
+			continue
+		}
+		if !e.card.Rules.poBoxAllows(dest, l.ID) {
+			poBoxed = true
+			continue
+		}
+		cents := int64(math.Round(float64(base)*l.Multiplier)) + toCents(l.Surcharge)
+		if units == 0 {
+			cents = 0
+		}
+		window := e.schedule.estimate(now, l.ID, days)
+		out = append(out, Option{
+			ServiceLevel:      l.ID,
+			Name:              l.Name,
+			Carrier:           l.Carrier,
+			Quote:             createQuoteFromCents(cents),
+			TransitDays:       days,
+			EstimatedDelivery: window.Latest,
+			EarliestDelivery:  window.Earliest,
+		})
+	}
+	if len(out) == 0 && poBoxed {
+		return nil, &RuleError{Violations: []Violation{e.card.Rules.poBoxViolation()}}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%w: nothing ships to zone %s", ErrUnavailable, zone)
+	}
+	return out, nil
+}
+
+// Estimate returns the delivery window of an option for a shipment handed
+// over to the carrier at t rather than now.
+func (e *Engine) Estimate(o Option, t time.Time) Window {
+	return e.schedule.estimate(t, o.ServiceLevel, o.TransitDays)
+}
+
+// Quote prices shipping items to dest with one service level, or the
+// default one offered there when serviceLevel is empty.
+func (e *Engine) Quote(ctx context.Context, dest Destination, items []Item, serviceLevel string) (Option, error) {
+	options, err := e.Options(ctx, dest, items)
+	if err != nil {
+		return Option{}, err
+	}
+	if serviceLevel == "" {
+		return options[0], nil
+	}
+	for _, o := range options {
+		if o.ServiceLevel == serviceLevel {
+			return o, nil
+		}
+	}
+	if l, err := e.ServiceLevel(serviceLevel); err == nil && !e.card.Rules.poBoxAllows(dest, l.ID) {
+		if zone, err := e.Zone(dest); err == nil {
+			if _, ok := l.TransitDays[zone]; ok {
+				return Option{}, &RuleError{Violations: []Violation{e.card.Rules.poBoxViolation()}}
+			}
+		}
+	}
+	return Option{}, fmt.Errorf("%w: %q does not ship to %q", ErrUnavailable, serviceLevel, dest.Country)
+}
+
+// packageOf returns the package of a product from the packaging service,
+// the rate card, or the rate card default, in that order. A packaging
+// service that fails is treated as having nothing on record so quotes do
+// not depend on it being up.
+func (e *Engine) packageOf(ctx context.Context, productID string) Package {
+	if e.packaging != nil {
+		if pkg, err := e.packaging.Package(ctx, productID); err == nil {
+			return pkg
+		}
+	}
+	if pkg, ok := e.card.Packages[productID]; ok {
+		return pkg
+	}
+	return e.card.DefaultPackage
+}
+
+func (e *Engine) billableWeight(pkg Package) float64 {
+	if e.card.DimDivisor == 0 {
+		return pkg.Weight
+	}
+	return math.Max(pkg.Weight, pkg.volume()/e.card.DimDivisor)
+}
+
+// price returns the cost in cents of shipping weight billable pounds in
+// units units at rate r.
+func (e *Engine) price(r Rate, weight float64, units int64) int64 {
+	cents := toCents(r.PerItem) * units
+	for _, b := range r.Bands {
+		if weight <= b.MaxWeight {
+			return cents + toCents(b.Price)
+		}
+	}
+	last := r.Bands[len(r.Bands)-1]
+	extra := int64(math.Ceil(weight - last.MaxWeight))
+	return cents + toCents(last.Price) + extra*toCents(r.PerExtraWeight)
+}
+
+func containsFold(list []string, s string) bool {
+	s = strings.TrimSpace(s)
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quote
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testRateCard() *RateCard {
+	return &RateCard{
+		CurrencyCode:   "USD",
+		DimDivisor:     1000,
+		DefaultPackage: Package{Weight: 1},
+		Packages: map[string]Package{
+			"HEAVY": {Weight: 4},
+			"BULKY": {Weight: 1, Width: 20, Height: 20, Depth: 10},
+		},
+		Zones: []Zone{
+			{Name: "remote", Countries: []string{"US"}, States: []string{"AK"}},
+			{Name: "domestic", Countries: []string{"US"}},
+		},
+		Rates: map[string]Rate{
+			"remote":   {Bands: []Band{{MaxWeight: 5, Price: 20}}, PerExtraWeight: 2},
+			"domestic": {Bands: []Band{{MaxWeight: 1, Price: 5}, {MaxWeight: 5, Price: 9.99}}, PerExtraWeight: 0.5, PerItem: 0.25},
+		},
+	}
+}
+
+func TestQuote(t *testing.T) {
+	e, err := New(testRateCard(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		dest  Destination
+		items []Item
+		want  string
+	}{
+		{"first band", Destination{Country: "us"}, []Item{{"A", 1}}, "$5.25"},
+		{"second band", Destination{Country: "US"}, []Item{{"A", 2}}, "$10.49"},
+		{"volumetric weight", Destination{Country: "US"}, []Item{{"BULKY", 1}}, "$10.24"},
+		{"over the last band", Destination{Country: "US"}, []Item{{"HEAVY", 2}}, "$11.99"},
+		{"state zone", Destination{Country: "US", State: "ak"}, []Item{{"HEAVY", 2}}, "$26.00"},
+		{"nothing to ship", Destination{Country: "US"}, nil, "$0.00"},
+	} {
+		o, err := e.Quote(context.Background(), tc.dest, tc.items, "")
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if o.Quote.String() != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, o.Quote, tc.want)
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	card := testRateCard()
+	card.ServiceLevels = []ServiceLevel{
+		{ID: "standard", Name: "Standard", Carrier: "USPS", Multiplier: 1, TransitDays: map[string]int{"domestic": 5, "remote": 9}},
+		{ID: "express", Name: "Express", Carrier: "UPS", Multiplier: 1.5, Surcharge: 1, TransitDays: map[string]int{"domestic": 2}},
+		{ID: "pickup", Name: "Pickup", Carrier: "Store", TransitDays: map[string]int{"domestic": 1}},
+	}
+	e, err := New(card, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.now = func() time.Time { return time.Date(2024, 3, 29, 10, 0, 0, 0, time.UTC) }
+
+	options, err := e.Options(context.Background(), Destination{Country: "US"}, []Item{{"A", 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// $5.25 at the zone rate.
+	want := []struct{ level, quote, date string }{
+		{"standard", "$5.25", "2024-04-03"},
+		{"express", "$8.88", "2024-03-31"},
+		{"pickup", "$0.00", "2024-03-30"},
+	}
+	if len(options) != len(want) {
+		t.Fatalf("got %d options, want %d", len(options), len(want))
+	}
+	for i, w := range want {
+		o := options[i]
+		if o.ServiceLevel != w.level || o.Quote.String() != w.quote || o.EstimatedDelivery.Format("2006-01-02") != w.date {
+			t.Errorf("option %d: got %s %s %s, want %s %s %s", i, o.ServiceLevel, o.Quote, o.EstimatedDelivery.Format("2006-01-02"), w.level, w.quote, w.date)
+		}
+	}
+
+	options, err = e.Options(context.Background(), Destination{Country: "US", State: "AK"}, []Item{{"A", 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(options) != 1 || options[0].ServiceLevel != "standard" {
+		t.Errorf("got %v, want standard only for the remote zone", options)
+	}
+}
+
+func TestQuoteErrors(t *testing.T) {
+	e, err := New(testRateCard(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Quote(context.Background(), Destination{Country: "FR"}, []Item{{"A", 1}}, ""); !errors.Is(err, ErrNoZone) {
+		t.Errorf("got %v, want ErrNoZone", err)
+	}
+	if _, err := e.Quote(context.Background(), Destination{Country: "US"}, []Item{{"A", 1}}, "express"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("got %v, want ErrUnavailable", err)
+	}
+	if _, err := e.Quote(context.Background(), Destination{Country: "US"}, []Item{{"A", 0}}, ""); err == nil {
+		t.Error("got no error for a zero quantity")
+	}
+}
+
+func TestQuoteUsesPackagingService(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/HEAVY":
+			w.Write([]byte(`{"weight": 0.5}`))
+		case "/BROKEN":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	e, err := New(testRateCard(), NewHTTPPackaging(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// HEAVY weighs 0.5 lb per the service, BROKEN and A fall back to the
+	// 1 lb default: 2.5 lb in the second band.
+	o, err := e.Quote(context.Background(), Destination{Country: "US"}, []Item{{"HEAVY", 1}, {"BROKEN", 1}, {"A", 1}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Quote.String() != "$10.74" {
+		t.Errorf("got %s, want $10.74", o.Quote)
+	}
+}
+
+func TestParseRateCard(t *testing.T) {
+	if _, err := DefaultRateCard(); err != nil {
+		t.Errorf("default rate card: %v", err)
+	}
+	for name, card := range map[string]string{
+		"no currency":          `{"default_package": {"weight": 1}, "zones": [{"name": "all"}], "rates": {"all": {"bands": [{"max_weight": 1, "price": 1}]}}}`,
+		"zone with no rates":   `{"currency_code": "USD", "default_package": {"weight": 1}, "zones": [{"name": "all"}], "rates": {}}`,
+		"unsorted bands":       `{"currency_code": "USD", "default_package": {"weight": 1}, "zones": [{"name": "all"}], "rates": {"all": {"bands": [{"max_weight": 5, "price": 2}, {"max_weight": 1, "price": 1}]}}}`,
+		"bad service level id": `{"currency_code": "USD", "default_package": {"weight": 1}, "zones": [{"name": "all"}], "rates": {"all": {"bands": [{"max_weight": 1, "price": 1}]}}, "service_levels": [{"id": "Next Day", "transit_days": {"all": 1}}]}`,
+		"service level zone":   `{"currency_code": "USD", "default_package": {"weight": 1}, "zones": [{"name": "all"}], "rates": {"all": {"bands": [{"max_weight": 1, "price": 1}]}}, "service_levels": [{"id": "standard", "transit_days": {"mars": 1}}]}`,
+		"empty package":        `{"currency_code": "USD", "zones": [{"name": "all"}], "rates": {"all": {"bands": [{"max_weight": 1, "price": 1}]}}}`,
+	} {
+		if _, err := ParseRateCard([]byte(card)); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+}
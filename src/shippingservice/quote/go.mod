@@ -0,0 +1,3 @@
+module github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/quote
+
+go 1.21
@@ -0,0 +1,71 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package quote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ErrNoPackage is returned by a Packaging that has nothing on record for a
+// product.
+var ErrNoPackage = errors.New("no packaging on record")
+
+// Packaging looks up the package of one unit of a product.
+type Packaging interface {
+	Package(ctx context.Context, productID string) (Package, error)
+}
+
+// HTTPPackaging asks the optional packaging service, which serves the
+// package of a product at <URL>/<product ID>.
+type HTTPPackaging struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewHTTPPackaging returns a client of the packaging service at baseURL.
+func NewHTTPPackaging(baseURL string) *HTTPPackaging {
+	return &HTTPPackaging{URL: baseURL, Client: &http.Client{Timeout: 2 * time.Second}}
+}
+
+func (p *HTTPPackaging) Package(ctx context.Context, productID string) (Package, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL+"/"+url.PathEscape(productID), nil)
+	if err != nil {
+		return Package{}, err
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return Package{}, fmt.Errorf("failed to get packaging of %s: %v", productID, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return Package{}, ErrNoPackage
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Package{}, fmt.Errorf("packaging service returned %d for %s", resp.StatusCode, productID)
+	}
+	var pkg Package
+	if err := json.NewDecoder(resp.Body).Decode(&pkg); err != nil {
+		return Package{}, fmt.Errorf("failed to parse packaging of %s: %v", productID, err)
+	}
+	if err := validatePackage(pkg); err != nil {
+		return Package{}, fmt.Errorf("packaging of %s: %v", productID, err)
+	}
+	return pkg, nil
+}
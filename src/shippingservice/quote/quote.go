@@ -1,4 +1,4 @@
-// Copyright 2018 Google LLC
+// Copyright 2024 Google LLC
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -12,7 +12,10 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+// Package quote prices shipments from a rate card. It is shared by the
+// shipping service and the shipping Cloud Function so both quote the same
+// amount for the same cart.
+package quote
 
 import (
 	"fmt"
@@ -27,19 +30,27 @@ type Quote struct {
 
 // String representation of the Quote.
 func (q Quote) String() string {
-	return fmt.Sprintf("$%d.%d", q.Dollars, q.Cents)
+	return fmt.Sprintf("$%d.%02d", q.Dollars, q.Cents)
 }
 
-// CreateQuoteFromCount takes a number of items and returns a Price struct.
-func CreateQuoteFromCount(count int) Quote {
-	return CreateQuoteFromFloat(8.99)
+// Nanos returns the cents of the quote as nanos of a Money value.
+func (q Quote) Nanos() int32 {
+	return int32(q.Cents * 10000000)
 }
 
-// CreateQuoteFromFloat takes a price represented as a float and creates a Price struct.
+// CreateQuoteFromFloat takes a price represented as a float and creates a Quote struct.
 func CreateQuoteFromFloat(value float64) Quote {
-	units, fraction := math.Modf(value)
+	return createQuoteFromCents(toCents(value))
+}
+
+func createQuoteFromCents(cents int64) Quote {
 	return Quote{
-		uint32(units),
-		uint32(math.Trunc(fraction * 100)),
+		Dollars: uint32(cents / 100),
+		Cents:   uint32(cents % 100),
 	}
-}
\ No newline at end of file
+}
+
+// toCents rounds a price in the rate card currency to whole cents.
+func toCents(value float64) int64 {
+	return int64(math.Round(value * 100))
+}
@@ -0,0 +1,265 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quote
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+//go:embed default_rates.json
+var defaultRates []byte
+
+// Package is the shipping box of one unit of a product, as reported by the
+// packaging service: weight in pounds and dimensions in centimetres.
+type Package struct {
+	Weight float64 `json:"weight"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+	Depth  float64 `json:"depth"`
+}
+
+// volume returns the volume of the package in cubic centimetres.
+func (p Package) volume() float64 {
+	return p.Width * p.Height * p.Depth
+}
+
+// Zone is a group of destinations that share rates. A zone without
+// countries matches every destination; one with states only matches those
+// states of its countries.
+type Zone struct {
+	Name      string   `json:"name"`
+	Countries []string `json:"countries,omitempty"`
+	States    []string `json:"states,omitempty"`
+}
+
+// Band is the price of shipping up to MaxWeight billable pounds.
+type Band struct {
+	MaxWeight float64 `json:"max_weight"`
+	Price     float64 `json:"price"`
+}
+
+// Rate is what shipping to a zone costs. Weight over the last band is
+// charged PerExtraWeight per started pound, and every unit shipped adds
+// PerItem for handling.
+type Rate struct {
+	Bands          []Band  `json:"bands"`
+	PerExtraWeight float64 `json:"per_extra_weight"`
+	PerItem        float64 `json:"per_item"`
+}
+
+// ServiceLevel is a carrier profile: how fast a carrier delivers to each
+// zone and how its price relates to the zone's rate. A level is offered in
+// the zones listed in TransitDays only.
+type ServiceLevel struct {
+	// ID is lowercase letters and digits, e.g. "express".
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Carrier string `json:"carrier"`
+	// The price is the zone rate times Multiplier plus Surcharge.
+	Multiplier float64 `json:"multiplier"`
+	Surcharge  float64 `json:"surcharge"`
+	// TransitDays are business days in the level's calendar. EarlyDays
+	// opens the delivery window that many business days earlier.
+	TransitDays map[string]int `json:"transit_days"`
+	EarlyDays   int            `json:"early_days,omitempty"`
+	// Calendar names the carrier's calendar in Delivery, if it differs
+	// from the warehouse's.
+	Calendar string `json:"calendar,omitempty"`
+}
+
+// RateCard holds everything a quote depends on. Zones are matched in order,
+// so list specific ones before the ones they carve out of.
+type RateCard struct {
+	CurrencyCode string `json:"currency_code"`
+	// DimDivisor turns a package's volume in cubic centimetres into its
+	// volumetric weight in pounds. Zero bills actual weight only.
+	DimDivisor     float64            `json:"dim_divisor"`
+	DefaultPackage Package            `json:"default_package"`
+	Packages       map[string]Package `json:"packages,omitempty"`
+	Zones          []Zone             `json:"zones"`
+	Rates          map[string]Rate    `json:"rates"`
+	// ServiceLevels are offered in order, the first being the default.
+	// Without any, everything ships at the zone rate in five days.
+	ServiceLevels []ServiceLevel `json:"service_levels,omitempty"`
+	Rules         Rules          `json:"rules"`
+	Delivery      Delivery       `json:"delivery"`
+}
+
+// DefaultRateCard returns the rate card built into the package.
+func DefaultRateCard() (*RateCard, error) {
+	return ParseRateCard(defaultRates)
+}
+
+// LoadRateCard reads a rate card from a JSON file.
+func LoadRateCard(path string) (*RateCard, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rate card: %v", err)
+	}
+	card, err := ParseRateCard(b)
+	if err != nil {
+		return nil, fmt.Errorf("rate card %s: %v", path, err)
+	}
+	return card, nil
+}
+
+// ParseRateCard decodes and validates a JSON rate card.
+func ParseRateCard(b []byte) (*RateCard, error) {
+	var card RateCard
+	if err := json.Unmarshal(b, &card); err != nil {
+		return nil, fmt.Errorf("failed to parse rate card: %v", err)
+	}
+	if err := card.validate(); err != nil {
+		return nil, err
+	}
+	return &card, nil
+}
+
+func (c *RateCard) validate() error {
+	if c.CurrencyCode == "" {
+		return fmt.Errorf("currency_code is required")
+	}
+	if c.DimDivisor < 0 {
+		return fmt.Errorf("dim_divisor must not be negative")
+	}
+	if err := validatePackage(c.DefaultPackage); err != nil {
+		return fmt.Errorf("default_package: %v", err)
+	}
+	if c.DefaultPackage.Weight == 0 && c.DefaultPackage.volume() == 0 {
+		return fmt.Errorf("default_package must have a weight or dimensions")
+	}
+	for id, p := range c.Packages {
+		if err := validatePackage(p); err != nil {
+			return fmt.Errorf("package of %s: %v", id, err)
+		}
+	}
+	if len(c.Zones) == 0 {
+		return fmt.Errorf("at least one zone is required")
+	}
+	seen := make(map[string]bool)
+	for _, z := range c.Zones {
+		if z.Name == "" {
+			return fmt.Errorf("zone is missing a name")
+		}
+		if seen[z.Name] {
+			return fmt.Errorf("zone %s is listed twice", z.Name)
+		}
+		seen[z.Name] = true
+		if len(z.States) > 0 && len(z.Countries) == 0 {
+			return fmt.Errorf("zone %s lists states without countries", z.Name)
+		}
+		rate, ok := c.Rates[z.Name]
+		if !ok {
+			return fmt.Errorf("zone %s has no rates", z.Name)
+		}
+		if err := validateRate(rate); err != nil {
+			return fmt.Errorf("rates of zone %s: %v", z.Name, err)
+		}
+	}
+	for name := range c.Rates {
+		if !seen[name] {
+			return fmt.Errorf("rates for unknown zone %s", name)
+		}
+	}
+	levels := make(map[string]bool)
+	for _, l := range c.ServiceLevels {
+		if !isServiceLevelID(l.ID) {
+			return fmt.Errorf("service level %q: id must be lowercase letters and digits", l.ID)
+		}
+		if levels[l.ID] {
+			return fmt.Errorf("service level %s is listed twice", l.ID)
+		}
+		levels[l.ID] = true
+		if l.Multiplier < 0 || l.Surcharge < 0 {
+			return fmt.Errorf("service level %s: multiplier and surcharge must not be negative", l.ID)
+		}
+		for zone, days := range l.TransitDays {
+			if !seen[zone] {
+				return fmt.Errorf("service level %s: unknown zone %s", l.ID, zone)
+			}
+			if days < 0 {
+				return fmt.Errorf("service level %s: transit days to %s must not be negative", l.ID, zone)
+			}
+		}
+	}
+	levelIDs := make(map[string]bool)
+	for _, l := range c.serviceLevels() {
+		levelIDs[l.ID] = true
+	}
+	if err := c.Rules.validate(seen, levelIDs); err != nil {
+		return fmt.Errorf("rules: %v", err)
+	}
+	if _, err := c.Delivery.schedule(c.serviceLevels()); err != nil {
+		return fmt.Errorf("delivery: %v", err)
+	}
+	return nil
+}
+
+func isServiceLevelID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// serviceLevels returns the card's service levels, or the implicit standard
+// one.
+func (c *RateCard) serviceLevels() []ServiceLevel {
+	if len(c.ServiceLevels) > 0 {
+		return c.ServiceLevels
+	}
+	std := ServiceLevel{ID: "standard", Name: "Standard", Multiplier: 1, TransitDays: make(map[string]int)}
+	for _, z := range c.Zones {
+		std.TransitDays[z.Name] = 5
+	}
+	return []ServiceLevel{std}
+}
+
+func validatePackage(p Package) error {
+	if p.Weight < 0 || p.Width < 0 || p.Height < 0 || p.Depth < 0 {
+		return fmt.Errorf("weight and dimensions must not be negative")
+	}
+	return nil
+}
+
+func validateRate(r Rate) error {
+	if len(r.Bands) == 0 {
+		return fmt.Errorf("at least one weight band is required")
+	}
+	if !sort.SliceIsSorted(r.Bands, func(i, j int) bool { return r.Bands[i].MaxWeight < r.Bands[j].MaxWeight }) {
+		return fmt.Errorf("weight bands must be in increasing order of max_weight")
+	}
+	for i, b := range r.Bands {
+		if b.MaxWeight <= 0 || b.Price < 0 {
+			return fmt.Errorf("band %d must have a positive max_weight and a non-negative price", i)
+		}
+		if i > 0 && b.MaxWeight == r.Bands[i-1].MaxWeight {
+			return fmt.Errorf("two bands have max_weight %v", b.MaxWeight)
+		}
+	}
+	if r.PerExtraWeight < 0 || r.PerItem < 0 {
+		return fmt.Errorf("per_extra_weight and per_item must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quote
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Kinds of Violation.
+const (
+	RuleBlockedDestination = "BLOCKED_DESTINATION"
+	RuleRestrictedCategory = "RESTRICTED_CATEGORY"
+	RulePOBox              = "PO_BOX"
+)
+
+// Rules restrict where and how items ship. They are checked before a
+// shipment is priced.
+type Rules struct {
+	// Blocked lists destinations nothing ships to.
+	Blocked []Region `json:"blocked,omitempty"`
+	// ProductCategories tags products with shipping categories, e.g.
+	// "batteries", that Restrictions refer to.
+	ProductCategories map[string][]string `json:"product_categories,omitempty"`
+	Restrictions      []Restriction       `json:"restrictions,omitempty"`
+	// POBox limits the service levels that deliver to post office boxes.
+	// Without it PO boxes are treated like any other address.
+	POBox *POBoxRule `json:"po_box,omitempty"`
+}
+
+// Region is a set of countries, or of states of those countries, that a
+// rule applies to.
+type Region struct {
+	Countries []string `json:"countries"`
+	States    []string `json:"states,omitempty"`
+	// Reason is shown to the customer.
+	Reason string `json:"reason"`
+}
+
+// Restriction limits the zones products of a category ship to.
+type Restriction struct {
+	Category     string   `json:"category"`
+	AllowedZones []string `json:"allowed_zones"`
+	Reason       string   `json:"reason"`
+}
+
+// POBoxRule lists the service levels that deliver to post office boxes.
+type POBoxRule struct {
+	ServiceLevels []string `json:"service_levels"`
+	Reason        string   `json:"reason"`
+}
+
+// Violation is a rule a shipment breaks.
+type Violation struct {
+	// Rule is one of the Rule constants.
+	Rule string
+	// Subject is what breaks the rule: "address.country", "address.state",
+	// "address.street_address" or "items/<product ID>".
+	Subject     string
+	Description string
+}
+
+// RuleError is returned for a shipment that breaks shipping rules.
+type RuleError struct {
+	Violations []Violation
+}
+
+func (e *RuleError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.Description
+	}
+	return "shipment is not allowed: " + strings.Join(msgs, "; ")
+}
+
+// poBoxPattern matches street addresses like "PO Box 12", "P.O. Box 12"
+// and "Post Office Box 12".
+var poBoxPattern = regexp.MustCompile(`(?i)\b(p\.?\s*o\.?\s*box|post\s+office\s+box)\b`)
+
+// IsPOBox reports whether a street address is a post office box.
+func IsPOBox(street string) bool {
+	return poBoxPattern.MatchString(street)
+}
+
+// check returns the destination and category rules that shipping items to
+// dest in zone breaks.
+func (r *Rules) check(dest Destination, zone string, items []Item) []Violation {
+	var out []Violation
+	for _, b := range r.Blocked {
+		if !containsFold(b.Countries, dest.Country) {
+			continue
+		}
+		subject := "address.country"
+		if len(b.States) > 0 {
+			if !containsFold(b.States, dest.State) {
+				continue
+			}
+			subject = "address.state"
+		}
+		out = append(out, Violation{Rule: RuleBlockedDestination, Subject: subject, Description: b.Reason})
+	}
+	for _, it := range items {
+		for _, category := range r.ProductCategories[it.ProductID] {
+			for _, res := range r.Restrictions {
+				if res.Category == category && !contains(res.AllowedZones, zone) {
+					out = append(out, Violation{Rule: RuleRestrictedCategory, Subject: "items/" + it.ProductID, Description: res.Reason})
+				}
+			}
+		}
+	}
+	return out
+}
+
+// poBoxAllows reports whether the service level may deliver to dest.
+func (r *Rules) poBoxAllows(dest Destination, level string) bool {
+	return r.POBox == nil || !IsPOBox(dest.Street) || contains(r.POBox.ServiceLevels, level)
+}
+
+func (r *Rules) poBoxViolation() Violation {
+	return Violation{Rule: RulePOBox, Subject: "address.street_address", Description: r.POBox.Reason}
+}
+
+func (r *Rules) validate(zones, levels map[string]bool) error {
+	for i, b := range r.Blocked {
+		if len(b.Countries) == 0 || b.Reason == "" {
+			return fmt.Errorf("blocked region %d needs countries and a reason", i)
+		}
+	}
+	categories := make(map[string]bool)
+	for _, res := range r.Restrictions {
+		if res.Category == "" || res.Reason == "" {
+			return fmt.Errorf("restrictions need a category and a reason")
+		}
+		for _, z := range res.AllowedZones {
+			if !zones[z] {
+				return fmt.Errorf("restriction of %s: unknown zone %s", res.Category, z)
+			}
+		}
+		categories[res.Category] = true
+	}
+	for id, cs := range r.ProductCategories {
+		for _, c := range cs {
+			if !categories[c] {
+				return fmt.Errorf("product %s: category %s has no restriction", id, c)
+			}
+		}
+	}
+	if r.POBox != nil {
+		if r.POBox.Reason == "" {
+			return fmt.Errorf("po_box needs a reason")
+		}
+		for _, l := range r.POBox.ServiceLevels {
+			if !levels[l] {
+				return fmt.Errorf("po_box: unknown service level %s", l)
+			}
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
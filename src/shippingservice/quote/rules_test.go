@@ -0,0 +1,144 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func testRulesEngine(t *testing.T) *Engine {
+	t.Helper()
+	card := testRateCard()
+	card.Zones = append(card.Zones, Zone{Name: "world"})
+	card.Rates["world"] = Rate{Bands: []Band{{MaxWeight: 5, Price: 30}}}
+	card.ServiceLevels = []ServiceLevel{
+		{ID: "standard", Multiplier: 1, TransitDays: map[string]int{"domestic": 5, "remote": 9, "world": 12}},
+		{ID: "express", Multiplier: 2, TransitDays: map[string]int{"domestic": 2, "world": 4}},
+	}
+	card.Rules = Rules{
+		Blocked: []Region{
+			{Countries: []string{"KP"}, Reason: "no shipping to KP"},
+			{Countries: []string{"US"}, States: []string{"GU"}, Reason: "no shipping to GU"},
+		},
+		ProductCategories: map[string][]string{"PERFUME": {"liquids"}},
+		Restrictions:      []Restriction{{Category: "liquids", AllowedZones: []string{"domestic", "remote"}, Reason: "liquids ship domestically only"}},
+		POBox:             &POBoxRule{ServiceLevels: []string{"standard"}, Reason: "PO boxes get standard only"},
+	}
+	e, err := New(card, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func violationsOf(t *testing.T, err error) []Violation {
+	t.Helper()
+	var rules *RuleError
+	if !errors.As(err, &rules) {
+		t.Fatalf("got %v, want a *RuleError", err)
+	}
+	return rules.Violations
+}
+
+func TestRules(t *testing.T) {
+	e := testRulesEngine(t)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name  string
+		dest  Destination
+		items []Item
+		want  []Violation
+	}{
+		{"blocked country", Destination{Country: "kp"}, []Item{{"A", 1}},
+			[]Violation{{RuleBlockedDestination, "address.country", "no shipping to KP"}}},
+		{"blocked state", Destination{Country: "US", State: "GU"}, []Item{{"A", 1}},
+			[]Violation{{RuleBlockedDestination, "address.state", "no shipping to GU"}}},
+		{"restricted category", Destination{Country: "FR"}, []Item{{"A", 1}, {"PERFUME", 1}},
+			[]Violation{{RuleRestrictedCategory, "items/PERFUME", "liquids ship domestically only"}}},
+		{"everything at once", Destination{Country: "KP"}, []Item{{"PERFUME", 2}},
+			[]Violation{{RuleBlockedDestination, "address.country", "no shipping to KP"}, {RuleRestrictedCategory, "items/PERFUME", "liquids ship domestically only"}}},
+	} {
+		_, err := e.Options(ctx, tc.dest, tc.items)
+		got := violationsOf(t, err)
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%s: got %v, want %v", tc.name, got[i], tc.want[i])
+			}
+		}
+	}
+
+	if _, err := e.Options(ctx, Destination{Country: "US", State: "CA"}, []Item{{"PERFUME", 1}}); err != nil {
+		t.Errorf("got %v shipping liquids domestically, want no error", err)
+	}
+}
+
+func TestPOBoxRule(t *testing.T) {
+	e := testRulesEngine(t)
+	ctx := context.Background()
+	poBox := Destination{Country: "US", Street: "P.O. Box 1234"}
+
+	options, err := e.Options(ctx, poBox, []Item{{"A", 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(options) != 1 || options[0].ServiceLevel != "standard" {
+		t.Errorf("got %v, want standard only for a PO box", options)
+	}
+	_, err = e.Quote(ctx, poBox, []Item{{"A", 1}}, "express")
+	if v := violationsOf(t, err); len(v) != 1 || v[0].Rule != RulePOBox || v[0].Subject != "address.street_address" {
+		t.Errorf("got %v, want the PO box rule", v)
+	}
+	// A level that does not serve the zone at all is just unavailable.
+	poBox.State = "AK"
+	if _, err := e.Quote(ctx, poBox, []Item{{"A", 1}}, "express"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("got %v, want ErrUnavailable", err)
+	}
+
+	for street, want := range map[string]bool{
+		"PO Box 12":              true,
+		"p.o. box 12":            true,
+		"Post Office Box 12":     true,
+		"POBox 12":               true,
+		"1600 Amphitheatre Pkwy": false,
+		"12 Boxwood Ln":          false,
+		"Pobrecito St":           false,
+	} {
+		if IsPOBox(street) != want {
+			t.Errorf("IsPOBox(%q) = %v, want %v", street, !want, want)
+		}
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	const base = `{"currency_code": "USD", "default_package": {"weight": 1}, "zones": [{"name": "all"}], "rates": {"all": {"bands": [{"max_weight": 1, "price": 1}]}}, "rules": %s}`
+	for name, rules := range map[string]string{
+		"blocked without reason":       `{"blocked": [{"countries": ["KP"]}]}`,
+		"restriction zone":             `{"restrictions": [{"category": "liquids", "allowed_zones": ["mars"], "reason": "r"}]}`,
+		"category with no restriction": `{"product_categories": {"A": ["liquids"]}}`,
+		"po box level":                 `{"po_box": {"service_levels": ["express"], "reason": "r"}}`,
+	} {
+		if _, err := ParseRateCard([]byte(fmt.Sprintf(base, rules))); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TODO: this file is duplicated in the other Go services since they do not
+// share packages.
+
+var (
+	// cardNumberPattern matches 13 to 19 digits, optionally grouped by
+	// spaces or dashes. Matches that fail the Luhn check are left alone so
+	// that IDs and timestamps survive.
+	cardNumberPattern = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+	// cvvPattern matches a CVV field in JSON, proto text or key=value form.
+	cvvPattern   = regexp.MustCompile(`(?i)(cvv\\?"?\s*[:=]\s*\\?"?)\d{3,4}`)
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@([A-Za-z0-9-]+\.)+[A-Za-z]{2,}`)
+)
+
+// redact masks card numbers (keeping the last four digits), CVVs and email
+// addresses in s.
+func redact(s string) string {
+	s = cardNumberPattern.ReplaceAllStringFunc(s, func(m string) string {
+		digits := strings.NewReplacer(" ", "", "-", "").Replace(m)
+		if !luhnValid(digits) {
+			return m
+		}
+		return strings.Repeat("*", len(digits)-4) + digits[len(digits)-4:]
+	})
+	s = cvvPattern.ReplaceAllString(s, "${1}***")
+	return emailPattern.ReplaceAllStringFunc(s, func(m string) string {
+		return "***" + m[strings.IndexByte(m, '@'):]
+	})
+}
+
+func luhnValid(digits string) bool {
+	sum := 0
+	for i := 0; i < len(digits); i++ {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// redactingFormatter redacts every formatted log entry, so that card data
+// and emails are masked whether they end up in the message or in a field.
+type redactingFormatter struct {
+	logrus.Formatter
+}
+
+func (f redactingFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	b, err := f.Formatter.Format(e)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(redact(string(b))), nil
+}
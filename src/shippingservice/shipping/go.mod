@@ -0,0 +1,12 @@
+module github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/shipping
+
+go 1.21
+
+require (
+	github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/quote v0.0.0
+	github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/trackingid v0.0.0
+)
+
+replace github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/quote => ../quote
+
+replace github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/trackingid => ../trackingid
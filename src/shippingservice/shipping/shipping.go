@@ -0,0 +1,166 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package shipping is the shipping domain shared by the gRPC shipping
+// service and the shipping Cloud Function: it quotes shipments, hands them
+// over to carriers under tracking IDs and tracks them. Transports only
+// translate requests and errors.
+package shipping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/quote"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/trackingid"
+)
+
+// Address is where a shipment goes.
+type Address struct {
+	StreetAddress string
+	City          string
+	State         string
+	Country       string
+	ZipCode       int32
+}
+
+// Destination returns where the quote engine rates a shipment to a.
+func (a Address) Destination() quote.Destination {
+	return quote.Destination{Country: a.Country, State: a.State, Street: a.StreetAddress}
+}
+
+// place returns the city and state, as shown in tracking.
+func (a Address) place() string {
+	var parts []string
+	for _, p := range []string{a.City, a.State} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Shipment is a shipment handed over to a carrier.
+type Shipment struct {
+	TrackingID   string
+	Address      Address
+	ServiceLevel quote.ServiceLevel
+	ShippedAt    time.Time
+	// Delivery is the promised delivery date, or zero if the shipment
+	// could not be quoted.
+	Delivery time.Time
+}
+
+// Service quotes, ships and tracks. Shipments and carrier events live in
+// memory, so callers pass hints to track shipments another instance
+// handed over.
+type Service struct {
+	quotes *quote.Engine
+	ids    *trackingid.Generator
+
+	// Now returns the current time; tests replace it.
+	Now func() time.Time
+	// EventSecret is the secret carriers sign their events with. Without
+	// it RecordEvent refuses every event.
+	EventSecret string
+
+	mu        sync.Mutex
+	shipments map[string]Shipment
+	events    map[string][]Event
+}
+
+// New returns a service that quotes with quotes and issues tracking IDs
+// from ids.
+func New(quotes *quote.Engine, ids *trackingid.Generator) *Service {
+	return &Service{
+		quotes:    quotes,
+		ids:       ids,
+		Now:       time.Now,
+		shipments: make(map[string]Shipment),
+		events:    make(map[string][]Event),
+	}
+}
+
+// FromEnv returns a service configured by the environment: the rate card
+// of quote.FromEnv, tracking IDs starting with TRACKING_ID_PREFIX and
+// carrier events signed with CARRIER_EVENT_SECRET.
+func FromEnv() (*Service, error) {
+	quotes, err := quote.FromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load shipping rates: %v", err)
+	}
+	ids, err := trackingid.NewGenerator(os.Getenv("TRACKING_ID_PREFIX"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tracking ID generator: %v", err)
+	}
+	s := New(quotes, ids)
+	s.EventSecret = os.Getenv("CARRIER_EVENT_SECRET")
+	return s, nil
+}
+
+// Quotes returns the quote engine.
+func (s *Service) Quotes() *quote.Engine {
+	return s.quotes
+}
+
+// Quote returns the options of shipping items to addr, default first. It
+// fails with a *quote.RuleError if the shipment breaks shipping rules.
+func (s *Service) Quote(ctx context.Context, addr Address, items []quote.Item) ([]quote.Option, error) {
+	return s.quotes.Options(ctx, addr.Destination(), items)
+}
+
+// Ship hands items over to the carrier of a service level, the default one
+// if serviceLevel is empty, and remembers the shipment for tracking. It
+// fails with an error wrapping quote.ErrUnavailable for a service level that
+// is unknown or not offered to the address, quote.ErrNoZone for an address
+// no zone serves, and a *quote.RuleError if the shipment breaks shipping
+// rules. Other quote failures leave the shipment without a promised
+// delivery; any other error is the service's own.
+func (s *Service) Ship(ctx context.Context, addr Address, items []quote.Item, serviceLevel string) (Shipment, error) {
+	level, err := s.quotes.ServiceLevel(serviceLevel)
+	if err != nil {
+		return Shipment{}, err
+	}
+	o, quoteErr := s.quotes.Quote(ctx, addr.Destination(), items, level.ID)
+	var rules *quote.RuleError
+	if errors.As(quoteErr, &rules) || errors.Is(quoteErr, quote.ErrUnavailable) || errors.Is(quoteErr, quote.ErrNoZone) {
+		return Shipment{}, quoteErr
+	}
+	id, err := s.ids.New()
+	if err != nil {
+		return Shipment{}, err
+	}
+
+	sh := Shipment{TrackingID: id, Address: addr, ServiceLevel: level, ShippedAt: s.Now()}
+	if quoteErr == nil {
+		sh.Delivery = s.quotes.Estimate(o, sh.ShippedAt).Latest
+	}
+	s.mu.Lock()
+	s.shipments[id] = sh
+	s.mu.Unlock()
+	return sh, nil
+}
+
+// Shipment returns a shipment this service handed over.
+func (s *Service) Shipment(trackingID string) (Shipment, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh, ok := s.shipments[trackingID]
+	return sh, ok
+}
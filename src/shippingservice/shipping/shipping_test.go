@@ -0,0 +1,210 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shipping
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/quote"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/trackingid"
+)
+
+func newTestService(t *testing.T) *Service {
+	t.Helper()
+	card, err := quote.DefaultRateCard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	quotes, err := quote.New(card, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := trackingid.NewGenerator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(quotes, ids)
+	s.EventSecret = testEventSecret
+	return s
+}
+
+const testEventSecret = "carrier-secret"
+
+var mountainView = Address{StreetAddress: "1600 Amphitheatre Pkwy", City: "Mountain View", State: "CA", Country: "US"}
+
+func TestShip(t *testing.T) {
+	s := newTestService(t)
+	shipped := time.Date(2024, 3, 4, 15, 0, 0, 0, time.UTC)
+	s.Now = func() time.Time { return shipped }
+	ctx := context.Background()
+	items := []quote.Item{{ProductID: "OLJCESPC7Z", Quantity: 1}}
+
+	sh, err := s.Ship(ctx, mountainView, items, "express")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := trackingid.ValidateTrackingId(sh.TrackingID); err != nil {
+		t.Errorf("got tracking ID %q: %v", sh.TrackingID, err)
+	}
+	if sh.ServiceLevel.ID != "express" || sh.ServiceLevel.Carrier != "UPS" || !sh.ShippedAt.Equal(shipped) || sh.Delivery.IsZero() {
+		t.Errorf("got shipment %+v, want it handed over to UPS with a promised delivery", sh)
+	}
+	if got, ok := s.Shipment(sh.TrackingID); !ok || got.Address != mountainView {
+		t.Errorf("got %+v, %t, want the shipment remembered", got, ok)
+	}
+
+	if _, err := s.Ship(ctx, mountainView, items, "teleport"); !errors.Is(err, quote.ErrUnavailable) {
+		t.Errorf("got %v for an unknown service level, want ErrUnavailable", err)
+	}
+	paris := Address{StreetAddress: "5 Avenue Anatole France", City: "Paris", Country: "FR"}
+	if sh, err := s.Ship(ctx, paris, items, "overnight"); !errors.Is(err, quote.ErrUnavailable) {
+		t.Errorf("got %+v, %v for a level not offered abroad, want ErrUnavailable", sh, err)
+	}
+	var rules *quote.RuleError
+	if _, err := s.Ship(ctx, Address{Country: "KP"}, items, ""); !errors.As(err, &rules) {
+		t.Errorf("got %v for a blocked destination, want a RuleError", err)
+	}
+}
+
+func TestTrack(t *testing.T) {
+	s := newTestService(t)
+	shipped := time.Date(2024, 3, 4, 15, 0, 0, 0, time.UTC)
+	now := shipped
+	s.Now = func() time.Time { return now }
+
+	sh, err := s.Ship(context.Background(), mountainView, []quote.Item{{ProductID: "OLJCESPC7Z", Quantity: 1}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := func() Status {
+		t.Helper()
+		events, err := s.Track(sh.TrackingID, Hints{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return events[len(events)-1].Status
+	}
+
+	if got := status(); got != StatusLabelCreated {
+		t.Errorf("got %s right after shipping, want LABEL_CREATED", got)
+	}
+	now = shipped.Add(24 * time.Hour)
+	if got := status(); got != StatusInTransit {
+		t.Errorf("got %s a day later, want IN_TRANSIT", got)
+	}
+	now = sh.Delivery.AddDate(0, 0, 1)
+	events, err := s.Track(sh.TrackingID, Hints{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := events[len(events)-1]
+	if last.Status != StatusDelivered || last.Location != "Mountain View, CA" {
+		t.Errorf("got %+v after the delivery date, want delivered in Mountain View, CA", last)
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].TimeUnix <= events[i-1].TimeUnix {
+			t.Errorf("event %d (%s) is not after the one before", i, events[i].Description)
+		}
+	}
+}
+
+func TestTrackHintsAndCarrierEvents(t *testing.T) {
+	s := newTestService(t)
+	id, err := s.ids.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Track("XX-1-2", Hints{}); !errors.Is(err, trackingid.ErrInvalid) {
+		t.Errorf("got %v for a malformed tracking ID, want ErrInvalid", err)
+	}
+	if _, err := s.Track(id, Hints{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v for an unknown shipment, want ErrNotFound", err)
+	}
+	shippedAt := time.Now().AddDate(0, 0, -10)
+	events, err := s.Track(id, Hints{ShippedAt: shippedAt, Delivery: shippedAt.AddDate(0, 0, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := events[len(events)-1].Status; got != StatusDelivered {
+		t.Errorf("got %s from the hints, want DELIVERED", got)
+	}
+	again, err := s.Track(id, Hints{ShippedAt: shippedAt, Delivery: shippedAt.AddDate(0, 0, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != len(events) || again[1] != events[1] {
+		t.Error("tracking the same shipment twice told different stories")
+	}
+
+	unspecified := Event{Status: "SHIPMENT_STATUS_UNSPECIFIED"}
+	if err := s.RecordEvent(id, unspecified, SignEvent(testEventSecret, time.Now(), id, unspecified)); !errors.Is(err, ErrInvalidEvent) {
+		t.Errorf("got %v for an event without a status, want ErrInvalidEvent", err)
+	}
+	later := Event{Status: StatusOutForDelivery, Description: "Out for delivery", TimeUnix: shippedAt.Add(time.Hour).Unix()}
+	earlier := Event{Status: StatusInTransit, Description: "Delayed by weather", TimeUnix: shippedAt.Unix()}
+	for _, e := range []Event{later, earlier} {
+		if err := s.RecordEvent(id, e, SignEvent(testEventSecret, time.Now(), id, e)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, err = s.Track(id, Hints{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0] != earlier || events[1] != later {
+		t.Errorf("got %+v, want the carrier's events in time order", events)
+	}
+}
+
+func TestRecordEventSignature(t *testing.T) {
+	s := newTestService(t)
+	id, err := s.ids.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := Event{Status: StatusDelivered, Description: "Delivered", Location: "Mountain View, CA"}
+	now := time.Now()
+	tampered := e
+	tampered.Location = "Elsewhere"
+	for _, tc := range []struct {
+		name, signature string
+	}{
+		{"unsigned", ""},
+		{"malformed", "v1=abc"},
+		{"wrong secret", SignEvent("guess", now, id, e)},
+		{"other event", SignEvent(testEventSecret, now, id, tampered)},
+		{"other shipment", SignEvent(testEventSecret, now, "XX-"+id, e)},
+		{"replayed", SignEvent(testEventSecret, now.Add(-time.Hour), id, e)},
+	} {
+		if err := s.RecordEvent(id, e, tc.signature); !errors.Is(err, ErrUnauthenticated) {
+			t.Errorf("%s: got %v, want ErrUnauthenticated", tc.name, err)
+		}
+	}
+	if _, err := s.Track(id, Hints{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v after rejected events, want ErrNotFound", err)
+	}
+
+	if err := s.RecordEvent(id, e, SignEvent(testEventSecret, now, id, e)); err != nil {
+		t.Fatal(err)
+	}
+	s.EventSecret = ""
+	if err := s.RecordEvent(id, e, SignEvent("", now, id, e)); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("got %v without a secret, want ErrUnauthenticated", err)
+	}
+}
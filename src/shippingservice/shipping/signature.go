@@ -0,0 +1,86 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shipping
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EventSignatureHeader is the HTTP header, or lower-cased the gRPC
+// metadata key, carrying the signature of a carrier event.
+const EventSignatureHeader = "X-Carrier-Signature"
+
+// eventSignatureTolerance is how far the time of a signature may be from
+// now, so a captured event cannot be replayed later.
+const eventSignatureTolerance = 5 * time.Minute
+
+// SignEvent returns the signature of a carrier event, "t=<unix>,v1=<hex>",
+// where v1 is HMAC-SHA256(secret, ...) of the time and the event's fields,
+// one per line: "<unix>", tracking ID, status, time_unix, location and
+// description. Fields are signed as sent, so an event without a time is
+// signed with time_unix 0.
+func SignEvent(secret string, ts time.Time, trackingID string, e Event) string {
+	t := strconv.FormatInt(ts.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", t, hex.EncodeToString(eventMAC(secret, t, trackingID, e)))
+}
+
+func eventMAC(secret, t, trackingID string, e Event) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{
+		t,
+		trackingID,
+		string(e.Status),
+		strconv.FormatInt(e.TimeUnix, 10),
+		e.Location,
+		e.Description,
+	}, "\n")))
+	return mac.Sum(nil)
+}
+
+// verifyEvent checks the signature of a carrier event. Without a secret
+// no event is accepted.
+func (s *Service) verifyEvent(signature, trackingID string, e Event) error {
+	if s.EventSecret == "" {
+		return fmt.Errorf("%w: carrier events are disabled, set CARRIER_EVENT_SECRET", ErrUnauthenticated)
+	}
+	var t, v1 string
+	for _, part := range strings.Split(signature, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			t = v
+		case "v1":
+			v1 = v
+		}
+	}
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: malformed %s", ErrUnauthenticated, EventSignatureHeader)
+	}
+	if d := s.Now().Sub(time.Unix(unix, 0)); d > eventSignatureTolerance || d < -eventSignatureTolerance {
+		return fmt.Errorf("%w: signature time out of range", ErrUnauthenticated)
+	}
+	got, err := hex.DecodeString(v1)
+	if err != nil || !hmac.Equal(got, eventMAC(s.EventSecret, t, trackingID, e)) {
+		return fmt.Errorf("%w: signature mismatch", ErrUnauthenticated)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shipping
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/trackingid"
+)
+
+// Status is the status of a shipment, named as in the ShipmentStatus enum
+// of demo.proto.
+type Status string
+
+const (
+	StatusLabelCreated   Status = "SHIPMENT_STATUS_LABEL_CREATED"
+	StatusInTransit      Status = "SHIPMENT_STATUS_IN_TRANSIT"
+	StatusOutForDelivery Status = "SHIPMENT_STATUS_OUT_FOR_DELIVERY"
+	StatusDelivered      Status = "SHIPMENT_STATUS_DELIVERED"
+)
+
+func (s Status) valid() bool {
+	switch s {
+	case StatusLabelCreated, StatusInTransit, StatusOutForDelivery, StatusDelivered:
+		return true
+	}
+	return false
+}
+
+// Event is a step in the status history of a shipment.
+type Event struct {
+	Status      Status `json:"status"`
+	Description string `json:"description"`
+	Location    string `json:"location,omitempty"`
+	TimeUnix    int64  `json:"time_unix"`
+}
+
+// Hints describe a shipment another instance handed over: when, and its
+// promised delivery date, if known.
+type Hints struct {
+	ShippedAt time.Time
+	Delivery  time.Time
+}
+
+var (
+	// ErrNotFound is returned for a shipment that is neither known nor
+	// described by hints.
+	ErrNotFound = errors.New("unknown tracking ID")
+	// ErrInvalidEvent is returned for a carrier event without a known
+	// status.
+	ErrInvalidEvent = errors.New("an event with a known status is required")
+	// ErrUnauthenticated is returned for a carrier event without a valid
+	// signature.
+	ErrUnauthenticated = errors.New("a valid carrier signature is required")
+)
+
+// sortingHubs are where simulated shipments are scanned in transit.
+var sortingHubs = []string{
+	"Memphis, TN",
+	"Louisville, KY",
+	"Indianapolis, IN",
+	"Dallas, TX",
+	"Ontario, CA",
+	"Chicago, IL",
+}
+
+// Track returns the status history of a shipment: the carrier's events if
+// there are any, or else a simulation from the shipment or, for one this
+// service did not hand over, from hints. Malformed IDs fail with an error
+// wrapping trackingid.ErrInvalid.
+func (s *Service) Track(trackingID string, hints Hints) ([]Event, error) {
+	if err := trackingid.ValidateTrackingId(trackingID); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	events := append([]Event(nil), s.events[trackingID]...)
+	sh, recorded := s.shipments[trackingID]
+	s.mu.Unlock()
+
+	if len(events) > 0 {
+		sort.SliceStable(events, func(i, j int) bool { return events[i].TimeUnix < events[j].TimeUnix })
+		return events, nil
+	}
+	if !recorded {
+		if hints.ShippedAt.IsZero() {
+			return nil, fmt.Errorf("%w %s", ErrNotFound, trackingID)
+		}
+		sh = Shipment{TrackingID: trackingID, ShippedAt: hints.ShippedAt, Delivery: hints.Delivery}
+	}
+	return simulate(sh, s.Now()), nil
+}
+
+// RecordEvent ingests a status update pushed by a carrier, signed with
+// SignEvent. An event without a time happened now. It fails with an error
+// wrapping ErrUnauthenticated if the signature does not match.
+func (s *Service) RecordEvent(trackingID string, e Event, signature string) error {
+	if err := s.verifyEvent(signature, trackingID, e); err != nil {
+		return err
+	}
+	if err := trackingid.ValidateTrackingId(trackingID); err != nil {
+		return err
+	}
+	if !e.Status.valid() {
+		return ErrInvalidEvent
+	}
+	if e.TimeUnix == 0 {
+		e.TimeUnix = s.Now().Unix()
+	}
+	s.mu.Lock()
+	s.events[trackingID] = append(s.events[trackingID], e)
+	s.mu.Unlock()
+	return nil
+}
+
+// simulate returns the events of a shipment up to now: picked up a few
+// hours after it was handed over, scanned at a sorting hub on each day in
+// between, and out for delivery and delivered on its delivery day. The
+// story depends only on the arguments, so every instance tells the same
+// one.
+func simulate(sh Shipment, now time.Time) []Event {
+	h := fnv.New64a()
+	h.Write([]byte(sh.TrackingID))
+	seed := h.Sum64()
+	// jitter returns a deterministic duration below max, varying with n.
+	jitter := func(n int, max time.Duration) time.Duration {
+		return time.Duration((seed>>(n*8))%uint64(max/time.Minute)) * time.Minute
+	}
+
+	delivery := sh.Delivery
+	if delivery.IsZero() {
+		delivery = sh.ShippedAt.AddDate(0, 0, 5)
+	}
+	deliveryDay := startOfDay(delivery)
+	pickup := sh.ShippedAt.Add(2*time.Hour + jitter(0, 4*time.Hour))
+	outForDelivery := deliveryDay.Add(8*time.Hour + jitter(1, time.Hour))
+	if !outForDelivery.After(pickup) {
+		outForDelivery = pickup.Add(time.Hour)
+	}
+	destination := sh.Address.place()
+
+	events := []Event{
+		{Status: StatusLabelCreated, Description: "Shipping label created", TimeUnix: sh.ShippedAt.Unix()},
+		{Status: StatusInTransit, Description: "Picked up by carrier", TimeUnix: pickup.Unix()},
+	}
+	for day := 1; day <= 3; day++ {
+		scan := startOfDay(pickup).AddDate(0, 0, day).Add(3*time.Hour + jitter(day+1, 2*time.Hour))
+		if !scan.Before(outForDelivery) {
+			break
+		}
+		events = append(events, Event{
+			Status:      StatusInTransit,
+			Description: "Arrived at sorting facility",
+			Location:    sortingHubs[(seed>>(day*8))%uint64(len(sortingHubs))],
+			TimeUnix:    scan.Unix(),
+		})
+	}
+	events = append(events,
+		Event{Status: StatusOutForDelivery, Description: "Out for delivery", Location: destination, TimeUnix: outForDelivery.Unix()},
+		Event{Status: StatusDelivered, Description: "Delivered", Location: destination, TimeUnix: outForDelivery.Add(2*time.Hour + jitter(5, 4*time.Hour)).Unix()},
+	)
+
+	for i, e := range events {
+		if e.TimeUnix > now.Unix() {
+			return events[:i]
+		}
+	}
+	return events
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
@@ -15,16 +15,74 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"go.opentelemetry.io/otel/metric/noop"
 	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/quote"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/shipping"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/trackingid"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
+func newTestServer(t *testing.T) *server {
+	t.Helper()
+	card, err := quote.DefaultRateCard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	quotes, err := quote.New(card, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := trackingid.NewGenerator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := newShippingMetrics(noop.NewMeterProvider())
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := shipping.New(quotes, ids)
+	svc.EventSecret = testEventSecret
+	return &server{shipping: svc, sender: defaultSender, metrics: metrics}
+}
+
+const testEventSecret = "carrier-secret"
+
+// newTrackingID returns a well-formed tracking ID of a shipment the server
+// did not hand over.
+func newTrackingID(t *testing.T) string {
+	t.Helper()
+	ids, err := trackingid.NewGenerator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := ids.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
 // TestGetQuote is a basic check on the GetQuote RPC service.
 func TestGetQuote(t *testing.T) {
-	s := server{}
+	s := newTestServer(t)
 
 	// A basic test case to test logic and protobuf interactions.
 	req := &pb.GetQuoteRequest{
@@ -50,14 +108,101 @@ func TestGetQuote(t *testing.T) {
 	if err != nil {
 		t.Errorf("TestGetQuote (%v) failed", err)
 	}
-	if res.CostUsd.GetUnits() != 8 || res.CostUsd.GetNanos() != 990000000 {
-		t.Errorf("TestGetQuote: Quote value '%d.%d' does not match expected '%s'", res.CostUsd.GetUnits(), res.CostUsd.GetNanos(), "11.220000000")
+	// Four units of the 1 lb default package to the international zone.
+	if res.CostUsd.GetUnits() != 38 || res.CostUsd.GetNanos() != 990000000 {
+		t.Errorf("TestGetQuote: Quote value '%d.%d' does not match expected '%s'", res.CostUsd.GetUnits(), res.CostUsd.GetNanos(), "38.990000000")
+	}
+	// Overnight and pickup are domestic only.
+	var levels []string
+	for _, o := range res.GetOptions() {
+		levels = append(levels, o.GetServiceLevel())
+		if _, err := time.Parse(time.DateOnly, o.GetEstimatedDeliveryDate()); err != nil {
+			t.Errorf("TestGetQuote: option %s has delivery date %q", o.GetServiceLevel(), o.GetEstimatedDeliveryDate())
+		}
+		if o.GetEarliestDeliveryDate() == "" || o.GetEarliestDeliveryDate() > o.GetEstimatedDeliveryDate() {
+			t.Errorf("TestGetQuote: option %s has delivery window %q to %q", o.GetServiceLevel(), o.GetEarliestDeliveryDate(), o.GetEstimatedDeliveryDate())
+		}
+	}
+	if strings.Join(levels, ",") != "standard,express" {
+		t.Errorf("TestGetQuote: got service levels %v, want standard and express", levels)
+	}
+}
+
+// TestGetQuoteUnservedDestination checks that a destination without rates is
+// rejected rather than quoted.
+func TestGetQuoteUnservedDestination(t *testing.T) {
+	card, err := quote.DefaultRateCard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only ship to the first zone.
+	card.Zones = card.Zones[:1]
+	card.Rates = map[string]quote.Rate{card.Zones[0].Name: card.Rates[card.Zones[0].Name]}
+	card.ServiceLevels = nil
+	card.Rules = quote.Rules{}
+	quotes, err := quote.New(card, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{shipping: shipping.New(quotes, nil)}
+	req := &pb.GetQuoteRequest{
+		Address: &pb.Address{Country: "France"},
+		Items:   []*pb.CartItem{{ProductId: "23", Quantity: 1}},
+	}
+	if _, err := s.GetQuote(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("TestGetQuoteUnservedDestination: got %v, want InvalidArgument", err)
+	}
+}
+
+// TestShippingRules checks that broken shipping rules come back as
+// FailedPrecondition with a violation per rule.
+func TestShippingRules(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	violations := func(err error) []*errdetails.PreconditionFailure_Violation {
+		t.Helper()
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Fatalf("got %v, want FailedPrecondition", err)
+		}
+		for _, d := range status.Convert(err).Details() {
+			if pf, ok := d.(*errdetails.PreconditionFailure); ok {
+				return pf.GetViolations()
+			}
+		}
+		t.Fatalf("got no PreconditionFailure in %v", err)
+		return nil
+	}
+
+	// The watch has a lithium battery and does not leave North America.
+	_, err := s.GetQuote(ctx, &pb.GetQuoteRequest{
+		Address: &pb.Address{Country: "North Korea"},
+		Items:   []*pb.CartItem{{ProductId: "1YMWWN1N4O", Quantity: 1}},
+	})
+	v := violations(err)
+	if len(v) != 2 || v[0].GetType() != quote.RuleBlockedDestination || v[0].GetSubject() != "address.country" ||
+		v[1].GetType() != quote.RuleRestrictedCategory || v[1].GetSubject() != "items/1YMWWN1N4O" {
+		t.Errorf("got violations %v, want the blocked country and the restricted watch", v)
+	}
+
+	req := &pb.ShipOrderRequest{
+		Address:      &pb.Address{StreetAddress: "PO Box 42", City: "Mountain View", State: "CA", Country: "US"},
+		Items:        []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}},
+		ServiceLevel: "express",
+	}
+	_, err = s.ShipOrder(ctx, req)
+	if v := violations(err); len(v) != 1 || v[0].GetType() != quote.RulePOBox || v[0].GetSubject() != "address.street_address" {
+		t.Errorf("got violations %v, want the PO box rule", v)
+	}
+	req.ServiceLevel = "standard"
+	if _, err := s.ShipOrder(ctx, req); err != nil {
+		t.Errorf("got %v shipping standard to a PO box, want it shipped", err)
 	}
 }
 
 // TestShipOrder is a basic check on the ShipOrder RPC service.
 func TestShipOrder(t *testing.T) {
-	s := server{}
+	s := newTestServer(t)
 
 	// A basic test case to test logic and protobuf interactions.
 	req := &pb.ShipOrderRequest{
@@ -83,8 +228,349 @@ func TestShipOrder(t *testing.T) {
 	if err != nil {
 		t.Errorf("TestShipOrder (%v) failed", err)
 	}
-	// @todo improve quality of this test to check for a pattern such as '[A-Z]{2}-\d+-\d+'.
-	if len(res.TrackingId) != 18 {
-		t.Errorf("TestShipOrder: Tracking ID is malformed - has %d characters, %d expected", len(res.TrackingId), 18)
+	if err := trackingid.ValidateTrackingId(res.TrackingId); err != nil {
+		t.Errorf("TestShipOrder: Tracking ID %q is malformed: %v", res.TrackingId, err)
+	}
+	if res.Carrier != "USPS" {
+		t.Errorf("TestShipOrder: got carrier %q, want USPS for the default service level", res.Carrier)
+	}
+
+	req.ServiceLevel = "teleport"
+	if _, err := s.ShipOrder(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("TestShipOrder: got %v for an unknown service level, want InvalidArgument", err)
+	}
+}
+
+// TestTrackShipment follows a shipment through its simulated timeline.
+func TestTrackShipment(t *testing.T) {
+	s := newTestServer(t)
+	shipped := time.Date(2024, 3, 4, 15, 0, 0, 0, time.UTC)
+	now := shipped
+	s.shipping.Now = func() time.Time { return now }
+
+	res, err := s.ShipOrder(context.Background(), &pb.ShipOrderRequest{
+		Address: &pb.Address{City: "Mountain View", State: "CA", Country: "US"},
+		Items:   []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	track := func() *pb.TrackShipmentResponse {
+		t.Helper()
+		tr, err := s.TrackShipment(context.Background(), &pb.TrackShipmentRequest{TrackingId: res.TrackingId})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tr
+	}
+
+	if got := track().GetStatus(); got != pb.ShipmentStatus_SHIPMENT_STATUS_LABEL_CREATED {
+		t.Errorf("TestTrackShipment: got %s right after shipping, want LABEL_CREATED", got)
+	}
+	now = shipped.Add(24 * time.Hour)
+	if got := track().GetStatus(); got != pb.ShipmentStatus_SHIPMENT_STATUS_IN_TRANSIT {
+		t.Errorf("TestTrackShipment: got %s a day later, want IN_TRANSIT", got)
+	}
+	// Standard shipping in the US takes five days.
+	now = shipped.AddDate(0, 0, 6)
+	final := track()
+	if final.GetStatus() != pb.ShipmentStatus_SHIPMENT_STATUS_DELIVERED {
+		t.Fatalf("TestTrackShipment: got %s after six days, want DELIVERED", final.GetStatus())
+	}
+	for i, e := range final.GetEvents() {
+		if i > 0 && e.GetTimeUnix() <= final.GetEvents()[i-1].GetTimeUnix() {
+			t.Errorf("TestTrackShipment: event %d (%s) is not after the one before", i, e.GetDescription())
+		}
+	}
+	if got := final.GetEvents()[len(final.GetEvents())-1].GetLocation(); got != "Mountain View, CA" {
+		t.Errorf("TestTrackShipment: delivered in %q, want Mountain View, CA", got)
+	}
+	if again := track(); len(again.GetEvents()) != len(final.GetEvents()) || again.GetEvents()[1].GetTimeUnix() != final.GetEvents()[1].GetTimeUnix() {
+		t.Error("TestTrackShipment: tracking the same shipment twice told different stories")
+	}
+}
+
+// TestTrackShipmentHintsAndCarrierEvents checks shipments the service did not
+// hand over, and that carrier events replace the simulation.
+func TestTrackShipmentHintsAndCarrierEvents(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	id := newTrackingID(t)
+	if _, err := s.TrackShipment(ctx, &pb.TrackShipmentRequest{TrackingId: "XX-1-2"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v for a malformed tracking ID, want InvalidArgument", err)
+	}
+	if _, err := s.TrackShipment(ctx, &pb.TrackShipmentRequest{TrackingId: id}); status.Code(err) != codes.NotFound {
+		t.Errorf("got %v for an unknown shipment, want NotFound", err)
+	}
+	shippedAt := time.Now().AddDate(0, 0, -10)
+	res, err := s.TrackShipment(ctx, &pb.TrackShipmentRequest{
+		TrackingId:            id,
+		ShippedAtUnix:         shippedAt.Unix(),
+		EstimatedDeliveryDate: shippedAt.AddDate(0, 0, 2).Format(time.DateOnly),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.GetStatus() != pb.ShipmentStatus_SHIPMENT_STATUS_DELIVERED {
+		t.Errorf("got %s from the hints, want DELIVERED", res.GetStatus())
+	}
+
+	req := &pb.RecordTrackingEventRequest{
+		TrackingId: id,
+		Event:      &pb.TrackingEvent{Status: pb.ShipmentStatus_SHIPMENT_STATUS_IN_TRANSIT, Description: "Delayed by weather", TimeUnix: shippedAt.Unix()},
+	}
+	if _, err := s.RecordTrackingEvent(ctx, req); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("got %v for an unsigned event, want Unauthenticated", err)
+	}
+	signature := shipping.SignEvent(testEventSecret, time.Now(), id, shipping.Event{
+		Status:      shipping.StatusInTransit,
+		Description: "Delayed by weather",
+		TimeUnix:    shippedAt.Unix(),
+	})
+	if _, err := s.RecordTrackingEvent(metadata.NewIncomingContext(ctx, metadata.Pairs("x-carrier-signature", signature)), req); err != nil {
+		t.Fatal(err)
+	}
+	res, err = s.TrackShipment(ctx, &pb.TrackShipmentRequest{TrackingId: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.GetEvents()) != 1 || res.GetStatus() != pb.ShipmentStatus_SHIPMENT_STATUS_IN_TRANSIT {
+		t.Errorf("got %v, want the carrier's event only", res.GetEvents())
+	}
+}
+
+func TestGetLabel(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	res, err := s.ShipOrder(ctx, &pb.ShipOrderRequest{
+		Address:      &pb.Address{StreetAddress: "1 Main St", City: "Seattle", State: "WA", Country: "US", ZipCode: 98101},
+		Items:        []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}},
+		ServiceLevel: "express",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := s.GetLabel(ctx, &pb.GetLabelRequest{TrackingId: res.TrackingId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.GetContentType() != "application/pdf" || l.GetFilename() != res.TrackingId+".pdf" || !bytes.HasPrefix(l.GetData(), []byte("%PDF-")) {
+		t.Errorf("got %s %s, want a PDF label", l.GetContentType(), l.GetFilename())
+	}
+	for _, want := range []string{"(1 Main St)", "(Seattle, WA 98101)", "(EXPRESS - UPS)", "(Online Boutique)"} {
+		if !bytes.Contains(l.GetData(), []byte(want)) {
+			t.Errorf("PDF label does not contain %s", want)
+		}
+	}
+
+	l, err = s.GetLabel(ctx, &pb.GetLabelRequest{TrackingId: res.TrackingId, Format: pb.LabelFormat_LABEL_FORMAT_ZPL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(l.GetData(), []byte("^BCN,220,N,N,N^FD"+res.TrackingId+"^FS")) {
+		t.Errorf("ZPL label has no barcode of %s", res.TrackingId)
+	}
+
+	id := newTrackingID(t)
+	if _, err := s.GetLabel(ctx, &pb.GetLabelRequest{TrackingId: "XX-1-2"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v for a malformed tracking ID, want InvalidArgument", err)
+	}
+	if _, err := s.GetLabel(ctx, &pb.GetLabelRequest{TrackingId: id}); status.Code(err) != codes.NotFound {
+		t.Errorf("got %v for an unknown shipment, want NotFound", err)
+	}
+	l, err = s.GetLabel(ctx, &pb.GetLabelRequest{
+		TrackingId:   id,
+		Format:       pb.LabelFormat_LABEL_FORMAT_ZPL,
+		Address:      &pb.Address{StreetAddress: "2 Side St", City: "Portland", State: "OR", Country: "US"},
+		ServiceLevel: "standard",
+	})
+	if err != nil {
+		t.Fatalf("got %v for a shipment with hints", err)
+	}
+	if !bytes.Contains(l.GetData(), []byte("^FD2 Side St^FS")) {
+		t.Error("label does not show the hinted address")
+	}
+}
+
+func TestLabelAdmin(t *testing.T) {
+	s := newTestServer(t)
+	res, err := s.ShipOrder(context.Background(), &pb.ShipOrderRequest{
+		Address: &pb.Address{StreetAddress: "1 Main St", City: "Seattle", State: "WA", Country: "US"},
+		Items:   []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := newTrackingID(t)
+	srv := httptest.NewServer(s.labelAdmin())
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		path, contentType string
+		code              int
+	}{
+		{"/labels/" + res.TrackingId, "application/pdf", http.StatusOK},
+		{"/labels/" + res.TrackingId + "?format=zpl", "application/zpl", http.StatusOK},
+		{"/labels/" + res.TrackingId + "?format=png", "", http.StatusBadRequest},
+		{"/labels/XX-1-2", "", http.StatusBadRequest},
+		{"/labels/" + id, "", http.StatusNotFound},
+		{"/labels/" + id + "?street_address=2+Side+St&city=Portland&state=OR&country=US&zip_code=97201&service_level=standard&shipped_at_unix=1711929600", "application/pdf", http.StatusOK},
+		{"/labels/" + id + "?country=US&zip_code=abc", "", http.StatusBadRequest},
+	} {
+		resp, err := http.Get(srv.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.code {
+			t.Errorf("GET %s: got %d, want %d", tc.path, resp.StatusCode, tc.code)
+			continue
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		if got := resp.Header.Get("Content-Type"); got != tc.contentType {
+			t.Errorf("GET %s: got Content-Type %s, want %s", tc.path, got, tc.contentType)
+		}
+		if got := resp.Header.Get("Content-Disposition"); !strings.HasPrefix(got, "attachment; filename=") {
+			t.Errorf("GET %s: got Content-Disposition %q", tc.path, got)
+		}
+	}
+}
+
+// TestGateway calls the service through its HTTP/JSON gateway with the
+// payloads of the shipping function.
+func TestGateway(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	s := newTestServer(t)
+	pb.RegisterShippingServiceServer(srv, s)
+	healthpb.RegisterHealthServer(srv, s)
+	go srv.Serve(lis)
+	defer srv.Stop()
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	gw, err := newGateway(context.Background(), conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	web := httptest.NewServer(gw)
+	defer web.Close()
+
+	post := func(path, body string, resp interface{}) int {
+		t.Helper()
+		r, err := http.Post(web.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(resp); err != nil {
+			t.Fatal(err)
+		}
+		return r.StatusCode
+	}
+	const address = `{"street_address": "1600 Amphitheatre Pkwy", "city": "Mountain View", "state": "CA", "country": "US", "zip_code": 94043}`
+	const items = `[{"product_id": "OLJCESPC7Z", "quantity": 1}]`
+
+	var quoted struct {
+		Options []struct {
+			ServiceLevel          string `json:"service_level"`
+			EstimatedDeliveryDate string `json:"estimated_delivery_date"`
+			Cost                  struct {
+				Units json.Number `json:"units"`
+			} `json:"cost"`
+		} `json:"options"`
+	}
+	if code := post("/shipping/getQuote", `{"version": "v1", "address": `+address+`, "items": `+items+`}`, &quoted); code != http.StatusOK {
+		t.Fatalf("getQuote: got %d, want 200", code)
+	}
+	if len(quoted.Options) == 0 || quoted.Options[0].ServiceLevel != "standard" || quoted.Options[0].EstimatedDeliveryDate == "" || quoted.Options[0].Cost.Units == "" {
+		t.Errorf("getQuote: got %+v, want the options default first", quoted.Options)
+	}
+
+	var shipped struct {
+		TrackingID string `json:"tracking_id"`
+		Carrier    string `json:"carrier"`
+	}
+	if code := post("/shipping/shipOrder", `{"version": "v1", "address": `+address+`, "items": `+items+`, "service_level": "express"}`, &shipped); code != http.StatusOK || shipped.Carrier != "UPS" {
+		t.Fatalf("shipOrder: got %d %+v, want it handed over to UPS", code, shipped)
+	}
+
+	var rules struct {
+		Violations []struct {
+			Type    string `json:"type"`
+			Subject string `json:"subject"`
+		} `json:"violations"`
+	}
+	if code := post("/shipping/getQuote", `{"address": {"country": "KP"}, "items": `+items+`}`, &rules); code != http.StatusUnprocessableEntity || len(rules.Violations) != 1 || rules.Violations[0].Subject != "address.country" {
+		t.Errorf("getQuote: got %d %+v, want 422 with the blocked country", code, rules)
+	}
+
+	r, err := http.Get(web.URL + "/shipping/track?tracking_id=" + shipped.TrackingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tracked struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&tracked); err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusOK || tracked.Status != "SHIPMENT_STATUS_LABEL_CREATED" {
+		t.Errorf("track: got %d %+v, want the label created", r.StatusCode, tracked)
+	}
+	r, err = http.Get(web.URL + "/shipping/track?tracking_id=" + newTrackingID(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusNotFound {
+		t.Errorf("track: got %d for an unknown shipment, want 404", r.StatusCode)
+	}
+
+	event := shipping.Event{Status: shipping.StatusDelivered, Description: "Delivered"}
+	body := `{"tracking_id": "` + shipped.TrackingID + `", "event": {"status": "SHIPMENT_STATUS_DELIVERED", "description": "Delivered"}}`
+	for _, tc := range []struct {
+		name, signature string
+		want            int
+	}{
+		{"unsigned", "", http.StatusUnauthorized},
+		{"signed", shipping.SignEvent(testEventSecret, time.Now(), shipped.TrackingID, event), http.StatusOK},
+	} {
+		req, err := http.NewRequest(http.MethodPost, web.URL+"/shipping/trackingEvent", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.signature != "" {
+			req.Header.Set(shipping.EventSignatureHeader, tc.signature)
+		}
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		if r.StatusCode != tc.want {
+			t.Errorf("trackingEvent %s: got %d, want %d", tc.name, r.StatusCode, tc.want)
+		}
+	}
+
+	// Labels show the recipient's address and are only on the admin route.
+	r, err = http.Get(web.URL + "/shipping/labels/" + shipped.TrackingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusNotFound {
+		t.Errorf("labels: got %d from the gateway, want 404", r.StatusCode)
 	}
 }
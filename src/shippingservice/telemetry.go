@@ -0,0 +1,201 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/net/context"
+)
+
+// initTracing sends spans to the exporter named by OTEL_TRACES_EXPORTER:
+// "otlp" (the default) for the collector at COLLECTOR_SERVICE_ADDR,
+// "console" or "none". OTEL_TRACES_SAMPLER and OTEL_TRACES_SAMPLER_ARG pick
+// the sampler.
+func initTracing() error {
+	sampler, err := newSampler(os.Getenv("OTEL_TRACES_SAMPLER"), os.Getenv("OTEL_TRACES_SAMPLER_ARG"))
+	if err != nil {
+		return err
+	}
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithSampler(sampler)}
+	switch name := os.Getenv("OTEL_TRACES_EXPORTER"); name {
+	case "", "otlp":
+		var collectorAddr string
+		mustMapEnv(&collectorAddr, "COLLECTOR_SERVICE_ADDR")
+		exporter, err := otlptracegrpc.New(context.Background(),
+			otlptracegrpc.WithEndpoint(collectorAddr),
+			otlptracegrpc.WithInsecure())
+		if err != nil {
+			return fmt.Errorf("failed to create trace exporter: %v", err)
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	case "console":
+		exporter, err := stdouttrace.New()
+		if err != nil {
+			return fmt.Errorf("failed to create trace exporter: %v", err)
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	case "none":
+	default:
+		return fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q", name)
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(opts...))
+	return nil
+}
+
+// newSampler returns the sampler with an OTEL_TRACES_SAMPLER name. arg is
+// the sampling ratio of the ratio samplers, 1 by default.
+func newSampler(name, arg string) (sdktrace.Sampler, error) {
+	ratio := 1.0
+	if arg != "" {
+		var err error
+		if ratio, err = strconv.ParseFloat(arg, 64); err != nil || ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("OTEL_TRACES_SAMPLER_ARG %q must be a ratio between 0 and 1", arg)
+		}
+	}
+	switch name {
+	case "", "always_on":
+		return sdktrace.AlwaysSample(), nil
+	case "always_off":
+		return sdktrace.NeverSample(), nil
+	case "traceidratio":
+		return sdktrace.TraceIDRatioBased(ratio), nil
+	case "parentbased_always_on":
+		return sdktrace.ParentBased(sdktrace.AlwaysSample()), nil
+	case "parentbased_always_off":
+		return sdktrace.ParentBased(sdktrace.NeverSample()), nil
+	case "parentbased_traceidratio":
+		return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio)), nil
+	}
+	return nil, fmt.Errorf("unknown OTEL_TRACES_SAMPLER %q", name)
+}
+
+// initStats exports metrics every OTEL_METRIC_EXPORT_INTERVAL milliseconds
+// to the exporter named by OTEL_METRICS_EXPORTER: "otlp" (the default) for
+// the collector's OTLP/HTTP receiver at COLLECTOR_METRICS_ADDR, "console"
+// or "none".
+func initStats() error {
+	var exporter sdkmetric.Exporter
+	switch name := os.Getenv("OTEL_METRICS_EXPORTER"); name {
+	case "", "otlp":
+		var collectorAddr string
+		mustMapEnv(&collectorAddr, "COLLECTOR_METRICS_ADDR")
+		var err error
+		exporter, err = otlpmetrichttp.New(context.Background(),
+			otlpmetrichttp.WithEndpoint(collectorAddr),
+			otlpmetrichttp.WithInsecure())
+		if err != nil {
+			return fmt.Errorf("failed to create metric exporter: %v", err)
+		}
+	case "console":
+		exporter = &consoleMetricExporter{enc: json.NewEncoder(os.Stdout)}
+	case "none":
+		return nil
+	default:
+		return fmt.Errorf("unknown OTEL_METRICS_EXPORTER %q", name)
+	}
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter))))
+	return nil
+}
+
+func mustMapEnv(target *string, envKey string) {
+	v := os.Getenv(envKey)
+	if v == "" {
+		panic(fmt.Sprintf("environment variable %q not set", envKey))
+	}
+	*target = v
+}
+
+// consoleMetricExporter writes each collection as a line of JSON.
+type consoleMetricExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (e *consoleMetricExporter) Temporality(k sdkmetric.InstrumentKind) metricdata.Temporality {
+	return sdkmetric.DefaultTemporalitySelector(k)
+}
+
+func (e *consoleMetricExporter) Aggregation(k sdkmetric.InstrumentKind) sdkmetric.Aggregation {
+	return sdkmetric.DefaultAggregationSelector(k)
+}
+
+func (e *consoleMetricExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.enc.Encode(rm)
+}
+
+func (e *consoleMetricExporter) ForceFlush(context.Context) error { return nil }
+
+func (e *consoleMetricExporter) Shutdown(context.Context) error { return nil }
+
+// shippingMetrics are the service's own instruments. RPC latency comes
+// from the gRPC instrumentation as rpc.server.duration.
+type shippingMetrics struct {
+	quotes    metric.Int64Counter
+	shipments metric.Int64Counter
+	labels    metric.Int64Counter
+}
+
+func newShippingMetrics(mp metric.MeterProvider) (*shippingMetrics, error) {
+	meter := mp.Meter("github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice")
+	var m shippingMetrics
+	var err error
+	if m.quotes, err = meter.Int64Counter("shipping.quotes",
+		metric.WithDescription("Quotes issued, by destination zone."),
+		metric.WithUnit("{quote}")); err != nil {
+		return nil, err
+	}
+	if m.shipments, err = meter.Int64Counter("shipping.shipments",
+		metric.WithDescription("Shipments created, by service level and carrier."),
+		metric.WithUnit("{shipment}")); err != nil {
+		return nil, err
+	}
+	if m.labels, err = meter.Int64Counter("shipping.labels",
+		metric.WithDescription("Labels rendered, by format."),
+		metric.WithUnit("{label}")); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (m *shippingMetrics) quoteIssued(ctx context.Context, zone string) {
+	m.quotes.Add(ctx, 1, metric.WithAttributes(attribute.String("shipping.zone", zone)))
+}
+
+func (m *shippingMetrics) shipmentCreated(ctx context.Context, serviceLevel, carrier string) {
+	m.shipments.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("shipping.service_level", serviceLevel),
+		attribute.String("shipping.carrier", carrier)))
+}
+
+func (m *shippingMetrics) labelRendered(ctx context.Context, format string) {
+	m.labels.Add(ctx, 1, metric.WithAttributes(attribute.String("shipping.label_format", format)))
+}
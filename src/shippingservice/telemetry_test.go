@@ -0,0 +1,112 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"golang.org/x/net/context"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/genproto"
+)
+
+func TestNewSampler(t *testing.T) {
+	for _, tc := range []struct {
+		name, arg, want string
+	}{
+		{"", "", "AlwaysOnSampler"},
+		{"always_off", "", "AlwaysOffSampler"},
+		{"traceidratio", "0.25", "TraceIDRatioBased{0.25}"},
+		{"parentbased_traceidratio", "0.5", "ParentBased{root:TraceIDRatioBased{0.5}"},
+		{"parentbased_always_on", "", "ParentBased{root:AlwaysOnSampler"},
+	} {
+		s, err := newSampler(tc.name, tc.arg)
+		if err != nil {
+			t.Errorf("%q: %v", tc.name, err)
+			continue
+		}
+		if got := s.Description(); len(got) < len(tc.want) || got[:len(tc.want)] != tc.want {
+			t.Errorf("%q: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+	for _, tc := range [][2]string{{"sometimes", ""}, {"traceidratio", "2"}, {"traceidratio", "half"}} {
+		if _, err := newSampler(tc[0], tc[1]); err == nil {
+			t.Errorf("%q %q: got no error", tc[0], tc[1])
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	metrics, err := newShippingMetrics(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t)
+	s.metrics = metrics
+	ctx := context.Background()
+
+	addr := &pb.Address{StreetAddress: "1 Main St", City: "Seattle", State: "WA", Country: "US"}
+	items := []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	for i := 0; i < 2; i++ {
+		if _, err := s.GetQuote(ctx, &pb.GetQuoteRequest{Address: addr, Items: items}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := s.ShipOrder(ctx, &pb.ShipOrderRequest{Address: addr, Items: items, ServiceLevel: "express"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetLabel(ctx, &pb.GetLabelRequest{TrackingId: res.TrackingId, Format: pb.LabelFormat_LABEL_FORMAT_ZPL}); err != nil {
+		t.Fatal(err)
+	}
+	// Rejected quotes are not counted.
+	if _, err := s.GetQuote(ctx, &pb.GetQuoteRequest{Address: &pb.Address{Country: "KP"}, Items: items}); err == nil {
+		t.Fatal("got no error for a blocked destination")
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(ctx, &rm); err != nil {
+		t.Fatal(err)
+	}
+	sums := make(map[string]metricdata.Sum[int64])
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			sums[m.Name] = m.Data.(metricdata.Sum[int64])
+		}
+	}
+	for _, tc := range []struct {
+		metric string
+		attrs  []attribute.KeyValue
+		want   int64
+	}{
+		{"shipping.quotes", []attribute.KeyValue{attribute.String("shipping.zone", "us")}, 2},
+		{"shipping.shipments", []attribute.KeyValue{attribute.String("shipping.service_level", "express"), attribute.String("shipping.carrier", "UPS")}, 1},
+		{"shipping.labels", []attribute.KeyValue{attribute.String("shipping.label_format", "zpl")}, 1},
+	} {
+		points := sums[tc.metric].DataPoints
+		if len(points) != 1 {
+			t.Errorf("%s: got %d data points, want 1", tc.metric, len(points))
+			continue
+		}
+		want := attribute.NewSet(tc.attrs...)
+		if points[0].Value != tc.want || !points[0].Attributes.Equals(&want) {
+			t.Errorf("%s: got %d %v, want %d %v", tc.metric, points[0].Value, points[0].Attributes.ToSlice(), tc.want, tc.attrs)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/shipping"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/trackingid"
+)
+
+// TrackShipment returns the status history of a shipment. Shipments handed
+// over by another replica or by the shipping function are tracked from the
+// request's hints.
+func (s *server) TrackShipment(ctx context.Context, in *pb.TrackShipmentRequest) (*pb.TrackShipmentResponse, error) {
+	log.Infof("[TrackShipment] tracking_id=%q", in.GetTrackingId())
+	var hints shipping.Hints
+	if in.GetShippedAtUnix() != 0 {
+		hints.ShippedAt = time.Unix(in.GetShippedAtUnix(), 0).UTC()
+	}
+	if in.GetEstimatedDeliveryDate() != "" {
+		d, err := time.Parse(time.DateOnly, in.GetEstimatedDeliveryDate())
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "estimated_delivery_date must be YYYY-MM-DD")
+		}
+		hints.Delivery = d
+	}
+
+	events, err := s.shipping.Track(in.GetTrackingId(), hints)
+	if err != nil {
+		return nil, trackingError(err)
+	}
+	resp := &pb.TrackShipmentResponse{TrackingId: in.GetTrackingId()}
+	for _, e := range events {
+		resp.Events = append(resp.Events, &pb.TrackingEvent{
+			Status:      pb.ShipmentStatus(pb.ShipmentStatus_value[string(e.Status)]),
+			Description: e.Description,
+			Location:    e.Location,
+			TimeUnix:    e.TimeUnix,
+		})
+	}
+	if len(resp.Events) > 0 {
+		resp.Status = resp.Events[len(resp.Events)-1].GetStatus()
+	}
+	return resp, nil
+}
+
+// RecordTrackingEvent ingests a status update pushed by a carrier, signed
+// in the x-carrier-signature metadata (see shipping.SignEvent).
+func (s *server) RecordTrackingEvent(ctx context.Context, in *pb.RecordTrackingEventRequest) (*pb.Empty, error) {
+	log.Infof("[RecordTrackingEvent] tracking_id=%q status=%s", in.GetTrackingId(), in.GetEvent().GetStatus())
+	e := in.GetEvent()
+	var signature string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(shipping.EventSignatureHeader); len(v) > 0 {
+			signature = v[0]
+		}
+	}
+	err := s.shipping.RecordEvent(in.GetTrackingId(), shipping.Event{
+		Status:      shipping.Status(e.GetStatus().String()),
+		Description: e.GetDescription(),
+		Location:    e.GetLocation(),
+		TimeUnix:    e.GetTimeUnix(),
+	}, signature)
+	if err != nil {
+		return nil, trackingError(err)
+	}
+	return &pb.Empty{}, nil
+}
+
+// trackingError returns a tracking failure as an RPC error.
+func trackingError(err error) error {
+	switch {
+	case errors.Is(err, shipping.ErrNotFound):
+		return status.Errorf(codes.NotFound, "%v", err)
+	case errors.Is(err, shipping.ErrUnauthenticated):
+		return status.Errorf(codes.Unauthenticated, "%v", err)
+	case errors.Is(err, trackingid.ErrInvalid), errors.Is(err, shipping.ErrInvalidEvent):
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	return status.Errorf(codes.Internal, "%v", err)
+}
@@ -0,0 +1,3 @@
+module github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/trackingid
+
+go 1.21
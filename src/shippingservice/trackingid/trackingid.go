@@ -0,0 +1,179 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package trackingid generates and checks shipment tracking IDs. It is
+// shared by the shipping service and the shipping Cloud Function.
+//
+// An ID is sixteen characters in four groups, e.g. "7K3M-9QZT-2HX4-0BNC",
+// optionally after a carrier or region prefix: "USW-7K3M-9QZT-2HX4-0BNC".
+// The first fifteen characters are Crockford base32, so there is no I, L, O
+// or U to misread. The last is an ISO 7064 MOD 37,36 check character over
+// the prefix and the body, which catches any single mistyped character and
+// any two swapped neighbours.
+package trackingid
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// bodyAlphabet is Crockford's base32.
+	bodyAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	// checkAlphabet holds the values of the check character and of every
+	// character it covers.
+	checkAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	bodyLen     = 15
+	groupLen    = 4
+	maxPrefix   = 6
+	counterBits = 35
+	randomBits  = bodyLen*5 - counterBits
+)
+
+// ErrInvalid is wrapped by every error of ValidateTrackingId.
+var ErrInvalid = errors.New("invalid tracking ID")
+
+// Generator creates tracking IDs. It is safe for concurrent use. IDs from
+// one generator never repeat until 2^35 have been issued; IDs from
+// different generators share 40 random bits as well, so they collide with
+// negligible probability.
+type Generator struct {
+	prefix  string
+	counter atomic.Uint64
+	// key and mult scramble the counter so consecutive IDs look unrelated.
+	key  uint64
+	mult uint64
+}
+
+// NewGenerator returns a generator of IDs with the given prefix: empty, or
+// two to six uppercase letters and digits.
+func NewGenerator(prefix string) (*Generator, error) {
+	if prefix != "" {
+		if err := checkPrefix(prefix); err != nil {
+			return nil, err
+		}
+	}
+	var seed [24]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		return nil, fmt.Errorf("failed to seed tracking ID generator: %v", err)
+	}
+	g := &Generator{
+		prefix: prefix,
+		key:    binary.BigEndian.Uint64(seed[0:8]),
+		mult:   binary.BigEndian.Uint64(seed[8:16]) | 1,
+	}
+	g.counter.Store(binary.BigEndian.Uint64(seed[16:24]))
+	return g, nil
+}
+
+// New returns a new tracking ID.
+func (g *Generator) New() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate tracking ID: %v", err)
+	}
+	// Multiplying by an odd number and xoring are both bijections modulo
+	// 2^35, so distinct counter values give distinct high bits.
+	const mask = 1<<counterBits - 1
+	high := ((g.counter.Add(1) * g.mult) ^ g.key) & mask
+	low := binary.BigEndian.Uint64(b[:]) & (1<<randomBits - 1)
+
+	var body [bodyLen]byte
+	for i := bodyLen - 1; i >= 0; i-- {
+		body[i] = bodyAlphabet[low&31]
+		low = low>>5 | (high&31)<<(randomBits-5)
+		high >>= 5
+	}
+	return format(g.prefix, string(body[:])), nil
+}
+
+// format joins the prefix and the grouped body and appends the check
+// character.
+func format(prefix, body string) string {
+	check := checkCharacter(prefix + body)
+	full := body + string(check)
+	groups := make([]string, 0, 5)
+	if prefix != "" {
+		groups = append(groups, prefix)
+	}
+	for i := 0; i < len(full); i += groupLen {
+		groups = append(groups, full[i:i+groupLen])
+	}
+	return strings.Join(groups, "-")
+}
+
+// ValidateTrackingId checks the shape and the check character of an ID.
+func ValidateTrackingId(id string) error {
+	groups := strings.Split(id, "-")
+	prefix := ""
+	switch len(groups) {
+	case 4:
+	case 5:
+		prefix, groups = groups[0], groups[1:]
+		if err := checkPrefix(prefix); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: want four groups of four characters, optionally after a prefix", ErrInvalid)
+	}
+	full := strings.Join(groups, "")
+	for _, g := range groups {
+		if len(g) != groupLen {
+			return fmt.Errorf("%w: group %q is not four characters", ErrInvalid, g)
+		}
+	}
+	body, check := full[:bodyLen], full[bodyLen]
+	for _, r := range body {
+		if !strings.ContainsRune(bodyAlphabet, r) {
+			return fmt.Errorf("%w: unexpected character %q", ErrInvalid, r)
+		}
+	}
+	if checkCharacter(prefix+body) != check {
+		return fmt.Errorf("%w: check character does not match", ErrInvalid)
+	}
+	return nil
+}
+
+func checkPrefix(prefix string) error {
+	if len(prefix) < 2 || len(prefix) > maxPrefix {
+		return fmt.Errorf("%w: prefix %q must be two to six characters", ErrInvalid, prefix)
+	}
+	for _, r := range prefix {
+		if !strings.ContainsRune(checkAlphabet, r) {
+			return fmt.Errorf("%w: prefix %q must be uppercase letters and digits", ErrInvalid, prefix)
+		}
+	}
+	return nil
+}
+
+// checkCharacter computes the ISO 7064 MOD 37,36 check character of s,
+// which must only hold characters of checkAlphabet.
+func checkCharacter(s string) byte {
+	const m = 36
+	p := m
+	for i := 0; i < len(s); i++ {
+		v := strings.IndexByte(checkAlphabet, s[i])
+		sum := (p + v) % m
+		if sum == 0 {
+			sum = m
+		}
+		p = (2 * sum) % (m + 1)
+	}
+	return checkAlphabet[(m+1-p)%m]
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trackingid
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var idPattern = regexp.MustCompile(`^([0-9A-Z]{2,6}-)?[0-9A-HJKMNP-TV-Z]{4}-[0-9A-HJKMNP-TV-Z]{4}-[0-9A-HJKMNP-TV-Z]{4}-[0-9A-HJKMNP-TV-Z]{3}[0-9A-Z]$`)
+
+func newGenerator(t *testing.T, prefix string) *Generator {
+	t.Helper()
+	g, err := NewGenerator(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestNew(t *testing.T) {
+	for _, prefix := range []string{"", "UPS", "USW1"} {
+		g := newGenerator(t, prefix)
+		id, err := g.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !idPattern.MatchString(id) || !strings.HasPrefix(id, prefix) {
+			t.Errorf("got %q, want an ID with prefix %q", id, prefix)
+		}
+		if err := ValidateTrackingId(id); err != nil {
+			t.Errorf("ValidateTrackingId(%q): %v", id, err)
+		}
+	}
+}
+
+func TestNewGeneratorPrefix(t *testing.T) {
+	for _, prefix := range []string{"U", "TOOLONG", "ups", "U-S"} {
+		if _, err := NewGenerator(prefix); !errors.Is(err, ErrInvalid) {
+			t.Errorf("NewGenerator(%q): got %v, want ErrInvalid", prefix, err)
+		}
+	}
+}
+
+func TestUnique(t *testing.T) {
+	const n = 100000
+	g := newGenerator(t, "")
+	seen := make(map[string]bool, n)
+	for i := 0; i < n; i++ {
+		id, err := g.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[id] {
+			t.Fatalf("got %q twice after %d IDs", id, i)
+		}
+		seen[id] = true
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	const workers, perWorker = 16, 5000
+	g := newGenerator(t, "EU")
+	ids := make(chan string, workers*perWorker)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				id, err := g.New()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ids <- id
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[string]bool, workers*perWorker)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("got %q twice", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != workers*perWorker {
+		t.Errorf("got %d IDs, want %d", len(seen), workers*perWorker)
+	}
+}
+
+func TestValidateTrackingIdDetectsTypos(t *testing.T) {
+	g := newGenerator(t, "UPS")
+	id, err := g.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every single-character substitution is caught.
+	for i := 0; i < len(id); i++ {
+		if id[i] == '-' {
+			continue
+		}
+		for _, c := range checkAlphabet {
+			if byte(c) == id[i] {
+				continue
+			}
+			typo := id[:i] + string(c) + id[i+1:]
+			if ValidateTrackingId(typo) == nil {
+				t.Errorf("ValidateTrackingId(%q) accepted a typo of %q", typo, id)
+			}
+		}
+	}
+	// So is every swap of two different neighbouring characters.
+	for i := 0; i+1 < len(id); i++ {
+		if id[i] == '-' || id[i+1] == '-' || id[i] == id[i+1] {
+			continue
+		}
+		swapped := id[:i] + string(id[i+1]) + string(id[i]) + id[i+2:]
+		if ValidateTrackingId(swapped) == nil {
+			t.Errorf("ValidateTrackingId(%q) accepted a transposition of %q", swapped, id)
+		}
+	}
+}
+
+func TestValidateTrackingIdMalformed(t *testing.T) {
+	for _, id := range []string{
+		"",
+		"AB-12345-1234567",
+		"7K3M-9QZT-2HX4",
+		"7K3M-9QZT-2HX4-0BNCX",
+		"7K3M-9QZT-2HX4-0BN",
+		"7K3I-9QZT-2HX4-0BNC",
+		"7k3m-9qzt-2hx4-0bnc",
+		"U-7K3M-9QZT-2HX4-0BNC",
+		"A-B-7K3M-9QZT-2HX4-0BNC",
+	} {
+		if err := ValidateTrackingId(id); !errors.Is(err, ErrInvalid) {
+			t.Errorf("ValidateTrackingId(%q): got %v, want ErrInvalid", id, err)
+		}
+	}
+}